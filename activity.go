@@ -0,0 +1,86 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/panoplyio/pgsrv/protocol"
+	"sort"
+	"time"
+)
+
+// activate marks the session as active while it handles messages that
+// execute queries, starting a new query for the ones that carry its sql
+func (s *session) activate(msg pgproto3.FrontendMessage) {
+	s.activityMu.Lock()
+	defer s.activityMu.Unlock()
+
+	switch v := msg.(type) {
+	case *pgproto3.Query:
+		s.query, s.queryStart = v.String, time.Now()
+	case *pgproto3.Parse:
+		s.query, s.queryStart = v.Query, time.Now()
+	case *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *protocol.FunctionCall:
+	default:
+		return
+	}
+	s.state = SessionActive
+}
+
+// deactivate marks the session as idle once the message is handled, possibly
+// within a transaction block, see transactionStatus
+func (s *session) deactivate() {
+	s.activityMu.Lock()
+	defer s.activityMu.Unlock()
+
+	switch {
+	case s.tx == nil:
+		s.state = SessionIdle
+	case s.aborted:
+		s.state = SessionIdleInTransactionAborted
+	default:
+		s.state = SessionIdleInTransaction
+	}
+}
+
+// info returns a snapshot of the session's activity
+func (s *session) info() SessionInfo {
+	s.activityMu.Lock()
+	defer s.activityMu.Unlock()
+
+	state := s.state
+	if state == "" {
+		state = SessionIdle
+	}
+	return SessionInfo{
+		PID:        s.pid,
+		RemoteAddr: s.RemoteAddr(),
+		User:       s.user,
+		Database:   s.database,
+		AppName:    s.appName,
+		State:      state,
+		Query:      s.query,
+		QueryStart: s.queryStart,
+	}
+}
+
+func (s *server) Sessions() []SessionInfo {
+	var sessions []SessionInfo
+	allSessions.Range(func(k, v interface{}) bool {
+		if sess := v.(*session); sess.Server == s {
+			sessions = append(sessions, sess.info())
+		}
+		return true
+	})
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].PID < sessions[j].PID
+	})
+	return sessions
+}
+
+// setAppName updates the application_name of the session, as reported in its
+// activity
+func (s *session) setAppName(name string) {
+	s.activityMu.Lock()
+	defer s.activityMu.Unlock()
+	s.appName = name
+}
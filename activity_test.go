@@ -0,0 +1,113 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// blockingQueryer blocks every query until it's released
+type blockingQueryer struct {
+	started chan bool
+	release chan bool
+}
+
+func (q *blockingQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	q.started <- true
+	<-q.release
+	return &mockRows{}, nil
+}
+
+func TestServer_Sessions(t *testing.T) {
+	queryer := &blockingQueryer{started: make(chan bool), release: make(chan bool)}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	require.Empty(t, srv.Sessions())
+
+	frontend, pid := connectWith(t, srv, map[string]string{"user": "alice", "database": "db"})
+	other, otherPid := connect(t, srv)
+
+	// sessions of other servers are omitted
+	connect(t, &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}})
+
+	sessions := srv.Sessions()
+	require.Len(t, sessions, 2)
+	for _, info := range sessions {
+		require.Equal(t, SessionIdle, info.State)
+		require.Equal(t, "", info.Query)
+		require.Equal(t, "pipe", info.RemoteAddr.String())
+	}
+
+	before := time.Now()
+	sendQuery(t, frontend, "SELECT 1")
+	<-queryer.started
+
+	sessions = srv.Sessions()
+	require.Len(t, sessions, 2)
+	info := sessions[0]
+	if info.PID != pid {
+		info = sessions[1]
+	}
+	require.Equal(t, pid, info.PID)
+	require.Equal(t, "alice", info.User)
+	require.Equal(t, "db", info.Database)
+	require.Equal(t, SessionActive, info.State)
+	require.Equal(t, "SELECT 1", info.Query)
+	require.False(t, info.QueryStart.Before(before))
+
+	queryer.release <- true
+	receive(t, frontend, &pgproto3.RowDescription{})
+	receive(t, frontend, &pgproto3.CommandComplete{})
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+	for _, info := range srv.Sessions() {
+		if info.PID == pid {
+			require.Equal(t, SessionIdle, info.State)
+			require.Equal(t, "SELECT 1", info.Query, "expected the last query")
+		}
+	}
+
+	// an extended query is idle once it's handled, outside of a transaction
+	// block
+	require.NoError(t, other.Send(&pgproto3.Parse{Query: "SELECT 2"}))
+	require.NoError(t, other.Send(&pgproto3.Sync{}))
+	receive(t, other, &pgproto3.ParseComplete{})
+	receive(t, other, &pgproto3.ReadyForQuery{})
+	for _, info := range srv.Sessions() {
+		if info.PID == otherPid {
+			require.Equal(t, SessionIdle, info.State)
+			require.Equal(t, "SELECT 2", info.Query)
+		}
+	}
+
+	require.NoError(t, frontend.Send(&pgproto3.Terminate{}))
+	require.Eventually(t, func() bool { return len(srv.Sessions()) == 1 }, time.Second, time.Millisecond)
+}
+
+func TestServer_Sessions_transaction(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &transactionExecer{}}
+	frontend, _ := connect(t, srv)
+
+	// state runs the query and returns the state of the session once it's
+	// complete
+	state := func(sql string) SessionState {
+		sendQuery(t, frontend, sql)
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				break
+			}
+		}
+		sessions := srv.Sessions()
+		require.Len(t, sessions, 1)
+		return sessions[0].State
+	}
+
+	require.Equal(t, SessionIdleInTransaction, state("BEGIN"))
+	require.Equal(t, SessionIdleInTransactionAborted, state("FETCH c"))
+	require.Equal(t, SessionIdle, state("ROLLBACK"))
+}
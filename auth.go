@@ -4,10 +4,17 @@ import (
 	"bytes"
 	"crypto/md5"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/panoplyio/pgsrv/protocol"
+	"io"
 )
 
+// RandSource is the source of the random bytes of the salts and nonces of the
+// authentication methods. It's crypto/rand.Reader by default, and may be
+// replaced, like with a deterministic source in tests.
+var RandSource io.Reader = rand.Reader
+
 const errExpectedPassword = "expected password response, got message type %q"
 const errWrongPassword = "password does not match for user \"%s\""
 
@@ -28,7 +35,7 @@ type authenticator interface {
 type noPasswordAuthenticator struct{}
 
 func (np *noPasswordAuthenticator) authenticate(rw protocol.MessageReadWriter, args map[string]interface{}) error {
-	return rw.Write(authOKMsg())
+	return rw.Write(protocol.AuthenticationOK)
 }
 
 // AuthType represents various types of authentication
@@ -43,14 +50,28 @@ const (
 
 	// Plain is an auth type where password is sent as plain text over network
 	Plain AuthType = "plain"
+
+	// SCRAM is an auth type where authentication uses SCRAM-SHA-256, which
+	// doesn't reveal the password, and binds the authentication to the TLS
+	// channel with SCRAM-SHA-256-PLUS, see SCRAMPasswords
+	SCRAM AuthType = "scram-sha-256"
 )
 
 // PasswordProvider describes objects that are able to provide a password given a user name.
 type PasswordProvider interface {
 	Type() AuthType
+
+	// GetPassword returns the password of the user, or ErrUnknownUser when
+	// the user has no password
 	GetPassword(user string) ([]byte, error)
 }
 
+// ErrUnknownUser is returned by a PasswordProvider for users without a
+// password, which are rejected like wrong passwords, to avoid revealing which
+// users exist. Any other error fails the authentication as an internal error,
+// which is logged (see WithLogger), without revealing its cause to the client.
+var ErrUnknownUser = errors.New("unknown user")
+
 // constantPasswordProvider is a password provider that always returns the same password,
 // which it is given during the initialization.
 type constantPasswordProvider struct {
@@ -66,7 +87,8 @@ func (cpp *constantPasswordProvider) GetPassword(user string) ([]byte, error) {
 }
 
 // md5ConstantPasswordProvider is a password provider that returns md5 hash of a given
-// username and a constant password as md5(concat(password, user)).
+// username and a constant password as md5(concat(password, user)). Prefer
+// md5PasswordProvider (see MD5Passwords), which also supports per-user passwords.
 type md5ConstantPasswordProvider struct {
 	password []byte
 }
@@ -82,6 +104,50 @@ func (cpp *md5ConstantPasswordProvider) GetPassword(user string) ([]byte, error)
 	return puHash[:], nil
 }
 
+// md5PasswordProvider is a password provider for md5 authentication that looks
+// up the raw passwords of the users, and returns the md5(concat(password, user))
+// digests expected by md5Authenticator.
+type md5PasswordProvider struct {
+	lookup func(user string) (string, error)
+}
+
+// MD5Passwords returns a PasswordProvider for md5 authentication of the users
+// with the provided raw passwords, keyed by user name. The md5 digests that
+// the clients send are computed internally. Embedding it in the Queryer (as an
+// anonymous PasswordProvider field) enables md5 authentication.
+func MD5Passwords(passwords map[string]string) PasswordProvider {
+	return MD5PasswordFunc(func(user string) (string, error) {
+		password, ok := passwords[user]
+		if !ok {
+			return "", ErrUnknownUser
+		}
+		return password, nil
+	})
+}
+
+// MD5PasswordFunc is like MD5Passwords, with the raw passwords returned by the
+// provided function, like from a database. Returning ErrUnknownUser rejects the
+// user, while other errors fail the authentication, like when the database is
+// unavailable.
+func MD5PasswordFunc(lookup func(user string) (string, error)) PasswordProvider {
+	return &md5PasswordProvider{lookup}
+}
+
+// Type implements PasswordProvider.
+func (pp *md5PasswordProvider) Type() AuthType {
+	return MD5
+}
+
+func (pp *md5PasswordProvider) GetPassword(user string) ([]byte, error) {
+	password, err := pp.lookup(user)
+	if err != nil {
+		return nil, err
+	}
+
+	puHash := md5.Sum([]byte(password + user))
+	return puHash[:], nil
+}
+
 // clearTextAuthenticator requests and accepts a clear text password.
 // It is not recommended to use it for security reasons.
 //
@@ -91,14 +157,7 @@ type clearTextAuthenticator struct {
 }
 
 func (a *clearTextAuthenticator) authenticate(rw protocol.MessageReadWriter, args map[string]interface{}) error {
-	// AuthenticationClearText
-	passwordRequest := protocol.Message{
-		'R',
-		0, 0, 0, 8, // length
-		0, 0, 0, 3, // clear text auth type
-	}
-
-	err := rw.Write(passwordRequest)
+	err := rw.Write(protocol.Authentication(protocol.AuthClearText, nil))
 	if err != nil {
 		return err
 	}
@@ -108,25 +167,26 @@ func (a *clearTextAuthenticator) authenticate(rw protocol.MessageReadWriter, arg
 		return err
 	}
 
-	if m.Type() != 'p' {
-		err = fmt.Errorf(errExpectedPassword, m.Type())
-		err = WithSeverity(fromErr(err), fatalSeverity)
-		rw.Write(protocol.ErrorResponse(err))
-		return err
+	if m.Type() != protocol.MsgTypePasswordMessage {
+		return reportFatal(rw, errorf("", errExpectedPassword, m.Type()))
+	}
+
+	actualPassword, err := extractPassword(m)
+	if err != nil {
+		return reportFatal(rw, err)
 	}
 
-	user := args["user"].(string)
+	user, _ := args["user"].(string)
 	expectedPassword, err := a.pp.GetPassword(user)
-	actualPassword := extractPassword(m)
+	if err != nil {
+		return reportFatal(rw, passwordLookupError(rw, user, err))
+	}
 
 	if !bytes.Equal(expectedPassword, actualPassword) {
-		err = fmt.Errorf(errWrongPassword, user)
-		err = WithSeverity(fromErr(err), fatalSeverity)
-		rw.Write(protocol.ErrorResponse(err))
-		return err
+		return reportFatal(rw, InvalidPassword(errWrongPassword, user))
 	}
 
-	return rw.Write(authOKMsg())
+	return rw.Write(protocol.AuthenticationOK)
 }
 
 // md5Authenticator requests and accepts an MD5 hashed password from the client.
@@ -137,16 +197,12 @@ type md5Authenticator struct {
 }
 
 func (a *md5Authenticator) authenticate(rw protocol.MessageReadWriter, args map[string]interface{}) error {
-	// AuthenticationMD5Password
-	passwordRequest := protocol.Message{
-		'R',
-		0, 0, 0, 12, // length
-		0, 0, 0, 5, // md5 auth type
+	salt, err := getRandomSalt()
+	if err != nil {
+		return reportFatal(rw, err)
 	}
-	salt := getRandomSalt()
-	passwordRequest = append(passwordRequest, salt...)
 
-	err := rw.Write(passwordRequest)
+	err = rw.Write(protocol.Authentication(protocol.AuthMD5, salt))
 	if err != nil {
 		return err
 	}
@@ -156,46 +212,162 @@ func (a *md5Authenticator) authenticate(rw protocol.MessageReadWriter, args map[
 		return err
 	}
 
-	if m.Type() != 'p' {
-		err = fmt.Errorf(errExpectedPassword, m.Type())
-		err = WithSeverity(fromErr(err), fatalSeverity)
-		rw.Write(protocol.ErrorResponse(err))
-		return err
+	if m.Type() != protocol.MsgTypePasswordMessage {
+		return reportFatal(rw, errorf("", errExpectedPassword, m.Type()))
 	}
 
-	user := args["user"].(string)
+	actualHash, err := extractPassword(m)
+	if err != nil {
+		return reportFatal(rw, err)
+	}
+
+	user, _ := args["user"].(string)
 	storedHash, err := a.pp.GetPassword(user)
+	if err != nil {
+		return reportFatal(rw, passwordLookupError(rw, user, err))
+	}
+
 	expectedHash := hashWithSalt(storedHash, salt)
+	if !bytes.Equal(expectedHash, actualHash) {
+		return reportFatal(rw, InvalidPassword(errWrongPassword, user))
+	}
 
-	actualHash := extractPassword(m)
+	return rw.Write(protocol.AuthenticationOK)
+}
 
-	if !bytes.Equal(expectedHash, actualHash) {
-		err = fmt.Errorf(errWrongPassword, user)
-		err = WithSeverity(fromErr(err), fatalSeverity)
-		rw.Write(protocol.ErrorResponse(err))
+// GSSProvider describes objects that are able to perform GSSAPI/SSPI (Kerberos)
+// authentication. It keeps the actual gssapi/SSPI library out of this package.
+type GSSProvider interface {
+	// NewGSSContext creates a new security context for authenticating the
+	// provided user. Every session gets its own context.
+	NewGSSContext(user string) (GSSContext, error)
+}
+
+// GSSContext is a single GSSAPI security context being established with a
+// client.
+type GSSContext interface {
+	// Accept processes a token received from the client and returns an output
+	// token to be sent back to the client, if any. done is true once the
+	// security context is established and the user is authenticated.
+	Accept(token []byte) (output []byte, done bool, err error)
+}
+
+// gssAuthenticator requests GSSAPI authentication and exchanges tokens with
+// the client until the security context is established.
+//
+// It requires a GSSProvider implementation to process the tokens.
+type gssAuthenticator struct {
+	gp GSSProvider
+}
+
+func (a *gssAuthenticator) authenticate(rw protocol.MessageReadWriter, args map[string]interface{}) error {
+	err := rw.Write(protocol.Authentication(protocol.AuthGSS, nil))
+	if err != nil {
 		return err
 	}
 
-	return rw.Write(authOKMsg())
+	user, _ := args["user"].(string)
+	gc, err := a.gp.NewGSSContext(user)
+	if err != nil {
+		return reportFatal(rw, err)
+	}
+
+	// the token exchange may take several rounds until the context is
+	// established
+	for done := false; !done; {
+		m, err := rw.Read()
+		if err != nil {
+			return err
+		}
+
+		if m.Type() != protocol.MsgTypePasswordMessage {
+			return reportFatal(rw, errorf("", errExpectedPassword, m.Type()))
+		}
+
+		var output []byte
+		output, done, err = gc.Accept(extractGSSToken(m))
+		if err != nil {
+			return reportFatal(rw, err)
+		}
+
+		if len(output) > 0 {
+			err = rw.Write(protocol.Authentication(protocol.AuthGSSContinue, output))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return rw.Write(protocol.AuthenticationOK)
+}
+
+// extractGSSToken extracts the GSSAPI token from a provided 'p' message.
+// Unlike passwords, the token isn't null-terminated.
+func extractGSSToken(m protocol.Message) []byte {
+	return m[5:]
+}
+
+// reportFatal reports the error that failed the authentication to the client,
+// as FATAL, and returns it. It's localized when the MessageReadWriter is the
+// localizedReadWriter of the session.
+func reportFatal(rw protocol.MessageReadWriter, err error) error {
+	err = WithSeverity(err, fatalSeverity)
+	reported := err
+	if lrw, ok := rw.(*localizedReadWriter); ok {
+		reported = lrw.localize(err)
+	}
+	rw.Write(protocol.ErrorResponse(fromErr(reported)))
+	return err
+}
+
+// passwordLookupError returns the error that fails the authentication of the
+// user when its PasswordProvider failed to provide its password. Unknown users
+// are rejected like wrong passwords, while other failures are logged with the
+// logger of the localizedReadWriter, and reported as internal errors.
+func passwordLookupError(rw protocol.MessageReadWriter, user string, err error) error {
+	if errors.Is(err, ErrUnknownUser) {
+		return InvalidPassword(errWrongPassword, user)
+	}
+	if lrw, ok := rw.(*localizedReadWriter); ok && lrw.logger != nil {
+		lrw.logger.Printf("pgsrv: could not get the password of user %q: %v", user, err)
+	}
+	return InternalError("could not get the password of user \"%s\"", user)
+}
+
+// localizedReadWriter is the MessageReadWriter passed to the authenticators by
+// the session, for localizing the errors they report (see reportFatal), and
+// logging the failures that aren't reported (see passwordLookupError)
+type localizedReadWriter struct {
+	protocol.MessageReadWriter
+	localize func(error) error
+	logger   Logger
 }
 
-// authOKMsg returns a message that indicates that the client is now authenticated.
-func authOKMsg() protocol.Message {
-	return []byte{'R', 0, 0, 0, 8, 0, 0, 0, 0}
+// getRandomSalt returns a cryptographically secure random slice of 4 bytes,
+// read from RandSource. It fails when the source fails or runs out of bytes.
+func getRandomSalt() ([]byte, error) {
+	return randomBytes(4)
 }
 
-// getRandomSalt returns a cryptographically secure random slice of 4 bytes.
-func getRandomSalt() []byte {
-	salt := make([]byte, 4)
-	rand.Read(salt)
-	return salt
+// randomBytes returns n cryptographically secure random bytes, read from
+// RandSource, for salts and nonces
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(RandSource, b)
+	if err != nil {
+		return nil, InternalError("could not generate random bytes: %v", err)
+	}
+	return b, nil
 }
 
 // extractPassword extracts the password from a provided 'p' message.
-// It assumes that the message is valid.
-func extractPassword(m protocol.Message) []byte {
+// It returns a protocol violation error if the message is malformed.
+func extractPassword(m protocol.Message) ([]byte, error) {
 	// password starts after the size (4 bytes) and lasts until null-terminator
-	return m[5 : len(m)-1]
+	if len(m) < 6 || m[len(m)-1] != 0 {
+		return nil, ProtocolViolation("invalid password packet size")
+	}
+	return m[5 : len(m)-1], nil
 }
 
 // hashWithSalt salts the provided md5 hash and hashes the result using md5.
@@ -208,3 +380,52 @@ func hashWithSalt(hash, salt []byte) []byte {
 	finalHash := fmt.Sprintf("md5%x", md5.Sum(puHashSalted))
 	return []byte(finalHash)
 }
+
+// Authorizer can be implemented by a Queryer in order to decide which of the
+// authenticated users may connect to which databases, separately from how
+// they're authenticated. A user that isn't permitted is rejected right after
+// authentication with the returned error, which is reported with the SQLSTATE
+// of its Code() if it has one (see Err), otherwise with 42501
+// (insufficient_privilege).
+type Authorizer interface {
+	Authorize(user, database string) error
+}
+
+// DatabaseAllowlist is an Authorizer permitting each of the users to connect
+// only to the listed databases, keyed by user name. Users that aren't listed
+// are rejected. It may be embedded in the Queryer.
+type DatabaseAllowlist map[string][]string
+
+// Authorize implements Authorizer.
+func (al DatabaseAllowlist) Authorize(user, database string) error {
+	for _, db := range al[user] {
+		if db == database {
+			return nil
+		}
+	}
+
+	err := InsufficientPrivilege("permission denied for database \"%s\"", database)
+	return WithDetail(err, "User does not have CONNECT privilege.")
+}
+
+// authorize rejects the session if the authenticated user isn't permitted to
+// connect to the requested database (see Authorizer)
+func (s *session) authorize() error {
+	authorizer, ok := s.Server.queryer.(Authorizer)
+	if !ok {
+		return nil
+	}
+
+	user, _ := s.Args["user"].(string)
+	database, _ := s.Args["database"].(string)
+	err := authorizer.Authorize(user, database)
+	if err == nil {
+		return nil
+	}
+
+	e := *fromErr(err) // copy, to avoid modifying the authorizer's error
+	if e.C == "" {
+		e.C = "42501" // insufficient_privilege
+	}
+	return WithSeverity(&e, fatalSeverity)
+}
@@ -3,9 +3,15 @@ package pgsrv
 import (
 	"bytes"
 	"crypto/md5"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
 	"github.com/panoplyio/pgsrv/protocol"
 	"github.com/stretchr/testify/require"
+	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 var authOKMessage = protocol.Message{'R', 0, 0, 0, 8, 0, 0, 0, 0}
@@ -13,13 +19,6 @@ var fatalMarker = []byte{
 	83, 70, 65, 84, 65, 76,
 }
 
-func TestAuthOKMsg(t *testing.T) {
-	actualResult := authOKMsg()
-	expectedResult := authOKMessage
-
-	require.Equal(t, expectedResult, actualResult)
-}
-
 func TestNoPassword_authenticate(t *testing.T) {
 	rw := &mockMessageReadWriter{output: []protocol.Message{}}
 	args := map[string]interface{}{
@@ -87,6 +86,82 @@ func TestAuthenticationClearText_authenticate(t *testing.T) {
 	})
 }
 
+func TestAuthentication_malformedPasswordMessage(t *testing.T) {
+	args := map[string]interface{}{
+		"user": "this-is-user",
+	}
+	authenticators := map[string]authenticator{
+		"clear text": &clearTextAuthenticator{&constantPasswordProvider{password: []byte("meh")}},
+		"md5":        &md5Authenticator{&md5ConstantPasswordProvider{password: []byte("meh")}},
+	}
+	messages := map[string]protocol.Message{
+		"empty":     {'p', 0, 0, 0, 4},
+		"truncated": {'p', 0, 0, 0, 5, 109},
+	}
+
+	for authName, a := range authenticators {
+		for msgName, m := range messages {
+			t.Run(authName+" "+msgName, func(t *testing.T) {
+				rw := &mockMessageReadWriter{output: []protocol.Message{m}}
+				err := a.authenticate(rw, args)
+
+				require.EqualError(t, err, "invalid password packet size")
+				require.Len(t, rw.messages, 2)
+				res, err := rw.messages[1].ErrorResponse()
+				require.NoError(t, err)
+				require.Equal(t, "FATAL", res.Severity)
+				require.Equal(t, "08P01", res.Code)
+			})
+		}
+	}
+}
+
+func TestAuthentication_passwordLookup(t *testing.T) {
+	// the password is never compared, so the md5 provider serves clear text
+	// authentication as well
+	pp := MD5PasswordFunc(func(user string) (string, error) {
+		if user == "bob" {
+			return "", fmt.Errorf("looking up %s: %w", user, ErrUnknownUser)
+		}
+		return "", errors.New("connection refused")
+	})
+	authenticators := map[string]authenticator{
+		"clear text": &clearTextAuthenticator{pp},
+		"md5":        &md5Authenticator{pp},
+	}
+	passwordMessage := protocol.Message{'p', 0, 0, 0, 8, 109, 101, 104, 0}
+
+	for name, a := range authenticators {
+		t.Run(name+" unknown user", func(t *testing.T) {
+			rw := &mockMessageReadWriter{output: []protocol.Message{passwordMessage}}
+			logger := &mockLogger{}
+			lrw := &localizedReadWriter{rw, func(err error) error { return err }, logger}
+			err := a.authenticate(lrw, map[string]interface{}{"user": "bob"})
+
+			require.EqualError(t, err, "password does not match for user \"bob\"")
+			res, err := rw.messages[1].ErrorResponse()
+			require.NoError(t, err)
+			require.Equal(t, "28P01", res.Code)
+			require.Empty(t, logger.logs)
+		})
+
+		t.Run(name+" lookup failure", func(t *testing.T) {
+			rw := &mockMessageReadWriter{output: []protocol.Message{passwordMessage}}
+			logger := &mockLogger{}
+			lrw := &localizedReadWriter{rw, func(err error) error { return err }, logger}
+			err := a.authenticate(lrw, map[string]interface{}{"user": "alice"})
+
+			// the cause is logged, rather than revealed to the client
+			require.EqualError(t, err, "could not get the password of user \"alice\"")
+			res, err := rw.messages[1].ErrorResponse()
+			require.NoError(t, err)
+			require.Equal(t, "FATAL", res.Severity)
+			require.Equal(t, "XX000", res.Code)
+			require.Equal(t, []string{"pgsrv: could not get the password of user \"alice\": connection refused"}, logger.logs)
+		})
+	}
+}
+
 func TestAuthenticationMD5_authenticate(t *testing.T) {
 	passwordRequest := protocol.Message{
 		'R',
@@ -137,6 +212,109 @@ func TestAuthenticationMD5_authenticate(t *testing.T) {
 	})
 }
 
+func TestMD5Passwords(t *testing.T) {
+	pp := MD5Passwords(map[string]string{"alice": "secret"})
+	require.Equal(t, MD5, pp.Type())
+
+	t.Run("digest", func(t *testing.T) {
+		digest, err := pp.GetPassword("alice")
+		require.NoError(t, err)
+		require.Equal(t, "4a0a68b43b6cd5cf266fa02f196e2371", fmt.Sprintf("%x", digest))
+
+		// the response of psql to the salt 0x01020304
+		require.Equal(t, "md598a0412b9c31436fc53776e863350083", string(hashWithSalt(digest, []byte{1, 2, 3, 4})))
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		_, err := pp.GetPassword("bob")
+		require.Equal(t, ErrUnknownUser, err)
+	})
+
+	t.Run("authenticate", func(t *testing.T) {
+		a := &md5Authenticator{pp}
+		args := map[string]interface{}{"user": "alice"}
+
+		rw := &mockMD5MessageReadWriter{user: "alice", pass: []byte("secret")}
+		require.NoError(t, a.authenticate(rw, args))
+		require.Equal(t, authOKMessage, rw.messages[1])
+
+		rw = &mockMD5MessageReadWriter{user: "alice", pass: []byte("wrong")}
+		require.EqualError(t, a.authenticate(rw, args), "password does not match for user \"alice\"")
+
+		rw = &mockMD5MessageReadWriter{user: "bob", pass: []byte("")}
+		args = map[string]interface{}{"user": "bob"}
+		require.EqualError(t, a.authenticate(rw, args), "password does not match for user \"bob\"")
+	})
+
+	t.Run("function", func(t *testing.T) {
+		pp := MD5PasswordFunc(func(user string) (string, error) {
+			return "secret", nil
+		})
+		digest, err := pp.GetPassword("alice")
+		require.NoError(t, err)
+		require.Equal(t, "4a0a68b43b6cd5cf266fa02f196e2371", fmt.Sprintf("%x", digest))
+	})
+}
+
+func TestAuthenticationGSS_authenticate(t *testing.T) {
+	gssRequest := protocol.Message{
+		'R',
+		0, 0, 0, 8, // length
+		0, 0, 0, 7, // gss auth type
+	}
+	tokenMessage := protocol.Message{
+		'p',
+		0, 0, 0, 7,
+		116, 111, 107, // 'tok'
+	}
+	args := map[string]interface{}{
+		"user": "this-is-user",
+	}
+
+	t.Run("multi-round exchange", func(t *testing.T) {
+		rw := &mockMessageReadWriter{output: []protocol.Message{tokenMessage}}
+		gp := &mockGSSProvider{rounds: 2}
+		a := &gssAuthenticator{gp}
+
+		err := a.authenticate(rw, args)
+
+		require.NoError(t, err)
+		expectedMessages := []protocol.Message{
+			gssRequest,
+			protocol.Authentication(protocol.AuthGSSContinue, []byte("round 1")),
+			protocol.Authentication(protocol.AuthGSSContinue, []byte("round 2")),
+			authOKMessage,
+		}
+		require.Equal(t, expectedMessages, rw.messages)
+		require.Equal(t, [][]byte{[]byte("tok"), []byte("tok")}, gp.tokens)
+	})
+
+	t.Run("rejected token", func(t *testing.T) {
+		rw := &mockMessageReadWriter{output: []protocol.Message{tokenMessage}}
+		gp := &mockGSSProvider{rounds: 2, err: fmt.Errorf("bad token")}
+		a := &gssAuthenticator{gp}
+
+		err := a.authenticate(rw, args)
+
+		require.EqualError(t, err, "bad token")
+		require.Equal(t, gssRequest, rw.messages[0])
+		require.True(t, bytes.Contains(rw.messages[1], fatalMarker))
+	})
+
+	t.Run("invalid message type", func(t *testing.T) {
+		rw := &mockMessageReadWriter{output: []protocol.Message{
+			{'q', 0, 0, 0, 5, 1},
+		}}
+		a := &gssAuthenticator{&mockGSSProvider{rounds: 1}}
+
+		err := a.authenticate(rw, args)
+
+		require.Equal(t, gssRequest, rw.messages[0])
+		require.True(t, bytes.Contains(rw.messages[1], fatalMarker))
+		require.EqualError(t, err, "expected password response, got message type 'q'")
+	})
+}
+
 func TestHashWithSalt(t *testing.T) {
 	user := "postgres"
 	pass := []byte("test")
@@ -155,14 +333,70 @@ func TestHashWithSalt(t *testing.T) {
 	require.Equal(t, expectedHash, actualHash)
 }
 
+// failingReader fails every read
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("entropy source unavailable")
+}
+
 func TestGetRandomSalt(t *testing.T) {
-	var lastSalt []byte
-	for i := 0; i < 100; i++ {
-		salt := getRandomSalt()
-		require.Equal(t, len(salt), 4)
-		require.NotEqual(t, lastSalt, salt)
-		lastSalt = salt
-	}
+	t.Run("random", func(t *testing.T) {
+		var lastSalt []byte
+		for i := 0; i < 100; i++ {
+			salt, err := getRandomSalt()
+			require.NoError(t, err)
+			require.Equal(t, len(salt), 4)
+			require.NotEqual(t, lastSalt, salt)
+			lastSalt = salt
+		}
+	})
+
+	t.Run("deterministic source", func(t *testing.T) {
+		defer func(r io.Reader) { RandSource = r }(RandSource)
+		RandSource = bytes.NewReader([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+
+		salt, err := getRandomSalt()
+		require.NoError(t, err)
+		require.Equal(t, []byte{1, 2, 3, 4}, salt)
+		salt, err = getRandomSalt()
+		require.NoError(t, err)
+		require.Equal(t, []byte{5, 6, 7, 8}, salt)
+	})
+
+	t.Run("failing source", func(t *testing.T) {
+		defer func(r io.Reader) { RandSource = r }(RandSource)
+		for name, r := range map[string]io.Reader{
+			"error": failingReader{},
+			"short": bytes.NewReader([]byte{1, 2}),
+			"empty": bytes.NewReader(nil),
+		} {
+			RandSource = r
+			_, err := getRandomSalt()
+			require.Error(t, err, name)
+			require.Equal(t, "XX000", fromErr(err).C, name)
+		}
+	})
+
+	t.Run("md5 authentication", func(t *testing.T) {
+		defer func(r io.Reader) { RandSource = r }(RandSource)
+		a := &md5Authenticator{MD5Passwords(map[string]string{"alice": "secret"})}
+		args := map[string]interface{}{"user": "alice"}
+
+		// the salt of the password request is read from the source
+		RandSource = bytes.NewReader([]byte{1, 2, 3, 4})
+		rw := &mockMD5MessageReadWriter{user: "alice", pass: []byte("secret")}
+		require.NoError(t, a.authenticate(rw, args))
+		require.Equal(t, []byte{1, 2, 3, 4}, []byte(rw.messages[0][9:]))
+
+		// the session is rejected before requesting the password
+		RandSource = failingReader{}
+		rw = &mockMD5MessageReadWriter{user: "alice", pass: []byte("secret")}
+		err := a.authenticate(rw, args)
+		require.Error(t, err)
+		require.Len(t, rw.messages, 1)
+		require.True(t, bytes.Contains(rw.messages[0], fatalMarker))
+	})
 }
 
 func TestExtractPassword(t *testing.T) {
@@ -175,7 +409,8 @@ func TestExtractPassword(t *testing.T) {
 		}
 
 		expectedResult := []byte{42, 42, 42, 42}
-		actualResult := extractPassword(passwordMessage)
+		actualResult, err := extractPassword(passwordMessage)
+		require.NoError(t, err)
 		require.Equal(t, expectedResult, actualResult)
 	})
 
@@ -187,9 +422,33 @@ func TestExtractPassword(t *testing.T) {
 		}
 
 		expectedResult := []byte{}
-		actualResult := extractPassword(passwordMessage)
+		actualResult, err := extractPassword(passwordMessage)
+		require.NoError(t, err)
 		require.Equal(t, expectedResult, actualResult)
 	})
+
+	t.Run("truncated message", func(t *testing.T) {
+		for _, m := range []protocol.Message{
+			{},
+			{'p'},
+			{'p', 0, 0, 0, 4},
+		} {
+			_, e := extractPassword(m)
+			require.EqualError(t, e, "invalid password packet size")
+			require.Equal(t, "08P01", e.(*err).Code())
+		}
+	})
+
+	t.Run("missing null terminator", func(t *testing.T) {
+		passwordMessage := protocol.Message{
+			'p',
+			0, 0, 0, 6,
+			42, 42,
+		}
+
+		_, err := extractPassword(passwordMessage)
+		require.EqualError(t, err, "invalid password packet size")
+	})
 }
 
 // mockMessageReadWriter implements messageReadWriter and outputs the provided output
@@ -242,3 +501,122 @@ func (rw *mockMD5MessageReadWriter) Write(m protocol.Message) error {
 func (rw *mockMD5MessageReadWriter) Reset() {
 	rw.messages = make([]protocol.Message, 0)
 }
+
+// mockGSSProvider creates security contexts that are established after the
+// configured number of rounds, replying with a token on each round
+type mockGSSProvider struct {
+	rounds int
+	err    error
+	tokens [][]byte
+}
+
+func (gp *mockGSSProvider) NewGSSContext(user string) (GSSContext, error) {
+	return gp, nil
+}
+
+func (gp *mockGSSProvider) Accept(token []byte) ([]byte, bool, error) {
+	if gp.err != nil {
+		return nil, false, gp.err
+	}
+	gp.tokens = append(gp.tokens, token)
+	output := []byte(fmt.Sprintf("round %d", len(gp.tokens)))
+	return output, len(gp.tokens) >= gp.rounds, nil
+}
+
+// authorizingQueryer permits the users to connect to the allowed databases
+type authorizingQueryer struct {
+	mockQueryer
+	DatabaseAllowlist
+}
+
+func TestDatabaseAllowlist(t *testing.T) {
+	al := DatabaseAllowlist{"alice": {"db1"}}
+	require.NoError(t, al.Authorize("alice", "db1"))
+
+	err := al.Authorize("alice", "db2")
+	require.Error(t, err)
+	require.Equal(t, "42501", fromErr(err).C)
+	require.Equal(t, "permission denied for database \"db2\"", err.Error())
+
+	require.Error(t, al.Authorize("bob", "db1"))
+}
+
+func TestSession_authorize(t *testing.T) {
+	queryer := &authorizingQueryer{DatabaseAllowlist: DatabaseAllowlist{"alice": {"db1"}}}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+
+	t.Run("permitted", func(t *testing.T) {
+		_, pid := connectWith(t, srv, map[string]string{"user": "alice", "database": "db1"})
+		require.NotZero(t, pid)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		f, b := net.Pipe()
+		defer f.Close()
+		go srv.Serve(b)
+
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+		err = frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "alice", "database": "db2"},
+		})
+		require.NoError(t, err)
+
+		// authenticated, but not authorized
+		receive(t, frontend, &pgproto3.Authentication{})
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{}).(*pgproto3.ErrorResponse)
+		require.Equal(t, "FATAL", msg.Severity)
+		require.Equal(t, "42501", msg.Code)
+		require.Equal(t, "permission denied for database \"db2\"", msg.Message)
+	})
+}
+
+func TestServer_authTimeout(t *testing.T) {
+	pp := &constantPasswordProvider{password: []byte("secret")}
+	srv := New(&passwordQueryer{PasswordProvider: pp}, WithAuthTimeout(50*time.Millisecond))
+
+	conn := Pipe(srv)
+	defer conn.Close()
+	frontend, err := pgproto3.NewFrontend(conn, conn)
+	require.NoError(t, err)
+	err = frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice"},
+	})
+	require.NoError(t, err)
+	receive(t, frontend, &pgproto3.Authentication{})
+
+	// never respond to the password request
+	msg := receive(t, frontend, &pgproto3.ErrorResponse{}).(*pgproto3.ErrorResponse)
+	require.Equal(t, "FATAL", msg.Severity)
+	require.Equal(t, "57014", msg.Code)
+	require.Equal(t, "canceling authentication due to timeout", msg.Message)
+
+	_, err = frontend.Receive()
+	require.Error(t, err, "expected the connection to be closed")
+}
+
+func TestServer_authTimeoutAuthenticated(t *testing.T) {
+	conn := Pipe(New(&mockQueryer{}, WithAuthTimeout(20*time.Millisecond)))
+	defer conn.Close()
+	frontend, err := pgproto3.NewFrontend(conn, conn)
+	require.NoError(t, err)
+	err = frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice"},
+	})
+	require.NoError(t, err)
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+
+	// the timeout doesn't apply once authenticated
+	time.Sleep(50 * time.Millisecond)
+	sendQuery(t, frontend, "SELECT 1")
+	receive(t, frontend, &pgproto3.RowDescription{})
+}
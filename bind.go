@@ -0,0 +1,192 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgtype"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+// the format codes of parameters and results
+const (
+	textFormat   = 0
+	binaryFormat = 1
+)
+
+// parameterValues maps the type OIDs of the supported bind parameter types to
+// the values decoding them, in both text and binary formats. Parameters of
+// other types are only supported in text format, and are left as strings.
+var parameterValues = map[pgtype.OID]func() pgtype.Value{
+	pgtype.BoolOID:        func() pgtype.Value { return &pgtype.Bool{} },
+	pgtype.ByteaOID:       func() pgtype.Value { return &pgtype.Bytea{} },
+	pgtype.Int2OID:        func() pgtype.Value { return &pgtype.Int2{} },
+	pgtype.Int4OID:        func() pgtype.Value { return &pgtype.Int4{} },
+	pgtype.Int8OID:        func() pgtype.Value { return &pgtype.Int8{} },
+	pgtype.Float4OID:      func() pgtype.Value { return &pgtype.Float4{} },
+	pgtype.Float8OID:      func() pgtype.Value { return &pgtype.Float8{} },
+	pgtype.NumericOID:     func() pgtype.Value { return &numericValue{} },
+	pgtype.TextOID:        func() pgtype.Value { return &pgtype.Text{} },
+	pgtype.VarcharOID:     func() pgtype.Value { return &pgtype.Varchar{} },
+	pgtype.BPCharOID:      func() pgtype.Value { return &pgtype.BPChar{} },
+	pgtype.DateOID:        func() pgtype.Value { return &pgtype.Date{} },
+	pgtype.TimestampOID:   func() pgtype.Value { return &pgtype.Timestamp{} },
+	pgtype.TimestamptzOID: func() pgtype.Value { return &pgtype.Timestamptz{} },
+}
+
+// decodeParameters decodes the parameters of a Bind message into values of
+// their types, according to their format codes: no format codes means that all
+// of the parameters are in text format, a single one applies to all of them,
+// and otherwise there's one per parameter.
+func decodeParameters(oids []uint32, formats []int16, params [][]byte) ([]driver.Value, error) {
+	if len(formats) > 1 && len(formats) != len(params) {
+		return nil, ProtocolViolation("bind message has %d parameter formats but %d parameters", len(formats), len(params))
+	}
+
+	values := make([]driver.Value, len(params))
+	for i, param := range params {
+		format := int16(textFormat)
+		if len(formats) == 1 {
+			format = formats[0]
+		} else if len(formats) > 1 {
+			format = formats[i]
+		}
+
+		var oid uint32
+		if i < len(oids) {
+			oid = oids[i]
+		}
+
+		v, err := decodeParameter(i+1, oid, format, param)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// decodeParameter decodes the value of the numbered parameter ($1, $2, etc.)
+func decodeParameter(num int, oid uint32, format int16, src []byte) (driver.Value, error) {
+	if src == nil {
+		return nil, nil // NULL
+	}
+
+	newValue, ok := parameterValues[pgtype.OID(oid)]
+	switch format {
+	case textFormat:
+		if !ok {
+			return string(src), nil
+		}
+
+		v := newValue()
+		err := v.(pgtype.TextDecoder).DecodeText(nil, src)
+		if err != nil {
+			return nil, InvalidTextRepresentation("invalid input syntax in bind parameter %d: \"%s\"", num, src)
+		}
+		return parameterValue(v), nil
+	case binaryFormat:
+		if !ok {
+			return nil, InvalidBinaryRepresentation("unsupported binary format for type %d in bind parameter %d", oid, num)
+		}
+
+		v := newValue()
+		err := v.(pgtype.BinaryDecoder).DecodeBinary(nil, src)
+		if err != nil {
+			return nil, InvalidBinaryRepresentation("incorrect binary data format in bind parameter %d", num)
+		}
+		return parameterValue(v), nil
+	default:
+		return nil, ProtocolViolation("unsupported format code: %d", format)
+	}
+}
+
+// parameterValue converts a decoded value into one of the types of
+// driver.Value
+func parameterValue(v pgtype.Value) driver.Value {
+	switch v := v.Get().(type) {
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	default:
+		return v
+	}
+}
+
+// checkResultFormats verifies that the result format codes of a Bind message
+// are supported. Their number is verified against the columns of the result
+// once it's known, see resultFormats.
+func checkResultFormats(formats []int16) error {
+	for _, format := range formats {
+		if format != textFormat && format != binaryFormat {
+			return ProtocolViolation("unsupported format code: %d", format)
+		}
+	}
+	return nil
+}
+
+// resultFormats returns the format code of each of the columns of a result,
+// from the result format codes of a Bind message: no format codes means that
+// all of the columns are in text format, a single one applies to all of them,
+// and otherwise there's one per column.
+func resultFormats(formats []int16, numCols int) ([]int16, error) {
+	res := make([]int16, numCols)
+	switch len(formats) {
+	case 0:
+	case 1:
+		for i := range res {
+			res[i] = formats[0]
+		}
+	case numCols:
+		copy(res, formats)
+	default:
+		return nil, ProtocolViolation("bind message has %d result formats but query has %d columns", len(formats), numCols)
+	}
+	return res, nil
+}
+
+// parameterNodes converts the decoded values of the parameters of a portal
+// into constants, to replace the parameters of its prepared statement (see
+// bindParams). Values other than integers are passed as string literals, which
+// are cast to the types of the parameters.
+func parameterNodes(values []driver.Value) []nodes.Node {
+	res := make([]nodes.Node, len(values))
+	for i, v := range values {
+		var val nodes.Node
+		switch v := v.(type) {
+		case nil:
+			val = nodes.Null{}
+		case int64:
+			val = nodes.Integer{Ival: v}
+		default:
+			val = nodes.String{Str: string(appendValue(nil, v))}
+		}
+		res[i] = nodes.A_Const{Val: val}
+	}
+	return res
+}
+
+// argTypeOIDs returns the type OIDs of the parameters of the prepared
+// statement, looking up the OIDs of the types specified only by name, like in
+// PREPARE. Unknown types are mapped to a zero OID.
+func (s *session) argTypeOIDs(ps *nodes.PrepareStmt) []uint32 {
+	oids := make([]uint32, len(ps.Argtypes.Items))
+	for i, item := range ps.Argtypes.Items {
+		tn, ok := item.(nodes.TypeName)
+		if !ok {
+			continue
+		}
+
+		oids[i] = uint32(tn.TypeOid)
+		if oids[i] != 0 || len(tn.Names.Items) == 0 || s.ConnInfo == nil {
+			continue
+		}
+
+		name, _ := tn.Names.Items[len(tn.Names.Items)-1].(nodes.String)
+		if dt, ok := s.ConnInfo.DataTypeForName(name.Str); ok {
+			oids[i] = uint32(dt.OID)
+		}
+	}
+	return oids
+}
@@ -0,0 +1,196 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/jackc/pgx/pgtype"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// encodeBinary returns the binary format of the value
+func encodeBinary(t *testing.T, v pgtype.BinaryEncoder) []byte {
+	b, err := v.EncodeBinary(nil, nil)
+	require.NoError(t, err)
+	return b
+}
+
+func TestDecodeParameters(t *testing.T) {
+	ts := time.Date(2018, 7, 1, 12, 30, 15, 123456000, time.UTC)
+
+	tests := map[string]struct {
+		oid      pgtype.OID
+		format   int16
+		param    []byte
+		expected driver.Value
+	}{
+		"binary int2":       {pgtype.Int2OID, binaryFormat, encodeBinary(t, &pgtype.Int2{Int: -42, Status: pgtype.Present}), int64(-42)},
+		"binary int4":       {pgtype.Int4OID, binaryFormat, []byte{0, 0, 1, 0}, int64(256)},
+		"binary int8":       {pgtype.Int8OID, binaryFormat, []byte{0, 0, 0, 1, 0, 0, 0, 0}, int64(1 << 32)},
+		"binary float4":     {pgtype.Float4OID, binaryFormat, encodeBinary(t, &pgtype.Float4{Float: 1.5, Status: pgtype.Present}), float64(1.5)},
+		"binary float8":     {pgtype.Float8OID, binaryFormat, encodeBinary(t, &pgtype.Float8{Float: 3.25, Status: pgtype.Present}), 3.25},
+		"binary bool":       {pgtype.BoolOID, binaryFormat, []byte{1}, true},
+		"binary bytea":      {pgtype.ByteaOID, binaryFormat, []byte{0xde, 0xad}, []byte{0xde, 0xad}},
+		"binary text":       {pgtype.TextOID, binaryFormat, []byte("hello"), "hello"},
+		"binary timestamp":  {pgtype.TimestampOID, binaryFormat, encodeBinary(t, &pgtype.Timestamp{Time: ts, Status: pgtype.Present}), ts},
+		"text int4":         {pgtype.Int4OID, textFormat, []byte("256"), int64(256)},
+		"text float8":       {pgtype.Float8OID, textFormat, []byte("3.25"), 3.25},
+		"text bool":         {pgtype.BoolOID, textFormat, []byte("t"), true},
+		"text bytea":        {pgtype.ByteaOID, textFormat, []byte(`\xdead`), []byte{0xde, 0xad}},
+		"text timestamp":    {pgtype.TimestampOID, textFormat, []byte("2018-07-01 12:30:15.123456"), ts},
+		"binary numeric":    {pgtype.NumericOID, binaryFormat, encodeBinary(t, &pgtype.Numeric{Int: big.NewInt(-12345), Exp: -2, Status: pgtype.Present}), "-123.45"},
+		"text numeric":      {pgtype.NumericOID, textFormat, []byte("1.50"), "1.50"},
+		"text unknown type": {pgtype.JSONOID, textFormat, []byte(`{"a":1}`), `{"a":1}`},
+		"null":              {pgtype.Int4OID, binaryFormat, nil, nil},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			values, err := decodeParameters([]uint32{uint32(test.oid)}, []int16{test.format}, [][]byte{test.param})
+			require.NoError(t, err)
+			require.Equal(t, []driver.Value{test.expected}, values)
+		})
+	}
+
+	t.Run("format per parameter", func(t *testing.T) {
+		oids := []uint32{pgtype.Int4OID, pgtype.Int4OID}
+		values, err := decodeParameters(oids, []int16{textFormat, binaryFormat}, [][]byte{[]byte("1"), {0, 0, 0, 2}})
+		require.NoError(t, err)
+		require.Equal(t, []driver.Value{int64(1), int64(2)}, values)
+	})
+
+	t.Run("text by default", func(t *testing.T) {
+		values, err := decodeParameters([]uint32{pgtype.Int4OID}, nil, [][]byte{[]byte("1")})
+		require.NoError(t, err)
+		require.Equal(t, []driver.Value{int64(1)}, values)
+	})
+
+	failures := map[string]struct {
+		oid     pgtype.OID
+		formats []int16
+		params  [][]byte
+		code    string
+	}{
+		"binary unknown type":     {pgtype.JSONOID, []int16{binaryFormat}, [][]byte{[]byte("{}")}, "22P03"},
+		"binary invalid length":   {pgtype.Int4OID, []int16{binaryFormat}, [][]byte{{0, 1}}, "22P03"},
+		"binary invalid numeric":  {pgtype.NumericOID, []int16{binaryFormat}, [][]byte{{0, 1, 0, 0}}, "22P03"},
+		"text invalid numeric":    {pgtype.NumericOID, []int16{textFormat}, [][]byte{[]byte("1.2.3")}, "22P02"},
+		"text invalid":            {pgtype.Int4OID, []int16{textFormat}, [][]byte{[]byte("abc")}, "22P02"},
+		"unsupported format":      {pgtype.Int4OID, []int16{2}, [][]byte{[]byte("1")}, "08P01"},
+		"wrong number of formats": {pgtype.Int4OID, []int16{0, 0}, [][]byte{[]byte("1")}, "08P01"},
+	}
+
+	for name, test := range failures {
+		t.Run(name, func(t *testing.T) {
+			_, err := decodeParameters([]uint32{uint32(test.oid)}, test.formats, test.params)
+			require.Error(t, err)
+			require.Equal(t, test.code, fromErr(err).C)
+		})
+	}
+}
+
+func TestSession_bindParameters(t *testing.T) {
+	newSession := func() *session {
+		sess := &session{
+			ConnInfo:     newConnInfo(),
+			stmts:        map[string]*nodes.PrepareStmt{},
+			pendingStmts: map[string]*nodes.PrepareStmt{},
+			portals:      map[string]*portal{},
+		}
+		sess.storePreparedStatement(&nodes.PrepareStmt{
+			Name:  &testStmtName,
+			Query: nodes.String{Str: "SELECT $1, $2"},
+			Argtypes: nodes.List{Items: []nodes.Node{
+				nodes.TypeName{TypeOid: pgtype.Int8OID},
+				nodes.TypeName{Names: nodes.List{Items: []nodes.Node{nodes.String{Str: "bool"}}}},
+			}},
+		})
+		return sess
+	}
+
+	t.Run("decodes the parameters", func(t *testing.T) {
+		sess := newSession()
+		msgs, err := sess.bind(&pgproto3.Bind{
+			PreparedStatement:    testStmtName,
+			ParameterFormatCodes: []int16{binaryFormat},
+			Parameters:           [][]byte{{0, 0, 0, 0, 0, 0, 0, 7}, {0}},
+		})
+		require.NoError(t, err)
+		require.False(t, msgs[0].IsError())
+		require.Equal(t, []driver.Value{int64(7), false}, sess.portals[""].parameters)
+	})
+
+	t.Run("invalid binary representation", func(t *testing.T) {
+		sess := newSession()
+		msgs, err := sess.bind(&pgproto3.Bind{
+			PreparedStatement:    testStmtName,
+			ParameterFormatCodes: []int16{binaryFormat},
+			Parameters:           [][]byte{{0, 7}, {0}},
+		})
+		require.NoError(t, err)
+		require.True(t, msgs[0].IsError())
+		res, err := msgs[0].ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "22P03", res.Code)
+		require.Empty(t, sess.portals)
+	})
+
+	t.Run("stores the result formats", func(t *testing.T) {
+		sess := newSession()
+		msgs, err := sess.bind(&pgproto3.Bind{
+			PreparedStatement: testStmtName,
+			Parameters:        [][]byte{[]byte("7"), []byte("t")},
+			ResultFormatCodes: []int16{binaryFormat, textFormat},
+		})
+		require.NoError(t, err)
+		require.False(t, msgs[0].IsError())
+		require.Equal(t, []int16{binaryFormat, textFormat}, sess.portals[""].resultFormats)
+	})
+
+	t.Run("unsupported result format", func(t *testing.T) {
+		sess := newSession()
+		msgs, err := sess.bind(&pgproto3.Bind{
+			PreparedStatement: testStmtName,
+			Parameters:        [][]byte{[]byte("7"), []byte("t")},
+			ResultFormatCodes: []int16{2},
+		})
+		require.NoError(t, err)
+		require.True(t, msgs[0].IsError())
+		res, err := msgs[0].ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "08P01", res.Code)
+		require.Empty(t, sess.portals)
+	})
+}
+
+func TestResultFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		formats []int16
+		numCols int
+		res     []int16
+	}{
+		{"none", nil, 3, []int16{0, 0, 0}},
+		{"single", []int16{binaryFormat}, 3, []int16{1, 1, 1}},
+		{"per column", []int16{binaryFormat, textFormat, binaryFormat}, 3, []int16{1, 0, 1}},
+		{"single column", []int16{binaryFormat}, 1, []int16{1}},
+		{"no columns", nil, 0, []int16{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := resultFormats(test.formats, test.numCols)
+			require.NoError(t, err)
+			require.Equal(t, test.res, res)
+		})
+	}
+
+	t.Run("wrong number of formats", func(t *testing.T) {
+		_, err := resultFormats([]int16{binaryFormat, textFormat}, 3)
+		require.Error(t, err)
+		require.Equal(t, "08P01", fromErr(err).C)
+		require.Equal(t, "bind message has 2 result formats but query has 3 columns", err.Error())
+	})
+}
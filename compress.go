@@ -0,0 +1,134 @@
+package pgsrv
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"sort"
+	"strings"
+)
+
+// compressionParam is the startup parameter of the protocol extension for
+// compressing the connection, listing the algorithms supported by the client
+// in order of preference, like "gzip,zstd"
+const compressionParam = "_pq_.server_compression"
+
+// Compressor compresses the byte streams of the connections of clients that
+// request it with the _pq_.server_compression protocol extension parameter
+// (see WithCompressors). Protocol extension parameters are part of protocol
+// 3.0, and are negotiated by clients that support NegotiateProtocolVersion,
+// introduced in PostgreSQL 11.
+//
+// The compression is acknowledged by sending the name of the chosen algorithm
+// in a ParameterStatus of _pq_.server_compression, once the client is
+// authenticated. All of the messages after it, in both directions, are
+// compressed. Clients that don't receive it by the first ReadyForQuery should
+// proceed uncompressed.
+type Compressor interface {
+	// Name is the name of the algorithm, as requested by clients
+	Name() string
+
+	// NewReader returns a reader decompressing the data read from r
+	NewReader(r io.Reader) io.Reader
+
+	// NewWriter returns a writer compressing the data written to w. Its Flush
+	// is called at the end of every message group (see WithWriteBufferSize),
+	// and must send all of the data written so far to w.
+	NewWriter(w io.Writer) CompressWriter
+}
+
+// CompressWriter is a writer that holds the compressed data until flushed, see
+// Compressor
+type CompressWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// GzipCompressor returns a Compressor of the "gzip" algorithm
+func GzipCompressor() Compressor {
+	return gzipCompressor{}
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (gzipCompressor) NewReader(r io.Reader) io.Reader {
+	return &lazyGzipReader{r: r}
+}
+
+func (gzipCompressor) NewWriter(w io.Writer) CompressWriter {
+	return gzip.NewWriter(w)
+}
+
+// lazyGzipReader defers reading the gzip header until the first read, since
+// the client may not send anything for a while
+type lazyGzipReader struct {
+	r  io.Reader
+	gz *gzip.Reader
+}
+
+func (r *lazyGzipReader) Read(p []byte) (int, error) {
+	if r.gz == nil {
+		gz, err := gzip.NewReader(r.r)
+		if err != nil {
+			return 0, err
+		}
+		r.gz = gz
+	}
+	return r.gz.Read(p)
+}
+
+// negotiateExtensions removes the protocol extension parameters (_pq_.*) from
+// the startup arguments, and returns the Compressor for the compression
+// requested by the client, if any, along with the names of the parameters
+// that aren't supported.
+func (s *server) negotiateExtensions(args map[string]interface{}) (Compressor, []string) {
+	var compressor Compressor
+	var unsupported []string
+	for k, v := range args {
+		if !strings.HasPrefix(k, "_pq_.") {
+			continue
+		}
+		delete(args, k)
+
+		if k != compressionParam || len(s.compressors) == 0 {
+			unsupported = append(unsupported, k)
+			continue
+		}
+
+		algorithms, _ := v.(string)
+		compressor = s.compressor(strings.Split(algorithms, ","))
+	}
+
+	sort.Strings(unsupported)
+	return compressor, unsupported
+}
+
+// compressor returns the first of the algorithms that the server supports
+func (s *server) compressor(algorithms []string) Compressor {
+	for _, name := range algorithms {
+		for _, c := range s.compressors {
+			if strings.TrimSpace(name) == c.Name() {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// compress flushes the pending data and compresses the data read from and
+// written to the connection from now on
+func (c *bufferedConn) compress(comp Compressor) error {
+	err := c.w.Flush()
+	if err != nil {
+		return err
+	}
+
+	c.cw = comp.NewWriter(c.Conn)
+	c.w = bufio.NewWriterSize(c.cw, c.w.Size())
+
+	// the data already buffered is compressed as well
+	c.r = bufio.NewReaderSize(comp.NewReader(c.r), c.r.Size())
+	return nil
+}
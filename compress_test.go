@@ -0,0 +1,156 @@
+package pgsrv
+
+import (
+	"encoding/binary"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// readRawMessage reads a single message from the connection, without reading
+// ahead
+func readRawMessage(t *testing.T, conn io.Reader) (byte, []byte) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(conn, header)
+	require.NoError(t, err)
+
+	body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	_, err = io.ReadFull(conn, body)
+	require.NoError(t, err)
+	return header[0], body
+}
+
+// startUpRaw sends the startup message with the parameters and protocol
+// version, returning the messages read until the expected parameter status
+func startUpRaw(t *testing.T, conn net.Conn, version uint32, params map[string]string, until string) map[byte][][]byte {
+	_, err := conn.Write((&pgproto3.StartupMessage{ProtocolVersion: version, Parameters: params}).Encode(nil))
+	require.NoError(t, err)
+
+	msgs := map[byte][][]byte{}
+	for {
+		typ, body := readRawMessage(t, conn)
+		msgs[typ] = append(msgs[typ], body)
+		if typ == 'Z' || (typ == 'S' && until != "" && strings.HasPrefix(string(body), until+"\x00")) {
+			return msgs
+		}
+	}
+}
+
+// dialServer serves a single session over a TCP connection, rather than over
+// net.Pipe, whose writes block until they're read
+func dialServer(t *testing.T, srv Server) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			srv.Serve(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	return conn
+}
+
+func TestServer_compression(t *testing.T) {
+	srv := New(&mockQueryer{}, WithCompressors(GzipCompressor()))
+
+	t.Run("negotiated", func(t *testing.T) {
+		conn := dialServer(t, srv)
+		defer conn.Close()
+
+		params := map[string]string{"user": "postgres", compressionParam: "zstd, gzip"}
+		msgs := startUpRaw(t, conn, pgproto3.ProtocolVersionNumber, params, compressionParam)
+		require.NotContains(t, msgs, byte('v'))
+		last := msgs['S'][len(msgs['S'])-1]
+		require.Equal(t, compressionParam+"\x00gzip\x00", string(last))
+
+		// from now on, the messages are compressed in both directions
+		comp := GzipCompressor()
+		w := comp.NewWriter(conn)
+		frontend, err := pgproto3.NewFrontend(comp.NewReader(conn), w)
+		require.NoError(t, err)
+
+		receive(t, frontend, &pgproto3.BackendKeyData{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		sendQuery(t, frontend, "SELECT 1")
+		require.NoError(t, w.Flush())
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("unsupported algorithm", func(t *testing.T) {
+		conn := Pipe(srv)
+		defer conn.Close()
+
+		params := map[string]string{"user": "postgres", compressionParam: "zstd"}
+		msgs := startUpRaw(t, conn, pgproto3.ProtocolVersionNumber, params, compressionParam)
+		require.NotContains(t, msgs, byte('v'))
+		require.Contains(t, msgs, byte('Z'), "expected an uncompressed session")
+	})
+}
+
+func TestSession_negotiateProtocolVersion(t *testing.T) {
+	tests := map[string]struct {
+		srv         Server
+		version     uint32
+		params      map[string]string
+		unsupported []string
+	}{
+		"newer minor version": {New(&mockQueryer{}), 3<<16 | 2, nil, nil},
+		"newer minor version and unknown extension": {
+			New(&mockQueryer{}),
+			3<<16 | 1,
+			map[string]string{"_pq_.foo": "bar"},
+			[]string{"_pq_.foo"},
+		},
+		"unsupported extensions": {
+			New(&mockQueryer{}),
+			pgproto3.ProtocolVersionNumber,
+			map[string]string{"_pq_.foo": "1", compressionParam: "gzip"},
+			[]string{"_pq_.foo", compressionParam},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn := Pipe(test.srv)
+			defer conn.Close()
+
+			params := map[string]string{"user": "postgres"}
+			for k, v := range test.params {
+				params[k] = v
+			}
+			msgs := startUpRaw(t, conn, test.version, params, "")
+			require.Len(t, msgs['v'], 1)
+
+			body := msgs['v'][0]
+			require.Equal(t, uint32(0), binary.BigEndian.Uint32(body[0:4]), "expected minor version 0")
+			require.Equal(t, uint32(len(test.unsupported)), binary.BigEndian.Uint32(body[4:8]))
+			require.Equal(t, test.unsupported, splitNull(body[8:]))
+		})
+	}
+}
+
+// splitNull splits the null-terminated strings
+func splitNull(b []byte) []string {
+	var res []string
+	for len(b) > 0 {
+		i := 0
+		for b[i] != 0 {
+			i++
+		}
+		res = append(res, string(b[:i]))
+		b = b[i+1:]
+	}
+	return res
+}
@@ -0,0 +1,185 @@
+package pgsrv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultBufferSize is the default size of the read and write buffers of
+// client connections. Matches the size of the send buffer used by postgres.
+const defaultBufferSize = 8192
+
+// bufferedConn wraps a client connection with buffered reads and writes, in
+// order to reduce the number of syscalls when sending multi-message responses
+// (RowDescription, DataRows, CommandComplete). Written data is held in memory
+// until Flush or Close is called.
+type bufferedConn struct {
+	net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+	cw CompressWriter // beneath w, once compressed, see compress()
+
+	// the certificate presented to the client, once encrypted, see startTLS
+	serverCert []byte
+
+	// the deadlines of every read and write, see setTimeouts
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	awaiting     bool // the next message, see awaitMessage
+
+	// the deadline of the writes of the results of queries, see watchQuery
+	slowClientTimeout time.Duration
+	cancelQuery       context.CancelFunc
+}
+
+func newBufferedConn(conn net.Conn, readSize, writeSize int) *bufferedConn {
+	return &bufferedConn{
+		Conn: conn,
+		r:    bufio.NewReaderSize(conn, readSize),
+		w:    bufio.NewWriterSize(conn, writeSize),
+	}
+}
+
+// setTimeouts bounds every read and write of the connection from now on, and
+// the writes of the results of queries, see WithReadTimeout, WithWriteTimeout
+// and WithSlowClientTimeout. Zero timeouts leave them unbounded.
+func (c *bufferedConn) setTimeouts(read, write, slowClient time.Duration) {
+	c.readTimeout, c.writeTimeout, c.slowClientTimeout = read, write, slowClient
+}
+
+// watchQuery bounds the writes of the results of a query by the slow client
+// timeout, when there's one, calling cancel once a write exceeds it. The
+// returned function stops watching, once the query is complete.
+func (c *bufferedConn) watchQuery(cancel context.CancelFunc) func() {
+	if c.slowClientTimeout <= 0 {
+		return func() {}
+	}
+
+	c.cancelQuery = cancel
+	return func() {
+		c.cancelQuery = nil
+		if c.writeTimeout <= 0 {
+			// clear the deadline of the last write of the query
+			c.Conn.SetWriteDeadline(time.Time{})
+		}
+	}
+}
+
+// awaitMessage marks the connection as waiting for the next message from the
+// client, which may take indefinitely, so reading isn't bounded by the read
+// timeout until some of the message is received
+func (c *bufferedConn) awaitMessage() {
+	c.awaiting = true
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.readTimeout <= 0 {
+		return c.r.Read(p)
+	}
+
+	var deadline time.Time
+	if !c.awaiting {
+		deadline = time.Now().Add(c.readTimeout)
+	}
+	err := c.Conn.SetReadDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.awaiting = false
+	}
+	return n, deadlineError(err, "read", c.readTimeout)
+}
+
+func (c *bufferedConn) Write(p []byte) (int, error) {
+	timeout, err := c.setWriteDeadline()
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(p)
+	return n, c.writeError(err, timeout)
+}
+
+// Flush sends all of the buffered data to the client
+func (c *bufferedConn) Flush() error {
+	timeout, err := c.setWriteDeadline()
+	if err == nil {
+		err = c.w.Flush()
+	}
+	if err == nil && c.cw != nil {
+		err = c.cw.Flush()
+	}
+	return c.writeError(err, timeout)
+}
+
+// setWriteDeadline sets the deadline of the next write, by the write timeout,
+// or by the slow client timeout while a query is watched if it's shorter. It
+// returns the timeout of the deadline, or zero when there's none.
+func (c *bufferedConn) setWriteDeadline() (time.Duration, error) {
+	timeout := c.writeTimeout
+	if c.cancelQuery != nil && (timeout <= 0 || c.slowClientTimeout < timeout) {
+		timeout = c.slowClientTimeout
+	}
+	if timeout <= 0 {
+		return 0, nil
+	}
+	return timeout, c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+}
+
+// writeError replaces the error of a write that exceeded the deadline set by
+// setWriteDeadline. When it's the slow client timeout, the watched query is
+// canceled, so the backend stops producing the results.
+func (c *bufferedConn) writeError(err error, timeout time.Duration) error {
+	if timeout <= 0 || !isTimeout(err) {
+		return err
+	}
+	if c.cancelQuery != nil && timeout == c.slowClientTimeout {
+		c.cancelQuery()
+		return &slowClientError{timeout}
+	}
+	return &timeoutError{"write", timeout}
+}
+
+// timeoutError is the error of a read or write of the client connection that
+// exceeded its timeout, see WithReadTimeout and WithWriteTimeout
+type timeoutError struct {
+	op      string // read or write
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string   { return fmt.Sprintf("%s timed out after %v", e.op, e.timeout) }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return false }
+
+// slowClientError is the error of a write of the results of a query that
+// exceeded the slow client timeout, see WithSlowClientTimeout
+type slowClientError struct {
+	timeout time.Duration
+}
+
+func (e *slowClientError) Error() string {
+	return fmt.Sprintf("client is too slow to read the results: write blocked for over %v", e.timeout)
+}
+func (e *slowClientError) Timeout() bool   { return true }
+func (e *slowClientError) Temporary() bool { return false }
+
+// deadlineError replaces the error of a deadline set by the timeout of the
+// operation with a timeoutError, leaving other errors as they are
+func deadlineError(err error, op string, timeout time.Duration) error {
+	if timeout > 0 && isTimeout(err) {
+		return &timeoutError{op, timeout}
+	}
+	return err
+}
+
+// Close flushes any pending data before closing the underlying connection,
+// so that final messages (like a FATAL error) reach the client.
+func (c *bufferedConn) Close() error {
+	c.Flush()
+	return c.Conn.Close()
+}
@@ -0,0 +1,349 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingConn is a net.Conn that discards all written data while counting
+// the number of writes it received
+type countingConn struct {
+	net.Conn
+	writes int
+	bytes  int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	c.bytes += len(p)
+	return len(p), nil
+}
+
+func (c *countingConn) Close() error { return nil }
+
+func TestBufferedConn(t *testing.T) {
+	t.Run("holds writes until flushed", func(t *testing.T) {
+		conn := &countingConn{}
+		bc := newBufferedConn(conn, defaultBufferSize, defaultBufferSize)
+
+		_, err := bc.Write(protocol.CommandComplete("SELECT 1"))
+		require.NoError(t, err)
+		_, err = bc.Write(protocol.ReadyForQuery)
+		require.NoError(t, err)
+		require.Equal(t, 0, conn.writes)
+
+		err = bc.Flush()
+		require.NoError(t, err)
+		require.Equal(t, 1, conn.writes)
+	})
+
+	t.Run("close flushes pending writes", func(t *testing.T) {
+		conn := &countingConn{}
+		bc := newBufferedConn(conn, defaultBufferSize, defaultBufferSize)
+
+		_, err := bc.Write(protocol.ReadyForQuery)
+		require.NoError(t, err)
+
+		err = bc.Close()
+		require.NoError(t, err)
+		require.Equal(t, 1, conn.writes)
+		require.Equal(t, len(protocol.ReadyForQuery), conn.bytes)
+	})
+}
+
+// BenchmarkBufferedConn compares the number of writes to the underlying
+// connection when sending a 1000 rows result with and without buffering
+func BenchmarkBufferedConn(b *testing.B) {
+	writeResult := func(t *protocol.Transport) {
+		t.Write(protocol.RowDescription([]string{"a", "b"}, []string{"TEXT", "TEXT"}))
+		for i := 0; i < 1000; i++ {
+			t.Write(protocol.DataRow([]string{"hello", "world"}))
+		}
+		t.Write(protocol.CommandComplete("SELECT 1000"))
+		t.Flush()
+	}
+
+	b.Run("unbuffered", func(b *testing.B) {
+		conn := &countingConn{}
+		t := protocol.NewTransport(conn)
+		for i := 0; i < b.N; i++ {
+			writeResult(t)
+		}
+		b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+	})
+
+	b.Run("buffered", func(b *testing.B) {
+		conn := &countingConn{}
+		t := protocol.NewTransport(newBufferedConn(conn, defaultBufferSize, defaultBufferSize))
+		for i := 0; i < b.N; i++ {
+			writeResult(t)
+		}
+		b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+	})
+}
+
+// keepAliveRecorder records the keepalive settings of the connection
+type keepAliveRecorder struct {
+	net.Conn
+	keepAlive *bool
+	period    time.Duration
+}
+
+func (c *keepAliveRecorder) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = &keepalive
+	return nil
+}
+
+func (c *keepAliveRecorder) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return nil
+}
+
+func TestServer_setKeepAlive(t *testing.T) {
+	enabled, disabled := true, false
+	tests := map[string]struct {
+		keepAlive time.Duration
+		expected  *bool
+		period    time.Duration
+	}{
+		"enabled":  {keepAlive: time.Minute, expected: &enabled, period: time.Minute},
+		"disabled": {keepAlive: -1, expected: &disabled},
+		"default":  {keepAlive: 0},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := &server{}
+			WithTCPKeepAlive(test.keepAlive)(srv)
+
+			conn := &keepAliveRecorder{}
+			require.NoError(t, srv.setKeepAlive(conn))
+			require.Equal(t, test.expected, conn.keepAlive)
+			require.Equal(t, test.period, conn.period)
+		})
+	}
+
+	t.Run("tcp", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		go func() {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		srv := &server{tcpKeepAlive: time.Minute}
+		require.NoError(t, srv.setKeepAlive(conn))
+	})
+
+	t.Run("not tcp", func(t *testing.T) {
+		f, b := net.Pipe()
+		defer f.Close()
+		defer b.Close()
+
+		srv := &server{tcpKeepAlive: time.Minute}
+		require.NoError(t, srv.setKeepAlive(b))
+	})
+}
+
+// infiniteQueryer returns rows that never end, recording when they're closed
+type infiniteQueryer struct {
+	closed chan struct{}
+}
+
+func (q *infiniteQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return &infiniteRows{closed: q.closed}, nil
+}
+
+type infiniteRows struct {
+	closed chan struct{}
+}
+
+func (r *infiniteRows) Columns() []string { return []string{"v"} }
+func (r *infiniteRows) Close() error      { close(r.closed); return nil }
+func (r *infiniteRows) Next(dest []driver.Value) error {
+	dest[0] = strings.Repeat("x", 1024)
+	return nil
+}
+
+func TestServer_timeouts(t *testing.T) {
+	// serve starts serving a session over a pipe, returning the client's end
+	// of it, and the channel of the error that ended the session
+	serve := func(t *testing.T, srv *server) (net.Conn, *pgproto3.Frontend, chan error) {
+		f, b := net.Pipe()
+		done := make(chan error, 1)
+		go func() { done <- srv.Serve(b) }()
+
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+		require.NoError(t, frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres"},
+		}))
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				return f, frontend, done
+			}
+		}
+	}
+
+	// expectTimeout expects the session to end with a timeout of the operation
+	expectTimeout := func(t *testing.T, done chan error, op string) {
+		select {
+		case err := <-done:
+			require.IsType(t, &timeoutError{}, err)
+			require.Equal(t, op, err.(*timeoutError).op)
+			require.True(t, isTimeout(err))
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the session to time out")
+		}
+	}
+
+	t.Run("write stalled mid-result", func(t *testing.T) {
+		queryer := &infiniteQueryer{closed: make(chan struct{})}
+		srv := New(queryer, WithWriteTimeout(50*time.Millisecond)).(*server)
+		_, frontend, done := serve(t, srv)
+
+		// the client stops reading the rows
+		sendQuery(t, frontend, "SELECT * FROM endless")
+		expectTimeout(t, done, "write")
+
+		select {
+		case <-queryer.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the rows to be closed")
+		}
+	})
+
+	t.Run("read stalled mid-message", func(t *testing.T) {
+		srv := New(&mockQueryer{}, WithReadTimeout(50*time.Millisecond)).(*server)
+		conn, _, done := serve(t, srv)
+
+		// a Query message that declares a longer body than sent
+		_, err := conn.Write([]byte{'Q', 0, 0, 0, 100, 'S', 'E'})
+		require.NoError(t, err)
+		expectTimeout(t, done, "read")
+	})
+
+	t.Run("idle sessions", func(t *testing.T) {
+		srv := New(&mockQueryer{}, WithReadTimeout(20*time.Millisecond), WithWriteTimeout(20*time.Millisecond)).(*server)
+		_, frontend, done := serve(t, srv)
+
+		for i := 0; i < 2; i++ {
+			time.Sleep(100 * time.Millisecond)
+			sendQuery(t, frontend, "SELECT 1")
+			receive(t, frontend, &pgproto3.RowDescription{})
+			receive(t, frontend, &pgproto3.DataRow{})
+			receive(t, frontend, &pgproto3.CommandComplete{})
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+		}
+
+		require.NoError(t, frontend.Send(&pgproto3.Terminate{}))
+		require.NoError(t, <-done)
+	})
+}
+
+// cancelingRows streams rows until the context of the query is canceled,
+// recording the error of the context when they're closed
+type cancelingRows struct {
+	ctx    context.Context
+	closed chan error
+}
+
+func (r *cancelingRows) Columns() []string { return []string{"v"} }
+func (r *cancelingRows) Close() error      { r.closed <- r.ctx.Err(); return nil }
+func (r *cancelingRows) Next(dest []driver.Value) error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	dest[0] = strings.Repeat("x", 1024)
+	return nil
+}
+
+type cancelingQueryer struct {
+	closed chan error
+}
+
+func (q *cancelingQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return &cancelingRows{ctx: ctx, closed: q.closed}, nil
+}
+
+func TestServer_slowClientTimeout(t *testing.T) {
+	t.Run("client stops reading mid-stream", func(t *testing.T) {
+		queryer := &cancelingQueryer{closed: make(chan error, 1)}
+		srv := New(queryer, WithSlowClientTimeout(50*time.Millisecond)).(*server)
+
+		f, b := net.Pipe()
+		done := make(chan error, 1)
+		go func() { done <- srv.Serve(b) }()
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+		require.NoError(t, frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres"},
+		}))
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				break
+			}
+		}
+
+		// idle sessions aren't affected
+		time.Sleep(100 * time.Millisecond)
+
+		// the client reads some of the rows, then stops reading
+		sendQuery(t, frontend, "SELECT * FROM endless")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		for i := 0; i < 100; i++ {
+			receive(t, frontend, &pgproto3.DataRow{})
+		}
+
+		select {
+		case err := <-done:
+			require.IsType(t, &slowClientError{}, err)
+			require.Contains(t, err.Error(), "too slow")
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the session to be aborted")
+		}
+
+		// the query was canceled before its rows were closed
+		select {
+		case err := <-queryer.closed:
+			require.Equal(t, context.Canceled, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the rows to be closed")
+		}
+	})
+
+	t.Run("client reads the results", func(t *testing.T) {
+		srv := New(&mockQueryer{}, WithSlowClientTimeout(20*time.Millisecond)).(*server)
+		frontend, _ := connect(t, srv)
+
+		for i := 0; i < 2; i++ {
+			time.Sleep(50 * time.Millisecond)
+			sendQuery(t, frontend, "SELECT 1")
+			receive(t, frontend, &pgproto3.RowDescription{})
+			receive(t, frontend, &pgproto3.DataRow{})
+			receive(t, frontend, &pgproto3.CommandComplete{})
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+		}
+	})
+}
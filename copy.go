@@ -0,0 +1,1040 @@
+package pgsrv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgtype"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// copySignature starts the data of a COPY in binary format
+var copySignature = []byte("PGCOPY\n\377\r\n\000")
+
+// copyFromStdin reports whether the COPY loads data sent by the client, rather
+// than from a file or a program on the server
+func copyFromStdin(n nodes.CopyStmt) bool {
+	return n.IsFrom && n.Filename == nil && !n.IsProgram
+}
+
+// copyToStdout reports whether the COPY sends the data to the client, rather
+// than to a file or a program on the server
+func copyToStdout(n nodes.CopyStmt) bool {
+	return !n.IsFrom && n.Filename == nil && !n.IsProgram
+}
+
+// copyFrom executes COPY FROM STDIN by the CopyHandler: it switches the client
+// to copy-in mode, and decodes the data that the client sends into the rows
+// read by the backend, up to the end of the data.
+func (q *query) copyFrom(ctx context.Context, n nodes.CopyStmt) (err error) {
+	defer q.recoverPanic(&err)
+
+	rows, err := newCopyRows(n)
+	if err != nil {
+		return err
+	}
+
+	rows.columns, err = q.copier.CopyColumns(ctx, n)
+	if err != nil {
+		return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
+	}
+
+	format := int8(protocol.CopyTextFormat)
+	if rows.binary {
+		format = protocol.CopyBinaryFormat
+	}
+	err = q.transport.Write(protocol.CopyInResponse(format, len(rows.columns)))
+	if err != nil {
+		return err
+	}
+
+	r := &copyReader{ctx: ctx, transport: q.transport}
+	rows.r = bufio.NewReader(r)
+	res, err := q.copier.CopyFrom(ctx, n, rows)
+
+	// the client keeps sending the data regardless of the backend, which may
+	// not have read all of it, until it's done
+	if rows.err != nil && rows.err != io.EOF {
+		err = rows.err
+	}
+	if drainErr := rows.drain(); err == nil {
+		err = drainErr
+	}
+
+	// once the query is canceled, the client is told right away, rather than
+	// once it's done sending the data, which is discarded
+	if r.canceled {
+		err = q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
+		if err == nil {
+			err = q.transport.Flush()
+		}
+		if err == nil {
+			err = r.discard()
+		}
+		return err
+	}
+
+	if err != nil {
+		return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
+	}
+	return q.complete(ctx, copyResult(res, rows.count), n)
+}
+
+// copyTo executes COPY TO STDOUT by the Queryer, which runs the query of the
+// COPY, or a SELECT of the columns of its table. The client is switched to
+// copy-out mode, and each of the rows is sent in a CopyData message, in the
+// format of the COPY, flushed in batches like the rows of queries.
+func (q *query) copyTo(ctx context.Context, n nodes.CopyStmt) (err error) {
+	defer q.recoverPanic(&err)
+
+	opts, err := parseCopyOptions(n)
+	if err != nil {
+		return err
+	}
+
+	rows, err := q.queryer.Query(ctx, copyQuery(n))
+	if err != nil {
+		return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
+	}
+	defer rows.Close()
+
+	cols := rows.Columns()
+	types := make([]string, len(cols))
+	rowsTypes, ok := rows.(driver.RowsColumnTypeDatabaseTypeName)
+	for i := 0; i < len(types) && ok; i++ {
+		types[i] = strings.ToUpper(rowsTypes.ColumnTypeDatabaseTypeName(i))
+	}
+
+	w := &copyWriter{copyOptions: opts, types: types, encoding: q.encoding}
+	if sess, ok := ctx.Value(sessionCtxKey).(Session); ok {
+		w.format = sessionValueFormat(sess)
+	}
+
+	format := int8(protocol.CopyTextFormat)
+	if opts.binary {
+		format = protocol.CopyBinaryFormat
+	}
+	err = q.transport.Write(protocol.CopyOutResponse(format, len(cols)))
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch {
+	case opts.binary:
+		data = w.binaryHeader()
+	case opts.header:
+		data = w.headerLine(cols)
+	}
+
+	var count int64
+	row := make([]driver.Value, len(cols))
+	for {
+		// abort when the statement times out, even if the backend doesn't
+		err = ctx.Err()
+		if err == nil {
+			err = rows.Next(row)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
+		}
+
+		data, err = w.appendRow(data, row)
+		if err != nil {
+			return q.transport.Write(q.errorResponse(err))
+		}
+		err = q.writeCopyData(w, data)
+		if err != nil {
+			return err
+		}
+
+		data = data[:0]
+		count++
+
+		// like the rows of queries, the data is flushed at the end of every
+		// batch, see writeRow
+		if q.batchSize > 0 && count%int64(q.batchSize) == 0 {
+			err = q.transport.Flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.binary {
+		data = appendUint16s(data, 0xffff) // the trailer, a row of -1 values
+	}
+	if len(data) > 0 {
+		err = q.writeCopyData(w, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = q.transport.Write(protocol.CopyOutDone)
+	if err != nil {
+		return err
+	}
+	return q.complete(ctx, CopyResult(count), n)
+}
+
+// writeCopyData sends a chunk of the data of COPY TO STDOUT, in the client
+// encoding. It fails the COPY when the data can't be converted to it.
+func (q *query) writeCopyData(w *copyWriter, data []byte) error {
+	data, err := w.encode(data)
+	if err != nil {
+		return q.transport.Write(q.errorResponse(err))
+	}
+	return q.transport.Write(protocol.CopyData(data))
+}
+
+// copyQuery returns the query of COPY TO STDOUT: its own query, like in
+// COPY (SELECT ...) TO STDOUT, or a SELECT of the columns of its table, all
+// of them unless the COPY lists them
+func copyQuery(n nodes.CopyStmt) nodes.Node {
+	if n.Query != nil {
+		return n.Query
+	}
+
+	var targets []nodes.Node
+	for _, col := range n.Attlist.Items {
+		ref := nodes.ColumnRef{Fields: nodes.List{Items: []nodes.Node{col}}}
+		targets = append(targets, nodes.ResTarget{Val: ref})
+	}
+	if len(targets) == 0 {
+		star := nodes.ColumnRef{Fields: nodes.List{Items: []nodes.Node{nodes.A_Star{}}}}
+		targets = append(targets, nodes.ResTarget{Val: star})
+	}
+
+	stmt := nodes.SelectStmt{TargetList: nodes.List{Items: targets}}
+	if n.Relation != nil {
+		stmt.FromClause = nodes.List{Items: []nodes.Node{*n.Relation}}
+	}
+	return stmt
+}
+
+// copyWriter formats the rows of COPY TO STDOUT in the format of the COPY
+type copyWriter struct {
+	copyOptions
+	types    []string
+	format   valueFormat
+	encoding *clientEncoding
+}
+
+// encode converts the data in text or CSV format to the client encoding
+func (w *copyWriter) encode(data []byte) ([]byte, error) {
+	if w.binary {
+		return data, nil
+	}
+	s, err := w.encoding.encode(string(data))
+	return []byte(s), err
+}
+
+// binaryHeader returns the header of the data in binary format: the
+// signature, no flags and an empty header extension
+func (w *copyWriter) binaryHeader() []byte {
+	return append(append([]byte{}, copySignature...), 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// headerLine returns the header of the data in CSV format, the names of the
+// columns
+func (w *copyWriter) headerLine(cols []string) []byte {
+	var line []byte
+	for i, col := range cols {
+		if i > 0 {
+			line = append(line, w.delimiter)
+		}
+		line = w.appendCSV(line, []byte(col))
+	}
+	return append(line, '\n')
+}
+
+// appendRow appends a row to the data, in the format of the COPY
+func (w *copyWriter) appendRow(data []byte, row []driver.Value) ([]byte, error) {
+	if w.binary {
+		return w.appendBinaryRow(data, row)
+	}
+
+	var value []byte
+	for i, v := range row {
+		if i > 0 {
+			data = append(data, w.delimiter)
+		}
+		if v == nil {
+			data = append(data, w.null...)
+			continue
+		}
+
+		value = w.format.appendValue(value[:0], v)
+		if w.csv {
+			data = w.appendCSV(data, value)
+		} else {
+			data = w.appendText(data, value)
+		}
+	}
+	return append(data, '\n'), nil
+}
+
+// appendBinaryRow appends a row in binary format: the number of its values,
+// followed by the length of each value and its bytes, with a length of -1
+// for NULL
+func (w *copyWriter) appendBinaryRow(data []byte, row []driver.Value) ([]byte, error) {
+	var err error
+	data = appendUint16s(data, uint16(len(row)))
+	for i, v := range row {
+		if v == nil {
+			data = appendUint32(data, 0xffffffff)
+			continue
+		}
+
+		start := len(data)
+		data, err = appendBinaryValue(appendUint32(data, 0), v, w.types[i])
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(data[start:], uint32(len(data)-start-4))
+	}
+	return data, nil
+}
+
+// copyTextEscapes are the characters escaped in text format, with the
+// characters that stand for them after a backslash
+var copyTextEscapes = map[byte]byte{
+	'\\': '\\',
+	'\b': 'b',
+	'\f': 'f',
+	'\n': 'n',
+	'\r': 'r',
+	'\t': 't',
+	'\v': 'v',
+}
+
+// appendText appends a value in text format, with backslash escapes of the
+// control characters, backslashes and the delimiter
+func (w *copyWriter) appendText(data []byte, value []byte) []byte {
+	for _, c := range value {
+		if e, ok := copyTextEscapes[c]; ok {
+			data = append(data, '\\', e)
+		} else if c == w.delimiter {
+			data = append(data, '\\', c)
+		} else {
+			data = append(data, c)
+		}
+	}
+	return data
+}
+
+// appendCSV appends a value in CSV format, quoted when it contains the
+// delimiter, quotes or newlines, or when it would be read as NULL or as the
+// end of the data otherwise
+func (w *copyWriter) appendCSV(data []byte, value []byte) []byte {
+	needsQuotes := string(value) == w.null || bytes.HasPrefix(value, []byte(`\.`))
+	for _, c := range value {
+		if c == w.delimiter || c == w.quote || c == w.escape || c == '\n' || c == '\r' {
+			needsQuotes = true
+			break
+		}
+	}
+	if !needsQuotes {
+		return append(data, value...)
+	}
+
+	data = append(data, w.quote)
+	for _, c := range value {
+		if c == w.quote || c == w.escape {
+			data = append(data, w.escape)
+		}
+		data = append(data, c)
+	}
+	return append(data, w.quote)
+}
+
+// CopyResult is the Result of a COPY, the number of rows it copied, which is
+// reported to the client as "COPY N". It may be returned by the CopyHandler.
+type CopyResult int64
+
+// LastInsertId is unsupported by COPY
+func (r CopyResult) LastInsertId() (int64, error) {
+	return 0, Unsupported("LastInsertId")
+}
+
+// RowsAffected returns the number of rows copied
+func (r CopyResult) RowsAffected() (int64, error) {
+	return int64(r), nil
+}
+
+// Tag returns the command tag of the COPY
+func (r CopyResult) Tag() (string, error) {
+	return fmt.Sprintf("COPY %d", r), nil
+}
+
+// copyResult returns the Result reported for the COPY, given the Result of the
+// CopyHandler and the number of rows read from the client: the Result itself
+// when it implements ResultTag, or the number of rows it affected, or else the
+// number of rows read when it's nil or doesn't report the rows it affected
+func copyResult(res driver.Result, count int64) driver.Result {
+	if _, ok := res.(ResultTag); ok {
+		return res
+	}
+	if res != nil {
+		if n, err := res.RowsAffected(); err == nil {
+			return CopyResult(n)
+		}
+	}
+	return CopyResult(count)
+}
+
+// copyReader reads the data of COPY FROM STDIN, sent by the client in CopyData
+// messages, up to CopyDone (io.EOF) or CopyFail. It stops reading between the
+// messages once the context of the query is canceled, like by a CancelRequest
+// or the statement's timeout.
+type copyReader struct {
+	ctx       context.Context
+	transport *protocol.Transport
+	buf       []byte
+	err       error
+	canceled  bool // the data was cut short by the context, see discard
+}
+
+func (r *copyReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if err := r.ctx.Err(); err != nil {
+			r.canceled = true
+			return 0, canceled(r.ctx, err)
+		}
+		r.buf, r.err = r.transport.ReadCopyData()
+		if e, ok := r.err.(*protocol.CopyFailError); ok {
+			r.err = QueryCanceled(e.Error())
+		} else if r.err != nil && r.err != io.EOF {
+			r.err = ProtocolViolation("%s", r.err)
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// discard reads the rest of the data of a canceled COPY, up to CopyDone or
+// CopyFail, keeping the protocol in sync
+func (r *copyReader) discard() error {
+	for r.err == nil {
+		_, r.err = r.transport.ReadCopyData()
+	}
+	if _, ok := r.err.(*protocol.CopyFailError); ok || r.err == io.EOF {
+		return nil
+	}
+	return ProtocolViolation("%s", r.err)
+}
+
+// copyOptions are the options of a COPY, which determine the format of its
+// data: text by default, CSV or binary
+type copyOptions struct {
+	binary bool
+	csv    bool
+
+	// the options of the text and CSV formats
+	delimiter byte
+	null      string
+	header    bool // the first line is the names of the columns, in CSV only
+	quote     byte // the quote and escape characters of CSV
+	escape    byte
+}
+
+// parseCopyOptions parses the options of the COPY, validated like postgres
+// does. The defaults depend on the format, like the delimiter, which is a tab
+// in text format and a comma in CSV.
+func parseCopyOptions(n nodes.CopyStmt) (opts copyOptions, err error) {
+	var delimiter, null, quote, escape *string
+	for _, item := range n.Options.Items {
+		opt, ok := item.(nodes.DefElem)
+		if !ok || opt.Defname == nil {
+			continue
+		}
+
+		arg, _ := opt.Arg.(nodes.String)
+		switch *opt.Defname {
+		case "format":
+			switch strings.ToLower(arg.Str) {
+			case "text":
+			case "binary":
+				opts.binary = true
+			case "csv":
+				opts.csv = true
+			default:
+				return opts, SyntaxError("COPY format \"%s\" not recognized", arg.Str)
+			}
+		case "delimiter":
+			delimiter = &arg.Str
+		case "null":
+			null = &arg.Str
+		case "header":
+			opts.header, err = copyBoolOption(opt)
+			if err != nil {
+				return opts, err
+			}
+		case "quote":
+			quote = &arg.Str
+		case "escape":
+			escape = &arg.Str
+		default:
+			return opts, SyntaxError("option \"%s\" not recognized", *opt.Defname)
+		}
+	}
+
+	if opts.binary && delimiter != nil {
+		return opts, SyntaxError("cannot specify DELIMITER in BINARY mode")
+	}
+	if opts.binary && null != nil {
+		return opts, SyntaxError("cannot specify NULL in BINARY mode")
+	}
+	if opts.header && !opts.csv {
+		return opts, Unsupported("COPY HEADER outside of CSV mode")
+	}
+	if quote != nil && !opts.csv {
+		return opts, Unsupported("COPY quote outside of CSV mode")
+	}
+	if escape != nil && !opts.csv {
+		return opts, Unsupported("COPY escape outside of CSV mode")
+	}
+
+	opts.delimiter, opts.null = '\t', `\N`
+	if opts.csv {
+		opts.delimiter, opts.null, opts.quote = ',', "", '"'
+	}
+	if delimiter != nil {
+		if len(*delimiter) != 1 {
+			return opts, Unsupported("COPY delimiter \"%s\", it must be a single one-byte character", *delimiter)
+		}
+		opts.delimiter = (*delimiter)[0]
+	}
+	if null != nil {
+		opts.null = *null
+	}
+	if quote != nil {
+		if len(*quote) != 1 {
+			return opts, Unsupported("COPY quote \"%s\", it must be a single one-byte character", *quote)
+		}
+		opts.quote = (*quote)[0]
+	}
+
+	// the escape character is the quote character, unless specified
+	opts.escape = opts.quote
+	if escape != nil {
+		if len(*escape) != 1 {
+			return opts, Unsupported("COPY escape \"%s\", it must be a single one-byte character", *escape)
+		}
+		opts.escape = (*escape)[0]
+	}
+	if opts.csv && opts.delimiter == opts.quote {
+		return opts, InvalidParameterValue("COPY delimiter and quote must be different")
+	}
+	return opts, nil
+}
+
+// copyBoolOption returns the value of a boolean option, like HEADER, which is
+// true when it has no value, like in CSV HEADER
+func copyBoolOption(opt nodes.DefElem) (bool, error) {
+	switch arg := opt.Arg.(type) {
+	case nil:
+		return true, nil
+	case nodes.Integer:
+		switch arg.Ival {
+		case 0:
+			return false, nil
+		case 1:
+			return true, nil
+		}
+	case nodes.String:
+		switch strings.ToLower(arg.Str) {
+		case "true", "on", "1":
+			return true, nil
+		case "false", "off", "0":
+			return false, nil
+		}
+	}
+	return false, SyntaxError("%s requires a Boolean value", *opt.Defname)
+}
+
+// copyRows implements driver.Rows over the data of COPY FROM STDIN, decoding
+// the values of the columns, in either text, CSV or binary format
+type copyRows struct {
+	copyOptions
+	table        string
+	columns      []ColumnDesc
+	r            *bufio.Reader
+	binaryHeader bool  // whether the header of the binary format was read
+	headerLine   bool  // whether the header line of the CSV format was read
+	count        int64 // the number of rows read so far
+	err          error // the error that ended the rows, or io.EOF
+}
+
+// newCopyRows creates the rows of the COPY, according to its options
+func newCopyRows(n nodes.CopyStmt) (*copyRows, error) {
+	opts, err := parseCopyOptions(n)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := &copyRows{copyOptions: opts}
+	if n.Relation != nil && n.Relation.Relname != nil {
+		rows.table = *n.Relation.Relname
+	}
+	return rows, nil
+}
+
+func (r *copyRows) Columns() []string {
+	cols := make([]string, len(r.columns))
+	for i, c := range r.columns {
+		cols[i] = c.Name
+	}
+	return cols
+}
+
+func (r *copyRows) ColumnTypeDatabaseTypeName(i int) string {
+	return r.columns[i].TypeName
+}
+
+func (r *copyRows) Close() error { return nil }
+
+func (r *copyRows) Next(dest []driver.Value) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	var err error
+	switch {
+	case r.binary:
+		err = r.nextBinary(dest)
+	case r.csv:
+		err = r.nextCSV(dest)
+	default:
+		err = r.nextText(dest)
+	}
+	if err != nil {
+		r.err = err
+		return err
+	}
+	r.count++
+	return nil
+}
+
+// drain reads the rest of the data, once the backend is done with the rows
+func (r *copyRows) drain() error {
+	for {
+		_, err := r.r.Read(make([]byte, 4096))
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// where describes the position in the data of an error in the current row,
+// like the context of the errors of COPY in postgres
+func (r *copyRows) where(err error, column int, value []byte) error {
+	line := r.count + 1
+	if column < 0 {
+		return WithWhere(err, "COPY %s, line %d", r.table, line)
+	}
+	name := r.columns[column].Name
+	if value == nil {
+		return WithWhere(err, "COPY %s, line %d, column %s", r.table, line, name)
+	}
+	return WithWhere(err, "COPY %s, line %d, column %s: \"%s\"", r.table, line, name, value)
+}
+
+// nextText reads a row in text format: a line of the values of the columns,
+// separated by the delimiter, with backslash escapes. It ends with the end of
+// the data, or a line of "\.".
+func (r *copyRows) nextText(dest []driver.Value) error {
+	line, err := r.readLine()
+	if err != nil {
+		return err
+	}
+
+	line = trimLineEnd(line)
+	if string(line) == `\.` {
+		return io.EOF
+	}
+
+	fields := r.splitText(line)
+	err = r.checkFields(len(fields), dest)
+	if err != nil {
+		return err
+	}
+
+	for i, field := range fields {
+		if string(field) == r.null {
+			dest[i] = nil
+			continue
+		}
+
+		dest[i], err = r.decode(i, unescapeCopyText(field))
+		if err != nil {
+			return r.where(err, i, field)
+		}
+	}
+	return nil
+}
+
+// readLine reads the next line of the data, with its line ending. The last
+// line may not end with a newline.
+func (r *copyRows) readLine() ([]byte, error) {
+	line, err := r.r.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	return line, err
+}
+
+// trimLineEnd trims the newline, or the carriage return and newline, that
+// ends the line
+func trimLineEnd(line []byte) []byte {
+	return bytes.TrimSuffix(bytes.TrimSuffix(line, []byte{'\n'}), []byte{'\r'})
+}
+
+// checkFields fails a row with more or less values than the columns
+func (r *copyRows) checkFields(n int, dest []driver.Value) error {
+	if n > len(dest) {
+		return r.where(BadCopyFileFormat("extra data after last expected column"), -1, nil)
+	}
+	if n < len(dest) {
+		err := BadCopyFileFormat("missing data for column \"%s\"", r.columns[n].Name)
+		return r.where(err, -1, nil)
+	}
+	return nil
+}
+
+// splitText splits a line in text format into the values of the columns,
+// still escaped. An escaped delimiter is a part of the value.
+func (r *copyRows) splitText(line []byte) [][]byte {
+	var fields [][]byte
+	start := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case r.delimiter:
+			fields = append(fields, line[start:i])
+			start = i + 1
+		}
+	}
+	return append(fields, line[start:])
+}
+
+// copyEscapes are the backslash escapes of single characters in text format
+var copyEscapes = map[byte]byte{
+	'b': '\b',
+	'f': '\f',
+	'n': '\n',
+	'r': '\r',
+	't': '\t',
+	'v': '\v',
+}
+
+// unescapeCopyText decodes the backslash escapes of a value in text format:
+// the escapes of control characters, octal (\123) and hex (\x4f) escapes, and
+// any other escaped character, which stands for itself
+func unescapeCopyText(field []byte) []byte {
+	if bytes.IndexByte(field, '\\') < 0 {
+		return field
+	}
+
+	res := make([]byte, 0, len(field))
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c != '\\' || i+1 == len(field) {
+			res = append(res, c)
+			continue
+		}
+
+		i++
+		c = field[i]
+		switch {
+		case c >= '0' && c <= '7':
+			v := c - '0'
+			for j := 0; j < 2 && i+1 < len(field) && field[i+1] >= '0' && field[i+1] <= '7'; j++ {
+				i++
+				v = v*8 + field[i] - '0'
+			}
+			res = append(res, v)
+		case c == 'x' && i+1 < len(field) && isHexDigit(field[i+1]):
+			var v byte
+			for j := 0; j < 2 && i+1 < len(field) && isHexDigit(field[i+1]); j++ {
+				i++
+				v = v*16 + hexValue(field[i])
+			}
+			res = append(res, v)
+		case copyEscapes[c] != 0:
+			res = append(res, copyEscapes[c])
+		default:
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// csvField is a value of a row in CSV format
+type csvField struct {
+	value  []byte
+	quoted bool
+}
+
+// nextCSV reads a row in CSV format: the values of the columns, separated by
+// the delimiter, where quoted values may contain the delimiter, newlines and
+// escaped quotes. An unquoted value that matches the NULL string is NULL,
+// unlike a quoted one, so "" is an empty string by default. The first line is
+// skipped when it's the header.
+func (r *copyRows) nextCSV(dest []driver.Value) error {
+	if r.header && !r.headerLine {
+		r.headerLine = true
+		_, err := r.readCSV()
+		if err != nil {
+			return err
+		}
+	}
+
+	fields, err := r.readCSV()
+	if err != nil {
+		return err
+	}
+	err = r.checkFields(len(fields), dest)
+	if err != nil {
+		return err
+	}
+
+	for i, field := range fields {
+		if !field.quoted && string(field.value) == r.null {
+			dest[i] = nil
+			continue
+		}
+
+		dest[i], err = r.decode(i, field.value)
+		if err != nil {
+			return r.where(err, i, field.value)
+		}
+	}
+	return nil
+}
+
+// readCSV reads the values of a row in CSV format, which spans the lines of
+// its quoted values. It ends with the end of the data, or a line of "\.".
+func (r *copyRows) readCSV() ([]csvField, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if string(trimLineEnd(line)) == `\.` {
+		return nil, io.EOF
+	}
+
+	var fields []csvField
+	var field csvField
+	quoted := false // within quotes
+	for i := 0; ; i++ {
+		if !quoted && isLineEnd(line[i:]) {
+			break
+		}
+
+		// a quoted value continues on the next line
+		if i == len(line) {
+			next, err := r.readLine()
+			if err == io.EOF {
+				return nil, r.where(BadCopyFileFormat("unterminated CSV quoted field"), -1, nil)
+			} else if err != nil {
+				return nil, err
+			}
+			line = append(line, next...)
+		}
+
+		c := line[i]
+		switch {
+		case quoted && c == r.escape && i+1 < len(line) && (line[i+1] == r.quote || line[i+1] == r.escape):
+			i++ // the escaped character stands for itself
+			field.value = append(field.value, line[i])
+		case quoted && c == r.quote:
+			quoted = false
+		case quoted:
+			field.value = append(field.value, c)
+		case c == r.quote:
+			quoted, field.quoted = true, true
+		case c == r.delimiter:
+			fields = append(fields, field)
+			field = csvField{}
+		default:
+			field.value = append(field.value, c)
+		}
+	}
+	return append(fields, field), nil
+}
+
+// isLineEnd reports whether the rest of the line is its line ending
+func isLineEnd(rest []byte) bool {
+	return len(rest) == 0 || string(rest) == "\n" || string(rest) == "\r\n"
+}
+
+// nextBinary reads a row in binary format, which is the header of the data
+// before the first row: the signature, flags and header extension. Each row
+// is the number of its values, followed by the length of each value and its
+// bytes, with a length of -1 for NULL. It ends with a row of -1 values.
+// see: https://www.postgresql.org/docs/current/sql-copy.html#id-1.9.3.55.9.4
+func (r *copyRows) nextBinary(dest []driver.Value) error {
+	if !r.binaryHeader {
+		r.binaryHeader = true
+		err := r.readBinaryHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	var numValues int16
+	err := r.readBinary(&numValues)
+	if err != nil {
+		return r.unexpectedEOF(err, -1)
+	}
+	if numValues == -1 {
+		return io.EOF
+	}
+	if int(numValues) != len(dest) {
+		return r.where(BadCopyFileFormat("row field count is %d, expected %d", numValues, len(dest)), -1, nil)
+	}
+
+	for i := range dest {
+		var length int32
+		err = r.readBinary(&length)
+		if err != nil {
+			return r.unexpectedEOF(err, i)
+		}
+		if length == -1 {
+			dest[i] = nil
+			continue
+		}
+		if length < 0 {
+			return r.where(BadCopyFileFormat("invalid field size"), i, nil)
+		}
+
+		value := make([]byte, length)
+		_, err = io.ReadFull(r.r, value)
+		if err != nil {
+			return r.unexpectedEOF(err, i)
+		}
+
+		dest[i], err = r.decode(i, value)
+		if err != nil {
+			return r.where(err, i, nil)
+		}
+	}
+	return nil
+}
+
+// readBinaryHeader reads the header of the data in binary format
+func (r *copyRows) readBinaryHeader() error {
+	signature := make([]byte, len(copySignature))
+	_, err := io.ReadFull(r.r, signature)
+	if err != nil && !isEOF(err) {
+		return err
+	}
+	if err != nil || !bytes.Equal(signature, copySignature) {
+		return BadCopyFileFormat("COPY file signature not recognized")
+	}
+
+	var flags, extension int32
+	err = r.readBinary(&flags)
+	if err != nil && !isEOF(err) {
+		return err
+	} else if err != nil {
+		return BadCopyFileFormat("invalid COPY file header (missing flags)")
+	}
+	if flags&(1<<16) != 0 {
+		return BadCopyFileFormat("invalid COPY file header (WITH OIDS)")
+	}
+	if flags&^0xffff != 0 {
+		return BadCopyFileFormat("unrecognized critical flags in COPY file header")
+	}
+
+	err = r.readBinary(&extension)
+	if err == nil && extension < 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		_, err = io.CopyN(ioutil.Discard, r.r, int64(extension))
+	}
+	if err != nil && !isEOF(err) {
+		return err
+	} else if err != nil {
+		return BadCopyFileFormat("invalid COPY file header (missing length)")
+	}
+	return nil
+}
+
+// readBinary reads a big-endian integer of the binary format
+func (r *copyRows) readBinary(v interface{}) error {
+	return binary.Read(r.r, binary.BigEndian, v)
+}
+
+// unexpectedEOF reports the end of the data before the end marker, or in the
+// middle of a row, in binary format
+func (r *copyRows) unexpectedEOF(err error, column int) error {
+	if !isEOF(err) {
+		return err
+	}
+	return r.where(BadCopyFileFormat("unexpected EOF in COPY data"), column, nil)
+}
+
+// isEOF reports whether the error is the end of the data
+func isEOF(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// decode decodes a value of the numbered column according to its type
+func (r *copyRows) decode(i int, src []byte) (driver.Value, error) {
+	typeName := r.columns[i].TypeName
+	newValue, ok := parameterValues[pgtype.OID(protocol.TypesOid[strings.ToUpper(typeName)])]
+	if !ok && r.binary {
+		return src, nil
+	} else if !ok {
+		return string(src), nil
+	}
+
+	v := newValue()
+	if r.binary {
+		err := v.(pgtype.BinaryDecoder).DecodeBinary(nil, src)
+		if err != nil {
+			return nil, InvalidBinaryRepresentation("incorrect binary data format")
+		}
+	} else {
+		err := v.(pgtype.TextDecoder).DecodeText(nil, src)
+		if err != nil {
+			return nil, InvalidTextRepresentation("invalid input syntax for type %s: \"%s\"", strings.ToLower(typeName), src)
+		}
+	}
+	return parameterValue(v), nil
+}
@@ -0,0 +1,463 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// copyingQueryer copies the rows of COPY FROM STDIN into memory, returning
+// result once done. It fails after reading failAfter rows, if set.
+type copyingQueryer struct {
+	mockQueryer
+	columns   []ColumnDesc
+	rows      [][]driver.Value
+	result    driver.Result
+	failAfter int
+}
+
+func (q *copyingQueryer) CopyColumns(ctx context.Context, n nodes.Node) ([]ColumnDesc, error) {
+	return q.columns, nil
+}
+
+func (q *copyingQueryer) CopyFrom(ctx context.Context, n nodes.Node, rows driver.Rows) (driver.Result, error) {
+	q.rows = nil
+	for {
+		if q.failAfter > 0 && len(q.rows) == q.failAfter {
+			return nil, UniqueViolation("duplicate key value violates unique constraint")
+		}
+
+		row := make([]driver.Value, len(rows.Columns()))
+		err := rows.Next(row)
+		if err == io.EOF {
+			return q.result, nil
+		} else if err != nil {
+			return nil, err
+		}
+		q.rows = append(q.rows, row)
+	}
+}
+
+// copyBinaryData is the data of the rows (1, 'foo', 1.5, true) and
+// (2, NULL, -0.25, false) of a table (id int4, name text, score float8,
+// active bool) in binary format, as written by postgres in
+// COPY t TO STDOUT WITH (FORMAT binary)
+const copyBinaryData = "5047434f50590aff0d0a00" + "00000000" + "00000000" +
+	"0004" + "0000000400000001" + "00000003666f6f" + "000000083ff8000000000000" + "0000000101" +
+	"0004" + "0000000400000002" + "ffffffff" + "00000008bfd0000000000000" + "0000000100" +
+	"ffff"
+
+func TestQuery_copyFrom(t *testing.T) {
+	queryer := &copyingQueryer{columns: []ColumnDesc{
+		{Name: "id", TypeName: "INT4"},
+		{Name: "name", TypeName: "TEXT"},
+		{Name: "score", TypeName: "FLOAT8"},
+		{Name: "active", TypeName: "BOOL"},
+	}}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	frontend, _ := connect(t, srv)
+
+	binaryData, err := hex.DecodeString(copyBinaryData)
+	require.NoError(t, err)
+
+	// copyIn sends the query and the data in chunks of the provided size, and
+	// returns the response to the data
+	copyIn := func(t *testing.T, sql string, format byte, data []byte, chunk int) pgproto3.BackendMessage {
+		sendQuery(t, frontend, sql)
+		msg := receive(t, frontend, &pgproto3.CopyInResponse{})
+		require.Equal(t, format, msg.(*pgproto3.CopyInResponse).OverallFormat)
+		require.Len(t, msg.(*pgproto3.CopyInResponse).ColumnFormatCodes, 4)
+
+		for len(data) > 0 {
+			n := chunk
+			if n > len(data) {
+				n = len(data)
+			}
+			require.NoError(t, frontend.Send(&pgproto3.CopyData{Data: data[:n]}))
+			data = data[n:]
+		}
+		require.NoError(t, frontend.Send(&protocol.CopyDone{}))
+
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+		return msg
+	}
+
+	expected := [][]driver.Value{{int64(1), "foo", 1.5, true}, {int64(2), nil, -0.25, false}}
+
+	t.Run("binary", func(t *testing.T) {
+		for _, sql := range []string{"COPY t FROM STDIN WITH (FORMAT binary)", "COPY t FROM STDIN BINARY"} {
+			for _, chunk := range []int{len(binaryData), 7, 1} {
+				msg := copyIn(t, sql, protocol.CopyBinaryFormat, binaryData, chunk)
+				require.Equal(t, &pgproto3.CommandComplete{CommandTag: "COPY 2"}, msg)
+				require.Equal(t, expected, queryer.rows)
+			}
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		data := []byte("1\tfoo\t1.5\tt\n2\t\\N\t-0.25\tf\n")
+		for _, chunk := range []int{len(data), 5} {
+			msg := copyIn(t, "COPY t FROM STDIN", protocol.CopyTextFormat, data, chunk)
+			require.Equal(t, &pgproto3.CommandComplete{CommandTag: "COPY 2"}, msg)
+			require.Equal(t, expected, queryer.rows)
+		}
+	})
+
+	t.Run("text options", func(t *testing.T) {
+		data := []byte("1,a\\,b\\tc\\x41\\101,2.5,t\r\n2,NULL,0,f\n\\.\n")
+		msg := copyIn(t, "COPY t FROM STDIN WITH (DELIMITER ',', NULL 'NULL')", protocol.CopyTextFormat, data, 3)
+		require.Equal(t, &pgproto3.CommandComplete{CommandTag: "COPY 2"}, msg)
+		require.Equal(t, [][]driver.Value{{int64(1), "a,b\tcAA", 2.5, true}, {int64(2), nil, 0.0, false}}, queryer.rows)
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		data := []byte("id,name,score,active\n1,\"a,b \"\"c\"\"\nd\",1.5,t\r\n2,,-0.25,f\n3,\"\",0,t\n")
+		for _, sql := range []string{"COPY t FROM STDIN WITH (FORMAT csv, HEADER true)", "COPY t FROM STDIN CSV HEADER"} {
+			for _, chunk := range []int{len(data), 5} {
+				msg := copyIn(t, sql, protocol.CopyTextFormat, data, chunk)
+				require.Equal(t, &pgproto3.CommandComplete{CommandTag: "COPY 3"}, msg)
+				require.Equal(t, [][]driver.Value{
+					{int64(1), "a,b \"c\"\nd", 1.5, true},
+					{int64(2), nil, -0.25, false},
+					{int64(3), "", 0.0, true},
+				}, queryer.rows)
+			}
+		}
+	})
+
+	t.Run("csv options", func(t *testing.T) {
+		data := []byte(`1;'a;\'b\\';2.5;t` + "\n" + `2;NULL;0;f` + "\n" + `\.` + "\n")
+		sql := `COPY t FROM STDIN WITH (FORMAT csv, DELIMITER ';', QUOTE '''', ESCAPE '\', NULL 'NULL')`
+		msg := copyIn(t, sql, protocol.CopyTextFormat, data, 3)
+		require.Equal(t, &pgproto3.CommandComplete{CommandTag: "COPY 2"}, msg)
+		require.Equal(t, [][]driver.Value{{int64(1), `a;'b\`, 2.5, true}, {int64(2), nil, 0.0, false}}, queryer.rows)
+	})
+
+	t.Run("malformed data", func(t *testing.T) {
+		invalidHeader := append([]byte("PGCOPY\n\377\r\n\000"), 0, 1, 0, 0, 0, 0, 0, 0) // WITH OIDS
+		tests := []struct {
+			sql   string
+			data  string
+			code  string
+			where string
+		}{
+			{"COPY t FROM STDIN", "1\tfoo\t1.5\n", "22P04", "COPY t, line 1"},
+			{"COPY t FROM STDIN", "1\tfoo\t1.5\tt\n2\tbar\t1\tt\tx\n", "22P04", "COPY t, line 2"},
+			{"COPY t FROM STDIN", "one\tfoo\t1.5\tt\n", "22P02", "COPY t, line 1, column id: \"one\""},
+			{"COPY t FROM STDIN CSV", "1,\"foo,1.5,t\n", "22P04", "COPY t, line 1"},
+			{"COPY t FROM STDIN CSV", "1,foo,1.5\n", "22P04", "COPY t, line 1"},
+			{"COPY t FROM STDIN BINARY", "1\tfoo\t1.5\tt\n", "22P04", ""},
+			{"COPY t FROM STDIN BINARY", string(invalidHeader), "22P04", ""},
+			{"COPY t FROM STDIN BINARY", string(binaryData[:30]), "22P04", "COPY t, line 1, column name"},
+			{"COPY t FROM STDIN BINARY", string(binaryData[:len(binaryData)-2]), "22P04", "COPY t, line 3"},
+			{"COPY t FROM STDIN BINARY", strings.Replace(string(binaryData), "\x00\x00\x00\x01\x01", "\x00\x00\x00\x02\x01\x01", 1), "22P03", "COPY t, line 1, column active"},
+		}
+		for _, test := range tests {
+			format := byte(protocol.CopyTextFormat)
+			if strings.HasSuffix(test.sql, "BINARY") {
+				format = protocol.CopyBinaryFormat
+			}
+			msg := copyIn(t, test.sql, format, []byte(test.data), 4)
+			require.IsType(t, &pgproto3.ErrorResponse{}, msg, test.data)
+			require.Equal(t, test.code, msg.(*pgproto3.ErrorResponse).Code, msg.(*pgproto3.ErrorResponse).Message)
+			require.Equal(t, test.where, msg.(*pgproto3.ErrorResponse).Where)
+		}
+	})
+
+	t.Run("client failure", func(t *testing.T) {
+		sendQuery(t, frontend, "COPY t FROM STDIN")
+		receive(t, frontend, &pgproto3.CopyInResponse{})
+		require.NoError(t, frontend.Send(&pgproto3.CopyData{Data: []byte("1\tfoo\t1.5\tt\n")}))
+		require.NoError(t, frontend.Send(&protocol.CopyFail{Message: "canceled by user"}))
+
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "57014", msg.(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, "COPY from stdin failed: canceled by user", msg.(*pgproto3.ErrorResponse).Message)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("backend failure", func(t *testing.T) {
+		queryer.failAfter = 1
+		defer func() { queryer.failAfter = 0 }()
+
+		// the rest of the data is consumed after the failure
+		msg := copyIn(t, "COPY t FROM STDIN BINARY", protocol.CopyBinaryFormat, binaryData, 1)
+		require.Equal(t, "23505", msg.(*pgproto3.ErrorResponse).Code)
+		require.Len(t, queryer.rows, 1)
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		for sql, code := range map[string]string{
+			"COPY t FROM STDIN WITH (HEADER true)":              "0A000",
+			"COPY t FROM STDIN WITH (QUOTE '\"')":               "0A000",
+			"COPY t FROM STDIN WITH (FORMAT csv, QUOTE ',')":    "22023",
+			"COPY t FROM STDIN WITH (FORMAT csv, HEADER maybe)": "42601",
+			"COPY t FROM STDIN WITH (FORMAT json)":              "42601",
+			"COPY t FROM STDIN WITH (FORMAT binary, NULL 'x')":  "42601",
+			"COPY t FROM STDIN WITH (DELIMITER '||')":           "0A000",
+			"COPY t FROM STDIN WITH (FREEZE true, HEADER true)": "42601",
+		} {
+			sendQuery(t, frontend, sql)
+			msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+			require.Equal(t, code, msg.(*pgproto3.ErrorResponse).Code, sql)
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+		}
+	})
+
+	t.Run("command tag", func(t *testing.T) {
+		defer func() { queryer.result = nil }()
+
+		// many rows, sent in CopyData messages of a few rows each
+		var data []byte
+		for i := 0; i < 1000; i++ {
+			data = append(data, "1\tfoo\t1.5\tt\n"...)
+		}
+
+		tests := []struct {
+			name   string
+			result driver.Result
+			tag    string
+		}{
+			{"rows read", nil, "COPY 1000"},
+			{"rows affected", driver.RowsAffected(998), "COPY 998"},
+			{"unknown rows affected", driver.ResultNoRows, "COPY 1000"},
+			{"result tag", CopyResult(7), "COPY 7"},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				queryer.result = test.result
+				msg := copyIn(t, "COPY t FROM STDIN", protocol.CopyTextFormat, data, 100)
+				require.Equal(t, &pgproto3.CommandComplete{CommandTag: test.tag}, msg)
+				require.Len(t, queryer.rows, 1000)
+			})
+		}
+	})
+
+	t.Run("the session is still alive", func(t *testing.T) {
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+func TestQuery_copyFromCanceled(t *testing.T) {
+	columns := []ColumnDesc{{Name: "id", TypeName: "INT4"}}
+
+	// copyIn starts copying a row in each CopyData, and expects the COPY to
+	// be canceled with the error message before the data is done. cancel is
+	// called after the first row.
+	copyIn := func(t *testing.T, srv *server, cancel func(Session), message string) {
+		queryer := srv.queryer.(*copyingQueryer)
+		frontend, pid := connect(t, srv)
+		s, ok := allSessions.Load(pid)
+		require.True(t, ok)
+
+		sendQuery(t, frontend, "COPY t FROM STDIN")
+		receive(t, frontend, &pgproto3.CopyInResponse{})
+		require.NoError(t, frontend.Send(&pgproto3.CopyData{Data: []byte("1\n")}))
+		cancel(s.(Session))
+
+		// the cancellation is noticed either before the next row is read, or
+		// right after it, so it's sent while the error is received
+		sent := make(chan error, 1)
+		go func() { sent <- frontend.Send(&pgproto3.CopyData{Data: []byte("2\n")}) }()
+
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "57014", msg.(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, message, msg.(*pgproto3.ErrorResponse).Message)
+		require.NoError(t, <-sent)
+		copied := len(queryer.rows)
+		require.Contains(t, []int{1, 2}, copied)
+
+		// the rest of the data is discarded
+		require.NoError(t, frontend.Send(&pgproto3.CopyData{Data: []byte("3\n")}))
+		require.NoError(t, frontend.Send(&protocol.CopyDone{}))
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+		require.Len(t, queryer.rows, copied)
+
+		// the session is still alive
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+
+	t.Run("cancel request", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &copyingQueryer{columns: columns}}
+		copyIn(t, srv, Session.CancelQuery, "canceling statement due to user request")
+	})
+
+	t.Run("statement timeout", func(t *testing.T) {
+		srv := &server{
+			authenticator: &noPasswordAuthenticator{},
+			queryer:       &copyingQueryer{columns: columns},
+			queryTimeout:  50 * time.Millisecond,
+		}
+		sleep := func(Session) { time.Sleep(100 * time.Millisecond) }
+		copyIn(t, srv, sleep, "canceling statement due to statement timeout")
+	})
+
+	t.Run("client failure after cancel", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &copyingQueryer{columns: columns}}
+		frontend, pid := connect(t, srv)
+		s, _ := allSessions.Load(pid)
+
+		sendQuery(t, frontend, "COPY t FROM STDIN")
+		receive(t, frontend, &pgproto3.CopyInResponse{})
+		s.(Session).CancelQuery()
+		sent := make(chan error, 1)
+		go func() { sent <- frontend.Send(&pgproto3.CopyData{Data: []byte("1\n")}) }()
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "57014", msg.(*pgproto3.ErrorResponse).Code)
+		require.NoError(t, <-sent)
+
+		// the client ends the COPY by failing it
+		require.NoError(t, frontend.Send(&protocol.CopyFail{Message: "canceled"}))
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+// copyToQueryer returns the same rows for any query, recording the queries
+type copyToQueryer struct {
+	columns []ColumnDesc
+	rows    [][]interface{}
+	queries []nodes.Node
+}
+
+func (q *copyToQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	q.queries = append(q.queries, n)
+	return RowsFromValues(q.columns, q.rows), nil
+}
+
+func TestQuery_copyTo(t *testing.T) {
+	queryer := &copyToQueryer{
+		columns: []ColumnDesc{
+			{Name: "id", TypeName: "INT4"},
+			{Name: "name", TypeName: "TEXT"},
+			{Name: "score", TypeName: "FLOAT8"},
+			{Name: "active", TypeName: "BOOL"},
+		},
+		rows: [][]interface{}{
+			{int32(1), "foo", 1.5, true},
+			{int32(2), nil, -0.25, false},
+		},
+	}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	frontend, _ := connect(t, srv)
+
+	// copyOut sends the query, and returns the data sent in response
+	copyOut := func(t *testing.T, sql string, format byte) string {
+		sendQuery(t, frontend, sql)
+		msg := receive(t, frontend, &pgproto3.CopyOutResponse{})
+		require.Equal(t, format, msg.(*pgproto3.CopyOutResponse).OverallFormat)
+		require.Len(t, msg.(*pgproto3.CopyOutResponse).ColumnFormatCodes, 4)
+
+		var data []byte
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.CopyDone); ok {
+				break
+			}
+			require.IsType(t, &pgproto3.CopyData{}, msg)
+			data = append(data, msg.(*pgproto3.CopyData).Data...)
+		}
+
+		msg = receive(t, frontend, &pgproto3.CommandComplete{})
+		require.Equal(t, "COPY 2", msg.(*pgproto3.CommandComplete).CommandTag)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+		return string(data)
+	}
+
+	t.Run("text", func(t *testing.T) {
+		data := copyOut(t, "COPY t TO STDOUT", protocol.CopyTextFormat)
+		require.Equal(t, "1\tfoo\t1.5\tt\n2\t\\N\t-0.25\tf\n", data)
+	})
+
+	t.Run("text options", func(t *testing.T) {
+		queryer.rows[0][1] = "a,b\tc\\"
+		defer func() { queryer.rows[0][1] = "foo" }()
+
+		data := copyOut(t, "COPY t TO STDOUT WITH (DELIMITER ',', NULL 'NULL')", protocol.CopyTextFormat)
+		require.Equal(t, "1,a\\,b\\tc\\\\,1.5,t\n2,NULL,-0.25,f\n", data)
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		queryer.rows[0][1] = "a,\"b\"\nc"
+		defer func() { queryer.rows[0][1] = "foo" }()
+
+		data := copyOut(t, "COPY t TO STDOUT WITH (FORMAT csv, HEADER true)", protocol.CopyTextFormat)
+		require.Equal(t, "id,name,score,active\n1,\"a,\"\"b\"\"\nc\",1.5,t\n2,,-0.25,f\n", data)
+
+		queryer.rows[0][1] = ""
+		data = copyOut(t, "COPY t TO STDOUT WITH (FORMAT csv, DELIMITER ';', QUOTE '''', NULL 'NULL')", protocol.CopyTextFormat)
+		require.Equal(t, "1;'';1.5;t\n2;NULL;-0.25;f\n", data)
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		data := copyOut(t, "COPY t TO STDOUT WITH (FORMAT binary)", protocol.CopyBinaryFormat)
+		require.Equal(t, copyBinaryData, hex.EncodeToString([]byte(data)))
+	})
+
+	t.Run("query", func(t *testing.T) {
+		queryer.queries = nil
+		copyOut(t, "COPY t TO STDOUT", protocol.CopyTextFormat)
+		copyOut(t, "COPY t (id, name) TO STDOUT", protocol.CopyTextFormat)
+		copyOut(t, "COPY (SELECT * FROM t WHERE id > 0) TO STDOUT", protocol.CopyTextFormat)
+		require.Len(t, queryer.queries, 3)
+
+		// the table, or its columns, are selected
+		stmt := queryer.queries[0].(nodes.SelectStmt)
+		require.Equal(t, "t", *stmt.FromClause.Items[0].(nodes.RangeVar).Relname)
+		require.Len(t, stmt.TargetList.Items, 1)
+		ref := stmt.TargetList.Items[0].(nodes.ResTarget).Val.(nodes.ColumnRef)
+		require.IsType(t, nodes.A_Star{}, ref.Fields.Items[0])
+
+		stmt = queryer.queries[1].(nodes.SelectStmt)
+		require.Len(t, stmt.TargetList.Items, 2)
+		for i, name := range []string{"id", "name"} {
+			ref = stmt.TargetList.Items[i].(nodes.ResTarget).Val.(nodes.ColumnRef)
+			require.Equal(t, nodes.String{Str: name}, ref.Fields.Items[0])
+		}
+
+		// the query of the COPY is queried as is
+		stmt = queryer.queries[2].(nodes.SelectStmt)
+		require.NotNil(t, stmt.WhereClause)
+	})
+
+	t.Run("backend failure", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &failingQueryer{UndefinedTable("relation \"t\" does not exist")}}
+		frontend, _ := connect(t, srv)
+		sendQuery(t, frontend, "COPY t TO STDOUT")
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "42P01", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+func TestCopyResult(t *testing.T) {
+	var res driver.Result = CopyResult(12345)
+	n, err := res.RowsAffected()
+	require.NoError(t, err)
+	require.Equal(t, int64(12345), n)
+
+	tag, err := res.(ResultTag).Tag()
+	require.NoError(t, err)
+	require.Equal(t, "COPY 12345", tag)
+
+	_, err = res.LastInsertId()
+	require.Error(t, err)
+}
@@ -0,0 +1,201 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"io"
+	"time"
+)
+
+// cursorOptHold is the option of a cursor declared WITH HOLD, as set in
+// nodes.DeclareCursorStmt (CURSOR_OPT_HOLD in postgres)
+const cursorOptHold = 0x0010
+
+// cursor is a query result declared with DECLARE CURSOR, which the client
+// fetches from in batches with FETCH, across the statements of the session.
+// The rows are read from the backend lazily, as they're fetched, so they're
+// held open until the cursor is closed.
+type cursor struct {
+	rows   driver.Rows
+	cancel context.CancelFunc // the context of the rows
+	hold   bool               // outlives the transaction block, WITH HOLD
+	tx     *transactionMode   // the transaction block it was declared in
+	done   bool               // the rows reached their end
+}
+
+// close closes the rows of the cursor, and cancels their context
+func (c *cursor) close() {
+	c.rows.Close()
+	c.cancel()
+}
+
+// cursorContext is the context of the rows of a cursor, which keeps the values
+// of the DECLARE statement's context, like the session, but not its deadline
+// or cancellation, since the rows outlive the statement
+type cursorContext struct {
+	context.Context
+}
+
+func (cursorContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (cursorContext) Done() <-chan struct{}       { return nil }
+func (cursorContext) Err() error                  { return nil }
+
+// cursorStatement handles DECLARE CURSOR, FETCH, MOVE and CLOSE of the cursors
+// of the session. The cursors can only be declared in a transaction block,
+// and they're closed once it ends, unless they're declared WITH HOLD.
+func (q *query) cursorStatement(ctx context.Context, sess Session, n nodes.Node) error {
+	s, ok := sess.(*session)
+	// only session implementation keeps the cursors between statements
+	if !ok {
+		return q.Exec(ctx, n)
+	}
+
+	switch v := n.(type) {
+	case nodes.DeclareCursorStmt:
+		return q.declareCursor(ctx, s, v)
+	case nodes.FetchStmt:
+		return q.fetch(ctx, s, v)
+	case nodes.ClosePortalStmt:
+		if v.Portalname == nil {
+			s.closeCursors(func(*cursor) bool { return true })
+			return q.transport.Write(protocol.CommandComplete("CLOSE CURSOR ALL"))
+		}
+		c, ok := s.cursors[*v.Portalname]
+		if !ok {
+			return InvalidCursorName(*v.Portalname)
+		}
+		c.close()
+		delete(s.cursors, *v.Portalname)
+		return q.transport.Write(protocol.CommandComplete("CLOSE CURSOR"))
+	}
+	return q.Exec(ctx, n)
+}
+
+// declareCursor runs the query of the cursor, holding its rows open to be
+// fetched by the following statements
+func (q *query) declareCursor(ctx context.Context, s *session, stmt nodes.DeclareCursorStmt) (err error) {
+	name := ""
+	if stmt.Portalname != nil {
+		name = *stmt.Portalname
+	}
+	hold := stmt.Options&cursorOptHold != 0
+	if !hold && s.tx == nil {
+		return NoActiveSQLTransaction("DECLARE CURSOR can only be used in transaction blocks")
+	}
+	if _, ok := s.cursors[name]; ok {
+		return DuplicateCursor(name)
+	}
+
+	defer q.recoverPanic(&err)
+
+	ctx, cancel := context.WithCancel(cursorContext{ctx})
+	rows, err := q.queryer.Query(ctx, stmt.Query)
+	if err != nil {
+		cancel()
+		return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
+	}
+
+	if s.cursors == nil {
+		s.cursors = map[string]*cursor{}
+	}
+	s.cursors[name] = &cursor{rows: rows, cancel: cancel, hold: hold, tx: s.tx}
+	return q.transport.Write(protocol.CommandComplete("DECLARE CURSOR"))
+}
+
+// fetch sends the next rows of the cursor, or skips them in MOVE. Cursors
+// only scan forward.
+func (q *query) fetch(ctx context.Context, s *session, stmt nodes.FetchStmt) error {
+	name := ""
+	if stmt.Portalname != nil {
+		name = *stmt.Portalname
+	}
+	c, ok := s.cursors[name]
+	if !ok {
+		return InvalidCursorName(name)
+	}
+	if stmt.Direction != nodes.FETCH_FORWARD || stmt.HowMany < 0 {
+		return Unsupported("cursor can only scan forward")
+	}
+
+	rows := &cursorRows{cursor: c, remaining: stmt.HowMany}
+	if !stmt.Ismove {
+		return q.writeRows(ctx, rows)
+	}
+
+	count := 0
+	row := make([]driver.Value, len(rows.Columns()))
+	for {
+		err := ctx.Err()
+		if err == nil {
+			err = rows.Next(row)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
+		}
+		count++
+	}
+	return q.transport.Write(protocol.CommandComplete(fmt.Sprintf("MOVE %d", count)))
+}
+
+// cursorRows are the rows of a single FETCH out of the cursor, up to the
+// requested number of rows, leaving the rest of the rows for the following
+// fetches
+type cursorRows struct {
+	*cursor
+	remaining int64
+}
+
+func (r *cursorRows) Columns() []string { return r.rows.Columns() }
+
+// Close leaves the rows of the cursor open, see CLOSE
+func (r *cursorRows) Close() error { return nil }
+
+func (r *cursorRows) Next(dest []driver.Value) error {
+	if r.done || r.remaining <= 0 {
+		return io.EOF
+	}
+
+	err := r.rows.Next(dest)
+	if err == io.EOF {
+		r.done = true
+	}
+	if err != nil {
+		return err
+	}
+	r.remaining--
+	return nil
+}
+
+// ColumnTypeDatabaseTypeName implements driver.RowsColumnTypeDatabaseTypeName
+// when the rows of the cursor implement it
+func (r *cursorRows) ColumnTypeDatabaseTypeName(index int) string {
+	if types, ok := r.rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return types.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+// closeCursors closes the cursors of the session that match the filter
+func (s *session) closeCursors(filter func(*cursor) bool) {
+	for name, c := range s.cursors {
+		if filter(c) {
+			c.close()
+			delete(s.cursors, name)
+		}
+	}
+}
+
+// endTransactionCursors closes the cursors once the transaction block ends.
+// The cursors declared WITH HOLD outlive a committed transaction, but not one
+// that was rolled back.
+func (s *session) endTransactionCursors(commit bool) {
+	tx := s.tx
+	s.closeCursors(func(c *cursor) bool {
+		return !c.hold || (!commit && c.tx == tx)
+	})
+}
@@ -0,0 +1,147 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strconv"
+	"testing"
+)
+
+// seriesQueryer returns the rows 1 to 5, keeping track of the rows that are
+// still open
+type seriesQueryer struct {
+	open int
+}
+
+func (q *seriesQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	q.open++
+	return &seriesRows{q: q}, nil
+}
+
+type seriesRows struct {
+	q *seriesQueryer
+	n int
+}
+
+func (r *seriesRows) Columns() []string { return []string{"n"} }
+func (r *seriesRows) Close() error      { r.q.open--; return nil }
+func (r *seriesRows) Next(dest []driver.Value) error {
+	if r.n == 5 {
+		return io.EOF
+	}
+	r.n++
+	dest[0] = int64(r.n)
+	return nil
+}
+
+func TestQuery_cursors(t *testing.T) {
+	queryer := &seriesQueryer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	frontend, _ := connect(t, srv)
+
+	// run runs the sql, returning the rows and the command tag, or the code of
+	// the error
+	run := func(t *testing.T, sql string) (rows []string, result string) {
+		sendQuery(t, frontend, sql)
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			switch v := msg.(type) {
+			case *pgproto3.DataRow:
+				rows = append(rows, string(v.Values[0]))
+			case *pgproto3.CommandComplete:
+				result = v.CommandTag
+			case *pgproto3.ErrorResponse:
+				result = v.Code
+			case *pgproto3.ReadyForQuery:
+				return rows, result
+			}
+		}
+	}
+
+	expectTag := func(t *testing.T, sql, tag string) {
+		_, result := run(t, sql)
+		require.Equal(t, tag, result, sql)
+	}
+
+	t.Run("fetches forward in batches", func(t *testing.T) {
+		expectTag(t, "BEGIN", "BEGIN")
+		expectTag(t, "DECLARE c CURSOR FOR SELECT n FROM series", "DECLARE CURSOR")
+
+		for _, expected := range [][]string{{"1", "2"}, {"3", "4"}, {"5"}, nil} {
+			rows, tag := run(t, "FETCH 2 FROM c")
+			require.Equal(t, expected, rows)
+			require.Equal(t, "FETCH "+strconv.Itoa(len(expected)), tag)
+		}
+
+		expectTag(t, "COMMIT", "COMMIT")
+		require.Zero(t, queryer.open)
+		expectTag(t, "FETCH c", "34000")
+	})
+
+	t.Run("move", func(t *testing.T) {
+		expectTag(t, "BEGIN", "BEGIN")
+		expectTag(t, "DECLARE c CURSOR FOR SELECT n FROM series", "DECLARE CURSOR")
+
+		rows, tag := run(t, "FETCH c")
+		require.Equal(t, []string{"1"}, rows)
+		require.Equal(t, "FETCH 1", tag)
+		expectTag(t, "MOVE 2 IN c", "MOVE 2")
+		rows, tag = run(t, "FETCH ALL FROM c")
+		require.Equal(t, []string{"4", "5"}, rows)
+		require.Equal(t, "FETCH 2", tag)
+		expectTag(t, "MOVE FORWARD 2 IN c", "MOVE 0")
+
+		expectTag(t, "CLOSE c", "CLOSE CURSOR")
+		require.Zero(t, queryer.open)
+		expectTag(t, "ROLLBACK", "ROLLBACK")
+	})
+
+	t.Run("requires a transaction block", func(t *testing.T) {
+		expectTag(t, "DECLARE c CURSOR FOR SELECT n FROM series", "25P01")
+		require.Zero(t, queryer.open)
+	})
+
+	t.Run("with hold", func(t *testing.T) {
+		expectTag(t, "DECLARE held CURSOR WITH HOLD FOR SELECT n FROM series", "DECLARE CURSOR")
+		expectTag(t, "DECLARE held CURSOR WITH HOLD FOR SELECT n FROM series", "42P03")
+
+		// outlives a committed transaction block, but not one rolled back
+		expectTag(t, "BEGIN", "BEGIN")
+		expectTag(t, "DECLARE c CURSOR FOR SELECT n FROM series", "DECLARE CURSOR")
+		expectTag(t, "DECLARE rolledback CURSOR WITH HOLD FOR SELECT n FROM series", "DECLARE CURSOR")
+		expectTag(t, "COMMIT", "COMMIT")
+		rows, _ := run(t, "FETCH 2 FROM held")
+		require.Equal(t, []string{"1", "2"}, rows)
+		expectTag(t, "FETCH rolledback", "FETCH 1")
+
+		expectTag(t, "BEGIN", "BEGIN")
+		expectTag(t, "DECLARE rolledback2 CURSOR WITH HOLD FOR SELECT n FROM series", "DECLARE CURSOR")
+		expectTag(t, "ROLLBACK", "ROLLBACK")
+		expectTag(t, "FETCH rolledback2", "34000")
+		rows, _ = run(t, "FETCH held")
+		require.Equal(t, []string{"3"}, rows)
+		require.Equal(t, 2, queryer.open)
+
+		expectTag(t, "CLOSE ALL", "CLOSE CURSOR ALL")
+		require.Zero(t, queryer.open)
+	})
+
+	t.Run("scans forward only", func(t *testing.T) {
+		expectTag(t, "DECLARE held CURSOR WITH HOLD FOR SELECT n FROM series", "DECLARE CURSOR")
+		expectTag(t, "FETCH BACKWARD 1 FROM held", "0A000")
+		expectTag(t, "FETCH PRIOR FROM held", "0A000")
+		expectTag(t, "CLOSE held", "CLOSE CURSOR")
+		expectTag(t, "CLOSE held", "34000")
+	})
+
+	t.Run("discard all", func(t *testing.T) {
+		expectTag(t, "DECLARE held CURSOR WITH HOLD FOR SELECT n FROM series", "DECLARE CURSOR")
+		expectTag(t, "DISCARD ALL", "DISCARD ALL")
+		require.Zero(t, queryer.open)
+	})
+}
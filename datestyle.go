@@ -0,0 +1,203 @@
+package pgsrv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultDateStyle is the value of DateStyle unless set by the client
+const defaultDateStyle = "ISO, YMD"
+
+// dateStyle is the parsed value of the DateStyle variable: the output format of
+// date and time values, along with the order of their day, month and year
+// fields. Its zero value is the default, "ISO, YMD".
+type dateStyle struct {
+	format dateFormat
+	order  dateOrder
+}
+
+// dateFormat is the output format of DateStyle
+type dateFormat int
+
+const (
+	dateFormatISO dateFormat = iota
+	dateFormatSQL
+	dateFormatPostgres
+	dateFormatGerman
+)
+
+var dateFormatNames = []string{"ISO", "SQL", "Postgres", "German"}
+
+// dateOrder is the order of the fields of DateStyle
+type dateOrder int
+
+const (
+	dateOrderYMD dateOrder = iota
+	dateOrderDMY
+	dateOrderMDY
+)
+
+var dateOrderNames = []string{"YMD", "DMY", "MDY"}
+
+// String returns the value of DateStyle as reported by postgres, like
+// "ISO, MDY"
+func (ds dateStyle) String() string {
+	return dateFormatNames[ds.format] + ", " + dateOrderNames[ds.order]
+}
+
+// parseDateStyle parses the value of DateStyle: a format, an order or both,
+// separated by a comma, like "ISO, MDY" or "German". The missing parts remain
+// as in the current style, except for German, which implies the DMY order.
+func parseDateStyle(value string, current dateStyle) (dateStyle, error) {
+	ds := current
+	haveFormat, haveOrder := false, false
+	setFormat := func(f dateFormat) error {
+		if haveFormat && ds.format != f {
+			return fmt.Errorf("conflicting \"datestyle\" specifications")
+		}
+		ds.format, haveFormat = f, true
+		return nil
+	}
+	setOrder := func(o dateOrder) error {
+		if haveOrder && ds.order != o {
+			return fmt.Errorf("conflicting \"datestyle\" specifications")
+		}
+		ds.order, haveOrder = o, true
+		return nil
+	}
+
+	german := false
+	for _, token := range strings.Split(value, ",") {
+		var err error
+		switch strings.ToUpper(strings.TrimSpace(token)) {
+		case "ISO":
+			err = setFormat(dateFormatISO)
+		case "SQL":
+			err = setFormat(dateFormatSQL)
+		case "POSTGRES":
+			err = setFormat(dateFormatPostgres)
+		case "GERMAN":
+			err = setFormat(dateFormatGerman)
+			german = true
+		case "YMD":
+			err = setOrder(dateOrderYMD)
+		case "DMY", "EURO", "EUROPEAN":
+			err = setOrder(dateOrderDMY)
+		case "MDY", "US", "NONEURO", "NONEUROPEAN":
+			err = setOrder(dateOrderMDY)
+		case "DEFAULT":
+			err = setFormat(dateFormatISO)
+			if err == nil {
+				err = setOrder(dateOrderYMD)
+			}
+		default:
+			err = fmt.Errorf("unrecognized \"datestyle\" key word: \"%s\"", strings.TrimSpace(token))
+		}
+		if err != nil {
+			return current, err
+		}
+	}
+
+	if german && !haveOrder {
+		ds.order = dateOrderDMY
+	}
+	return ds, nil
+}
+
+// dateStyle returns the session's DateStyle
+func (s *session) dateStyle() dateStyle {
+	value, _ := s.Get("datestyle").(string)
+	ds, _ := parseDateStyle(value, dateStyle{})
+	return ds
+}
+
+// initDateStyle normalizes the DateStyle provided at startup, under the name
+// used by SET, after validating it
+func (s *session) initDateStyle() error {
+	for k, v := range s.Args {
+		if strings.ToLower(k) != "datestyle" {
+			continue
+		}
+
+		value, _ := v.(string)
+		ds, err := parseDateStyle(value, dateStyle{})
+		if err != nil {
+			return InvalidParameterValue("invalid value for parameter \"DateStyle\": \"%s\"", value)
+		}
+
+		delete(s.Args, k)
+		delete(s.defaults, k)
+		s.Args["datestyle"] = ds.String()
+		s.defaults["datestyle"] = ds.String()
+		return nil
+	}
+	return nil
+}
+
+// appendTime appends the text representation of the time as a value of the
+// postgres type, in the date style: DATE, TIMESTAMP or TIMESTAMPTZ by default
+func (ds dateStyle) appendTime(buf []byte, t time.Time, typ string) []byte {
+	switch typ {
+	case "DATE":
+		return ds.appendDate(buf, t)
+	case "TIMESTAMP":
+		return ds.appendTimestamp(buf, t)
+	}
+
+	buf = ds.appendTimestamp(buf, t)
+	if ds.format == dateFormatISO {
+		return appendOffset(buf, t)
+	}
+
+	// the other formats use the name of the zone, when it has one
+	buf = append(buf, ' ')
+	if name, _ := t.Zone(); name != "" && name[0] != '+' && name[0] != '-' {
+		return append(buf, name...)
+	}
+	return appendOffset(buf, t)
+}
+
+// appendDate appends the date of the time
+func (ds dateStyle) appendDate(buf []byte, t time.Time) []byte {
+	switch ds.format {
+	case dateFormatSQL:
+		if ds.order == dateOrderDMY {
+			return t.AppendFormat(buf, "02/01/2006")
+		}
+		return t.AppendFormat(buf, "01/02/2006")
+	case dateFormatPostgres:
+		if ds.order == dateOrderDMY {
+			return t.AppendFormat(buf, "02-01-2006")
+		}
+		return t.AppendFormat(buf, "01-02-2006")
+	case dateFormatGerman:
+		return t.AppendFormat(buf, "02.01.2006")
+	}
+	return t.AppendFormat(buf, "2006-01-02")
+}
+
+// appendTimestamp appends the date and time of the time, without its zone
+func (ds dateStyle) appendTimestamp(buf []byte, t time.Time) []byte {
+	if ds.format != dateFormatPostgres {
+		buf = ds.appendDate(buf, t)
+		buf = append(buf, ' ')
+		return t.AppendFormat(buf, "15:04:05.999999")
+	}
+
+	// like "Wed Dec 17 07:37:16 1997", or "Wed 17 Dec ..." in DMY order
+	if ds.order == dateOrderDMY {
+		buf = t.AppendFormat(buf, "Mon 02 Jan")
+	} else {
+		buf = t.AppendFormat(buf, "Mon Jan 02")
+	}
+	return t.AppendFormat(buf, " 15:04:05.999999 2006")
+}
+
+// appendOffset appends the offset of the time's zone, like "-07" or "+05:30"
+func appendOffset(buf []byte, t time.Time) []byte {
+	if _, offset := t.Zone(); offset%3600 != 0 {
+		return t.AppendFormat(buf, "-07:00")
+	}
+	return t.AppendFormat(buf, "-07")
+}
@@ -0,0 +1,149 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseDateStyle(t *testing.T) {
+	current := dateStyle{dateFormatSQL, dateOrderMDY}
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"ISO, DMY", "ISO, DMY"},
+		{"iso", "ISO, MDY"},
+		{"dmy", "SQL, DMY"},
+		{"Postgres, European", "Postgres, DMY"},
+		{"US , german", "German, MDY"},
+		{"German", "German, DMY"},
+		{"ISO, YMD, ISO", "ISO, YMD"},
+		{"DEFAULT", "ISO, YMD"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			ds, err := parseDateStyle(test.value, current)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, ds.String())
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := parseDateStyle("ISO, SQL", current)
+		require.EqualError(t, err, "conflicting \"datestyle\" specifications")
+		_, err = parseDateStyle("MDY, YMD", current)
+		require.EqualError(t, err, "conflicting \"datestyle\" specifications")
+		_, err = parseDateStyle("ISO, foo", current)
+		require.EqualError(t, err, "unrecognized \"datestyle\" key word: \"foo\"")
+		_, err = parseDateStyle("", current)
+		require.Error(t, err)
+	})
+}
+
+func TestDateStyle_appendTime(t *testing.T) {
+	ts := time.Date(1997, 12, 7, 7, 37, 16, 250000000, time.FixedZone("PST", -8*3600))
+	tests := []struct {
+		style    string
+		typ      string
+		expected string
+	}{
+		{"ISO, YMD", "DATE", "1997-12-07"},
+		{"ISO, YMD", "TIMESTAMP", "1997-12-07 07:37:16.25"},
+		{"ISO, YMD", "", "1997-12-07 07:37:16.25-08"},
+		{"SQL, MDY", "DATE", "12/07/1997"},
+		{"SQL, DMY", "DATE", "07/12/1997"},
+		{"SQL, MDY", "TIMESTAMPTZ", "12/07/1997 07:37:16.25 PST"},
+		{"Postgres, MDY", "DATE", "12-07-1997"},
+		{"Postgres, DMY", "DATE", "07-12-1997"},
+		{"Postgres, MDY", "TIMESTAMP", "Sun Dec 07 07:37:16.25 1997"},
+		{"Postgres, DMY", "", "Sun 07 Dec 07:37:16.25 1997 PST"},
+		{"German", "DATE", "07.12.1997"},
+		{"German", "TIMESTAMP", "07.12.1997 07:37:16.25"},
+		{"German", "", "07.12.1997 07:37:16.25 PST"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.style+" "+test.typ, func(t *testing.T) {
+			ds, err := parseDateStyle(test.style, dateStyle{})
+			require.NoError(t, err)
+			require.Equal(t, test.expected, string(ds.appendTime(nil, ts, test.typ)))
+		})
+	}
+
+	t.Run("unnamed zone", func(t *testing.T) {
+		ts := time.Date(1997, 12, 7, 7, 37, 16, 0, time.FixedZone("", 5*3600+1800))
+		ds := dateStyle{dateFormatGerman, dateOrderDMY}
+		require.Equal(t, "07.12.1997 07:37:16 +05:30", string(ds.appendTime(nil, ts, "")))
+	})
+}
+
+// timeQueryer returns a single row of a date and a timestamptz
+type timeQueryer struct{}
+
+func (timeQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	cols := []ColumnDesc{{Name: "d", TypeName: "DATE"}, {Name: "ts", TypeName: "TIMESTAMPTZ"}}
+	return RowsFromValues(cols, [][]interface{}{{ts, ts}}), nil
+}
+
+func TestQuery_dateStyle(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: timeQueryer{}}
+
+	// selectTime returns the text of the date and timestamptz values
+	selectTime := func(t *testing.T, frontend *pgproto3.Frontend) []string {
+		sendQuery(t, frontend, "SELECT now()::date, now()")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		msg := receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+		values := msg.(*pgproto3.DataRow).Values
+		return []string{string(values[0]), string(values[1])}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		require.Equal(t, []string{"2020-01-02", "2020-01-02 03:04:05+00"}, selectTime(t, frontend))
+	})
+
+	t.Run("startup", func(t *testing.T) {
+		frontend, _ := connectWith(t, srv, map[string]string{"user": "postgres", "DateStyle": "german"})
+		require.Equal(t, []string{"02.01.2020", "02.01.2020 03:04:05 UTC"}, selectTime(t, frontend))
+	})
+
+	t.Run("set", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		tests := []struct {
+			sql      string
+			style    string
+			expected []string
+		}{
+			{"SET datestyle = 'SQL, DMY'", "SQL, DMY", []string{"02/01/2020", "02/01/2020 03:04:05 UTC"}},
+			{"SET DateStyle = 'Postgres'", "Postgres, DMY", []string{"02-01-2020", "Thu 02 Jan 03:04:05 2020 UTC"}},
+			{"RESET datestyle", "ISO, YMD", []string{"2020-01-02", "2020-01-02 03:04:05+00"}},
+		}
+
+		for _, test := range tests {
+			t.Run(test.sql, func(t *testing.T) {
+				sendQuery(t, frontend, test.sql)
+				msg := receive(t, frontend, &pgproto3.ParameterStatus{})
+				require.Equal(t, &pgproto3.ParameterStatus{Name: "DateStyle", Value: test.style}, msg)
+				receive(t, frontend, &pgproto3.CommandComplete{})
+				receive(t, frontend, &pgproto3.ReadyForQuery{})
+				require.Equal(t, test.expected, selectTime(t, frontend))
+			})
+		}
+
+		t.Run("invalid value", func(t *testing.T) {
+			sendQuery(t, frontend, "SET datestyle = 'ISO, SQL'")
+			msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+			require.Equal(t, "22023", msg.(*pgproto3.ErrorResponse).Code)
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+		})
+	})
+}
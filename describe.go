@@ -0,0 +1,146 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"strings"
+)
+
+// ResultDescriber can be implemented by a Queryer in order to describe the
+// columns of the rows returned by a statement without executing it, as
+// requested by clients that Describe prepared statements or portals in the
+// extended protocol, like JDBC and pgx. Otherwise, SELECT statements are
+// described by querying them, with NULL parameters when they aren't bound yet,
+// and closing their rows unread, while the other statements that return rows,
+// like INSERT RETURNING, can't be described.
+type ResultDescriber interface {
+	// DescribeResult returns the columns of the rows returned by the
+	// statement, or nil when it returns no rows. The parameters of the
+	// statement are bound when it's the statement of a portal.
+	DescribeResult(ctx context.Context, n nodes.Node) ([]ColumnDesc, error)
+}
+
+// describeResult returns the RowDescription of the rows returned by the
+// statement, in the result formats requested by Bind, or NoData when it
+// returns no rows, like commands
+func (s *session) describeResult(stmt nodes.Node, formats []int16) (protocol.Message, error) {
+	cols, err := s.resultColumns(stmt)
+	if err != nil {
+		return nil, err
+	}
+	if cols == nil {
+		return protocol.NoData, nil
+	}
+
+	names := make([]string, len(cols))
+	types := make([]string, len(cols))
+	for i, col := range cols {
+		names[i], err = s.encoding.encode(col.Name)
+		if err != nil {
+			return nil, err
+		}
+		types[i] = col.TypeName
+	}
+
+	formats, err = resultFormats(formats, len(cols))
+	if err != nil {
+		return nil, err
+	}
+	return protocol.RowDescriptionFormats(names, types, formats), nil
+}
+
+// resultColumns returns the columns of the rows returned by the statement, or
+// nil when it returns no rows. The rows of SHOW and FETCH are known to the
+// session, while the rest of the queries are described by the backend.
+func (s *session) resultColumns(stmt nodes.Node) ([]ColumnDesc, error) {
+	switch v := stmt.(type) {
+	case nil:
+		return nil, nil // an empty query
+	case nodes.VariableShowStmt:
+		if cols, ok := s.showColumns(v); ok {
+			return cols, nil
+		}
+	case nodes.FetchStmt:
+		return s.fetchColumns(v)
+	}
+
+	kind := statementKind(stmt)
+	if kind != QueryStatement && kind != ShowStatement {
+		return nil, nil
+	}
+
+	ctx, done := s.queryContext()
+	defer done()
+	ctx = context.WithValue(ctx, sessionCtxKey, Session(s))
+	if describer, ok := s.queryer.(ResultDescriber); ok {
+		return describer.DescribeResult(ctx, stmt)
+	}
+
+	switch stmt.(type) {
+	case nodes.SelectStmt, nodes.VariableShowStmt:
+		rows, err := s.Query(ctx, stmt)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		return rowsColumns(rows), nil
+	case nodes.ExplainStmt:
+		return []ColumnDesc{{Name: "QUERY PLAN", TypeName: "TEXT"}}, nil
+	}
+	return nil, Unsupported("describing the rows of %s, without a ResultDescriber", commandName(stmt))
+}
+
+// showColumns returns the columns of SHOW of the variables that are known to
+// the session, see show
+func (s *session) showColumns(stmt nodes.VariableShowStmt) ([]ColumnDesc, bool) {
+	if stmt.Name == nil {
+		return nil, false
+	}
+
+	name := strings.ToLower(*stmt.Name)
+	if name == "all" {
+		return []ColumnDesc{
+			{Name: "name", TypeName: "TEXT"},
+			{Name: "setting", TypeName: "TEXT"},
+			{Name: "description", TypeName: "TEXT"},
+		}, true
+	}
+	if _, ok := s.variables()[name]; ok {
+		return []ColumnDesc{{Name: name, TypeName: "TEXT"}}, true
+	}
+	return nil, false
+}
+
+// fetchColumns returns the columns of the rows of the cursor of FETCH, or nil
+// for MOVE, see fetch
+func (s *session) fetchColumns(stmt nodes.FetchStmt) ([]ColumnDesc, error) {
+	name := ""
+	if stmt.Portalname != nil {
+		name = *stmt.Portalname
+	}
+	c, ok := s.cursors[name]
+	if !ok {
+		return nil, InvalidCursorName(name)
+	}
+	if stmt.Ismove {
+		return nil, nil
+	}
+	return rowsColumns(&cursorRows{cursor: c}), nil
+}
+
+// rowsColumns returns the columns of the rows, along with their types when the
+// rows report them
+func rowsColumns(rows driver.Rows) []ColumnDesc {
+	names := rows.Columns()
+	cols := make([]ColumnDesc, len(names))
+	rowsTypes, ok := rows.(driver.RowsColumnTypeDatabaseTypeName)
+	for i, name := range names {
+		cols[i].Name = name
+		if ok {
+			cols[i].TypeName = rowsTypes.ColumnTypeDatabaseTypeName(i)
+		}
+	}
+	return cols
+}
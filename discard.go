@@ -0,0 +1,55 @@
+package pgsrv
+
+import (
+	"context"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+)
+
+// discardTags are the command tags of the DISCARD statements
+var discardTags = map[nodes.DiscardMode]string{
+	nodes.DISCARD_ALL:       "DISCARD ALL",
+	nodes.DISCARD_PLANS:     "DISCARD PLANS",
+	nodes.DISCARD_SEQUENCES: "DISCARD SEQUENCES",
+	nodes.DISCARD_TEMP:      "DISCARD TEMP",
+}
+
+// discard handles the DISCARD statements, which connection poolers issue to
+// reset the session between clients. DISCARD ALL resets all of the state kept
+// by the server: the prepared statements and portals, the session variables
+// and the LISTEN subscriptions. The statement is then passed on to the
+// backend, if it executes commands, to discard its own state, like temporary
+// tables.
+func (q *query) discard(ctx context.Context, sess Session, n nodes.Node) error {
+	s, ok := sess.(*session)
+	v, isDiscard := n.(nodes.DiscardStmt)
+	// only session implementation keeps track of the state to discard
+	if !ok || !isDiscard {
+		return q.Exec(ctx, n)
+	}
+
+	if v.Target == nodes.DISCARD_ALL {
+		s.stmts = map[string]*nodes.PrepareStmt{}
+		s.pendingStmts = map[string]*nodes.PrepareStmt{}
+		s.portals = map[string]*portal{}
+		s.closeCursors(func(*cursor) bool { return true })
+		s.Server.broker.unlistenAll(s)
+
+		s.resetAll()
+		appName, _ := s.Get("application_name").(string)
+		s.setAppName(appName)
+		err := q.transport.Write(protocol.ParameterStatus("application_name", appName))
+		if err != nil {
+			return err
+		}
+		err = q.transport.Write(protocol.ParameterStatus("DateStyle", s.dateStyle().String()))
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, ok := s.queryer.(Execer); !ok {
+		return q.transport.Write(protocol.CommandComplete(discardTags[v.Target]))
+	}
+	return q.Exec(ctx, n)
+}
@@ -0,0 +1,98 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// discardExecer records the DISCARD statements passed to the backend
+type discardExecer struct {
+	mockQueryer
+	discarded []nodes.DiscardMode
+}
+
+func (e *discardExecer) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
+	if v, ok := n.(nodes.DiscardStmt); ok {
+		e.discarded = append(e.discarded, v.Target)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func TestQuery_discard(t *testing.T) {
+	// run sends the sql and expects the messages of a successful command
+	run := func(t *testing.T, frontend *pgproto3.Frontend, sql string, tag string) {
+		sendQuery(t, frontend, sql)
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if cc, ok := msg.(*pgproto3.CommandComplete); ok {
+				require.Equal(t, tag, cc.CommandTag)
+				break
+			}
+			require.IsType(t, &pgproto3.ParameterStatus{}, msg)
+		}
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+
+	t.Run("all", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+		frontend, pid := connectWith(t, srv, map[string]string{"user": "postgres", "search_path": "public"})
+		sess := loadSession(pid)
+
+		run(t, frontend, "SET search_path = 'foo'", "SET")
+		run(t, frontend, "SET application_name = 'client1'", "SET")
+		run(t, frontend, "PREPARE stmt AS SELECT 1", "PREPARE")
+		run(t, frontend, "LISTEN foo", "LISTEN")
+
+		sendQuery(t, frontend, "DISCARD ALL")
+		msg := receive(t, frontend, &pgproto3.ParameterStatus{})
+		require.Equal(t, &pgproto3.ParameterStatus{Name: "application_name", Value: ""}, msg)
+		msg = receive(t, frontend, &pgproto3.ParameterStatus{})
+		require.Equal(t, &pgproto3.ParameterStatus{Name: "DateStyle", Value: "ISO, YMD"}, msg)
+		msg = receive(t, frontend, &pgproto3.CommandComplete{})
+		require.Equal(t, "DISCARD ALL", msg.(*pgproto3.CommandComplete).CommandTag)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		require.Empty(t, sess.stmts)
+		require.Equal(t, "public", sess.Get("search_path"))
+		require.Nil(t, sess.Get("application_name"))
+		srv.broker.mu.Lock()
+		require.Empty(t, srv.broker.listeners)
+		srv.broker.mu.Unlock()
+
+		sendQuery(t, frontend, "EXECUTE stmt")
+		msg = receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "26000", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("other targets", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+		frontend, pid := connect(t, srv)
+
+		run(t, frontend, "PREPARE stmt AS SELECT 1", "PREPARE")
+		run(t, frontend, "DISCARD PLANS", "DISCARD PLANS")
+		run(t, frontend, "DISCARD TEMP", "DISCARD TEMP")
+		require.Len(t, loadSession(pid).stmts, 1)
+	})
+
+	t.Run("backend", func(t *testing.T) {
+		execer := &discardExecer{}
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: execer}
+		frontend, _ := connect(t, srv)
+
+		run(t, frontend, "DISCARD TEMP", "DISCARD TEMP")
+		run(t, frontend, "DISCARD ALL", "DISCARD ALL")
+		require.Equal(t, []nodes.DiscardMode{nodes.DISCARD_TEMP, nodes.DISCARD_ALL}, execer.discarded)
+	})
+}
+
+// loadSession returns the registered session of the pid
+func loadSession(pid int32) *session {
+	sess, _ := allSessions.Load(pid)
+	return sess.(*session)
+}
@@ -0,0 +1,162 @@
+package pgsrv
+
+import (
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultEncoding is the encoding of all text passed to and from the Queryer,
+// and the default encoding of the clients
+const defaultEncoding = "UTF8"
+
+// clientEncodings maps the supported client encodings, by their postgres names,
+// to their implementation. UTF8 is nil as it doesn't require transcoding.
+var clientEncodings = map[string]encoding.Encoding{
+	"UTF8":    nil,
+	"LATIN1":  charmap.ISO8859_1,
+	"WIN1252": charmap.Windows1252,
+}
+
+// encodingAliases maps the alternative names accepted by postgres, after
+// normalization, to the names of the encodings
+var encodingAliases = map[string]string{
+	"UNICODE":     "UTF8",
+	"ISO88591":    "LATIN1",
+	"WINDOWS1252": "WIN1252",
+}
+
+// clientEncoding transcodes the text exchanged with the client from and to the
+// encoding it requested, either at startup or with SET client_encoding. A nil
+// clientEncoding is UTF8.
+type clientEncoding struct {
+	name string
+	enc  encoding.Encoding
+}
+
+// newClientEncoding creates a clientEncoding by its name, which is case
+// insensitive and ignores dashes and underscores, like postgres does.
+func newClientEncoding(name string) (*clientEncoding, error) {
+	normalized := strings.ToUpper(name)
+	normalized = strings.Replace(normalized, "-", "", -1)
+	normalized = strings.Replace(normalized, "_", "", -1)
+	if alias, ok := encodingAliases[normalized]; ok {
+		normalized = alias
+	}
+
+	enc, ok := clientEncodings[normalized]
+	if !ok {
+		return nil, InvalidParameterValue("invalid value for parameter \"client_encoding\": \"%s\"", name)
+	}
+	return &clientEncoding{name: normalized, enc: enc}, nil
+}
+
+// Name returns the postgres name of the encoding, as reported to the client
+func (ce *clientEncoding) Name() string {
+	if ce == nil {
+		return defaultEncoding
+	}
+	return ce.name
+}
+
+// encode converts UTF8 text to the client encoding, failing when it contains
+// characters that have no equivalent in the client encoding.
+func (ce *clientEncoding) encode(s string) (string, error) {
+	if ce == nil || ce.enc == nil {
+		return s, nil
+	}
+
+	res, err := ce.enc.NewEncoder().String(s)
+	if err != nil {
+		return "", ce.untranslatable(s)
+	}
+	return res, nil
+}
+
+// untranslatable finds the first character of s that has no equivalent in the
+// client encoding and returns an error describing it
+func (ce *clientEncoding) untranslatable(s string) error {
+	encoder := ce.enc.NewEncoder()
+	for _, r := range s {
+		if _, err := encoder.String(string(r)); err != nil {
+			return UntranslatableCharacter(r, defaultEncoding, ce.name)
+		}
+	}
+	return UntranslatableCharacter(utf8.RuneError, defaultEncoding, ce.name)
+}
+
+// decode converts text sent by the client in its encoding to UTF8
+func (ce *clientEncoding) decode(s string) (string, error) {
+	if ce == nil || ce.enc == nil {
+		return s, nil
+	}
+	return ce.enc.NewDecoder().String(s)
+}
+
+// errorResponse creates an ErrorResponse for the error with its text fields
+// converted to the client encoding. Characters that have no equivalent in the
+// client encoding are replaced, as errors are reported regardless.
+func (ce *clientEncoding) errorResponse(e error) protocol.Message {
+	return protocol.ErrorResponse(ce.encodeErr(e))
+}
+
+// encodeErr returns a copy of the error with its text fields converted to the
+// client encoding, replacing characters with no equivalent in it
+func (ce *clientEncoding) encodeErr(e error) *err {
+	res := *fromErr(e)
+	if ce == nil || ce.enc == nil {
+		return &res
+	}
+
+	encoder := encoding.ReplaceUnsupported(ce.enc.NewEncoder())
+	for _, field := range []*string{&res.M, &res.D, &res.H, &res.W, &res.s, &res.t, &res.c, &res.d, &res.n} {
+		if v, err := encoder.String(*field); err == nil {
+			*field = v
+		}
+	}
+	return &res
+}
+
+// setClientEncoding handles SET client_encoding (and SET NAMES). Unlike other
+// variables, it's handled by the server rather than the backend since it
+// affects the protocol. Resetting it restores the encoding requested at
+// startup, or UTF8.
+func (q *query) setClientEncoding(sess Session, stmt nodes.VariableSetStmt) error {
+	s, ok := sess.(*session)
+	// only session implementation is capable of transcoding
+	if !ok {
+		return Unsupported("SET client_encoding")
+	}
+
+	name, ok := s.defaults["client_encoding"].(string)
+	if !ok {
+		name = defaultEncoding
+	}
+	if stmt.Kind == nodes.VAR_SET_VALUE {
+		name = ""
+		if len(stmt.Args.Items) == 1 {
+			if c, ok := stmt.Args.Items[0].(nodes.A_Const); ok {
+				if v, ok := c.Val.(nodes.String); ok {
+					name = v.Str
+				}
+			}
+		}
+	}
+
+	enc, err := newClientEncoding(name)
+	if err != nil {
+		return err
+	}
+	s.encoding = enc
+	q.encoding = enc
+	s.Set("client_encoding", enc.Name())
+
+	err = q.transport.Write(protocol.ParameterStatus("client_encoding", enc.Name()))
+	if err != nil {
+		return err
+	}
+	return q.transport.Write(protocol.CommandComplete("SET"))
+}
@@ -0,0 +1,145 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestNewClientEncoding(t *testing.T) {
+	for name, expected := range map[string]string{
+		"UTF8":         "UTF8",
+		"utf-8":        "UTF8",
+		"unicode":      "UTF8",
+		"latin1":       "LATIN1",
+		"ISO_8859_1":   "LATIN1",
+		"win1252":      "WIN1252",
+		"Windows-1252": "WIN1252",
+	} {
+		t.Run(name, func(t *testing.T) {
+			ce, err := newClientEncoding(name)
+			require.NoError(t, err)
+			require.Equal(t, expected, ce.Name())
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, e := newClientEncoding("EUC_JP")
+		require.EqualError(t, e, "invalid value for parameter \"client_encoding\": \"EUC_JP\"")
+		require.Equal(t, "22023", fromErr(e).C)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		var ce *clientEncoding
+		require.Equal(t, "UTF8", ce.Name())
+
+		s, err := ce.encode("café")
+		require.NoError(t, err)
+		require.Equal(t, "café", s)
+	})
+}
+
+func TestClientEncoding_transcode(t *testing.T) {
+	latin1, err := newClientEncoding("LATIN1")
+	require.NoError(t, err)
+
+	t.Run("encode", func(t *testing.T) {
+		s, err := latin1.encode("café")
+		require.NoError(t, err)
+		require.Equal(t, "caf\xe9", s)
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		s, err := latin1.decode("caf\xe9")
+		require.NoError(t, err)
+		require.Equal(t, "café", s)
+	})
+
+	t.Run("untranslatable", func(t *testing.T) {
+		_, e := latin1.encode("price: €5")
+		require.EqualError(t, e, "character with byte sequence 0xe282ac in encoding \"UTF8\" has no equivalent in encoding \"LATIN1\"")
+		require.Equal(t, "22P05", fromErr(e).C)
+
+		win1252, err := newClientEncoding("WIN1252")
+		require.NoError(t, err)
+		s, err := win1252.encode("price: €5")
+		require.NoError(t, err)
+		require.Equal(t, "price: \x805", s)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		e := latin1.encodeErr(WithHint(Invalid("café"), "€"))
+		require.Equal(t, "invalid caf\xe9", e.M)
+		require.Equal(t, "\x1a", e.H, "expected untranslatable characters to be replaced")
+	})
+}
+
+// echoQueryer returns the query it received as a single value
+type echoQueryer struct{}
+
+func (*echoQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return &echoRows{sql: QueryFromContext(ctx)}, nil
+}
+
+type echoRows struct {
+	sql  string
+	done bool
+}
+
+func (*echoRows) Columns() []string { return []string{"café"} }
+func (*echoRows) Close() error      { return nil }
+func (r *echoRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	dest[0], r.done = r.sql, true
+	return nil
+}
+
+func TestSession_clientEncoding(t *testing.T) {
+	srv := &server{
+		authenticator: &noPasswordAuthenticator{},
+		queryer:       &echoQueryer{},
+	}
+
+	t.Run("startup", func(t *testing.T) {
+		frontend, _ := connectWith(t, srv, map[string]string{"user": "postgres", "client_encoding": "latin1"})
+
+		sendQuery(t, frontend, "SELECT 'caf\xe9'")
+		msg := receive(t, frontend, &pgproto3.RowDescription{})
+		require.Equal(t, "caf\xe9", string(msg.(*pgproto3.RowDescription).Fields[0].Name))
+
+		msg = receive(t, frontend, &pgproto3.DataRow{})
+		require.Equal(t, "SELECT 'caf\xe9'", string(msg.(*pgproto3.DataRow).Values[0]))
+
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("set", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "SET client_encoding TO 'WIN1252'")
+		msg := receive(t, frontend, &pgproto3.ParameterStatus{})
+		require.Equal(t, &pgproto3.ParameterStatus{Name: "client_encoding", Value: "WIN1252"}, msg)
+		msg = receive(t, frontend, &pgproto3.CommandComplete{})
+		require.Equal(t, "SET", msg.(*pgproto3.CommandComplete).CommandTag)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		sendQuery(t, frontend, "SELECT '\x80'")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		msg = receive(t, frontend, &pgproto3.DataRow{})
+		require.Equal(t, "SELECT '\x80'", string(msg.(*pgproto3.DataRow).Values[0]))
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		sendQuery(t, frontend, "SET client_encoding TO 'EUC_JP'")
+		msg = receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "22023", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
@@ -1,12 +1,28 @@
 package pgsrv
 
 import (
+	"errors"
 	"fmt"
 )
 
 // fatalSeverity error terminates session
 const fatalSeverity = "FATAL"
 
+// Severities of non-fatal messages, sent to the client with Session.Notice
+const (
+	SeverityWarning = "WARNING"
+	SeverityNotice  = "NOTICE"
+	SeverityInfo    = "INFO"
+	SeverityDebug   = "DEBUG"
+	SeverityLog     = "LOG"
+)
+
+// ErrSessionClosed is returned by the methods of a Session that write to the
+// client, like Notify and NoticeErr, once the session is closed. Backends may
+// get it from goroutines that outlived the session, and should stop producing
+// results.
+var ErrSessionClosed = errors.New("session is closed")
+
 // Err is a postgres-compatible error object. It's not required to be used, as
 // any other normal error object would be converted to a generic internal error,
 // but it provides the API to generate user-friendly error messages. Note that
@@ -25,6 +41,9 @@ const fatalSeverity = "FATAL"
 //          Code() string
 //      }
 //
+// Any of the other fields can be provided the same way, by implementing the
+// method named after it, like Hint() string or TableName() string.
+//
 // For the full list of error codes, see: https://www.postgresql.org/docs/10/static/errcodes-appendix.html
 type Err error
 
@@ -35,6 +54,17 @@ type err struct {
 	D string // Detail
 	H string // Hint
 	P int    // Position
+	W string // Where
+	s string // Schema name
+	t string // Table name
+	c string // Column name
+	d string // Data type name
+	n string // Constraint name
+
+	// the format and arguments of the message, set for the messages generated
+	// by the server, for localizing them (see WithMessageLocalizer)
+	f    string
+	args []interface{}
 }
 
 func (e *err) Severity() string { return e.S }
@@ -44,6 +74,57 @@ func (e *err) Detail() string   { return e.D }
 func (e *err) Hint() string     { return e.H }
 func (e *err) Position() int    { return e.P }
 
+func (e *err) Where() string          { return e.W }
+func (e *err) SchemaName() string     { return e.s }
+func (e *err) TableName() string      { return e.t }
+func (e *err) ColumnName() string     { return e.c }
+func (e *err) DataTypeName() string   { return e.d }
+func (e *err) ConstraintName() string { return e.n }
+
+// Error is a postgres error with all of its fields, which may be returned
+// instead of implementing the interface described in Err. It's recognized even
+// when wrapped by other errors (with an Unwrap method), and all of its fields
+// are reported to the client. For example:
+//
+//      return &pgsrv.Error{Code: "23505", Message: "duplicate key"}
+//
+// Empty fields are omitted, and Position (1-based) is omitted when zero.
+type Error struct {
+	Severity       string
+	Code           string
+	Message        string
+	Detail         string
+	Hint           string
+	Position       int
+	Where          string
+	SchemaName     string
+	TableName      string
+	ColumnName     string
+	DataTypeName   string
+	ConstraintName string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// asError finds the first *Error in the chain of wrapped errors, like
+// errors.As does in newer versions of go
+func asError(e error) (*Error, bool) {
+	for e != nil {
+		if res, ok := e.(*Error); ok {
+			return res, true
+		}
+
+		wrapper, ok := e.(interface {
+			Unwrap() error
+		})
+		if !ok {
+			break
+		}
+		e = wrapper.Unwrap()
+	}
+	return nil, false
+}
+
 // WithSeverity decorates an error object to also include an optional severity
 func WithSeverity(err error, severity string) Err {
 	if err == nil {
@@ -55,6 +136,19 @@ func WithSeverity(err error, severity string) Err {
 	return e
 }
 
+// WithCode decorates an error object to also include the SQLSTATE code, which
+// overrides the code of the error, if any. See:
+// https://www.postgresql.org/docs/10/static/errcodes-appendix.html
+func WithCode(err error, code string) Err {
+	if err == nil {
+		return nil
+	}
+
+	e := fromErr(err)
+	e.C = code
+	return e
+}
+
 // WithDetail decorates an error object to also include  an optional secondary
 // error message carrying more detail about the problem. Might run to multiple
 // lines
@@ -101,6 +195,81 @@ func WithPosition(err error, position int) Err {
 	return e
 }
 
+// WithWhere decorates an error object to also include an indication of the
+// context in which the error occurred, like a call stack traceback of active
+// functions. One entry per line, most recent first
+func WithWhere(err error, where string, args ...interface{}) Err {
+	if err == nil {
+		return nil
+	}
+
+	e := fromErr(err)
+	e.W = fmt.Sprintf(where, args...)
+	return e
+}
+
+// WithSchema decorates an error object to also include the name of the schema
+// containing the database object associated with the error
+func WithSchema(err error, schema string) Err {
+	if err == nil {
+		return nil
+	}
+
+	e := fromErr(err)
+	e.s = schema
+	return e
+}
+
+// WithTable decorates an error object to also include the name of the table
+// associated with the error. The schema name should be provided as well, see
+// WithSchema
+func WithTable(err error, table string) Err {
+	if err == nil {
+		return nil
+	}
+
+	e := fromErr(err)
+	e.t = table
+	return e
+}
+
+// WithColumn decorates an error object to also include the name of the column
+// associated with the error. The table name should be provided as well, see
+// WithTable
+func WithColumn(err error, column string) Err {
+	if err == nil {
+		return nil
+	}
+
+	e := fromErr(err)
+	e.c = column
+	return e
+}
+
+// WithDataType decorates an error object to also include the name of the data
+// type associated with the error
+func WithDataType(err error, dataType string) Err {
+	if err == nil {
+		return nil
+	}
+
+	e := fromErr(err)
+	e.d = dataType
+	return e
+}
+
+// WithConstraint decorates an error object to also include the name of the
+// constraint associated with the error, like a violated unique index
+func WithConstraint(err error, constraint string) Err {
+	if err == nil {
+		return nil
+	}
+
+	e := fromErr(err)
+	e.n = constraint
+	return e
+}
+
 // Unrecognized indicates that a certain entity (function, column, etc.) is not
 // registered or available for use.
 func Unrecognized(msg string, args ...interface{}) Err {
@@ -134,6 +303,13 @@ func Unsupported(msg string, args ...interface{}) Err {
 	return &err{M: msg, C: "0A000", P: -1}
 }
 
+// InternalError indicates an unexpected failure within the server or its
+// backend, like a panic.
+func InternalError(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "XX000", P: -1}
+}
+
 // InvalidSQLStatementName indicates that a referred statement name is
 // unknown/missing to the server.
 func InvalidSQLStatementName(stmtName string) Err {
@@ -141,9 +317,180 @@ func InvalidSQLStatementName(stmtName string) Err {
 	return &err{M: msg, C: "26000", P: -1}
 }
 
+// DuplicatePreparedStatement indicates that a prepared statement with the same
+// name already exists
+func DuplicatePreparedStatement(stmtName string) Err {
+	msg := fmt.Sprintf("prepared statement \"%s\" already exists", stmtName)
+	return &err{M: msg, C: "42P05", P: -1}
+}
+
+// InvalidCursorName indicates that a referred cursor is unknown to the server
+func InvalidCursorName(cursorName string) Err {
+	msg := fmt.Sprintf("cursor \"%s\" does not exist", cursorName)
+	return &err{M: msg, C: "34000", P: -1}
+}
+
+// DuplicateCursor indicates that a cursor with the same name already exists
+func DuplicateCursor(cursorName string) Err {
+	msg := fmt.Sprintf("cursor \"%s\" already exists", cursorName)
+	return &err{M: msg, C: "42P03", P: -1}
+}
+
+// InvalidCatalogName indicates that the requested database does not exist
+func InvalidCatalogName(database string) Err {
+	msg := fmt.Sprintf("database \"%s\" does not exist", database)
+	return &err{M: msg, C: "3D000", P: -1}
+}
+
+// InvalidParameterValue indicates that a value provided to a command or
+// function is outside of its accepted range
+func InvalidParameterValue(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "22023", P: -1}
+}
+
+// InvalidPassword indicates that the client failed the password authentication
+func InvalidPassword(msg string, args ...interface{}) Err {
+	return errorf("28P01", msg, args...)
+}
+
+// InvalidAuthorizationSpecification indicates that the client isn't allowed
+// to connect with the provided startup parameters
+func InvalidAuthorizationSpecification(msg string, args ...interface{}) Err {
+	return errorf("28000", msg, args...)
+}
+
+// UniqueViolation indicates that a command would create a duplicate value in a
+// unique index or constraint
+func UniqueViolation(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "23505", P: -1}
+}
+
+// ForeignKeyViolation indicates that a command would break a reference to
+// another table
+func ForeignKeyViolation(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "23503", P: -1}
+}
+
+// NotNullViolation indicates that a command would set a null value to a column
+// that doesn't allow it
+func NotNullViolation(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "23502", P: -1}
+}
+
+// CheckViolation indicates that a command would break a check constraint
+func CheckViolation(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "23514", P: -1}
+}
+
+// UndefinedTable indicates that a referred table, or any other relation, does
+// not exist
+func UndefinedTable(table string) Err {
+	msg := fmt.Sprintf("relation \"%s\" does not exist", table)
+	return &err{M: msg, C: "42P01", P: -1}
+}
+
+// UndefinedColumn indicates that a referred column does not exist
+func UndefinedColumn(column string) Err {
+	msg := fmt.Sprintf("column \"%s\" does not exist", column)
+	return &err{M: msg, C: "42703", P: -1}
+}
+
+// InsufficientPrivilege indicates that the user isn't permitted to perform the
+// command
+func InsufficientPrivilege(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "42501", P: -1}
+}
+
+// DivisionByZero indicates an attempt to divide by zero
+func DivisionByZero() Err {
+	return &err{M: "division by zero", C: "22012", P: -1}
+}
+
+// UntranslatableCharacter indicates that a character has no equivalent in the
+// encoding it's converted to, like the client encoding
+func UntranslatableCharacter(r rune, from, to string) Err {
+	msg := fmt.Sprintf("character with byte sequence 0x%x in encoding \"%s\" has no equivalent in encoding \"%s\"", string(r), from, to)
+	return &err{M: msg, C: "22P05", P: -1}
+}
+
+// InvalidTextRepresentation indicates that a value in text format isn't valid
+// for its type, like a bind parameter
+func InvalidTextRepresentation(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "22P02", P: -1}
+}
+
+// InvalidBinaryRepresentation indicates that a value in binary format isn't
+// valid for its type, or that its type has no binary format
+func InvalidBinaryRepresentation(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "22P03", P: -1}
+}
+
+// BadCopyFileFormat indicates that the data of a COPY is malformed, like a row
+// with a missing column
+func BadCopyFileFormat(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "22P04", P: -1}
+}
+
+// ProgramLimitExceeded indicates that a request exceeds one of the limits of
+// the server, like the maximum length of a query
+func ProgramLimitExceeded(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "54000", P: -1}
+}
+
+// AdminShutdown indicates that the session is terminated since the server is
+// shutting down
+func AdminShutdown() Err {
+	return &err{M: "terminating connection due to administrator command", C: "57P01", P: -1}
+}
+
+// QueryCanceled indicates that the query was canceled before it completed,
+// either by the client or due to a timeout
+func QueryCanceled(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "57014", P: -1}
+}
+
+// ActiveSQLTransaction indicates that the statement can't be used inside of a
+// transaction block
+func ActiveSQLTransaction(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "25001", P: -1}
+}
+
+// NoActiveSQLTransaction indicates that the statement can only be used inside
+// of a transaction block
+func NoActiveSQLTransaction(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "25P01", P: -1}
+}
+
+// InFailedSQLTransaction indicates that the statement was rejected since the
+// transaction block failed, until it ends with ROLLBACK
+func InFailedSQLTransaction(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "25P02", P: -1}
+}
+
+// ReadOnlySQLTransaction indicates that the statement writes, while only
+// reading is allowed
+func ReadOnlySQLTransaction(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "25006", P: -1}
+}
+
 // ProtocolViolation indicates that a provided typed message has an invalid value
-func ProtocolViolation(msg string) Err {
-	return &err{M: msg, C: "08P01", P: -1}
+func ProtocolViolation(msg string, args ...interface{}) Err {
+	return errorf("08P01", msg, args...)
 }
 
 // SyntaxError indicates that sent command is invalid
@@ -152,12 +499,44 @@ func SyntaxError(msg string, args ...interface{}) Err {
 	return &err{M: msg, C: "42601", P: -1, S: "ERROR"}
 }
 
+// errorf creates an error of the code with the formatted message, keeping the
+// format and arguments for localizing it. The message is used as is when there
+// are no arguments.
+func errorf(code, msg string, args ...interface{}) *err {
+	e := &err{M: msg, C: code, P: -1, f: msg, args: args}
+	if len(args) > 0 {
+		e.M = fmt.Sprintf(msg, args...)
+	}
+	return e
+}
+
 func fromErr(e error) *err {
 	err1, ok := e.(*err)
 	if ok {
 		return err1
 	}
 
+	if pe, ok := asError(e); ok {
+		p := pe.Position
+		if p <= 0 {
+			p = -1
+		}
+		return &err{
+			S: pe.Severity,
+			C: pe.Code,
+			M: pe.Message,
+			D: pe.Detail,
+			H: pe.Hint,
+			P: p,
+			W: pe.Where,
+			s: pe.SchemaName,
+			t: pe.TableName,
+			c: pe.ColumnName,
+			d: pe.DataTypeName,
+			n: pe.ConstraintName,
+		}
+	}
+
 	severitier, ok := e.(interface {
 		Severity() string
 	})
@@ -200,5 +579,25 @@ func fromErr(e error) *err {
 		p = positioner.Position()
 	}
 
-	return &err{S: s, C: c, M: m, D: d, H: h, P: p}
+	res := &err{S: s, C: c, M: m, D: d, H: h, P: p}
+
+	if wherer, ok := e.(interface{ Where() string }); ok {
+		res.W = wherer.Where()
+	}
+	if schemer, ok := e.(interface{ SchemaName() string }); ok {
+		res.s = schemer.SchemaName()
+	}
+	if tabler, ok := e.(interface{ TableName() string }); ok {
+		res.t = tabler.TableName()
+	}
+	if columner, ok := e.(interface{ ColumnName() string }); ok {
+		res.c = columner.ColumnName()
+	}
+	if typer, ok := e.(interface{ DataTypeName() string }); ok {
+		res.d = typer.DataTypeName()
+	}
+	if constrainter, ok := e.(interface{ ConstraintName() string }); ok {
+		res.n = constrainter.ConstraintName()
+	}
+	return res
 }
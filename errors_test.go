@@ -25,9 +25,69 @@ func TestFromErr(t *testing.T) {
 		require.Equal(t, "Some detail", actualErr.Detail())
 		require.Equal(t, "A hint", actualErr.Hint())
 		require.Equal(t, 42, actualErr.Position())
+		require.Equal(t, "SQL function \"foo\"", actualErr.Where())
+		require.Equal(t, "public", actualErr.SchemaName())
+		require.Equal(t, "users", actualErr.TableName())
+		require.Equal(t, "email", actualErr.ColumnName())
+		require.Equal(t, "text", actualErr.DataTypeName())
+		require.Equal(t, "users_email_key", actualErr.ConstraintName())
 	})
 }
 
+func TestFromErr_Error(t *testing.T) {
+	pgErr := &Error{
+		Severity:  "FATAL",
+		Code:      "23505",
+		Message:   "duplicate key",
+		Hint:      "try another",
+		Position:  3,
+		Where:     "somewhere",
+		TableName: "users",
+	}
+
+	t.Run("error", func(t *testing.T) {
+		e := fromErr(pgErr)
+		require.Equal(t, &err{S: "FATAL", C: "23505", M: "duplicate key", H: "try another", P: 3, W: "somewhere", t: "users"}, e)
+	})
+
+	t.Run("wrapped error", func(t *testing.T) {
+		e := fromErr(&wrappedErr{&wrappedErr{pgErr}})
+		require.Equal(t, "23505", e.Code())
+		require.Equal(t, "duplicate key", e.Error())
+	})
+
+	t.Run("no position", func(t *testing.T) {
+		e := fromErr(&Error{Message: "boom"})
+		require.Equal(t, -1, e.Position())
+	})
+}
+
+func TestErrorClasses(t *testing.T) {
+	tests := map[string]struct {
+		err  Err
+		code string
+		msg  string
+	}{
+		"unique violation":       {UniqueViolation("dup %d", 1), "23505", "dup 1"},
+		"foreign key violation":  {ForeignKeyViolation("fk"), "23503", "fk"},
+		"not null violation":     {NotNullViolation("nn"), "23502", "nn"},
+		"check violation":        {CheckViolation("check"), "23514", "check"},
+		"undefined table":        {UndefinedTable("foo"), "42P01", "relation \"foo\" does not exist"},
+		"undefined column":       {UndefinedColumn("bar"), "42703", "column \"bar\" does not exist"},
+		"insufficient privilege": {InsufficientPrivilege("denied"), "42501", "denied"},
+		"division by zero":       {DivisionByZero(), "22012", "division by zero"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			e := test.err.(*err)
+			require.Equal(t, test.code, e.Code())
+			require.Equal(t, -1, e.Position())
+			require.Equal(t, test.msg, e.Error())
+		})
+	}
+}
+
 func TestUnrecognized(t *testing.T) {
 	e := Unrecognized("thing %s", "meh").(*err)
 	require.Equal(t, "42000", e.Code())
@@ -112,6 +172,49 @@ func TestWithPosition(t *testing.T) {
 	})
 }
 
+func TestWithCode(t *testing.T) {
+	t.Run("error is nil", func(t *testing.T) {
+		err := WithCode(nil, "23505")
+		require.Nil(t, err)
+	})
+
+	t.Run("real error", func(t *testing.T) {
+		e := Unsupported("thing")
+		es := WithCode(e, "23505")
+		require.NotNil(t, es)
+		require.Equal(t, "23505", es.(*err).Code())
+	})
+}
+
+func TestWithObjects(t *testing.T) {
+	t.Run("error is nil", func(t *testing.T) {
+		require.Nil(t, WithWhere(nil, "somewhere"))
+		require.Nil(t, WithSchema(nil, "public"))
+		require.Nil(t, WithTable(nil, "users"))
+		require.Nil(t, WithColumn(nil, "email"))
+		require.Nil(t, WithDataType(nil, "text"))
+		require.Nil(t, WithConstraint(nil, "users_email_key"))
+	})
+
+	t.Run("real error", func(t *testing.T) {
+		var e error = fmt.Errorf("duplicate key value violates unique constraint")
+		e = WithWhere(e, "SQL function \"%s\"", "foo")
+		e = WithSchema(e, "public")
+		e = WithTable(e, "users")
+		e = WithColumn(e, "email")
+		e = WithDataType(e, "text")
+		e = WithConstraint(e, "users_email_key")
+
+		es := e.(*err)
+		require.Equal(t, "SQL function \"foo\"", es.Where())
+		require.Equal(t, "public", es.SchemaName())
+		require.Equal(t, "users", es.TableName())
+		require.Equal(t, "email", es.ColumnName())
+		require.Equal(t, "text", es.DataTypeName())
+		require.Equal(t, "users_email_key", es.ConstraintName())
+	})
+}
+
 type mockErr struct{}
 
 func (*mockErr) Severity() string { return "BAD" }
@@ -120,3 +223,10 @@ func (*mockErr) Error() string    { return "This is bad" }
 func (*mockErr) Detail() string   { return "Some detail" }
 func (*mockErr) Hint() string     { return "A hint" }
 func (*mockErr) Position() int    { return 42 }
+
+func (*mockErr) Where() string          { return "SQL function \"foo\"" }
+func (*mockErr) SchemaName() string     { return "public" }
+func (*mockErr) TableName() string      { return "users" }
+func (*mockErr) ColumnName() string     { return "email" }
+func (*mockErr) DataTypeName() string   { return "text" }
+func (*mockErr) ConstraintName() string { return "users_email_key" }
@@ -0,0 +1,66 @@
+package pgsrv
+
+import (
+	"github.com/panoplyio/pgsrv/protocol"
+	"net"
+)
+
+// AllowCIDRs creates a ConnFilter that only accepts connections from clients
+// within the provided networks, in CIDR notation (like "10.0.0.0/8" or
+// "::1/128"). Other connections are rejected with an
+// invalid_authorization_specification (28000) error.
+func AllowCIDRs(cidrs ...string) (ConnFilter, error) {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks[i] = network
+	}
+
+	return func(conn net.Conn) error {
+		host := remoteHost(conn)
+		ip := net.ParseIP(host)
+		for _, network := range networks {
+			if ip != nil && network.Contains(ip) {
+				return nil
+			}
+		}
+		return InvalidAuthorizationSpecification("connections from host \"%s\" are not allowed", host)
+	}, nil
+}
+
+// remoteHost returns the host of the connection's remote address, without the
+// port
+func remoteHost(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// rejectConn closes a connection rejected by the ConnFilter, after sending the
+// error to the client if it has a code. It's localized to the default locale,
+// since the startup parameters weren't read yet.
+func (s *server) rejectConn(conn net.Conn, err error) {
+	defer conn.Close()
+
+	coder, ok := err.(interface {
+		Code() string
+	})
+	if !ok || coder.Code() == "" {
+		return
+	}
+
+	conn.Write(protocol.ErrorResponse(WithSeverity(s.localize(err, ""), fatalSeverity)))
+}
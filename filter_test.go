@@ -0,0 +1,118 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// recordingAuthenticator records whether authentication was attempted
+type recordingAuthenticator struct {
+	noPasswordAuthenticator
+	called bool
+}
+
+func (a *recordingAuthenticator) authenticate(rw protocol.MessageReadWriter, args map[string]interface{}) error {
+	a.called = true
+	return a.noPasswordAuthenticator.authenticate(rw, args)
+}
+
+func TestAllowCIDRs(t *testing.T) {
+	filter, err := AllowCIDRs("10.0.0.0/8", "::1/128")
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		addr    net.Addr
+		allowed bool
+	}{
+		"allowed ipv4":  {&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5432}, true},
+		"allowed ipv6":  {&net.TCPAddr{IP: net.ParseIP("::1"), Port: 5432}, true},
+		"blocked ipv4":  {&net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 5432}, false},
+		"unix socket":   {&net.UnixAddr{Name: "/tmp/.s.PGSQL.5432", Net: "unix"}, false},
+		"host and port": {&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432}, true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := filter(&addrConn{addr: test.addr})
+			if test.allowed {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.Equal(t, "28000", fromErr(err).C)
+			}
+		})
+	}
+
+	t.Run("invalid cidr", func(t *testing.T) {
+		_, err := AllowCIDRs("10.0.0.0")
+		require.Error(t, err)
+	})
+}
+
+func TestServer_connFilter(t *testing.T) {
+	filter, err := AllowCIDRs("10.0.0.0/8")
+	require.NoError(t, err)
+
+	t.Run("blocked", func(t *testing.T) {
+		auth := &recordingAuthenticator{}
+		srv := &server{authenticator: auth, queryer: &mockQueryer{}, connFilter: filter}
+
+		f, b := net.Pipe()
+		done := make(chan error)
+		go func() {
+			done <- srv.Serve(&addrConn{b, &net.TCPAddr{IP: net.ParseIP("192.168.1.1")}})
+		}()
+
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{}).(*pgproto3.ErrorResponse)
+		require.Equal(t, "FATAL", msg.Severity)
+		require.Equal(t, "28000", msg.Code)
+		require.Error(t, <-done)
+
+		// the connection is closed
+		_, err = ioutil.ReadAll(f)
+		require.NoError(t, err)
+		require.False(t, auth.called, "expected the connection to be rejected before authentication")
+	})
+
+	t.Run("silently", func(t *testing.T) {
+		srv := &server{
+			authenticator: &recordingAuthenticator{},
+			queryer:       &mockQueryer{},
+			connFilter:    func(net.Conn) error { return net.UnknownNetworkError("pipe") },
+		}
+
+		f, b := net.Pipe()
+		go srv.Serve(b)
+
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		require.Empty(t, data)
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		auth := &recordingAuthenticator{}
+		srv := &server{authenticator: auth, queryer: &mockQueryer{}, connFilter: filter}
+
+		f, b := net.Pipe()
+		go srv.Serve(&addrConn{b, &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}})
+
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+		err = frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres"},
+		})
+		require.NoError(t, err)
+
+		receive(t, frontend, &pgproto3.Authentication{})
+		require.True(t, auth.called)
+		f.Close()
+	})
+}
@@ -0,0 +1,69 @@
+package pgsrv
+
+import (
+	"context"
+	"github.com/panoplyio/pgsrv/protocol"
+)
+
+// functionCall calls the function of a fast-path FunctionCall message with
+// the server's FunctionCaller, if there's one
+func (s *session) functionCall(t *protocol.Transport, msg *protocol.FunctionCall) error {
+	caller := s.Server.functionCaller
+	if caller == nil {
+		return t.Write(s.errorResponse(Unsupported("function call")))
+	}
+
+	formats, err := argFormats(msg.ArgFormatCodes, len(msg.Arguments))
+	if err != nil {
+		return t.Write(s.errorResponse(err))
+	}
+
+	q := &query{
+		transport:    t,
+		logger:       s.Server.logger,
+		errorMapper:  s.Server.errorMapper,
+		localize:     s.localize,
+		failed:       s.fail,
+		encoding:     s.encoding,
+		queryTimeout: s.Server.queryTimeout,
+	}
+	ctx, done := s.queryContext()
+	defer done()
+
+	ctx = context.WithValue(ctx, sessionCtxKey, Session(s))
+	return q.call(ctx, s, caller, msg.Function, msg.Arguments, formats)
+}
+
+// call executes the function within the statement's timeout, and sends its
+// result to the client
+func (q *query) call(ctx context.Context, sess Session, caller FunctionCaller, oid uint32, args [][]byte, formats []int16) (err error) {
+	defer q.recoverPanic(&err)
+
+	ctx, cancel := q.withTimeout(ctx, sess)
+	defer cancel()
+
+	res, err := caller.Call(ctx, oid, args, formats)
+	if err != nil {
+		return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
+	}
+	return q.transport.Write(protocol.FunctionCallResponse(res))
+}
+
+// argFormats returns the format code of each of the n arguments. Clients may
+// send no codes when all of the arguments are text, or a single code for all
+// of them.
+func argFormats(codes []int16, n int) ([]int16, error) {
+	formats := make([]int16, n)
+	switch len(codes) {
+	case 0:
+	case 1:
+		for i := range formats {
+			formats[i] = codes[0]
+		}
+	case n:
+		copy(formats, codes)
+	default:
+		return nil, ProtocolViolation("function call message has %d argument formats but %d arguments", len(codes), n)
+	}
+	return formats, nil
+}
@@ -0,0 +1,90 @@
+package pgsrv
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// concatCaller concatenates the arguments of function 1000, as text
+type concatCaller struct {
+	formats []int16
+}
+
+func (c *concatCaller) Call(ctx context.Context, oid uint32, args [][]byte, formats []int16) ([]byte, error) {
+	c.formats = formats
+	if oid != 1000 {
+		return nil, fmt.Errorf("function %d does not exist", oid)
+	}
+
+	var res []byte
+	for _, arg := range args {
+		if arg == nil {
+			arg = []byte("null")
+		}
+		res = append(res, arg...)
+	}
+	return res, nil
+}
+
+func TestSession_functionCall(t *testing.T) {
+	call := func(t *testing.T, frontend *pgproto3.Frontend, msg *protocol.FunctionCall) pgproto3.BackendMessage {
+		err := frontend.Send(msg)
+		require.NoError(t, err)
+
+		res, err := frontend.Receive()
+		require.NoError(t, err)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+		return res
+	}
+
+	t.Run("result", func(t *testing.T) {
+		caller := &concatCaller{}
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}, functionCaller: caller}
+		frontend, _ := connect(t, srv)
+
+		res := call(t, frontend, &protocol.FunctionCall{
+			Function:       1000,
+			ArgFormatCodes: []int16{1},
+			Arguments:      [][]byte{[]byte("foo"), []byte("bar")},
+		})
+		require.Equal(t, &pgproto3.FunctionCallResponse{Result: []byte("foobar")}, res)
+		require.Equal(t, []int16{1, 1}, caller.formats)
+
+		res = call(t, frontend, &protocol.FunctionCall{
+			Function:  1000,
+			Arguments: [][]byte{[]byte("foo"), nil},
+		})
+		require.Equal(t, &pgproto3.FunctionCallResponse{Result: []byte("foonull")}, res)
+		require.Equal(t, []int16{0, 0}, caller.formats)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}, functionCaller: &concatCaller{}}
+		frontend, _ := connect(t, srv)
+
+		res := call(t, frontend, &protocol.FunctionCall{Function: 1})
+		require.IsType(t, &pgproto3.ErrorResponse{}, res)
+		require.Equal(t, "function 1 does not exist", res.(*pgproto3.ErrorResponse).Message)
+
+		res = call(t, frontend, &protocol.FunctionCall{
+			Function:       1000,
+			ArgFormatCodes: []int16{0, 1},
+			Arguments:      [][]byte{[]byte("foo")},
+		})
+		require.IsType(t, &pgproto3.ErrorResponse{}, res)
+		require.Equal(t, "08P01", res.(*pgproto3.ErrorResponse).Code)
+	})
+
+	t.Run("no caller", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+		frontend, _ := connect(t, srv)
+
+		res := call(t, frontend, &protocol.FunctionCall{Function: 1000})
+		require.IsType(t, &pgproto3.ErrorResponse{}, res)
+		require.Equal(t, "0A000", res.(*pgproto3.ErrorResponse).Code)
+	})
+}
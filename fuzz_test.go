@@ -0,0 +1,28 @@
+//go:build go1.18
+// +build go1.18
+
+package pgsrv
+
+import (
+	"testing"
+)
+
+// FuzzExtractPassword feeds arbitrary password messages, expecting them to
+// either succeed or fail with a protocol violation
+func FuzzExtractPassword(f *testing.F) {
+	f.Add([]byte{'p', 0, 0, 0, 11, 's', 'e', 'c', 'r', 'e', 't', 0})
+	f.Add([]byte{'p', 0, 0, 0, 4})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		password, err := extractPassword(data)
+		if err != nil {
+			if code := fromErr(err).C; code != "08P01" {
+				t.Fatalf("expected a protocol violation, got %s: %v", code, err)
+			}
+			return
+		}
+		if len(password) > len(data) {
+			t.Fatalf("password longer than the message: %q", password)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package pgsrv
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of the backend messages")
+
+// formatBackendStream formats the bytes written by the backend as a line per
+// message, of its name followed by all of its bytes in hex, including its type
+// and length.
+func formatBackendStream(b []byte) string {
+	var buf strings.Builder
+	for len(b) > 0 {
+		if len(b) < 5 {
+			fmt.Fprintf(&buf, "incomplete %s\n", hex.EncodeToString(b))
+			break
+		}
+
+		size := int(binary.BigEndian.Uint32(b[1:5])) + 1
+		if size < 5 || size > len(b) {
+			fmt.Fprintf(&buf, "malformed %s\n", hex.EncodeToString(b))
+			break
+		}
+		fmt.Fprintf(&buf, "%s %s\n", protocol.BackendMessageName(b[0]), hex.EncodeToString(b[:size]))
+		b = b[size:]
+	}
+	return buf.String()
+}
+
+// TestGolden drives complete sessions over Pipe, and compares the exact bytes
+// written by the backend to the golden files in testdata/golden. Run with
+// -update to record them again.
+func TestGolden(t *testing.T) {
+	defer func(f func() (int32, int32), r io.Reader) {
+		newCancelKey, RandSource = f, r
+	}(newCancelKey, RandSource)
+
+	// startUp sends the startup message of alice
+	startUp := func(t *testing.T, frontend *pgproto3.Frontend) {
+		require.NoError(t, frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "alice", "application_name": "golden"},
+		}))
+	}
+
+	// untilReady reads the messages up to ReadyForQuery
+	untilReady := func(t *testing.T, frontend *pgproto3.Frontend) {
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				return
+			}
+		}
+	}
+
+	// md5Password responds to the md5 challenge of alice like psql
+	md5Password := func(t *testing.T, frontend *pgproto3.Frontend, pass string) {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		auth := msg.(*pgproto3.Authentication)
+		require.Equal(t, uint32(pgproto3.AuthTypeMD5Password), auth.Type)
+
+		digest := md5.Sum([]byte(pass + "alice"))
+		password := string(hashWithSalt(digest[:], auth.Salt[:]))
+		require.NoError(t, frontend.Send(&pgproto3.PasswordMessage{Password: password}))
+	}
+
+	md5Server := New(&passwordQueryer{PasswordProvider: MD5Passwords(map[string]string{"alice": "secret"})})
+	tests := []struct {
+		name string
+		srv  Server
+
+		// run drives the session, which is then terminated
+		run func(t *testing.T, frontend *pgproto3.Frontend)
+	}{
+		{"trust", New(&mockQueryer{}), func(t *testing.T, frontend *pgproto3.Frontend) {
+			startUp(t, frontend)
+			untilReady(t, frontend)
+			sendQuery(t, frontend, "SELECT 1")
+			untilReady(t, frontend)
+		}},
+		{"md5", md5Server, func(t *testing.T, frontend *pgproto3.Frontend) {
+			startUp(t, frontend)
+			md5Password(t, frontend, "secret")
+			untilReady(t, frontend)
+			sendQuery(t, frontend, "SELECT 1")
+			untilReady(t, frontend)
+		}},
+		{"md5_failure", md5Server, func(t *testing.T, frontend *pgproto3.Frontend) {
+			startUp(t, frontend)
+			md5Password(t, frontend, "wrong")
+		}},
+		{"error_response", New(&failingQueryer{UndefinedTable("missing")}), func(t *testing.T, frontend *pgproto3.Frontend) {
+			startUp(t, frontend)
+			untilReady(t, frontend)
+			sendQuery(t, frontend, "SELECT * FROM missing")
+			untilReady(t, frontend)
+		}},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// a distinct pid for every session, as the previous ones may
+			// still be registered
+			pid := int32(1000 + i)
+			newCancelKey = func() (int32, int32) { return pid, 42 }
+			RandSource = bytes.NewReader([]byte{1, 2, 3, 4})
+
+			conn := Pipe(test.srv)
+			defer conn.Close()
+
+			// all of the bytes read by the frontend are recorded, up to the end
+			// of the session
+			var recorded bytes.Buffer
+			r := io.TeeReader(conn, &recorded)
+			frontend, err := pgproto3.NewFrontend(r, conn)
+			require.NoError(t, err)
+
+			// the session may have ended already, like after a failure, in
+			// which case the Terminate isn't read
+			test.run(t, frontend)
+			go conn.Write((&pgproto3.Terminate{}).Encode(nil))
+			_, err = ioutil.ReadAll(r)
+			require.NoError(t, err)
+
+			actual := formatBackendStream(recorded.Bytes())
+			path := filepath.Join("testdata", "golden", test.name+".golden")
+			if *updateGolden {
+				require.NoError(t, ioutil.WriteFile(path, []byte(actual), 0644))
+			}
+			expected, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			require.Equal(t, string(expected), actual)
+		})
+	}
+}
+
+func TestFormatBackendStream(t *testing.T) {
+	stream := append([]byte{}, protocol.ReadyForQuery...)
+	stream = append(stream, protocol.CommandComplete("SELECT 1")...)
+	require.Equal(t, "ReadyForQuery 5a0000000549\nCommandComplete 430000000d53454c454354203100\n", formatBackendStream(stream))
+
+	// a wrong length breaks the framing of the rest of the stream
+	stream[1] = 0x7f
+	require.Equal(t, "malformed "+hex.EncodeToString(stream)+"\n", formatBackendStream(stream))
+}
@@ -0,0 +1,106 @@
+package pgsrv
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// ListenerOption configures the connections accepted by a listener added with
+// AddListener, overriding the configuration of the server for them
+type ListenerOption func(*listener)
+
+// listener is the configuration of the connections accepted by a listener
+// added with AddListener. Unset fields default to the server's.
+type listener struct {
+	authenticator authenticator
+	tls           *tls.Config
+	tlsSet        bool // the TLS configuration was set, even if to nil
+}
+
+// WithListenerTLS sets the TLS configuration of the connections accepted by
+// the listener, like WithTLSConfig. A nil config disables TLS, like for a
+// unix socket of a server that requires TLS over the network. Client
+// certificates are verified like the rest of the server's connections.
+func WithListenerTLS(config *tls.Config) ListenerOption {
+	return func(l *listener) {
+		l.tls = config
+		l.tlsSet = true
+	}
+}
+
+// WithListenerTrust accepts the connections of the listener without a
+// password, like the trust method of pg_hba.conf, regardless of how the rest
+// of the server's connections are authenticated. It's suitable for local
+// connections, like over a unix socket.
+func WithListenerTrust() ListenerOption {
+	return func(l *listener) {
+		l.authenticator = &noPasswordAuthenticator{}
+	}
+}
+
+// WithListenerPasswords authenticates the connections of the listener with
+// the passwords of the provider, in the method of its Type, regardless of how
+// the rest of the server's connections are authenticated.
+func WithListenerPasswords(pp PasswordProvider) ListenerOption {
+	return func(l *listener) {
+		l.authenticator = passwordAuthenticator(pp)
+	}
+}
+
+func (s *server) AddListener(ln net.Listener, opts ...ListenerOption) {
+	l := &listener{}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+
+	if s.closed {
+		ln.Close()
+		return
+	}
+	if s.listenersCtx == nil {
+		s.listenersCtx, s.stopListeners = context.WithCancel(context.Background())
+	}
+
+	ctx := s.listenersCtx
+	s.listeners.Add(1)
+	go func() {
+		defer s.listeners.Done()
+		err := s.serveContext(ctx, ln, l)
+		if err != nil && s.logger != nil {
+			s.logger.Printf("pgsrv: listener %s failed: %v", ln.Addr(), err)
+		}
+	}()
+}
+
+func (s *server) Shutdown() {
+	s.listenersMu.Lock()
+	s.closed = true
+	if s.stopListeners != nil {
+		s.stopListeners()
+	}
+	s.listenersMu.Unlock()
+
+	s.listeners.Wait()
+}
+
+// authenticator returns the authenticator of the session's connection, which
+// may be specific to the listener that accepted it
+func (s *session) authenticator() authenticator {
+	if s.listener != nil && s.listener.authenticator != nil {
+		return s.listener.authenticator
+	}
+	return s.Server.authenticator
+}
+
+// tlsConfig returns the TLS configuration of the session's connection, which
+// may be specific to the listener that accepted it
+func (s *session) tlsConfig() *tls.Config {
+	if s.listener != nil && s.listener.tlsSet {
+		return s.Server.clientTLSConfig(s.listener.tls)
+	}
+	return s.Server.tlsConfig()
+}
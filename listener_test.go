@@ -0,0 +1,92 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestServer_AddListener(t *testing.T) {
+	listen := func(t *testing.T) net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		return ln
+	}
+
+	// startUp sends the startup message over a new connection to the listener
+	// and returns the first response
+	startUp := func(t *testing.T, ln net.Listener) (*pgproto3.Frontend, pgproto3.BackendMessage) {
+		conn, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+		require.NoError(t, err)
+		frontend, err := pgproto3.NewFrontend(conn, conn)
+		require.NoError(t, err)
+
+		err = frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres"},
+		})
+		require.NoError(t, err)
+
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		return frontend, msg
+	}
+
+	pp := &md5ConstantPasswordProvider{password: []byte("secret")}
+
+	t.Run("authenticates per listener", func(t *testing.T) {
+		srv := New(&passwordQueryer{PasswordProvider: pp})
+		defer srv.Shutdown()
+
+		network, local := listen(t), listen(t)
+		srv.AddListener(network)
+		srv.AddListener(local, WithListenerTrust())
+
+		_, msg := startUp(t, network)
+		require.IsType(t, &pgproto3.Authentication{}, msg)
+		require.Equal(t, uint32(pgproto3.AuthTypeMD5Password), msg.(*pgproto3.Authentication).Type)
+
+		_, msg = startUp(t, local)
+		require.Equal(t, &pgproto3.Authentication{Type: pgproto3.AuthTypeOk}, msg)
+	})
+
+	t.Run("overrides the passwords", func(t *testing.T) {
+		srv := New(&mockQueryer{})
+		defer srv.Shutdown()
+
+		ln := listen(t)
+		srv.AddListener(ln, WithListenerPasswords(pp))
+
+		_, msg := startUp(t, ln)
+		require.Equal(t, uint32(pgproto3.AuthTypeMD5Password), msg.(*pgproto3.Authentication).Type)
+	})
+
+	t.Run("shutdown drains all listeners", func(t *testing.T) {
+		srv := New(&mockQueryer{})
+		first, second := listen(t), listen(t)
+		srv.AddListener(first)
+		srv.AddListener(second, WithListenerTLS(nil))
+
+		frontends := []*pgproto3.Frontend{dialFrontend(t, first), dialFrontend(t, second)}
+		srv.Shutdown()
+
+		for _, frontend := range frontends {
+			expectShutdown(t, frontend)
+		}
+		for _, ln := range []net.Listener{first, second} {
+			_, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+			require.Error(t, err, "expected the listener to be closed")
+		}
+	})
+
+	t.Run("after shutdown", func(t *testing.T) {
+		srv := New(&mockQueryer{})
+		srv.Shutdown()
+
+		ln := listen(t)
+		srv.AddListener(ln)
+		_, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+		require.Error(t, err, "expected the listener to be closed")
+	})
+}
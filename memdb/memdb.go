@@ -0,0 +1,240 @@
+// Package memdb is a trivial in-memory backend for pgsrv, meant only for
+// examples and tests. It isn't a SQL engine: it answers SELECTs of literal
+// lists, like SELECT 1, 'foo', VALUES lists, and SELECTs of the columns of its
+// static tables, like SELECT * FROM users. That's enough for connecting with
+// psql and running basic queries, and for exercising the full protocol path of
+// the server in integration tests:
+//
+//	srv := pgsrv.New(memdb.New())
+//	srv.ServeListener(l)
+//
+// The rest of the statements are rejected as unsupported.
+package memdb
+
+import (
+	"context"
+	"database/sql/driver"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DB is an in-memory database of static tables. It implements pgsrv.Queryer.
+type DB struct {
+	mu     sync.RWMutex
+	tables map[string]*table
+}
+
+type table struct {
+	columns []pgsrv.ColumnDesc
+	rows    [][]interface{}
+}
+
+// New returns a database with a single static table, users, of the columns
+// id, name and email
+func New() *DB {
+	db := &DB{tables: map[string]*table{}}
+	db.CreateTable("users", []pgsrv.ColumnDesc{
+		{Name: "id", TypeName: "INT4"},
+		{Name: "name", TypeName: "TEXT"},
+		{Name: "email", TypeName: "TEXT"},
+	}, [][]interface{}{
+		{int32(1), "alice", "alice@example.com"},
+		{int32(2), "bob", "bob@example.com"},
+		{int32(3), "carol", "carol@example.com"},
+	})
+	return db
+}
+
+// CreateTable adds a static table of the rows, with a value per column in each
+// of the rows, replacing the existing table of the same name
+func (db *DB) CreateTable(name string, columns []pgsrv.ColumnDesc, rows [][]interface{}) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.tables[strings.ToLower(name)] = &table{columns: columns, rows: rows}
+}
+
+// Query implements pgsrv.Queryer
+func (db *DB) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	stmt, ok := n.(nodes.SelectStmt)
+	if !ok {
+		return nil, pgsrv.Unsupported("statement")
+	}
+	if stmt.WithClause != nil || stmt.WhereClause != nil {
+		return nil, pgsrv.Unsupported("query")
+	}
+
+	if len(stmt.ValuesLists) > 0 {
+		return values(stmt.ValuesLists)
+	}
+
+	switch len(stmt.FromClause.Items) {
+	case 0:
+		return db.selectFrom(nil, stmt.TargetList.Items)
+	case 1:
+		rv, ok := stmt.FromClause.Items[0].(nodes.RangeVar)
+		if !ok || rv.Relname == nil {
+			return nil, pgsrv.Unsupported("FROM clause")
+		}
+		if rv.Schemaname != nil && *rv.Schemaname != "public" {
+			return nil, pgsrv.UndefinedTable(*rv.Schemaname + "." + *rv.Relname)
+		}
+
+		db.mu.RLock()
+		t, ok := db.tables[*rv.Relname]
+		db.mu.RUnlock()
+		if !ok {
+			return nil, pgsrv.UndefinedTable(*rv.Relname)
+		}
+		return db.selectFrom(t, stmt.TargetList.Items)
+	}
+	return nil, pgsrv.Unsupported("joins")
+}
+
+// selectFrom returns the targets of every row of the table, or a single row of
+// the literal targets when there's no table
+func (db *DB) selectFrom(t *table, targets []nodes.Node) (driver.Rows, error) {
+	if t == nil {
+		t = &table{rows: [][]interface{}{nil}}
+	}
+
+	// every target is either a literal, or the index of a column of the
+	// table, in place of the literal
+	var columns []pgsrv.ColumnDesc
+	var indexes []int
+	var literals []interface{}
+	for _, target := range targets {
+		res, ok := target.(nodes.ResTarget)
+		if !ok {
+			return nil, pgsrv.Unsupported("target")
+		}
+
+		switch v := res.Val.(type) {
+		case nodes.ColumnRef:
+			name, star := columnName(v)
+			if star {
+				for i, col := range t.columns {
+					columns = append(columns, col)
+					indexes = append(indexes, i)
+					literals = append(literals, nil)
+				}
+				continue
+			}
+
+			i := columnIndex(t.columns, name)
+			if i < 0 {
+				return nil, pgsrv.UndefinedColumn(name)
+			}
+			col := t.columns[i]
+			if res.Name != nil {
+				col.Name = *res.Name
+			}
+			columns = append(columns, col)
+			indexes = append(indexes, i)
+			literals = append(literals, nil)
+		default:
+			v, typ, err := literal(res.Val)
+			if err != nil {
+				return nil, err
+			}
+
+			// postgres names the columns of expressions ?column?
+			col := pgsrv.ColumnDesc{Name: "?column?", TypeName: typ}
+			if res.Name != nil {
+				col.Name = *res.Name
+			}
+			columns = append(columns, col)
+			indexes = append(indexes, -1)
+			literals = append(literals, v)
+		}
+	}
+
+	rows := make([][]interface{}, len(t.rows))
+	for i, row := range t.rows {
+		rows[i] = make([]interface{}, len(columns))
+		for j, index := range indexes {
+			if index < 0 {
+				rows[i][j] = literals[j]
+			} else {
+				rows[i][j] = row[index]
+			}
+		}
+	}
+	return pgsrv.RowsFromValues(columns, rows), nil
+}
+
+// values returns the rows of a VALUES list, with columns named column1,
+// column2, etc. and typed by the values of the first row
+func values(lists [][]nodes.Node) (driver.Rows, error) {
+	var columns []pgsrv.ColumnDesc
+	rows := make([][]interface{}, len(lists))
+	for i, list := range lists {
+		if i > 0 && len(list) != len(columns) {
+			return nil, pgsrv.SyntaxError("VALUES lists must all be the same length")
+		}
+
+		rows[i] = make([]interface{}, len(list))
+		for j, n := range list {
+			v, typ, err := literal(n)
+			if err != nil {
+				return nil, err
+			}
+			rows[i][j] = v
+			if i == 0 {
+				name := "column" + strconv.Itoa(j+1)
+				columns = append(columns, pgsrv.ColumnDesc{Name: name, TypeName: typ})
+			}
+		}
+	}
+	return pgsrv.RowsFromValues(columns, rows), nil
+}
+
+// literal returns the value of a constant, along with the name of its type
+func literal(n nodes.Node) (interface{}, string, error) {
+	c, ok := n.(nodes.A_Const)
+	if !ok {
+		return nil, "", pgsrv.Unsupported("expressions other than literals")
+	}
+
+	switch v := c.Val.(type) {
+	case nodes.Integer:
+		if v.Ival < math.MinInt32 || v.Ival > math.MaxInt32 {
+			return v.Ival, "INT8", nil
+		}
+		return int32(v.Ival), "INT4", nil
+	case nodes.Float:
+		return v.Str, "NUMERIC", nil
+	case nodes.String:
+		return v.Str, "TEXT", nil
+	}
+	return nil, "", pgsrv.Unsupported("literal")
+}
+
+// columnName returns the name of the referenced column, without the table
+// name qualifying it, or whether it's a *
+func columnName(ref nodes.ColumnRef) (string, bool) {
+	if len(ref.Fields.Items) == 0 {
+		return "", false
+	}
+	switch v := ref.Fields.Items[len(ref.Fields.Items)-1].(type) {
+	case nodes.A_Star:
+		return "", true
+	case nodes.String:
+		return v.Str, false
+	}
+	return "", false
+}
+
+// columnIndex returns the index of the named column, or -1 when there's no
+// such column
+func columnIndex(columns []pgsrv.ColumnDesc, name string) int {
+	for i, col := range columns {
+		if strings.EqualFold(col.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
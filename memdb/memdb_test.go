@@ -0,0 +1,179 @@
+package memdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	pg_query "github.com/lfittl/pg_query_go"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+// query parses the sql and runs it against the database
+func query(t *testing.T, db *DB, sql string) (driver.Rows, error) {
+	tree, err := pg_query.Parse(sql)
+	require.NoError(t, err)
+	require.Len(t, tree.Statements, 1)
+	return db.Query(context.Background(), tree.Statements[0].(nodes.RawStmt).Stmt)
+}
+
+// readAll reads the names and types of the columns, and all of the rows
+func readAll(t *testing.T, rows driver.Rows) ([]string, []string, [][]driver.Value) {
+	cols := rows.Columns()
+	types := make([]string, len(cols))
+	for i := range types {
+		types[i] = rows.(driver.RowsColumnTypeDatabaseTypeName).ColumnTypeDatabaseTypeName(i)
+	}
+
+	var res [][]driver.Value
+	for {
+		row := make([]driver.Value, len(cols))
+		err := rows.Next(row)
+		if err == io.EOF {
+			return cols, types, res
+		}
+		require.NoError(t, err)
+		res = append(res, row)
+	}
+}
+
+func TestDB_Query(t *testing.T) {
+	db := New()
+
+	t.Run("literals", func(t *testing.T) {
+		rows, err := query(t, db, "SELECT 1, 'foo' AS name, 1.5")
+		require.NoError(t, err)
+		cols, types, res := readAll(t, rows)
+		require.Equal(t, []string{"?column?", "name", "?column?"}, cols)
+		require.Equal(t, []string{"INT4", "TEXT", "NUMERIC"}, types)
+		require.Equal(t, [][]driver.Value{{int32(1), "foo", "1.5"}}, res)
+	})
+
+	t.Run("values", func(t *testing.T) {
+		rows, err := query(t, db, "VALUES (1, 'a'), (2, 'b')")
+		require.NoError(t, err)
+		cols, _, res := readAll(t, rows)
+		require.Equal(t, []string{"column1", "column2"}, cols)
+		require.Equal(t, [][]driver.Value{{int32(1), "a"}, {int32(2), "b"}}, res)
+	})
+
+	t.Run("table", func(t *testing.T) {
+		rows, err := query(t, db, "SELECT * FROM users")
+		require.NoError(t, err)
+		cols, types, res := readAll(t, rows)
+		require.Equal(t, []string{"id", "name", "email"}, cols)
+		require.Equal(t, []string{"INT4", "TEXT", "TEXT"}, types)
+		require.Len(t, res, 3)
+		require.Equal(t, []driver.Value{int32(1), "alice", "alice@example.com"}, res[0])
+	})
+
+	t.Run("columns", func(t *testing.T) {
+		rows, err := query(t, db, "SELECT name, id AS user_id, 'x' FROM public.users")
+		require.NoError(t, err)
+		cols, _, res := readAll(t, rows)
+		require.Equal(t, []string{"name", "user_id", "?column?"}, cols)
+		require.Equal(t, []driver.Value{"bob", int32(2), "x"}, res[1])
+	})
+
+	t.Run("created table", func(t *testing.T) {
+		db := New()
+		db.CreateTable("Pets", []pgsrv.ColumnDesc{{Name: "name", TypeName: "TEXT"}}, [][]interface{}{{"rex"}})
+		rows, err := query(t, db, "SELECT name FROM pets")
+		require.NoError(t, err)
+		_, _, res := readAll(t, rows)
+		require.Equal(t, [][]driver.Value{{"rex"}}, res)
+	})
+
+	errors := []struct {
+		sql  string
+		code string
+	}{
+		{"SELECT * FROM missing", "42P01"},
+		{"SELECT * FROM other.users", "42P01"},
+		{"SELECT missing FROM users", "42703"},
+		{"SELECT * FROM users WHERE id = 1", "0A000"},
+		{"INSERT INTO users VALUES (4)", "0A000"},
+	}
+	for _, test := range errors {
+		t.Run(test.sql, func(t *testing.T) {
+			_, err := query(t, db, test.sql)
+			require.Error(t, err)
+			require.Equal(t, test.code, err.(interface{ Code() string }).Code())
+		})
+	}
+}
+
+// TestDB_protocol runs queries through the full protocol path of the server
+func TestDB_protocol(t *testing.T) {
+	conn := pgsrv.Pipe(pgsrv.New(New()))
+	defer conn.Close()
+
+	frontend, err := pgproto3.NewFrontend(conn, conn)
+	require.NoError(t, err)
+
+	// receive reads the next message, expecting it to be of the same type as
+	// expected
+	receive := func(t *testing.T, expected pgproto3.BackendMessage) pgproto3.BackendMessage {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, expected, msg)
+		return msg
+	}
+
+	err = frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice"},
+	})
+	require.NoError(t, err)
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+
+	t.Run("simple query", func(t *testing.T) {
+		require.NoError(t, frontend.Send(&pgproto3.Query{String: "SELECT name FROM users"}))
+		desc := receive(t, &pgproto3.RowDescription{}).(*pgproto3.RowDescription)
+		require.Equal(t, "name", desc.Fields[0].Name)
+		for _, name := range []string{"alice", "bob", "carol"} {
+			row := receive(t, &pgproto3.DataRow{}).(*pgproto3.DataRow)
+			require.Equal(t, name, string(row.Values[0]))
+		}
+		msg := receive(t, &pgproto3.CommandComplete{})
+		require.Equal(t, "SELECT 3", msg.(*pgproto3.CommandComplete).CommandTag)
+		receive(t, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("extended query", func(t *testing.T) {
+		msgs := []pgproto3.FrontendMessage{
+			&pgproto3.Parse{Query: "SELECT 42 AS answer"},
+			&pgproto3.Bind{},
+			&pgproto3.Describe{ObjectType: 'P'},
+			&pgproto3.Execute{},
+			&pgproto3.Sync{},
+		}
+		for _, msg := range msgs {
+			require.NoError(t, frontend.Send(msg))
+		}
+		receive(t, &pgproto3.ParseComplete{})
+		receive(t, &pgproto3.BindComplete{})
+		desc := receive(t, &pgproto3.RowDescription{}).(*pgproto3.RowDescription)
+		require.Equal(t, "answer", desc.Fields[0].Name)
+		row := receive(t, &pgproto3.DataRow{}).(*pgproto3.DataRow)
+		require.Equal(t, "42", string(row.Values[0]))
+		receive(t, &pgproto3.CommandComplete{})
+		receive(t, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("error", func(t *testing.T) {
+		require.NoError(t, frontend.Send(&pgproto3.Query{String: "SELECT * FROM missing"}))
+		msg := receive(t, &pgproto3.ErrorResponse{})
+		require.Equal(t, "42P01", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, &pgproto3.ReadyForQuery{})
+	})
+}
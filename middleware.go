@@ -0,0 +1,45 @@
+package pgsrv
+
+import (
+	"context"
+	"time"
+)
+
+// LoggingMiddleware is a QueryMiddleware that logs every statement, with the
+// PID of its session, the time it took and the error that aborted it, if any.
+// Statements are logged by the sql string of their query, since a query may
+// consist of several statements.
+func LoggingMiddleware(logger Logger) QueryMiddleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(ctx context.Context, stmt Statement) error {
+			start := time.Now()
+			err := next(ctx, stmt)
+
+			var pid int32
+			if sess, ok := ctx.Value(sessionCtxKey).(Session); ok {
+				pid = sess.PID()
+			}
+			if err != nil {
+				logger.Printf("pgsrv: [%d] %q failed after %v: %v", pid, QueryFromContext(ctx), time.Since(start), err)
+			} else {
+				logger.Printf("pgsrv: [%d] %q completed in %v", pid, QueryFromContext(ctx), time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+// ReadOnlyMiddleware is a QueryMiddleware that rejects the statements that may
+// write, like WithReadOnly does for the entire server. It allows enforcing
+// read-only access selectively, e.g. by the user of the session.
+func ReadOnlyMiddleware() QueryMiddleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(ctx context.Context, stmt Statement) error {
+			err := checkReadOnly(stmt)
+			if err != nil {
+				return err
+			}
+			return next(ctx, stmt)
+		}
+	}
+}
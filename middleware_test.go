@@ -0,0 +1,122 @@
+package pgsrv
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+// tracingMiddleware records the calls to the middleware before and after the
+// execution of each statement
+func tracingMiddleware(name string, calls *[]string) QueryMiddleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(ctx context.Context, stmt Statement) error {
+			*calls = append(*calls, name+" before")
+			err := next(ctx, stmt)
+			*calls = append(*calls, name+" after")
+			return err
+		}
+	}
+}
+
+func TestQueryMiddleware(t *testing.T) {
+	t.Run("order", func(t *testing.T) {
+		var calls []string
+		srv := New(&mockQueryer{}, WithQueryMiddleware(tracingMiddleware("a", &calls)),
+			WithQueryMiddleware(tracingMiddleware("b", &calls), tracingMiddleware("c", &calls)))
+		frontend, _ := connect(t, srv.(*server))
+
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		require.Equal(t, []string{"a before", "b before", "c before", "c after", "b after", "a after"}, calls)
+	})
+
+	t.Run("short-circuit", func(t *testing.T) {
+		queryer := &recordingQueryer{}
+		reject := func(next QueryHandler) QueryHandler {
+			return func(ctx context.Context, stmt Statement) error {
+				return InsufficientPrivilege("permission denied")
+			}
+		}
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer, middlewares: []QueryMiddleware{reject}}
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "SELECT 1")
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "42501", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+		require.Empty(t, queryer.nodes)
+	})
+
+	t.Run("modify", func(t *testing.T) {
+		queryer := &recordingQueryer{}
+		rewrite := func(next QueryHandler) QueryHandler {
+			return func(ctx context.Context, stmt Statement) error {
+				stmt.Node = nodes.SelectStmt{WhereClause: nodes.Null{}}
+				return next(ctx, stmt)
+			}
+		}
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer, middlewares: []QueryMiddleware{rewrite}}
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+		require.Equal(t, []nodes.Node{nodes.SelectStmt{WhereClause: nodes.Null{}}}, queryer.nodes)
+	})
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	logger := &mockLogger{}
+	srv := &server{
+		authenticator: &noPasswordAuthenticator{},
+		queryer:       &mockQueryer{},
+		middlewares:   []QueryMiddleware{LoggingMiddleware(logger), ReadOnlyMiddleware()},
+	}
+	frontend, pid := connect(t, srv)
+
+	sendQuery(t, frontend, "SET foo = 'bar'; INSERT INTO t")
+	receive(t, frontend, &pgproto3.CommandComplete{})
+	receive(t, frontend, &pgproto3.ErrorResponse{})
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+	require.Len(t, logger.logs, 2)
+	prefix := fmt.Sprintf("pgsrv: [%d] \"SET foo = 'bar'; INSERT INTO t\" ", pid)
+	require.True(t, strings.HasPrefix(logger.logs[0], prefix+"completed in "), logger.logs[0])
+	require.True(t, strings.HasPrefix(logger.logs[1], prefix+"failed after "), logger.logs[1])
+	require.Contains(t, logger.logs[1], "cannot execute INSERT in a read-only transaction")
+}
+
+func TestReadOnlyMiddleware(t *testing.T) {
+	queryer := &recordingQueryer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer, middlewares: []QueryMiddleware{ReadOnlyMiddleware()}}
+	frontend, _ := connect(t, srv)
+
+	for _, sql := range []string{"SELECT 1", "SHOW foo"} {
+		sendQuery(t, frontend, sql)
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+
+	sendQuery(t, frontend, "PREPARE ins AS INSERT INTO t")
+	receive(t, frontend, &pgproto3.CommandComplete{})
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+	for _, sql := range []string{"INSERT INTO t", "UPDATE t", "EXECUTE ins"} {
+		sendQuery(t, frontend, sql)
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "25006", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+	require.Len(t, queryer.nodes, 2, "expected only the queries to be executed")
+}
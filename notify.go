@@ -0,0 +1,128 @@
+package pgsrv
+
+import (
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"sync"
+)
+
+// limits on notifications, as enforced by postgres
+const (
+	maxChannelNameLen = 63   // NAMEDATALEN - 1
+	maxPayloadLen     = 7999 // NOTIFY_PAYLOAD_MAX_LENGTH - 1
+)
+
+// broker delivers notifications to the sessions listening on their channels.
+// The zero value is ready for use.
+//
+// Notifications are delivered to each listening session at a safe protocol
+// boundary: immediately if the session is idle, waiting for its next query,
+// otherwise right before the ReadyForQuery that concludes the current query
+// cycle. Notifications raised sequentially are delivered to each session in
+// the same order, while the order of concurrently raised notifications is
+// unspecified.
+type broker struct {
+	mu        sync.Mutex
+	listeners map[string]map[*session]bool
+}
+
+func (b *broker) listen(channel string, s *session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.listeners == nil {
+		b.listeners = map[string]map[*session]bool{}
+	}
+	if b.listeners[channel] == nil {
+		b.listeners[channel] = map[*session]bool{}
+	}
+	b.listeners[channel][s] = true
+}
+
+func (b *broker) unlisten(channel string, s *session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.listeners[channel], s)
+	if len(b.listeners[channel]) == 0 {
+		delete(b.listeners, channel)
+	}
+}
+
+// unlistenAll stops the delivery of all notifications to the session
+func (b *broker) unlistenAll(s *session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for channel, sessions := range b.listeners {
+		delete(sessions, s)
+		if len(sessions) == 0 {
+			delete(b.listeners, channel)
+		}
+	}
+}
+
+// notify sends a notification on behalf of the session with the provided pid
+// to all of the sessions listening on the channel
+func (b *broker) notify(pid int32, channel, payload string) error {
+	if channel == "" {
+		return InvalidParameterValue("channel name cannot be empty")
+	}
+	if len(channel) > maxChannelNameLen {
+		return InvalidParameterValue("channel name too long")
+	}
+	if len(payload) > maxPayloadLen {
+		return InvalidParameterValue("payload string too long")
+	}
+
+	// writing to an idle session may block, so it's done without holding the
+	// lock on the listeners.
+	b.mu.Lock()
+	sessions := make([]*session, 0, len(b.listeners[channel]))
+	for s := range b.listeners[channel] {
+		sessions = append(sessions, s)
+	}
+	b.mu.Unlock()
+
+	msg := protocol.NotificationResponse(pid, channel, payload)
+	for _, s := range sessions {
+		// failing to write indicates a broken connection, which is reported
+		// to the session's own query cycle
+		s.transport.WriteAsync(msg)
+	}
+	return nil
+}
+
+// notification handles the LISTEN, UNLISTEN and NOTIFY commands
+func (q *query) notification(sess Session, n nodes.Node) error {
+	s, ok := sess.(*session)
+	// only session implementation is capable of receiving notifications
+	if !ok {
+		return Unsupported("LISTEN/NOTIFY")
+	}
+
+	var tag string
+	switch v := n.(type) {
+	case nodes.ListenStmt:
+		s.Server.broker.listen(*v.Conditionname, s)
+		tag = "LISTEN"
+	case nodes.UnlistenStmt:
+		if v.Conditionname == nil { // UNLISTEN *
+			s.Server.broker.unlistenAll(s)
+		} else {
+			s.Server.broker.unlisten(*v.Conditionname, s)
+		}
+		tag = "UNLISTEN"
+	case nodes.NotifyStmt:
+		payload := ""
+		if v.Payload != nil {
+			payload = *v.Payload
+		}
+		err := s.Notify(*v.Conditionname, payload)
+		if err != nil {
+			return err
+		}
+		tag = "NOTIFY"
+	}
+	return q.transport.Write(protocol.CommandComplete(tag))
+}
@@ -0,0 +1,131 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+)
+
+// connect starts a session served by srv and returns its frontend after the
+// startup is complete, along with the session's pid.
+func connect(t *testing.T, srv *server) (*pgproto3.Frontend, int32) {
+	return connectWith(t, srv, map[string]string{"user": "postgres"})
+}
+
+// connectWith is like connect, with the provided startup parameters
+func connectWith(t *testing.T, srv *server, params map[string]string) (*pgproto3.Frontend, int32) {
+	f, b := net.Pipe()
+	go srv.Serve(b)
+
+	frontend, err := pgproto3.NewFrontend(f, f)
+	require.NoError(t, err)
+
+	err = frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      params,
+	})
+	require.NoError(t, err)
+
+	var pid int32
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		switch v := msg.(type) {
+		case *pgproto3.BackendKeyData:
+			pid = int32(v.ProcessID)
+		case *pgproto3.ReadyForQuery:
+			return frontend, pid
+		}
+	}
+}
+
+// receive reads the next message from the frontend, expecting it to be of the
+// same type as expected.
+func receive(t *testing.T, frontend *pgproto3.Frontend, expected pgproto3.BackendMessage) pgproto3.BackendMessage {
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, expected, msg)
+	return msg
+}
+
+func sendQuery(t *testing.T, frontend *pgproto3.Frontend, sql string) {
+	err := frontend.Send(&pgproto3.Query{String: sql})
+	require.NoError(t, err)
+}
+
+func TestNotify(t *testing.T) {
+	srv := &server{
+		authenticator: &noPasswordAuthenticator{},
+		queryer:       &mockQueryer{},
+	}
+	listener, listenerPid := connect(t, srv)
+	notifier, notifierPid := connect(t, srv)
+
+	sendQuery(t, listener, "LISTEN foo")
+	msg := receive(t, listener, &pgproto3.CommandComplete{})
+	require.Equal(t, "LISTEN", msg.(*pgproto3.CommandComplete).CommandTag)
+	receive(t, listener, &pgproto3.ReadyForQuery{})
+
+	t.Run("delivered to idle sessions", func(t *testing.T) {
+		sendQuery(t, notifier, "NOTIFY foo, 'hello'")
+
+		msg := receive(t, listener, &pgproto3.NotificationResponse{})
+		require.Equal(t, &pgproto3.NotificationResponse{
+			PID:     uint32(notifierPid),
+			Channel: "foo",
+			Payload: "hello",
+		}, msg)
+
+		msg = receive(t, notifier, &pgproto3.CommandComplete{})
+		require.Equal(t, "NOTIFY", msg.(*pgproto3.CommandComplete).CommandTag)
+		receive(t, notifier, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("delivered to the notifying session after the query", func(t *testing.T) {
+		sendQuery(t, listener, "NOTIFY foo")
+
+		receive(t, listener, &pgproto3.CommandComplete{})
+		msg := receive(t, listener, &pgproto3.NotificationResponse{})
+		require.Equal(t, uint32(listenerPid), msg.(*pgproto3.NotificationResponse).PID)
+		receive(t, listener, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("server notification", func(t *testing.T) {
+		go func() {
+			require.NoError(t, srv.Notify("foo", "bar"))
+		}()
+
+		msg := receive(t, listener, &pgproto3.NotificationResponse{})
+		require.Equal(t, &pgproto3.NotificationResponse{
+			PID:     0,
+			Channel: "foo",
+			Payload: "bar",
+		}, msg)
+	})
+
+	t.Run("unlisten", func(t *testing.T) {
+		sendQuery(t, listener, "UNLISTEN *")
+		msg := receive(t, listener, &pgproto3.CommandComplete{})
+		require.Equal(t, "UNLISTEN", msg.(*pgproto3.CommandComplete).CommandTag)
+		receive(t, listener, &pgproto3.ReadyForQuery{})
+
+		require.NoError(t, srv.Notify("foo", "bar"))
+
+		sendQuery(t, listener, "SELECT 1")
+		receive(t, listener, &pgproto3.RowDescription{})
+	})
+
+	t.Run("invalid notifications", func(t *testing.T) {
+		e := srv.Notify("", "")
+		require.EqualError(t, e, "channel name cannot be empty")
+		require.Equal(t, "22023", fromErr(e).C)
+
+		e = srv.Notify(strings.Repeat("a", 64), "")
+		require.EqualError(t, e, "channel name too long")
+
+		e = srv.Notify("foo", strings.Repeat("a", 8000))
+		require.EqualError(t, e, "payload string too long")
+	})
+}
@@ -0,0 +1,361 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgtype"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// the signs of the binary format of numeric
+const (
+	numericPositive = 0x0000
+	numericNegative = 0x4000
+	numericNaN      = 0xC000
+)
+
+// numericRatScale is the number of fraction digits of a *big.Rat value with
+// no exact decimal representation, like 1/3, which is NUMERIC_MIN_SIG_DIGITS
+// in postgres
+const numericRatScale = 16
+
+// numericMaxExponent is the largest exponent of the scientific notation of
+// numeric values, like 1e1000
+const numericMaxExponent = 1000
+
+// decimal is the exact decimal representation of a numeric value, as its
+// integer and fraction digits, without leading zeros in the integer digits
+type decimal struct {
+	neg      bool
+	nan      bool
+	integer  string
+	fraction string
+}
+
+// String returns the text format of the decimal
+func (d decimal) String() string {
+	if d.nan {
+		return "NaN"
+	}
+	s := d.integer
+	if s == "" {
+		s = "0"
+	}
+	if d.neg && strings.Trim(d.integer+d.fraction, "0") != "" {
+		s = "-" + s
+	}
+	if d.fraction != "" {
+		s += "." + d.fraction
+	}
+	return s
+}
+
+// parseDecimal parses the text format of numeric, like -12.340 or 1.5e3, and
+// NaN. The scale of the value is kept, so 1.50 has two fraction digits.
+func parseDecimal(s string) (decimal, error) {
+	s = strings.TrimSpace(s)
+	if strings.EqualFold(s, "NaN") {
+		return decimal{nan: true}, nil
+	}
+
+	var d decimal
+	invalid := fmt.Errorf("invalid input syntax for type numeric: \"%s\"", s)
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		d.neg = s[0] == '-'
+		s = s[1:]
+	}
+
+	exp := 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		var err error
+		exp, err = strconv.Atoi(s[i+1:])
+		if err != nil || exp > numericMaxExponent || exp < -numericMaxExponent {
+			return d, invalid
+		}
+		s = s[:i]
+	}
+
+	d.integer, d.fraction = s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		d.integer, d.fraction = s[:i], s[i+1:]
+	}
+	if d.integer == "" && d.fraction == "" || !isDigits(d.integer) || !isDigits(d.fraction) {
+		return d, invalid
+	}
+
+	// move the decimal point by the exponent
+	digits := d.integer + d.fraction
+	point := len(d.integer) + exp
+	switch {
+	case point < 0:
+		digits = strings.Repeat("0", -point) + digits
+		point = 0
+	case point > len(digits):
+		digits += strings.Repeat("0", point-len(digits))
+	}
+	d.integer, d.fraction = strings.TrimLeft(digits[:point], "0"), digits[point:]
+	return d, nil
+}
+
+// isDigits reports whether s consists of decimal digits only
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// numericDecimal converts the value into its exact decimal representation.
+// Floats are converted with their shortest representation, and a *big.Rat
+// with no exact decimal representation is rounded to numericRatScale digits.
+func numericDecimal(v driver.Value) (decimal, error) {
+	switch v := v.(type) {
+	case string:
+		return parseDecimal(v)
+	case []byte:
+		return parseDecimal(string(v))
+	case int64:
+		return parseDecimal(strconv.FormatInt(v, 10))
+	case int:
+		return parseDecimal(strconv.FormatInt(int64(v), 10))
+	case int32:
+		return parseDecimal(strconv.FormatInt(int64(v), 10))
+	case int16:
+		return parseDecimal(strconv.FormatInt(int64(v), 10))
+	case uint64:
+		return parseDecimal(strconv.FormatUint(v, 10))
+	case uint32:
+		return parseDecimal(strconv.FormatUint(uint64(v), 10))
+	case float64:
+		return floatDecimal(v, 64)
+	case float32:
+		return floatDecimal(float64(v), 32)
+	case *big.Int:
+		return parseDecimal(v.String())
+	case *big.Float:
+		if v.IsInf() {
+			return decimal{}, fmt.Errorf("cannot convert infinity to numeric")
+		}
+		return parseDecimal(v.Text('f', -1))
+	case *big.Rat:
+		return parseDecimal(v.FloatString(ratScale(v)))
+	default:
+		return decimal{}, fmt.Errorf("cannot convert %T to numeric", v)
+	}
+}
+
+// floatDecimal converts the float with its shortest representation
+func floatDecimal(v float64, bitSize int) (decimal, error) {
+	switch {
+	case math.IsNaN(v):
+		return decimal{nan: true}, nil
+	case math.IsInf(v, 0):
+		return decimal{}, fmt.Errorf("cannot convert infinity to numeric")
+	}
+	return parseDecimal(strconv.FormatFloat(v, 'f', -1, bitSize))
+}
+
+// ratScale returns the number of fraction digits of the exact decimal
+// representation of the rational, which exists when its denominator has no
+// prime factors other than 2 and 5, or numericRatScale otherwise
+func ratScale(r *big.Rat) int {
+	denom := new(big.Int).Set(r.Denom())
+	twos, fives := 0, 0
+	for _, f := range []struct {
+		factor int64
+		count  *int
+	}{{2, &twos}, {5, &fives}} {
+		factor, mod := big.NewInt(f.factor), new(big.Int)
+		for {
+			q, m := new(big.Int).QuoRem(denom, factor, mod)
+			if m.Sign() != 0 {
+				break
+			}
+			denom = q
+			*f.count++
+		}
+	}
+	if denom.Cmp(big.NewInt(1)) != 0 {
+		return numericRatScale
+	}
+	if twos > fives {
+		return twos
+	}
+	return fives
+}
+
+// appendBinaryNumeric appends the value in the binary format of numeric: the
+// number of base-10000 digits, the weight of the first digit, the sign and
+// the display scale, followed by the digits, all as 16 bit integers
+func appendBinaryNumeric(buf []byte, v driver.Value) ([]byte, error) {
+	d, err := numericDecimal(v)
+	if err != nil {
+		return nil, err
+	}
+	return d.appendBinary(buf), nil
+}
+
+// appendBinary appends the decimal in the binary format of numeric
+func (d decimal) appendBinary(buf []byte) []byte {
+	if d.nan {
+		return appendUint16s(buf, 0, 0, numericNaN, 0)
+	}
+
+	// pad the integer digits at the start, and the fraction digits at the
+	// end, into groups of 4 decimal digits
+	integer := strings.Repeat("0", (4-len(d.integer)%4)%4) + d.integer
+	fraction := d.fraction + strings.Repeat("0", (4-len(d.fraction)%4)%4)
+	groups := integer + fraction
+	weight := len(integer)/4 - 1
+
+	var digits []uint16
+	for i := 0; i < len(groups); i += 4 {
+		n, _ := strconv.Atoi(groups[i : i+4])
+		digits = append(digits, uint16(n))
+	}
+
+	// strip the leading and trailing zero digits
+	for len(digits) > 0 && digits[0] == 0 {
+		digits = digits[1:]
+		weight--
+	}
+	for len(digits) > 0 && digits[len(digits)-1] == 0 {
+		digits = digits[:len(digits)-1]
+	}
+
+	sign := uint16(numericPositive)
+	if len(digits) == 0 {
+		weight = 0
+	} else if d.neg {
+		sign = numericNegative
+	}
+	buf = appendUint16s(buf, uint16(len(digits)), uint16(weight), sign, uint16(len(d.fraction)))
+	return appendUint16s(buf, digits...)
+}
+
+// appendUint16s appends the integers in big-endian
+func appendUint16s(buf []byte, values ...uint16) []byte {
+	for _, v := range values {
+		buf = append(buf, byte(v>>8), byte(v))
+	}
+	return buf
+}
+
+// decodeBinaryNumeric decodes the binary format of numeric into its exact
+// decimal text, with as many fraction digits as its display scale
+func decodeBinaryNumeric(src []byte) (string, error) {
+	if len(src) < 8 {
+		return "", fmt.Errorf("numeric too short: %d bytes", len(src))
+	}
+	ndigits := int(binary.BigEndian.Uint16(src))
+	weight := int(int16(binary.BigEndian.Uint16(src[2:])))
+	sign := binary.BigEndian.Uint16(src[4:])
+	dscale := int(binary.BigEndian.Uint16(src[6:]))
+	if len(src) != 8+ndigits*2 {
+		return "", fmt.Errorf("invalid numeric length: %d bytes for %d digits", len(src), ndigits)
+	}
+
+	switch sign {
+	case numericNaN:
+		return "NaN", nil
+	case numericPositive, numericNegative:
+	default:
+		return "", fmt.Errorf("invalid numeric sign: 0x%04x", sign)
+	}
+
+	digits := make([]int, ndigits)
+	for i := range digits {
+		digits[i] = int(binary.BigEndian.Uint16(src[8+i*2:]))
+		if digits[i] > 9999 {
+			return "", fmt.Errorf("invalid numeric digit: %d", digits[i])
+		}
+	}
+	// digit returns the base-10000 digit of the weight, counting down from
+	// the weight of the first digit
+	digit := func(w int) int {
+		i := weight - w
+		if i < 0 || i >= ndigits {
+			return 0
+		}
+		return digits[i]
+	}
+
+	var b strings.Builder
+	if sign == numericNegative && ndigits > 0 {
+		b.WriteByte('-')
+	}
+	if weight < 0 {
+		b.WriteByte('0')
+	} else {
+		b.WriteString(strconv.Itoa(digit(weight)))
+		for w := weight - 1; w >= 0; w-- {
+			fmt.Fprintf(&b, "%04d", digit(w))
+		}
+	}
+
+	if dscale > 0 {
+		var fraction strings.Builder
+		for w := -1; fraction.Len() < dscale; w-- {
+			fmt.Fprintf(&fraction, "%04d", digit(w))
+		}
+		b.WriteByte('.')
+		b.WriteString(fraction.String()[:dscale])
+	}
+	return b.String(), nil
+}
+
+// numericValue is the pgtype.Value of numeric bind parameters and COPY
+// columns. It's decoded into its exact decimal text, like 12.340, since there
+// is no decimal type among the types of driver.Value.
+type numericValue struct {
+	text   string
+	status pgtype.Status
+}
+
+func (v *numericValue) Set(src interface{}) error {
+	if src == nil {
+		*v = numericValue{status: pgtype.Null}
+		return nil
+	}
+	d, err := numericDecimal(src)
+	if err != nil {
+		return err
+	}
+	*v = numericValue{text: d.String(), status: pgtype.Present}
+	return nil
+}
+
+func (v *numericValue) Get() interface{} {
+	if v.status != pgtype.Present {
+		return nil
+	}
+	return v.text
+}
+
+func (v *numericValue) AssignTo(dst interface{}) error {
+	p, ok := dst.(*string)
+	if !ok {
+		return fmt.Errorf("cannot assign numeric to %T", dst)
+	}
+	*p = v.text
+	return nil
+}
+
+func (v *numericValue) DecodeText(ci *pgtype.ConnInfo, src []byte) error {
+	return v.Set(src)
+}
+
+func (v *numericValue) DecodeBinary(ci *pgtype.ConnInfo, src []byte) error {
+	text, err := decodeBinaryNumeric(src)
+	if err != nil {
+		return err
+	}
+	*v = numericValue{text: text, status: pgtype.Present}
+	return nil
+}
@@ -0,0 +1,138 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/stretchr/testify/require"
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestBinaryNumeric(t *testing.T) {
+	tests := []struct {
+		value driver.Value
+		text  string // decoded back, with the scale of the value
+	}{
+		{"0", "0"},
+		{"0.000", "0.000"},
+		{"-0", "0"},
+		{"1", "1"},
+		{"-1", "-1"},
+		{"9999", "9999"},
+		{"10000", "10000"},
+		{"123456789", "123456789"},
+		{"-123456789.987654321", "-123456789.987654321"},
+		{"0.0001", "0.0001"},
+		{"-0.00001", "-0.00001"},
+		{"1.50", "1.50"},
+		{"100000000.00000001", "100000000.00000001"},
+		{"0.12345678901234567890123456789", "0.12345678901234567890123456789"},
+		{"-98765432109876543210.0000000000000000000001", "-98765432109876543210.0000000000000000000001"},
+		{"1.5e3", "1500"},
+		{"1.5E-3", "0.0015"},
+		{"+.5", "0.5"},
+		{int64(-42), "-42"},
+		{int64(math.MinInt64), "-9223372036854775808"},
+		{uint64(math.MaxUint64), "18446744073709551615"},
+		{1.25, "1.25"},
+		{float32(-0.5), "-0.5"},
+		{big.NewInt(-1000000000000), "-1000000000000"},
+		{big.NewRat(-1, 8), "-0.125"},
+		{big.NewRat(1, 3), "0.3333333333333333"},
+		{big.NewFloat(2.5), "2.5"},
+	}
+
+	for _, test := range tests {
+		b, err := appendBinaryNumeric(nil, test.value)
+		require.NoError(t, err, "%v", test.value)
+
+		text, err := decodeBinaryNumeric(b)
+		require.NoError(t, err)
+		require.Equal(t, test.text, text, "%v", test.value)
+
+		// pgx decodes the same value
+		var n pgtype.Numeric
+		require.NoError(t, n.DecodeBinary(nil, b), "%v", test.value)
+		expected, ok := new(big.Rat).SetString(test.text)
+		require.True(t, ok)
+		require.Equal(t, 0, numericRat(n).Cmp(expected), "%v: %v * 10^%d", test.value, n.Int, n.Exp)
+
+		// and the value encoded by pgx is decoded back
+		b, err = n.EncodeBinary(nil, nil)
+		require.NoError(t, err)
+		text, err = decodeBinaryNumeric(b)
+		require.NoError(t, err)
+		actual, ok := new(big.Rat).SetString(text)
+		require.True(t, ok, text)
+		require.Equal(t, 0, actual.Cmp(expected), "%v: %s", test.value, text)
+	}
+
+	t.Run("NaN", func(t *testing.T) {
+		for _, v := range []driver.Value{"NaN", math.NaN()} {
+			b, err := appendBinaryNumeric(nil, v)
+			require.NoError(t, err)
+			require.Equal(t, []byte{0, 0, 0, 0, 0xc0, 0, 0, 0}, b)
+
+			text, err := decodeBinaryNumeric(b)
+			require.NoError(t, err)
+			require.Equal(t, "NaN", text)
+		}
+	})
+
+	t.Run("digit groups", func(t *testing.T) {
+		b, err := appendBinaryNumeric(nil, "-12345.678")
+		require.NoError(t, err)
+		require.Equal(t, []byte{
+			0, 3, // digits
+			0, 1, // weight
+			0x40, 0, // negative
+			0, 3, // scale
+			0, 1, 0x09, 0x29, 0x1a, 0x7c, // 1, 2345, 6780
+		}, b)
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		for _, v := range []driver.Value{"", "-", ".", "abc", "1.2.3", "1e", "1e100000", math.Inf(1), true} {
+			_, err := appendBinaryNumeric(nil, v)
+			require.Error(t, err, "%v", v)
+		}
+	})
+
+	t.Run("invalid binary", func(t *testing.T) {
+		for _, b := range [][]byte{
+			{0, 0, 0, 0},
+			{0, 1, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0x12, 0x34, 0, 0},
+			{0, 1, 0, 0, 0, 0, 0, 0, 0x27, 0x10},
+		} {
+			_, err := decodeBinaryNumeric(b)
+			require.Error(t, err, "%v", b)
+		}
+	})
+}
+
+// numericRat returns the rational value of the numeric decoded by pgx
+func numericRat(n pgtype.Numeric) *big.Rat {
+	r := new(big.Rat).SetInt(n.Int)
+	exp := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(n.Exp))), nil))
+	if n.Exp < 0 {
+		return r.Quo(r, exp)
+	}
+	return r.Mul(r, exp)
+}
+
+func abs(n int32) int32 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func TestAppendBinaryBytea(t *testing.T) {
+	for _, b := range [][]byte{{}, {0x00, 0xab, 0xff}, []byte("bytes")} {
+		var bytea pgtype.Bytea
+		require.NoError(t, bytea.DecodeBinary(nil, appendBinaryBytea(nil, b)))
+		require.Equal(t, string(b), string(bytea.Bytes))
+	}
+}
@@ -0,0 +1,475 @@
+package pgsrv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/panoplyio/pgsrv/protocol"
+	"time"
+)
+
+// Option configures optional behavior of a Server created by New.
+type Option func(*server)
+
+// WithReadBufferSize sets the size, in bytes, of the buffer used for reading
+// messages from client connections. Defaults to 8192.
+func WithReadBufferSize(n int) Option {
+	return func(s *server) {
+		s.readBufferSize = n
+	}
+}
+
+// WithWriteBufferSize sets the size, in bytes, of the buffer used for writing
+// messages to client connections. Outgoing messages are accumulated in this
+// buffer and sent to the client at message-group boundaries (end of a query
+// cycle, Sync, Flush) instead of one write per message. Defaults to 8192.
+func WithWriteBufferSize(n int) Option {
+	return func(s *server) {
+		s.writeBufferSize = n
+	}
+}
+
+// WithStreamBatchSize sets the number of rows of a result that are sent to the
+// client at once. The rows are buffered, and flushed every n rows, letting the
+// client process the rows of long, slow results as they're produced, without
+// flushing every single row. The buffer is also flushed whenever it's full (see
+// WithWriteBufferSize), while n <= 0 leaves it to that alone. Defaults to 100.
+func WithStreamBatchSize(n int) Option {
+	return func(s *server) {
+		s.streamBatchSize = n
+	}
+}
+
+// WithMaxQueryLength sets the maximum length, in bytes, of the query text sent
+// by clients, either as a simple query or a prepared statement. Longer queries
+// are rejected before they're parsed. Defaults to 16MB, while n <= 0 disables
+// the limit.
+func WithMaxQueryLength(n int) Option {
+	return func(s *server) {
+		s.maxQueryLength = n
+	}
+}
+
+// WithMaxPreparedStatements limits the number of named prepared statements of
+// each session, created by Parse messages or PREPARE, protecting the memory of
+// long-lived pooled connections from clients that never close them. Creating
+// more fails with a program_limit_exceeded (54000) error, until some of them
+// are closed or deallocated. The unnamed statement isn't counted. By default
+// there's no limit.
+func WithMaxPreparedStatements(n int) Option {
+	return func(s *server) {
+		s.maxPreparedStmts = n
+	}
+}
+
+// WithMaxPortals limits the number of named portals of each session, created
+// by Bind messages, like WithMaxPreparedStatements. Binding more fails with a
+// program_limit_exceeded (54000) error, until some of them are closed or the
+// transaction ends. The unnamed portal isn't counted. By default there's no
+// limit.
+func WithMaxPortals(n int) Option {
+	return func(s *server) {
+		s.maxPortals = n
+	}
+}
+
+// WithQueryTimeout limits the time for executing each statement. The context
+// passed to the Queryer and Execer expires after the timeout, and the
+// statement is canceled with a query_canceled (57014) error. Clients may set a
+// shorter timeout for their session with the statement_timeout variable, but
+// not a longer one. By default there's no timeout.
+func WithQueryTimeout(d time.Duration) Option {
+	return func(s *server) {
+		s.queryTimeout = d
+	}
+}
+
+// WithMaxResultRows limits the number of rows that each query may return to the
+// client, protecting the server from runaway queries, like a SELECT * of a huge
+// table. Once a result exceeds the limit, reading it stops and the query fails
+// with a program_limit_exceeded (54000) error, after the rows up to the limit
+// were already sent, unless WithStrictResultRows is set. By default there's no
+// limit.
+func WithMaxResultRows(n int) Option {
+	return func(s *server) {
+		s.maxResultRows = n
+	}
+}
+
+// WithStrictResultRows fails the results that exceed WithMaxResultRows without
+// sending any of their rows, rather than after sending the rows up to the
+// limit. It holds up to the limit of rows in memory until the result is known
+// to be within the limit.
+func WithStrictResultRows() Option {
+	return func(s *server) {
+		s.strictResultRows = true
+	}
+}
+
+// WithAuthTimeout limits the time for completing the startup of sessions,
+// from the startup message through authentication. Clients that don't complete
+// it in time, like ones that never respond to the password request, are
+// disconnected with a FATAL error, rather than holding on to a session
+// indefinitely. By default there's no timeout.
+func WithAuthTimeout(d time.Duration) Option {
+	return func(s *server) {
+		s.authTimeout = d
+	}
+}
+
+// WithReadTimeout limits the time for every single read from client
+// connections once they're authenticated, like while receiving a message or
+// the data of COPY FROM STDIN, so stalled clients, like slow-loris ones or a
+// stalled TLS renegotiation, can't hold on to a session indefinitely. It's
+// reset after every read, and it doesn't apply while the session waits for the
+// next message of the client, so idle clients aren't affected. Once it
+// expires, the session ends. By default there's no timeout.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *server) {
+		s.readTimeout = d
+	}
+}
+
+// WithWriteTimeout limits the time for every single write to client
+// connections once they're authenticated, like while sending the rows of a
+// result to a client that stopped reading them. It's reset after every write.
+// Once it expires, the statement is aborted and the session ends. By default
+// there's no timeout.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithSlowClientTimeout limits the time for every single write of the results
+// of a statement to client connections, protecting the backend's resources
+// from clients that are slow to read, or stopped reading, large results. Once
+// a write blocks for longer, the context of the statement is canceled, so the
+// backend can stop producing its results, and the session ends. Unlike
+// WithWriteTimeout, it only applies while statements are executed. By default
+// there's no timeout.
+func WithSlowClientTimeout(d time.Duration) Option {
+	return func(s *server) {
+		s.slowClient = d
+	}
+}
+
+// WithParser sets the Parser of the sql strings sent by clients, replacing the
+// default one built on pg_query_go. It's required for builds without cgo.
+func WithParser(parser Parser) Option {
+	return func(s *server) {
+		s.parser = parser
+	}
+}
+
+// WithParseCacheSize caches the parsed statements of up to n distinct sql
+// strings, evicting the least recently used ones, so workloads that send the
+// same sql repeatedly, like many identical INSERTs, parse it once. The cache is
+// keyed on the exact sql string and shared by all of the sessions, and it
+// applies to the Parser set with WithParser as well. Parsers whose results
+// depend on anything other than the sql string shouldn't be cached. By
+// default nothing is cached.
+func WithParseCacheSize(n int) Option {
+	return func(s *server) {
+		s.parseCacheSize = n
+	}
+}
+
+// WithRawSQLMode passes the sql strings of simple queries, as sent by clients,
+// to the backend without parsing them, when the Queryer implements RawQueryer.
+// It's useful for backends that parse the sql by themselves, possibly in a
+// different dialect. Otherwise, the sql is parsed and executed as usual.
+func WithRawSQLMode() Option {
+	return func(s *server) {
+		s.rawSQL = true
+	}
+}
+
+// WithFunctionCaller sets the FunctionCaller of the fast-path FunctionCall
+// messages sent by clients. Without it, function calls are rejected with a
+// feature_not_supported (0A000) error.
+func WithFunctionCaller(caller FunctionCaller) Option {
+	return func(s *server) {
+		s.functionCaller = caller
+	}
+}
+
+// WithServerVersion sets the postgres version reported to clients in the
+// server_version parameter, along with its numeric form in server_version_num.
+// Some clients enable features only for specific versions, so this allows
+// masquerading as the version that the backend is compatible with. Defaults to
+// 10.5.
+func WithServerVersion(version string) Option {
+	return func(s *server) {
+		s.serverVersion = version
+	}
+}
+
+// WithParameterStatus sets additional parameters reported to clients at
+// startup in ParameterStatus messages, following the standard ones, like
+// "pgsrv.product" identifying the product built on the server. Clients ignore
+// the parameters they don't know. The standard parameters, like
+// server_version, can't be replaced or removed this way. Multiple calls add
+// to the previous parameters.
+func WithParameterStatus(params map[string]string) Option {
+	return func(s *server) {
+		if s.parameterStatus == nil {
+			s.parameterStatus = map[string]string{}
+		}
+		for k, v := range params {
+			s.parameterStatus[k] = v
+		}
+	}
+}
+
+// WithTCPKeepAlive enables TCP keepalive on client connections, probing the
+// client every d once the connection is idle. It detects half-open
+// connections, like after a network partition, when the client disappears
+// without sending Terminate, and ends their sessions as soon as the probes
+// fail rather than keeping them indefinitely. It doesn't affect idle clients
+// that are still reachable. A negative d disables keepalive, while zero, the
+// default, leaves the system's defaults. It has no effect on connections other
+// than TCP, like unix sockets.
+func WithTCPKeepAlive(d time.Duration) Option {
+	return func(s *server) {
+		s.tcpKeepAlive = d
+	}
+}
+
+// WithDatabaseRouter binds each session to the Queryer returned by the router
+// for the database requested by the client at startup, allowing a single
+// server to serve multiple logical databases. Sessions requesting a database
+// for which the router returns nil are rejected. When unset, all sessions are
+// served by the Queryer provided to New.
+func WithDatabaseRouter(router DatabaseRouter) Option {
+	return func(s *server) {
+		s.router = router
+	}
+}
+
+// WithConnFilter sets a filter for all incoming connections, which is called
+// as soon as the connection is served, before any of the protocol messages are
+// exchanged. Rejected connections are closed immediately. See AllowCIDRs for a
+// filter of the client networks.
+func WithConnFilter(filter ConnFilter) Option {
+	return func(s *server) {
+		s.connFilter = filter
+	}
+}
+
+// WithBaseContext sets the function that returns the root context of each
+// session from its connection, propagating its values, and its cancellation,
+// to the contexts passed to the backend for all of the session's queries. By
+// default the root context is context.Background().
+func WithBaseContext(baseContext BaseContext) Option {
+	return func(s *server) {
+		s.baseContext = baseContext
+	}
+}
+
+// WithConnWrapper sets a wrapper for all incoming connections, which is called
+// as soon as the connection is served, even before the ConnFilter. When
+// WithAuthTimeout is set, it also limits the time for the wrapper to read
+// from the connection.
+func WithConnWrapper(wrapper ConnWrapper) Option {
+	return func(s *server) {
+		s.connWrapper = wrapper
+	}
+}
+
+// WithTLSConfig enables TLS for the clients that request it with an
+// SSLRequest, like clients connecting with sslmode=require. The config must
+// provide the server's certificate. By default, SSLRequests are declined and
+// clients proceed unencrypted, if they allow it.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *server) {
+		s.tls = config
+	}
+}
+
+// WithRequireTLS rejects the clients that don't connect with TLS (see
+// WithTLSConfig), like clients connecting with sslmode=disable, or ones that
+// proceed unencrypted once their SSLRequest is declined, with an
+// invalid_authorization_specification (28000) error before they're
+// authenticated, like hostssl entries in pg_hba.conf. Connections over unix
+// sockets, where clients don't request TLS, are exempt, like in postgres.
+func WithRequireTLS() Option {
+	return func(s *server) {
+		s.requireTLS = true
+	}
+}
+
+// WithClientCertificates requires the clients connecting with TLS (see
+// WithTLSConfig) to present a certificate signed by one of the provided CAs.
+// Clients that don't present a valid certificate are rejected during the TLS
+// handshake.
+func WithClientCertificates(cas *x509.CertPool) Option {
+	return func(s *server) {
+		s.clientCAs = cas
+	}
+}
+
+// WithClientCertUser requires the clients to present a certificate for the
+// user they connect as, either in the certificate's common name or in one of
+// its DNS names, like the verify-full mode of clientcert in pg_hba.conf.
+// Clients that don't are rejected with an invalid_authorization_specification
+// (28000) error before they're authenticated. It's meant to be used along with
+// WithClientCertificates, which verifies the certificates themselves.
+func WithClientCertUser() Option {
+	return func(s *server) {
+		s.verifyCertUser = true
+	}
+}
+
+// WithStartupValidator sets a validator for the parameters of all incoming
+// connections, which is called before authenticating the client. This allows
+// enforcing connection policies, like requiring an application_name. The
+// parameters set in the startup "options" (like "-c tenant=foo") are
+// available as individual arguments.
+func WithStartupValidator(validator StartupValidator) Option {
+	return func(s *server) {
+		s.startupValidator = validator
+	}
+}
+
+// WithErrorMapper sets a mapper for translating the errors returned by the
+// backend into postgres errors, e.g. reporting a unique constraint violation
+// with the 23505 SQLSTATE that clients expect.
+func WithErrorMapper(mapper ErrorMapper) Option {
+	return func(s *server) {
+		s.errorMapper = mapper
+	}
+}
+
+// WithMessageLocalizer sets a localizer for translating the messages of the
+// errors generated by the server, like authentication failures and protocol
+// violations, to the locale requested by the client with lc_messages. Their
+// SQLSTATE codes aren't affected. By default they're reported in English.
+func WithMessageLocalizer(localizer MessageLocalizer) Option {
+	return func(s *server) {
+		s.localizer = localizer
+	}
+}
+
+// WithReadOnly rejects the statements that may write, like INSERT, UPDATE,
+// DELETE, COPY FROM and DDL, with a read_only_sql_transaction (25006) error,
+// before they reach the Execer. Queries, read-only commands like COPY TO and
+// the statements handled by the server, like SET and SHOW, are allowed.
+// Commands that aren't known to the server are rejected as well.
+func WithReadOnly() Option {
+	return func(s *server) {
+		s.readOnly = true
+	}
+}
+
+// WithQueryMiddleware adds middlewares wrapping the execution of every parsed
+// statement, including the prepared statements run by EXECUTE. The first
+// middleware is the outermost, so it's called first. Middlewares don't apply
+// in raw sql mode, where the statements aren't parsed. See QueryMiddleware.
+func WithQueryMiddleware(middlewares ...QueryMiddleware) Option {
+	return func(s *server) {
+		s.middlewares = append(s.middlewares, middlewares...)
+	}
+}
+
+// WithASTRewriter sets the ASTRewriter transforming every parsed statement,
+// including the prepared statements run by EXECUTE, before the middlewares
+// and the backend are called with it. The rewritten node is passed on to the
+// backend as is, keeping the kind of the original statement, while
+// ASTFromContext still returns the statements as parsed. Since parsed nodes
+// may be shared by the sessions (see WithParseCacheSize), the rewriter must
+// return a modified copy rather than modify the node in place. Rewriting
+// doesn't apply in raw sql mode, where the statements aren't parsed.
+func WithASTRewriter(rewriter ASTRewriter) Option {
+	return func(s *server) {
+		s.rewriter = rewriter
+	}
+}
+
+// WithParseNotice sets the ParseNotice hook inspecting the parsed statements
+// of every sql string, whose notices are sent to the client before the
+// statements are executed, as a lightweight channel for linting and advice.
+// The notices are sent even if the statements fail later on. The hook doesn't
+// apply in raw sql mode, where the statements aren't parsed.
+func WithParseNotice(notice ParseNotice) Option {
+	return func(s *server) {
+		s.parseNotice = notice
+	}
+}
+
+// WithCompressors enables the compression of the connections of clients that
+// request it with the _pq_.server_compression protocol extension, using the
+// first of the requested algorithms that's provided. See Compressor. By
+// default, connections aren't compressed.
+func WithCompressors(compressors ...Compressor) Option {
+	return func(s *server) {
+		s.compressors = compressors
+	}
+}
+
+// WithOnConnect sets a hook called for every session once the client is
+// authenticated. See OnConnectHook.
+func WithOnConnect(hook OnConnectHook) Option {
+	return func(s *server) {
+		s.onConnect = hook
+	}
+}
+
+// WithOnDisconnect sets a hook called for every session when it ends. See
+// OnDisconnectHook.
+func WithOnDisconnect(hook OnDisconnectHook) Option {
+	return func(s *server) {
+		s.onDisconnect = hook
+	}
+}
+
+// WithTracer sets a Tracer to observe all of the messages exchanged with
+// clients after the startup handshake, for debugging purposes. See
+// protocol.NewTextTracer for a tracer that prints the messages.
+func WithTracer(tracer protocol.Tracer) Option {
+	return func(s *server) {
+		s.tracer = tracer
+	}
+}
+
+// WithSpanTracer traces every session with a span, from its startup until it
+// ends, and every statement with a child span of the session's span, carrying
+// the sql string, the kind of the statement, the number of rows it returned or
+// affected and the error that failed it. The session's span is a child of the
+// span of its base context, if there's one (see WithBaseContext), correlating
+// the statements with the upstream requests. See SpanTracer for adapting an
+// OpenTelemetry tracer.
+func WithSpanTracer(tracer SpanTracer) Option {
+	return func(s *server) {
+		s.spanTracer = tracer
+	}
+}
+
+// WithSQLRedaction sets the function redacting the sql strings recorded in the
+// spans of the statements (see WithSpanTracer), like by removing the literals
+// that may hold sensitive data. Returning an empty string omits the sql string
+// from the span. By default the sql strings are recorded as sent by clients.
+func WithSQLRedaction(redact func(sql string) string) Option {
+	return func(s *server) {
+		s.redactSQL = redact
+	}
+}
+
+// WithStrictFraming validates the framing of every message sent to clients,
+// panicking on messages whose declared length doesn't match their contents,
+// which would otherwise corrupt the stream in subtle ways. It's meant for
+// development, like when writing custom messages, and is off by default.
+// Panics during queries are recovered and reported like other panics of the
+// backend (see WithLogger).
+func WithStrictFraming() Option {
+	return func(s *server) {
+		s.strictFraming = true
+	}
+}
+
+// WithLogger sets the Logger used for reporting unexpected failures. By
+// default nothing is logged.
+func WithLogger(logger Logger) Option {
+	return func(s *server) {
+		s.logger = logger
+	}
+}
@@ -0,0 +1,171 @@
+package pgsrv
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/pgtype"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"reflect"
+	"strings"
+)
+
+// StatementDescriber can be implemented by a Queryer in order to describe the
+// types of the parameters of prepared statements, when these are left
+// unspecified by the client. This is common with drivers like JDBC that
+// expect the server to infer the types.
+type StatementDescriber interface {
+	// DescribeStatement returns the type OIDs of the parameters ($1, $2, etc.)
+	// of the provided statement, in order. A zero OID, or a missing one, leaves
+	// the type of the parameter to be inferred by the server.
+	DescribeStatement(ctx context.Context, n nodes.Node) ([]uint32, error)
+}
+
+// parameterTypes returns the type OIDs of all of the parameters referenced by
+// the provided statement. Types specified by the client take precedence,
+// followed by the types described by the backend (see StatementDescriber) and
+// types inferred from the statement itself. Parameters of unknown types
+// default to text.
+func (s *session) parameterTypes(stmt nodes.Node, specified []uint32) ([]uint32, error) {
+	inferred := inferParameterTypes(stmt)
+
+	n := len(specified)
+	for num := range inferred {
+		if num > n {
+			n = num
+		}
+	}
+
+	var described []uint32
+	describer, ok := s.queryer.(StatementDescriber)
+	if ok && n > len(specified) {
+		var err error
+		described, err = describer.DescribeStatement(s.Ctx, stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	oids := make([]uint32, n)
+	for i := range oids {
+		switch {
+		case i < len(specified) && specified[i] != 0:
+			oids[i] = specified[i]
+		case i < len(described) && described[i] != 0:
+			oids[i] = described[i]
+		case inferred[i+1] != "":
+			dt, ok := s.ConnInfo.DataTypeForName(inferred[i+1])
+			if ok {
+				oids[i] = uint32(dt.OID)
+			}
+		}
+
+		if oids[i] == 0 {
+			oids[i] = uint32(protocol.TypesOid["TEXT"])
+		}
+	}
+	return oids, nil
+}
+
+// inferParameterTypes infers the type names of the parameters referenced by
+// the provided statement from their usage, keyed by their number. Parameters
+// are inferred from explicit casts ($1::int4) and from comparisons with
+// constants ($1 = 5). Parameters that cannot be inferred are mapped to an
+// empty type name.
+func inferParameterTypes(stmt nodes.Node) map[int]string {
+	types := map[int]string{}
+	infer := func(num int, typ string) {
+		if types[num] == "" {
+			types[num] = typ
+		}
+	}
+
+	walkNodes(stmt, func(n nodes.Node) {
+		switch v := n.(type) {
+		case nodes.ParamRef:
+			infer(v.Number, "")
+		case nodes.TypeCast:
+			p, ok := v.Arg.(nodes.ParamRef)
+			if ok && v.TypeName != nil && len(v.TypeName.Names.Items) > 0 {
+				name := v.TypeName.Names.Items[len(v.TypeName.Names.Items)-1]
+				if s, ok := name.(nodes.String); ok {
+					infer(p.Number, strings.ToLower(s.Str))
+				}
+			}
+		case nodes.A_Expr:
+			if p, ok := v.Lexpr.(nodes.ParamRef); ok {
+				infer(p.Number, constType(v.Rexpr))
+			}
+			if p, ok := v.Rexpr.(nodes.ParamRef); ok {
+				infer(p.Number, constType(v.Lexpr))
+			}
+		}
+	})
+	return types
+}
+
+// constType returns the type name of a constant node, or an empty string if
+// the node isn't a constant.
+func constType(n nodes.Node) string {
+	c, ok := n.(nodes.A_Const)
+	if !ok {
+		return ""
+	}
+
+	switch v := c.Val.(type) {
+	case nodes.Integer:
+		if int64(int32(v.Ival)) != v.Ival {
+			return "int8"
+		}
+		return "int4"
+	case nodes.Float:
+		return "numeric"
+	case nodes.String:
+		return "text"
+	}
+	return ""
+}
+
+// walkNodes calls fn for every node in the tree rooted at n, depth-first.
+func walkNodes(n nodes.Node, fn func(nodes.Node)) {
+	walkValue(reflect.ValueOf(n), fn)
+}
+
+func walkValue(v reflect.Value, fn func(nodes.Node)) {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if !v.IsNil() {
+			walkValue(v.Elem(), fn)
+		}
+	case reflect.Struct:
+		if v.CanInterface() {
+			if n, ok := v.Interface().(nodes.Node); ok {
+				fn(n)
+			}
+		}
+		for i := 0; i < v.NumField(); i++ {
+			walkValue(v.Field(i), fn)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			walkValue(v.Index(i), fn)
+		}
+	}
+}
+
+// typeNameForOID returns a TypeName node for the provided type OID
+func (s *session) typeNameForOID(oid uint32) (nodes.TypeName, error) {
+	dt, ok := s.ConnInfo.DataTypeForOID(pgtype.OID(oid))
+	if !ok {
+		return nodes.TypeName{}, fmt.Errorf("cache lookup failed for type %d", oid)
+	}
+
+	return nodes.TypeName{
+		TypeOid: nodes.Oid(oid),
+		Names: nodes.List{
+			Items: []nodes.Node{
+				nodes.String{Str: dt.Name},
+			},
+		},
+	}, nil
+}
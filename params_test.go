@@ -0,0 +1,115 @@
+package pgsrv
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func paramRef(num int) nodes.ParamRef {
+	return nodes.ParamRef{Number: num}
+}
+
+func intConst(v int64) nodes.A_Const {
+	return nodes.A_Const{Val: nodes.Integer{Ival: v}}
+}
+
+func TestInferParameterTypes(t *testing.T) {
+	t.Run("explicit cast", func(t *testing.T) {
+		stmt := nodes.SelectStmt{
+			TargetList: nodes.List{Items: []nodes.Node{
+				nodes.ResTarget{Val: nodes.TypeCast{
+					Arg: paramRef(1),
+					TypeName: &nodes.TypeName{Names: nodes.List{Items: []nodes.Node{
+						nodes.String{Str: "pg_catalog"},
+						nodes.String{Str: "int4"},
+					}}},
+				}},
+			}},
+		}
+		require.Equal(t, map[int]string{1: "int4"}, inferParameterTypes(stmt))
+	})
+
+	t.Run("comparison with constants", func(t *testing.T) {
+		stmt := nodes.SelectStmt{
+			WhereClause: nodes.BoolExpr{Args: nodes.List{Items: []nodes.Node{
+				nodes.A_Expr{Lexpr: paramRef(1), Rexpr: intConst(5)},
+				nodes.A_Expr{Lexpr: intConst(5000000000), Rexpr: paramRef(2)},
+				nodes.A_Expr{Lexpr: paramRef(3), Rexpr: nodes.A_Const{Val: nodes.Float{Str: "1.5"}}},
+				nodes.A_Expr{Lexpr: paramRef(4), Rexpr: nodes.A_Const{Val: nodes.String{Str: "foo"}}},
+			}}},
+		}
+		expected := map[int]string{1: "int4", 2: "int8", 3: "numeric", 4: "text"}
+		require.Equal(t, expected, inferParameterTypes(stmt))
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		stmt := nodes.SelectStmt{
+			TargetList: nodes.List{Items: []nodes.Node{nodes.ResTarget{Val: paramRef(1)}}},
+		}
+		require.Equal(t, map[int]string{1: ""}, inferParameterTypes(stmt))
+	})
+}
+
+type mockDescriber struct {
+	mockQueryer
+	oids []uint32
+	err  error
+}
+
+func (d *mockDescriber) DescribeStatement(ctx context.Context, n nodes.Node) ([]uint32, error) {
+	return d.oids, d.err
+}
+
+func TestSession_parameterTypes(t *testing.T) {
+	stmt := nodes.SelectStmt{
+		TargetList: nodes.List{Items: []nodes.Node{
+			nodes.ResTarget{Val: paramRef(1)},
+			nodes.ResTarget{Val: paramRef(2)},
+			nodes.ResTarget{Val: paramRef(3)},
+		}},
+		WhereClause: nodes.A_Expr{Lexpr: paramRef(4), Rexpr: intConst(1)},
+	}
+
+	t.Run("specified, described, inferred and default types", func(t *testing.T) {
+		sess := &session{ConnInfo: newConnInfo(), queryer: &mockDescriber{oids: []uint32{0, 16}}}
+		oids, err := sess.parameterTypes(stmt, []uint32{20})
+		require.NoError(t, err)
+		require.Equal(t, []uint32{20, 16, 25, 23}, oids)
+	})
+
+	t.Run("all types specified", func(t *testing.T) {
+		sess := &session{ConnInfo: newConnInfo(), queryer: &mockDescriber{err: fmt.Errorf("not called")}}
+		oids, err := sess.parameterTypes(stmt, []uint32{20, 20, 20, 20})
+		require.NoError(t, err)
+		require.Equal(t, []uint32{20, 20, 20, 20}, oids)
+	})
+
+	t.Run("describer error", func(t *testing.T) {
+		sess := &session{ConnInfo: newConnInfo(), queryer: &mockDescriber{err: fmt.Errorf("boom")}}
+		_, err := sess.parameterTypes(stmt, nil)
+		require.EqualError(t, err, "boom")
+	})
+}
+
+func TestSession_prepare_unspecifiedTypes(t *testing.T) {
+	sess := &session{
+		Server:       &server{},
+		ConnInfo:     newConnInfo(),
+		queryer:      &mockQueryer{},
+		pendingStmts: map[string]*nodes.PrepareStmt{},
+	}
+	_, err := sess.prepare(&pgproto3.Parse{
+		Name:  testStmtName,
+		Query: "SELECT $1::int4, $2",
+	})
+	require.NoError(t, err)
+
+	ps := sess.pendingStmts[testStmtName]
+	require.Len(t, ps.Argtypes.Items, 2)
+	require.Equal(t, nodes.Oid(23), ps.Argtypes.Items[0].(nodes.TypeName).TypeOid)
+	require.Equal(t, nodes.Oid(25), ps.Argtypes.Items[1].(nodes.TypeName).TypeOid)
+}
@@ -0,0 +1,87 @@
+package pgsrv
+
+import (
+	"container/list"
+	"sync"
+)
+
+// parseCache is a Parser that memoizes the results of another Parser by the
+// exact sql string, including the kinds of the statements that route them to
+// the Queryer or Execer, so statements that clients send repeatedly are parsed
+// once. It holds up to size results, evicting the least recently used ones.
+// See WithParseCacheSize.
+//
+// The nodes of the cached statements are shared by all of the sessions that
+// send the same sql, so they must not be modified in place.
+type parseCache struct {
+	parser Parser
+	size   int
+
+	mu      sync.Mutex
+	order   *list.List               // of *parseResult, most recently used first
+	results map[string]*list.Element // by sql
+}
+
+// parseResult is the cached result of parsing the sql string
+type parseResult struct {
+	sql   string
+	stmts Statements
+	err   error
+}
+
+func newParseCache(parser Parser, size int) *parseCache {
+	return &parseCache{
+		parser:  parser,
+		size:    size,
+		order:   list.New(),
+		results: map[string]*list.Element{},
+	}
+}
+
+// Parse implements Parser. The statements are copied, so callers may replace
+// them, but not modify their nodes.
+func (c *parseCache) Parse(sql string) (Statements, error) {
+	c.mu.Lock()
+	elem, ok := c.results[sql]
+	if ok {
+		c.order.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+
+	var res *parseResult
+	if ok {
+		res = elem.Value.(*parseResult)
+	} else {
+		// parsed outside of the lock, concurrent misses of the same sql
+		// just parse it more than once
+		stmts, err := c.parser.Parse(sql)
+		res = &parseResult{sql, stmts, err}
+		c.add(res)
+	}
+
+	if res.err != nil {
+		return nil, res.err
+	}
+	stmts := make(Statements, len(res.stmts))
+	copy(stmts, res.stmts)
+	return stmts, nil
+}
+
+// add adds the result to the cache, evicting the least recently used results
+// beyond the size of the cache
+func (c *parseCache) add(res *parseResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.results[res.sql]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.results[res.sql] = c.order.PushFront(res)
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.results, oldest.Value.(*parseResult).sql)
+	}
+}
@@ -0,0 +1,120 @@
+package pgsrv
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+// countingParser counts the sql strings parsed by the default parser
+type countingParser struct {
+	mu     sync.Mutex
+	parsed map[string]int
+}
+
+func (p *countingParser) Parse(sql string) (Statements, error) {
+	p.mu.Lock()
+	p.parsed[sql]++
+	p.mu.Unlock()
+	return defaultParser.Parse(sql)
+}
+
+func TestParseCache(t *testing.T) {
+	t.Run("hits", func(t *testing.T) {
+		parser := &countingParser{parsed: map[string]int{}}
+		cache := newParseCache(parser, 2)
+
+		for _, sql := range []string{"SELECT 1", "INSERT INTO foo VALUES (1); SELECT 2"} {
+			expected, err := defaultParser.Parse(sql)
+			require.NoError(t, err)
+
+			for i := 0; i < 3; i++ {
+				stmts, err := cache.Parse(sql)
+				require.NoError(t, err)
+				require.Equal(t, expected, stmts)
+			}
+			require.Equal(t, 1, parser.parsed[sql])
+		}
+	})
+
+	t.Run("statements are copied", func(t *testing.T) {
+		cache := newParseCache(&countingParser{parsed: map[string]int{}}, 1)
+		stmts, err := cache.Parse("SELECT 1")
+		require.NoError(t, err)
+		stmts[0].Kind = CommandStatement
+
+		stmts, err = cache.Parse("SELECT 1")
+		require.NoError(t, err)
+		require.Equal(t, QueryStatement, stmts[0].Kind)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		parser := &countingParser{parsed: map[string]int{}}
+		cache := newParseCache(parser, 1)
+
+		_, expected := defaultParser.Parse("SELEC 1")
+		require.Error(t, expected)
+		for i := 0; i < 2; i++ {
+			_, err := cache.Parse("SELEC 1")
+			require.Equal(t, expected, err)
+		}
+		require.Equal(t, 1, parser.parsed["SELEC 1"])
+	})
+
+	t.Run("evicts the least recently used", func(t *testing.T) {
+		parser := &countingParser{parsed: map[string]int{}}
+		cache := newParseCache(parser, 2)
+
+		for _, sql := range []string{"SELECT 1", "SELECT 2", "SELECT 1", "SELECT 3", "SELECT 1", "SELECT 2"} {
+			_, err := cache.Parse(sql)
+			require.NoError(t, err)
+		}
+		require.Equal(t, map[string]int{"SELECT 1": 1, "SELECT 2": 2, "SELECT 3": 1}, parser.parsed)
+		require.Len(t, cache.results, 2)
+		require.Equal(t, 2, cache.order.Len())
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		cache := newParseCache(&countingParser{parsed: map[string]int{}}, 4)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					sql := fmt.Sprintf("SELECT %d", (i+j)%6)
+					stmts, err := cache.Parse(sql)
+					require.NoError(t, err)
+					require.Len(t, stmts, 1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		require.Len(t, cache.results, 4)
+	})
+}
+
+func TestWithParseCacheSize(t *testing.T) {
+	parser := &countingParser{parsed: map[string]int{}}
+	srv := New(&mockQueryer{}, WithParser(parser), WithParseCacheSize(10)).(*server)
+	frontend, _ := connect(t, srv)
+
+	for i := 0; i < 3; i++ {
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+
+	// the extended protocol shares the cache with simple queries
+	require.NoError(t, frontend.Send(&pgproto3.Parse{Query: "SELECT 1"}))
+	require.NoError(t, frontend.Send(&pgproto3.Sync{}))
+	receive(t, frontend, &pgproto3.ParseComplete{})
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+	require.Equal(t, 1, parser.parsed["SELECT 1"])
+}
@@ -0,0 +1,56 @@
+package pgsrv
+
+import (
+	nodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+// parse parses the sql string with the server's Parser (see WithParser), or
+// the default one
+func (s *server) parse(sql string) (Statements, error) {
+	if s.parser != nil {
+		return s.parser.Parse(sql)
+	}
+	return defaultParser.Parse(sql)
+}
+
+// statementKind classifies the nodes produced by pg_query_go. The statements
+// that return rows are queries, including SELECT with a WITH clause, VALUES
+// and TABLE (which are all parsed as SelectStmt), EXPLAIN, and INSERT, UPDATE
+// or DELETE with a RETURNING clause.
+func statementKind(n nodes.Node) StatementKind {
+	switch v := n.(type) {
+	case nodes.PrepareStmt, nodes.ExecuteStmt, nodes.DeallocateStmt:
+		return PrepareStatement
+	case nodes.VariableSetStmt:
+		return SetStatement
+	case nodes.ListenStmt, nodes.UnlistenStmt, nodes.NotifyStmt:
+		return NotificationStatement
+	case nodes.VariableShowStmt:
+		return ShowStatement
+	case nodes.DiscardStmt:
+		return DiscardStatement
+	case nodes.TransactionStmt:
+		return TransactionStatement
+	case nodes.DeclareCursorStmt, nodes.FetchStmt, nodes.ClosePortalStmt:
+		return CursorStatement
+	case nodes.SelectStmt, nodes.ExplainStmt:
+		return QueryStatement
+	case nodes.InsertStmt:
+		return returningKind(v.ReturningList)
+	case nodes.UpdateStmt:
+		return returningKind(v.ReturningList)
+	case nodes.DeleteStmt:
+		return returningKind(v.ReturningList)
+	default:
+		return CommandStatement
+	}
+}
+
+// returningKind classifies the commands that return rows with a RETURNING
+// clause as queries
+func returningKind(returning nodes.List) StatementKind {
+	if len(returning.Items) > 0 {
+		return QueryStatement
+	}
+	return CommandStatement
+}
@@ -0,0 +1,33 @@
+//go:build cgo
+// +build cgo
+
+package pgsrv
+
+import (
+	parser "github.com/lfittl/pg_query_go"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+// defaultParser is used unless another Parser is provided with WithParser
+var defaultParser Parser = &pgQueryParser{}
+
+// pgQueryParser implements Parser with pg_query_go, which is built on the
+// actual parser of postgres
+type pgQueryParser struct{}
+
+func (*pgQueryParser) Parse(sql string) (Statements, error) {
+	tree, err := parser.Parse(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	stmts := make(Statements, len(tree.Statements))
+	for i, stmt := range tree.Statements {
+		rawStmt, isRaw := stmt.(nodes.RawStmt)
+		if isRaw {
+			stmt = rawStmt.Stmt
+		}
+		stmts[i] = Statement{Kind: statementKind(stmt), Node: stmt}
+	}
+	return stmts, nil
+}
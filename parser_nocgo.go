@@ -0,0 +1,15 @@
+//go:build !cgo
+// +build !cgo
+
+package pgsrv
+
+// defaultParser is used unless another Parser is provided with WithParser.
+// pg_query_go requires cgo, so without it there's no default.
+var defaultParser Parser = &noParser{}
+
+// noParser rejects all queries, as there's no Parser to parse them
+type noParser struct{}
+
+func (*noParser) Parse(sql string) (Statements, error) {
+	return nil, InternalError("no parser available, see WithParser")
+}
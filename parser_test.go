@@ -0,0 +1,101 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestStatementKind(t *testing.T) {
+	tests := map[string]StatementKind{
+		"SELECT 1":           QueryStatement,
+		"SHOW foo":           ShowStatement,
+		"SET foo = 'bar'":    SetStatement,
+		"RESET foo":          SetStatement,
+		"LISTEN foo":         NotificationStatement,
+		"NOTIFY foo, 'bar'":  NotificationStatement,
+		"INSERT INTO foo":    CommandStatement,
+		"CREATE TABLE foo()": CommandStatement,
+		"BEGIN":              TransactionStatement,
+		"COMMIT":             TransactionStatement,
+
+		"EXPLAIN SELECT 1":                     QueryStatement,
+		"WITH x AS (SELECT 1) SELECT * FROM x": QueryStatement,
+		"VALUES (1), (2)":                      QueryStatement,
+		"TABLE foo":                            QueryStatement,
+		"INSERT INTO foo RETURNING id":         QueryStatement,
+		"DELETE FROM foo RETURNING id":         QueryStatement,
+		"UPDATE foo SET a = 1":                 CommandStatement,
+
+		"DECLARE c CURSOR FOR SELECT 1": CursorStatement,
+		"FETCH 10 FROM c":               CursorStatement,
+		"MOVE c":                        CursorStatement,
+		"CLOSE c":                       CursorStatement,
+	}
+
+	for sql, expected := range tests {
+		t.Run(sql, func(t *testing.T) {
+			stmts, err := (&server{}).parse(sql)
+			require.NoError(t, err)
+			require.Len(t, stmts, 1)
+			require.Equal(t, expected, stmts[0].Kind)
+			require.Equal(t, expected, statementKind(stmts[0].Node))
+		})
+	}
+}
+
+// rawSQL is a node of the passthroughParser, holding the sql of the statement
+type rawSQL string
+
+// passthroughParser splits the sql string into statements without parsing
+// them, leaving it to the backend
+type passthroughParser struct{}
+
+func (*passthroughParser) Parse(sql string) (Statements, error) {
+	var stmts Statements
+	for _, s := range strings.Split(sql, ";") {
+		s = strings.TrimSpace(s)
+		kind := CommandStatement
+		if strings.HasPrefix(strings.ToUpper(s), "SELECT") {
+			kind = QueryStatement
+		}
+		stmts = append(stmts, Statement{Kind: kind, Node: rawSQL(s)})
+	}
+	return stmts, nil
+}
+
+// rawQueryer records the nodes it serves
+type rawQueryer struct {
+	nodes []nodes.Node
+}
+
+func (q *rawQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	q.nodes = append(q.nodes, n)
+	return &mockRows{}, nil
+}
+
+func (q *rawQueryer) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
+	q.nodes = append(q.nodes, n)
+	return driver.RowsAffected(1), nil
+}
+
+func TestServer_parser(t *testing.T) {
+	queryer := &rawQueryer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	WithParser(&passthroughParser{})(srv)
+
+	frontend, _ := connect(t, srv)
+	sendQuery(t, frontend, "SELECT whatever; DO something")
+
+	receive(t, frontend, &pgproto3.RowDescription{})
+	receive(t, frontend, &pgproto3.CommandComplete{})
+	msg := receive(t, frontend, &pgproto3.CommandComplete{})
+	require.Equal(t, "UPDATE 1", string(msg.(*pgproto3.CommandComplete).CommandTag))
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+	require.Equal(t, []nodes.Node{rawSQL("SELECT whatever"), rawSQL("DO something")}, queryer.nodes)
+}
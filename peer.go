@@ -0,0 +1,77 @@
+package pgsrv
+
+import (
+	"fmt"
+	"github.com/panoplyio/pgsrv/protocol"
+	"net"
+	"os/user"
+	"strconv"
+)
+
+const errPeerAuthFailed = "Peer authentication failed for user \"%s\""
+
+// PeerMapper describes objects that are able to authenticate clients connected
+// over unix sockets by the operating system user running the client process,
+// like the peer authentication of postgres. It's only supported on linux,
+// where the user is obtained with SO_PEERCRED. On other platforms, like BSD and
+// macOS (LOCAL_PEERCRED), obtaining the user requires golang.org/x/sys, so the
+// clients of a Queryer that implements it are always rejected, like clients
+// that aren't connected over unix sockets.
+type PeerMapper interface {
+	// MapPeer reports whether the operating system user may connect as the
+	// requested database user. Like postgres without a user name map, an
+	// implementation may simply require the names to be the same.
+	MapPeer(osUser, user string) (bool, error)
+}
+
+// connAuthenticator is an authenticator that requires access to the client's
+// connection itself, rather than just its messages.
+type connAuthenticator interface {
+	authenticateConn(conn net.Conn, rw protocol.MessageReadWriter, args map[string]interface{}) error
+}
+
+// peerAuthenticator authenticates the clients connected over unix sockets
+// by the operating system user of the client process. It requires a PeerMapper
+// to map the operating system user to the database user.
+type peerAuthenticator struct {
+	pm PeerMapper
+}
+
+// authenticate fails without the connection, see authenticateConn
+func (a *peerAuthenticator) authenticate(rw protocol.MessageReadWriter, args map[string]interface{}) error {
+	return a.authenticateConn(nil, rw, args)
+}
+
+func (a *peerAuthenticator) authenticateConn(conn net.Conn, rw protocol.MessageReadWriter, args map[string]interface{}) error {
+	dbUser, _ := args["user"].(string)
+	ok, err := a.mapPeer(conn, dbUser)
+	if err == nil && !ok {
+		err = InvalidAuthorizationSpecification(errPeerAuthFailed, dbUser)
+	}
+	if err != nil {
+		return reportFatal(rw, err)
+	}
+
+	return rw.Write(protocol.AuthenticationOK)
+}
+
+// mapPeer looks up the operating system user of the client process and maps
+// it to the database user
+func (a *peerAuthenticator) mapPeer(conn net.Conn, dbUser string) (bool, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false, fmt.Errorf("peer authentication is only supported on unix socket connections")
+	}
+
+	uid, err := peerUID(uc)
+	if err != nil {
+		return false, fmt.Errorf("could not get peer credentials: %v", err)
+	}
+
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return false, fmt.Errorf("could not look up local user ID %d: %v", uid, err)
+	}
+
+	return a.pm.MapPeer(u.Username, dbUser)
+}
@@ -0,0 +1,85 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"testing"
+)
+
+// mapPeerQueryer maps the operating system users to database users
+type mapPeerQueryer struct {
+	mockQueryer
+	users map[string]string
+}
+
+func (q *mapPeerQueryer) MapPeer(osUser, user string) (bool, error) {
+	return q.users[osUser] == user, nil
+}
+
+func TestPeerAuthenticator(t *testing.T) {
+	current, err := user.Current()
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "pgsrv")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queryer := &mapPeerQueryer{users: map[string]string{current.Username: "alice"}}
+	srv := New(queryer).(*server)
+	require.IsType(t, &peerAuthenticator{}, srv.authenticator)
+
+	ln, err := ListenUnix(dir, 5432)
+	require.NoError(t, err)
+	defer ln.Close()
+	go srv.ServeListener(ln)
+
+	startUp := func(t *testing.T, dbUser string) *pgproto3.Frontend {
+		conn, err := net.Dial("unix", UnixSocketPath(dir, 5432))
+		require.NoError(t, err)
+
+		frontend, err := pgproto3.NewFrontend(conn, conn)
+		require.NoError(t, err)
+		err = frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": dbUser},
+		})
+		require.NoError(t, err)
+		return frontend
+	}
+
+	t.Run("mapped user", func(t *testing.T) {
+		frontend := startUp(t, "alice")
+		msg := receive(t, frontend, &pgproto3.Authentication{})
+		require.Equal(t, uint32(pgproto3.AuthTypeOk), msg.(*pgproto3.Authentication).Type)
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		frontend := startUp(t, "bob")
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+		require.Equal(t, "28000", msg.(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, `Peer authentication failed for user "bob"`, msg.(*pgproto3.ErrorResponse).Message)
+	})
+
+	t.Run("not a unix socket", func(t *testing.T) {
+		f, b := net.Pipe()
+		defer f.Close()
+		go srv.Serve(b)
+
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+		err = frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "alice"},
+		})
+		require.NoError(t, err)
+
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+		require.Contains(t, msg.(*pgproto3.ErrorResponse).Message, "only supported on unix socket")
+	})
+}
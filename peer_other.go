@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package pgsrv
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerUID isn't supported on this platform, where obtaining the peer
+// credentials (like with LOCAL_PEERCRED on BSD) requires golang.org/x/sys
+func peerUID(conn *net.UnixConn) (int, error) {
+	return 0, fmt.Errorf("peer credentials are not supported on this platform")
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql/driver"
 	nodes "github.com/lfittl/pg_query_go/nodes"
 	"net"
+	"time"
 )
 
 // Queryer is a generic interface for objects capable of performing sql queries.
@@ -21,6 +22,237 @@ type Execer interface {
 	Exec(ctx context.Context, n nodes.Node) (driver.Result, error)
 }
 
+// Executor can be implemented by the Queryer of backends that determine by
+// themselves whether a statement returns rows, rather than relying on the
+// server's classification of the parsed statement (see StatementKind). When
+// implemented, it's used instead of Query and Exec for the queries and
+// commands, and returns the rows of queries, or nil rows along with the Result
+// of commands, like RawQueryer. The Result may implement ResultTag.
+type Executor interface {
+	Execute(ctx context.Context, n nodes.Node) (driver.Rows, driver.Result, error)
+}
+
+// StreamQueryer can be implemented by the Queryer of backends that produce
+// rows lazily, like from a remote system, as an alternative to implementing
+// driver.Rows. When implemented, it's used instead of Query, and the server
+// reads the rows from the stream until it's closed.
+type StreamQueryer interface {
+	QueryStream(ctx context.Context, n nodes.Node) (RowStream, error)
+}
+
+// RowStream is a stream of rows produced by a StreamQueryer. The producer sends
+// the rows on the channel returned by Rows, and closes it after the last row,
+// or when the context of the query is done. See StreamRows for reading it as
+// driver.Rows.
+type RowStream interface {
+	Columns() []string
+
+	// Rows returns the channel of rows, each having a value per column
+	Rows() <-chan []interface{}
+
+	// Err returns the error that ended the stream, if any. It's called once
+	// the channel is closed.
+	Err() error
+}
+
+// RawQueryer is a generic interface for objects capable of performing raw sql
+// strings, which are parsed by the backend rather than the server (see
+// WithRawSQLMode). It returns the rows of queries, or nil rows along with the
+// Result of commands, as the backend determines. The Result may implement
+// ResultTag; otherwise the command is reported as "UPDATE N".
+type RawQueryer interface {
+	QueryRaw(ctx context.Context, sql string) (driver.Rows, driver.Result, error)
+}
+
+// FunctionCaller calls functions by their OIDs, for the fast-path FunctionCall
+// message of the protocol that's still used by some legacy clients and
+// drivers (see WithFunctionCaller). The arguments are encoded in the formats
+// of their format codes, 0 for text and 1 for binary, with one code per
+// argument, while nil arguments are NULL. The result is sent to the client as
+// is, and a nil result is NULL.
+type FunctionCaller interface {
+	Call(ctx context.Context, oid uint32, args [][]byte, formats []int16) ([]byte, error)
+}
+
+// CopyHandler can be implemented by the Queryer of backends that load data
+// with COPY FROM STDIN, like psql's \copy or pg_restore. The data sent by the
+// client, in either text, CSV or binary format, is decoded into rows of values
+// of the types of the target columns, which are read from the provided rows as
+// they arrive. The returned Result may implement ResultTag, like CopyResult;
+// otherwise the command is reported as "COPY N", where N is the number of rows
+// affected, or the number of rows read from the client when the Result is nil
+// or fails to report the rows affected. Once the query is canceled, like by a
+// CancelRequest or the statement's timeout, the rows fail with a
+// query_canceled error and the rest of the data is discarded. COPY TO STDOUT
+// doesn't require a CopyHandler, as its rows are queried by the Queryer: the
+// query of the COPY, or a SELECT of the columns of its table.
+type CopyHandler interface {
+	// CopyColumns returns the columns that the rows of the COPY are copied
+	// into, in order, like the columns of its table or of its column list.
+	// Values are decoded according to the TypeName of their column, while
+	// those of unsupported types are left as strings in text format, and as
+	// []byte in binary format.
+	CopyColumns(ctx context.Context, n nodes.Node) ([]ColumnDesc, error)
+
+	// CopyFrom copies the rows. The rows fail with an error once the data is
+	// malformed or the client aborts the COPY, which should also fail it.
+	CopyFrom(ctx context.Context, n nodes.Node, rows driver.Rows) (driver.Result, error)
+}
+
+// Parser parses the sql strings sent by clients into their statements. The
+// default Parser is built on pg_query_go, which requires cgo, so builds with
+// CGO_ENABLED=0 must provide an alternative with WithParser, like a pure Go
+// parser or one that defers the parsing to the backend.
+type Parser interface {
+	Parse(sql string) (Statements, error)
+}
+
+// StatementKind determines how the server executes a Statement
+type StatementKind int
+
+const (
+	// CommandStatement is executed by the Execer, like INSERT or CREATE TABLE.
+	// It's the kind of all of the statements not classified otherwise.
+	CommandStatement StatementKind = iota
+
+	// QueryStatement returns rows, and is executed by the Queryer, like SELECT
+	// or SHOW.
+	QueryStatement
+
+	// PrepareStatement is a PREPARE, EXECUTE or DEALLOCATE statement, managing
+	// the prepared statements of the session. Its Node must be a
+	// nodes.PrepareStmt, nodes.ExecuteStmt or nodes.DeallocateStmt.
+	PrepareStatement
+
+	// SetStatement is a SET or RESET of a session variable, handled by the
+	// server before it's passed on to the Execer. Its Node must be a
+	// nodes.VariableSetStmt, otherwise it's just executed.
+	SetStatement
+
+	// ShowStatement is a SHOW of a session variable, answered by the server
+	// when it knows the variable, otherwise executed by the Queryer. Its Node
+	// must be a nodes.VariableShowStmt.
+	ShowStatement
+
+	// NotificationStatement is a LISTEN, UNLISTEN or NOTIFY statement, handled
+	// by the server. Its Node must be a nodes.ListenStmt, nodes.UnlistenStmt
+	// or nodes.NotifyStmt.
+	NotificationStatement
+
+	// DiscardStatement is a DISCARD statement, resetting the state of the
+	// session before it's passed on to the Execer. Its Node must be a
+	// nodes.DiscardStmt, otherwise it's just executed.
+	DiscardStatement
+
+	// TransactionStatement is a BEGIN, COMMIT, ROLLBACK or another statement
+	// controlling the transaction block, tracked by the server before it's
+	// passed on to the Execer. Its Node must be a nodes.TransactionStmt,
+	// otherwise it's just executed.
+	TransactionStatement
+
+	// CursorStatement is a DECLARE CURSOR, FETCH, MOVE or CLOSE statement,
+	// managing the cursors of the session, whose rows are fetched from the
+	// Queryer. Its Node must be a nodes.DeclareCursorStmt, nodes.FetchStmt or
+	// nodes.ClosePortalStmt, otherwise it's just executed.
+	CursorStatement
+)
+
+// Statement is a single statement out of a parsed sql string
+type Statement struct {
+	Kind StatementKind
+
+	// Node is the parsed statement, passed to the Queryer or Execer. Parsers
+	// that don't produce the nodes of pg_query_go may provide their own
+	// implementation of nodes.Node.
+	Node nodes.Node
+}
+
+// Statements are all of the statements of a parsed sql string, in order
+type Statements []Statement
+
+// DatabaseRouter returns the Queryer responsible for serving the sessions
+// connected to the provided database. A nil Queryer indicates that the
+// database does not exist, in which case the session is rejected.
+type DatabaseRouter func(database string) Queryer
+
+// ConnFilter decides whether to serve a newly accepted connection, rejecting
+// it by returning an error. If the error has a Code() (see Err), it's first
+// sent to the client as a FATAL error, allowing it to display the reason.
+// Otherwise the connection is closed silently.
+type ConnFilter func(conn net.Conn) error
+
+// ConnWrapper is called for every newly accepted connection, before anything
+// else, and may replace it with a wrapping connection, like one that consumes
+// a header sent by a proxy ahead of the protocol messages (see ProxyProtocol).
+// The returned address, if not nil, replaces the connection's remote address
+// from then on, like in logs, ConnFilter and SessionInfo. Returning an error
+// closes the connection.
+type ConnWrapper func(conn net.Conn) (net.Conn, net.Addr, error)
+
+// BaseContext returns the root context of the session served over the
+// connection, which all of the contexts of its queries are derived from, like
+// one holding a tenant ID or a tracing span. It's called once the client is
+// authenticated, and the session's context is canceled when it ends.
+type BaseContext func(conn net.Conn) context.Context
+
+// StartupValidator validates the parameters sent by the client at startup,
+// before it's authenticated, and rejects the connection by returning an error.
+// The error is reported with the SQLSTATE of its Code() if it has one (see
+// Err), otherwise with 28000 (invalid_authorization_specification).
+type StartupValidator func(args map[string]interface{}) error
+
+// ErrorMapper translates the errors returned by the backend, like its domain
+// errors, into postgres errors with the proper SQLSTATE, severity and message,
+// before they're reported to the client. Returning nil leaves the error as is,
+// so it's reported as described in Err.
+type ErrorMapper func(err error) *Error
+
+// MessageLocalizer translates the message of an error generated by the server
+// to the locale of the session, which is the value of its lc_messages (empty
+// when not set). It's called with the SQLSTATE code of the error and its
+// English message, as a format string along with its arguments, like:
+//
+//      "password does not match for user \"%s\"", "alice"
+//
+// Returning the empty string leaves the English message.
+type MessageLocalizer func(locale, code, defaultText string, args ...interface{}) string
+
+// QueryHandler executes a single statement out of a query, writing its results
+// to the client. Its context holds the session and the sql string, like the
+// context provided to the Queryer (see Session and QueryFromContext). The
+// returned error aborts the query and is reported to the client, while the
+// errors of the backend are reported by the handler itself.
+type QueryHandler func(ctx context.Context, stmt Statement) error
+
+// QueryMiddleware wraps the execution of every statement, like HTTP
+// middleware, and may observe the statement, modify it before calling next,
+// or reject it by returning an error without calling next at all. See
+// WithQueryMiddleware.
+type QueryMiddleware func(next QueryHandler) QueryHandler
+
+// ASTRewriter transforms the parsed node of every statement before it's
+// executed, like adding a filter by the tenant to its WHERE clause, renaming
+// its tables or rejecting certain constructs, returning the node executed in
+// place of it, or nil to leave it as is. Returning an error aborts the query,
+// reporting the error to the client. See WithASTRewriter.
+type ASTRewriter func(n nodes.Node) (nodes.Node, error)
+
+// ParseNotice inspects the statements of every sql string once it's parsed,
+// returning notices to send to the client before the statements are executed,
+// like advice against SELECT * or deprecated syntax. See WithParseNotice.
+type ParseNotice func(sql string, stmts Statements) []Notice
+
+// OnConnectHook is called when a client is connected, after it's authenticated
+// and before it's ready for queries. It may prepare resources for serving the
+// session, possibly stored with Session.SetUserData. Returning an error
+// terminates the session, with the error reported to the client as FATAL.
+type OnConnectHook func(sess Session) error
+
+// OnDisconnectHook is called exactly once when a session ends for any reason,
+// if the OnConnectHook succeeded (or wasn't provided). It may release the
+// resources of the session.
+type OnDisconnectHook func(sess Session)
+
 // ResultTag can be implemented by driver.Result to provide the tag name to be
 // used to notify the postgres client of the completed command. If left
 // unimplemented, the default behavior follows the spec described in the link
@@ -31,8 +263,27 @@ type ResultTag interface {
 	Tag() (string, error)
 }
 
+// WarningProvider can be implemented by the driver.Rows of queries or the
+// driver.Result of commands to attach non-fatal messages to a successful
+// result, like a deprecated function or a slow plan. They're sent to the
+// client as NoticeResponse messages before the CommandComplete of the result,
+// once its rows are all read, so the rows may collect them as they're read.
+type WarningProvider interface {
+	Warnings() []Notice
+}
+
+// Notice is a non-fatal message, sent to the client like Session.Notice. The
+// Severity is SeverityWarning by default, and the Code of warnings is 01000
+// (warning) by default.
+type Notice struct {
+	Severity string
+	Code     string
+	Message  string
+}
+
 // Session represents a connected client session. It provides the API to set,
-// get, delete and accessing all of the session variables. The session should
+// get, delete and accessing all of the session variables, which are initially
+// the startup parameters and are updated by SET and RESET. The session should
 // added to the context of all queries executed via the "Session" key:
 //
 //      ctx.Value("Session").(Session)
@@ -42,14 +293,132 @@ type Session interface {
 	Get(k string) interface{}
 	Del(k string)
 	All() map[string]interface{}
+
+	// UserData returns the value stored with SetUserData, or nil.
+	UserData() interface{}
+
+	// SetUserData stores an arbitrary value in the session, like resources
+	// allocated by the OnConnectHook, for the lifetime of the session.
+	SetUserData(v interface{})
+
+	// PID returns the process ID assigned to the session and reported to the
+	// client in BackendKeyData. It's stable for the connection's lifetime.
+	PID() int32
+
+	// RemoteAddr returns the network address of the client, if known.
+	RemoteAddr() net.Addr
+
+	// Notify sends a notification, on behalf of this session, to all of the
+	// sessions listening on the channel, including this one. It's safe to call
+	// from any goroutine. Each listening session receives the notification
+	// immediately if it's idle, or once its current query cycle is complete.
+	// It fails with ErrSessionClosed once the session is closed.
+	Notify(channel, payload string) error
+
+	// Notice sends a non-fatal message, like a warning, to the client without
+	// interrupting the query, e.g. Notice(SeverityWarning, "01000", "...").
+	// Empty severity and code default to NOTICE and 00000 respectively
+	// (01000 for warnings). It must be called from the goroutine serving the
+	// query, i.e. within the Queryer, Execer or while the rows are read, and
+	// is delivered in order with the query results. It has no effect once the
+	// session is closed.
+	Notice(severity, code, message string)
+
+	// NoticeErr is like Notice, but returns the error of writing the notice,
+	// or ErrSessionClosed once the session is closed, which is checked
+	// atomically with the write. It tells a goroutine of the backend that
+	// outlived its query, like one still producing rows, to stop.
+	NoticeErr(severity, code, message string) error
+
+	// CancelQuery cancels the context of the query currently executed by the
+	// session, if any, like from an admin API. The query is aborted with a
+	// query_canceled (57014) error once the backend returns, while its rows
+	// are aborted regardless of the backend. It's safe to call from any
+	// goroutine, and has no effect on an idle session.
+	CancelQuery()
+}
+
+// Logger is used by the server to report unexpected failures, like panics in
+// the Queryer. It's satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
 }
 
 // Server is an interface for objects capable for handling the postgres protocol
 // by serving client connections. Each connection is assigned a Session that's
 // maintained in-memory until the connection is closed.
 type Server interface {
-	// Manually serve a connection
+	// Manually serve a connection, which may be any net.Conn, like one end of
+	// net.Pipe in tests (see Pipe).
 	Serve(net.Conn) error // blocks. Run in go-routine.
+
+	// ServeListener serves all of the connections accepted by the listener,
+	// each in its own goroutine, until accepting fails, like when the
+	// listener is closed. It's suitable for any listener, like TCP or unix
+	// sockets (see ListenUnix).
+	ServeListener(ln net.Listener) error
+
+	// ServeContext is like ServeListener, until the context is done. It then
+	// closes the listener and drains its sessions: each session is terminated
+	// with a FATAL admin_shutdown error once its current query is complete,
+	// and ServeContext returns nil after all of them have ended.
+	ServeContext(ctx context.Context, ln net.Listener) error
+
+	// AddListener serves all of the connections accepted by the listener in
+	// the background, until Shutdown. Any number of listeners may be added,
+	// like a unix socket along with TCP, sharing the server's backend and
+	// sessions, while the listener's options override the configuration of
+	// the server for its connections, like their authentication and TLS.
+	AddListener(ln net.Listener, opts ...ListenerOption)
+
+	// Shutdown closes all of the listeners added with AddListener and drains
+	// their sessions, like ServeContext, returning once all of them have
+	// ended. Listeners added afterwards are closed immediately.
+	Shutdown()
+
+	// Notify sends a notification to all of the sessions listening on the
+	// channel, like NOTIFY does, from outside of any session. It's safe to
+	// call from any goroutine.
+	Notify(channel, payload string) error
+
+	// Sessions returns a snapshot of the activity of all of the sessions
+	// currently served, ordered by their PID. It's safe to call from any
+	// goroutine.
+	Sessions() []SessionInfo
+}
+
+// SessionState is the state of a session, as reported in SessionInfo
+type SessionState string
+
+const (
+	// SessionIdle is waiting for a new query from the client
+	SessionIdle SessionState = "idle"
+
+	// SessionActive is executing a query
+	SessionActive SessionState = "active"
+
+	// SessionIdleInTransaction is waiting for a new query from the client
+	// within a transaction block (see BEGIN)
+	SessionIdleInTransaction SessionState = "idle in transaction"
+
+	// SessionIdleInTransactionAborted is waiting for the client to end a
+	// transaction block that failed, see InFailedSQLTransaction
+	SessionIdleInTransactionAborted SessionState = "idle in transaction (aborted)"
+)
+
+// SessionInfo describes the activity of a session, like pg_stat_activity
+type SessionInfo struct {
+	PID        int32
+	RemoteAddr net.Addr
+	User       string
+	Database   string
+	AppName    string // the application_name set by the client
+	State      SessionState
+
+	// Query is the sql of the query currently executed, or the last one if the
+	// session isn't active, which started at QueryStart.
+	Query      string
+	QueryStart time.Time
 }
 
 // general pgsrv constants to manage session and queries info
@@ -59,4 +428,6 @@ const (
 	sessionCtxKey ctxKey = "Session"
 	sqlCtxKey     ctxKey = "SQL"
 	astCtxKey     ctxKey = "AST"
+	stmtCtxKey    ctxKey = "Statement"
+	spanCtxKey    ctxKey = "Span"
 )
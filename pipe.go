@@ -0,0 +1,16 @@
+package pgsrv
+
+import (
+	"net"
+)
+
+// Pipe serves a single session in-process over net.Pipe, and returns the
+// client end of the connection. It's the supported way of writing protocol
+// level tests, driving the session with a frontend like pgproto3.Frontend and
+// asserting the exact messages of the startup, authentication and query
+// flows without sockets. Closing the returned connection ends the session.
+func Pipe(srv Server) net.Conn {
+	client, backend := net.Pipe()
+	go srv.Serve(backend)
+	return client
+}
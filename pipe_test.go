@@ -0,0 +1,94 @@
+package pgsrv
+
+import (
+	"crypto/md5"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// passwordQueryer authenticates the users with its PasswordProvider
+type passwordQueryer struct {
+	mockQueryer
+	PasswordProvider
+}
+
+func TestPipe(t *testing.T) {
+	// startUp sends the startup message of alice over a new pipe
+	startUp := func(t *testing.T, srv Server) *pgproto3.Frontend {
+		conn := Pipe(srv)
+		frontend, err := pgproto3.NewFrontend(conn, conn)
+		require.NoError(t, err)
+
+		err = frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "alice"},
+		})
+		require.NoError(t, err)
+		return frontend
+	}
+
+	authOK := &pgproto3.Authentication{Type: pgproto3.AuthTypeOk}
+	expectReady := func(t *testing.T, frontend *pgproto3.Frontend) {
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				return
+			}
+		}
+	}
+
+	t.Run("trust", func(t *testing.T) {
+		frontend := startUp(t, New(&mockQueryer{}))
+		require.Equal(t, authOK, receive(t, frontend, &pgproto3.Authentication{}))
+		expectReady(t, frontend)
+
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("clear text", func(t *testing.T) {
+		srv := New(&passwordQueryer{PasswordProvider: &constantPasswordProvider{password: []byte("secret")}})
+
+		frontend := startUp(t, srv)
+		require.Equal(t, &pgproto3.Authentication{Type: pgproto3.AuthTypeCleartextPassword}, receive(t, frontend, &pgproto3.Authentication{}))
+		require.NoError(t, frontend.Send(&pgproto3.PasswordMessage{Password: "secret"}))
+		require.Equal(t, authOK, receive(t, frontend, &pgproto3.Authentication{}))
+		expectReady(t, frontend)
+
+		frontend = startUp(t, srv)
+		receive(t, frontend, &pgproto3.Authentication{})
+		require.NoError(t, frontend.Send(&pgproto3.PasswordMessage{Password: "wrong"}))
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{}).(*pgproto3.ErrorResponse)
+		require.Equal(t, "FATAL", msg.Severity)
+		require.Equal(t, "password does not match for user \"alice\"", msg.Message)
+	})
+
+	t.Run("md5", func(t *testing.T) {
+		srv := New(&passwordQueryer{PasswordProvider: MD5Passwords(map[string]string{"alice": "secret"})})
+
+		// password responds to the md5 challenge like psql
+		password := func(pass string, auth *pgproto3.Authentication) string {
+			digest := md5.Sum([]byte(pass + "alice"))
+			return string(hashWithSalt(digest[:], auth.Salt[:]))
+		}
+
+		frontend := startUp(t, srv)
+		auth := receive(t, frontend, &pgproto3.Authentication{}).(*pgproto3.Authentication)
+		require.Equal(t, uint32(pgproto3.AuthTypeMD5Password), auth.Type)
+		require.NoError(t, frontend.Send(&pgproto3.PasswordMessage{Password: password("secret", auth)}))
+		require.Equal(t, authOK, receive(t, frontend, &pgproto3.Authentication{}))
+		expectReady(t, frontend)
+
+		frontend = startUp(t, srv)
+		auth = receive(t, frontend, &pgproto3.Authentication{}).(*pgproto3.Authentication)
+		require.NoError(t, frontend.Send(&pgproto3.PasswordMessage{Password: password("wrong", auth)}))
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{}).(*pgproto3.ErrorResponse)
+		require.Equal(t, "FATAL", msg.Severity)
+		require.Equal(t, "password does not match for user \"alice\"", msg.Message)
+	})
+}
@@ -0,0 +1,174 @@
+package pgsrv
+
+import (
+	"context"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"reflect"
+)
+
+// prepared handles the PREPARE, EXECUTE and DEALLOCATE statements of the
+// simple protocol, against the same prepared statements used by the extended
+// protocol.
+func (q *query) prepared(ctx context.Context, sess Session, n nodes.Node) error {
+	s, ok := sess.(*session)
+	// only session implementation is capable of storing prepared stmts
+	if !ok {
+		return Unsupported("prepared statements")
+	}
+
+	switch v := n.(type) {
+	case nodes.PrepareStmt:
+		name := ""
+		if v.Name != nil {
+			name = *v.Name
+		}
+		if _, exists := s.stmts[name]; exists {
+			return DuplicatePreparedStatement(name)
+		}
+		err := s.checkStatementsLimit(name)
+		if err != nil {
+			return err
+		}
+		s.stmts[name] = &v
+		return q.transport.Write(protocol.CommandComplete("PREPARE"))
+	case nodes.ExecuteStmt:
+		name := ""
+		if v.Name != nil {
+			name = *v.Name
+		}
+		ps, exists := s.stmts[name]
+		if !exists {
+			return InvalidSQLStatementName(name)
+		}
+
+		stmt, err := bindParams(ps, v.Params.Items)
+		if err != nil {
+			return err
+		}
+		return q.handle(ctx, sess, Statement{Kind: statementKind(stmt), Node: stmt})
+	case nodes.DeallocateStmt:
+		if v.Name == nil { // DEALLOCATE ALL
+			s.stmts = map[string]*nodes.PrepareStmt{}
+			return q.transport.Write(protocol.CommandComplete("DEALLOCATE ALL"))
+		}
+		if _, exists := s.stmts[*v.Name]; !exists {
+			return InvalidSQLStatementName(*v.Name)
+		}
+		delete(s.stmts, *v.Name)
+		return q.transport.Write(protocol.CommandComplete("DEALLOCATE"))
+	}
+	return Unsupported("prepared statement command")
+}
+
+// bindParams returns a copy of the prepared statement's query with its
+// parameters ($1, $2, etc.) replaced by the provided values, cast to the types
+// of the parameters when these were specified.
+func bindParams(ps *nodes.PrepareStmt, params []nodes.Node) (nodes.Node, error) {
+	n := len(ps.Argtypes.Items)
+	for num := range inferParameterTypes(ps.Query) {
+		if num > n {
+			n = num
+		}
+	}
+
+	name := ""
+	if ps.Name != nil {
+		name = *ps.Name
+	}
+	if len(params) != n {
+		err := SyntaxError("wrong number of parameters for prepared statement \"%s\"", name)
+		return nil, WithDetail(err, "Expected %d parameters but got %d.", n, len(params))
+	}
+
+	values := make([]nodes.Node, n)
+	for i, param := range params {
+		values[i] = param
+		if i < len(ps.Argtypes.Items) {
+			if typ, ok := ps.Argtypes.Items[i].(nodes.TypeName); ok {
+				values[i] = nodes.TypeCast{Arg: param, TypeName: &typ}
+			}
+		}
+	}
+
+	return replaceNodes(ps.Query, func(n nodes.Node) (nodes.Node, bool) {
+		p, ok := n.(nodes.ParamRef)
+		if !ok || p.Number < 1 || p.Number > len(values) {
+			return nil, false
+		}
+		return values[p.Number-1], true
+	}), nil
+}
+
+// replaceNodes returns a copy of the tree rooted at n, with the nodes for
+// which fn returns true replaced by the node it returns. The original tree is
+// left unmodified.
+func replaceNodes(n nodes.Node, fn func(nodes.Node) (nodes.Node, bool)) nodes.Node {
+	res := replaceValue(reflect.ValueOf(n), fn)
+	if !res.IsValid() {
+		return nil
+	}
+	return res.Interface().(nodes.Node)
+}
+
+func replaceValue(v reflect.Value, fn func(nodes.Node) (nodes.Node, bool)) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		res := reflect.New(v.Type()).Elem()
+		setValue(res, replaceValue(v.Elem(), fn), v.Elem())
+		return res
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		res := reflect.New(v.Type().Elem())
+		setValue(res.Elem(), replaceValue(v.Elem(), fn), v.Elem())
+		return res
+	case reflect.Struct:
+		if v.CanInterface() {
+			if n, ok := v.Interface().(nodes.Node); ok {
+				if replaced, ok := fn(n); ok {
+					return reflect.ValueOf(replaced)
+				}
+			}
+		}
+		res := reflect.New(v.Type()).Elem()
+		res.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if res.Field(i).CanSet() {
+				setValue(res.Field(i), replaceValue(v.Field(i), fn), v.Field(i))
+			}
+		}
+		return res
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		res := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			setValue(res.Index(i), replaceValue(v.Index(i), fn), v.Index(i))
+		}
+		return res
+	case reflect.Array:
+		res := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			setValue(res.Index(i), replaceValue(v.Index(i), fn), v.Index(i))
+		}
+		return res
+	}
+	return v
+}
+
+// setValue sets dst to the replaced value, or to the original one if the
+// replacement isn't assignable to it, like a node replacing a field of a
+// concrete type
+func setValue(dst, replaced, original reflect.Value) {
+	if replaced.IsValid() && replaced.Type().AssignableTo(dst.Type()) {
+		dst.Set(replaced)
+	} else if original.IsValid() {
+		dst.Set(original)
+	}
+}
@@ -0,0 +1,113 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// recordingQueryer records the nodes it serves
+type recordingQueryer struct {
+	nodes []nodes.Node
+}
+
+func (q *recordingQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	q.nodes = append(q.nodes, n)
+	return &mockRows{}, nil
+}
+
+func (q *recordingQueryer) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
+	q.nodes = append(q.nodes, n)
+	return driver.RowsAffected(1), nil
+}
+
+func TestQuery_prepared(t *testing.T) {
+	queryer := &recordingQueryer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	frontend, _ := connect(t, srv)
+
+	complete := func(t *testing.T, sql, tag string) {
+		sendQuery(t, frontend, sql)
+		msg := receive(t, frontend, &pgproto3.CommandComplete{})
+		require.Equal(t, tag, string(msg.(*pgproto3.CommandComplete).CommandTag))
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+	fail := func(t *testing.T, sql, code string) {
+		sendQuery(t, frontend, sql)
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, code, msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+
+	t.Run("prepare", func(t *testing.T) {
+		complete(t, "PREPARE foo (int4) AS SELECT $1", "PREPARE")
+		complete(t, "PREPARE bar AS INSERT INTO t", "PREPARE")
+		fail(t, "PREPARE foo AS SELECT 1", "42P05")
+		require.Empty(t, queryer.nodes)
+	})
+
+	t.Run("execute query", func(t *testing.T) {
+		sendQuery(t, frontend, "EXECUTE foo(42)")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		require.Len(t, queryer.nodes, 1)
+		target := queryer.nodes[0].(nodes.SelectStmt).TargetList.Items[0].(nodes.ResTarget)
+		cast := target.Val.(nodes.TypeCast)
+		require.Equal(t, nodes.A_Const{Val: nodes.Integer{Ival: 42}}, cast.Arg)
+		require.Equal(t, nodes.String{Str: "int4"}, cast.TypeName.Names.Items[0])
+	})
+
+	t.Run("execute command", func(t *testing.T) {
+		complete(t, "EXECUTE bar", "INSERT 0 1")
+		require.Len(t, queryer.nodes, 2)
+		require.IsType(t, nodes.InsertStmt{}, queryer.nodes[1])
+	})
+
+	t.Run("execute errors", func(t *testing.T) {
+		fail(t, "EXECUTE foo(1, 2)", "42601")
+		fail(t, "EXECUTE foo", "42601")
+		fail(t, "EXECUTE missing", "26000")
+	})
+
+	t.Run("deallocate", func(t *testing.T) {
+		complete(t, "DEALLOCATE foo", "DEALLOCATE")
+		fail(t, "EXECUTE foo(42)", "26000")
+		fail(t, "DEALLOCATE foo", "26000")
+
+		complete(t, "DEALLOCATE ALL", "DEALLOCATE ALL")
+		fail(t, "EXECUTE bar", "26000")
+	})
+}
+
+func TestBindParams(t *testing.T) {
+	name := "foo"
+	ps := &nodes.PrepareStmt{
+		Name: &name,
+		Query: nodes.SelectStmt{TargetList: nodes.List{Items: []nodes.Node{
+			nodes.ResTarget{Val: nodes.ParamRef{Number: 2}},
+			nodes.ResTarget{Val: nodes.ParamRef{Number: 1}},
+		}}},
+	}
+	original := ps.Query
+
+	stmt, err := bindParams(ps, []nodes.Node{
+		nodes.A_Const{Val: nodes.Integer{Ival: 1}},
+		nodes.A_Const{Val: nodes.String{Str: "two"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, nodes.SelectStmt{TargetList: nodes.List{Items: []nodes.Node{
+		nodes.ResTarget{Val: nodes.A_Const{Val: nodes.String{Str: "two"}}},
+		nodes.ResTarget{Val: nodes.A_Const{Val: nodes.Integer{Ival: 1}}},
+	}}}, stmt)
+	require.Equal(t, original, ps.Query, "expected the prepared statement to remain unmodified")
+
+	_, err = bindParams(ps, nil)
+	require.Error(t, err)
+	require.Equal(t, "wrong number of parameters for prepared statement \"foo\"", err.Error())
+	require.Equal(t, "Expected 2 parameters but got 0.", fromErr(err).D)
+}
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgio"
+	"github.com/jackc/pgx/pgproto3"
+	"io"
+)
+
+// COPY data formats, of the entire data and of each of its columns
+const (
+	CopyTextFormat   = 0
+	CopyBinaryFormat = 1
+)
+
+// CopyInResponse is sent when the backend is ready to receive the data of a
+// COPY FROM STDIN, in the provided overall format. All of the columns are in
+// the same format, as postgres currently requires.
+func CopyInResponse(format int8, numCols int) Message {
+	return copyResponse(MsgTypeCopyInResponse, format, numCols)
+}
+
+// CopyOutResponse is sent when the backend starts sending the data of a COPY
+// TO STDOUT, in the provided overall format, followed by the data in CopyData
+// messages and a CopyDone
+func CopyOutResponse(format int8, numCols int) Message {
+	return copyResponse(MsgTypeCopyOutResponse, format, numCols)
+}
+
+// copyResponse creates a CopyInResponse or a CopyOutResponse
+func copyResponse(typ byte, format int8, numCols int) Message {
+	msg := []byte{typ, 0, 0, 0, 0, byte(format)}
+	msg = pgio.AppendInt16(msg, int16(numCols))
+	for i := 0; i < numCols; i++ {
+		msg = pgio.AppendInt16(msg, int16(format))
+	}
+
+	// write the length
+	binary.BigEndian.PutUint32(msg[1:5], uint32(len(msg)-1))
+	return msg
+}
+
+// CopyData is a chunk of the data of a COPY TO STDOUT, which is usually a
+// single row
+func CopyData(data []byte) Message {
+	msg := []byte{MsgTypeCopyData, 0, 0, 0, 0}
+	msg = append(msg, data...)
+
+	// write the length
+	binary.BigEndian.PutUint32(msg[1:5], uint32(len(msg)-1))
+	return msg
+}
+
+// CopyOutDone is sent by the backend once it's done sending the data of a COPY
+// TO STDOUT. It's the same message as CopyDone, sent by the frontend.
+var CopyOutDone = Message((&CopyDone{}).Encode(nil))
+
+// CopyDone is sent by the frontend when it's done sending the data of a COPY
+// FROM STDIN. It isn't decoded by pgproto3.Backend, which only supports it as
+// a backend message.
+type CopyDone struct{}
+
+// Frontend identifies this message as sendable by the frontend
+func (*CopyDone) Frontend() {}
+
+// Decode decodes src into dst. src must contain the complete message with the
+// exception of the initial 1 byte message type identifier and 4 byte message
+// length.
+func (dst *CopyDone) Decode(src []byte) error {
+	if len(src) != 0 {
+		return fmt.Errorf("invalid CopyDone message format")
+	}
+	return nil
+}
+
+// Encode appends the message to dst and returns the new buffer
+func (src *CopyDone) Encode(dst []byte) []byte {
+	return append(dst, MsgTypeCopyDone, 0, 0, 0, 4)
+}
+
+// CopyFail is sent by the frontend to abort a COPY FROM STDIN, with the reason
+// of the failure. It isn't decoded by pgproto3.Backend, which only supports it
+// as a backend message.
+type CopyFail struct {
+	Message string
+}
+
+// Frontend identifies this message as sendable by the frontend
+func (*CopyFail) Frontend() {}
+
+// Decode decodes src into dst. src must contain the complete message with the
+// exception of the initial 1 byte message type identifier and 4 byte message
+// length.
+func (dst *CopyFail) Decode(src []byte) error {
+	idx := bytes.IndexByte(src, 0)
+	if idx != len(src)-1 {
+		return fmt.Errorf("invalid CopyFail message format")
+	}
+	dst.Message = string(src[:idx])
+	return nil
+}
+
+// Encode appends the message to dst and returns the new buffer
+func (src *CopyFail) Encode(dst []byte) []byte {
+	dst = append(dst, MsgTypeCopyFail)
+	sp := len(dst)
+	dst = pgio.AppendInt32(dst, -1)
+
+	dst = append(dst, src.Message...)
+	dst = append(dst, 0)
+
+	pgio.SetInt32(dst[sp:], int32(len(dst[sp:])))
+	return dst
+}
+
+// CopyFailError is returned by ReadCopyData when the frontend aborts the COPY
+// with a CopyFail message
+type CopyFailError struct {
+	Message string
+}
+
+func (e *CopyFailError) Error() string {
+	return "COPY from stdin failed: " + e.Message
+}
+
+// ReadCopyData reads the next chunk of the data sent by the frontend after a
+// CopyInResponse. The chunks aren't aligned with the rows of the data. It
+// returns io.EOF once the frontend sends CopyDone, and a CopyFailError when
+// it sends CopyFail. Flush and Sync messages are ignored until then, as the
+// protocol requires, while any other message fails the COPY.
+func (t *Transport) ReadCopyData() ([]byte, error) {
+	for {
+		msg, err := t.readFrontendMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			return msg.Data, nil
+		case *CopyDone:
+			return nil, io.EOF
+		case *CopyFail:
+			return nil, &CopyFailError{msg.Message}
+		case *pgproto3.Flush, *pgproto3.Sync:
+			continue
+		default:
+			return nil, fmt.Errorf("unexpected message type %T during COPY from stdin", msg)
+		}
+	}
+}
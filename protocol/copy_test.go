@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"bytes"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCopyInResponse(t *testing.T) {
+	res := &pgproto3.CopyInResponse{}
+	err := res.Decode(CopyInResponse(CopyBinaryFormat, 2)[5:])
+	require.NoError(t, err)
+	require.Equal(t, &pgproto3.CopyInResponse{OverallFormat: 1, ColumnFormatCodes: []uint16{1, 1}}, res)
+}
+
+func TestCopyOutResponse(t *testing.T) {
+	res := &pgproto3.CopyOutResponse{}
+	msg := CopyOutResponse(CopyTextFormat, 3)
+	require.Equal(t, byte('H'), msg[0])
+	require.NoError(t, res.Decode(msg[5:]))
+	require.Equal(t, &pgproto3.CopyOutResponse{OverallFormat: 0, ColumnFormatCodes: []uint16{0, 0, 0}}, res)
+}
+
+func TestCopyData(t *testing.T) {
+	msg := CopyData([]byte("1\tfoo\n"))
+	require.Equal(t, []byte{'d', 0, 0, 0, 11}, []byte(msg[:5]))
+	require.Equal(t, "1\tfoo\n", string(msg[5:]))
+	require.Equal(t, []byte{'c', 0, 0, 0, 4}, []byte(CopyOutDone))
+}
+
+func TestCopyDone(t *testing.T) {
+	b := (&CopyDone{}).Encode(nil)
+	require.Equal(t, []byte{'c', 0, 0, 0, 4}, b)
+	require.NoError(t, (&CopyDone{}).Decode(b[5:]))
+	require.Error(t, (&CopyDone{}).Decode([]byte{0}))
+}
+
+func TestCopyFail(t *testing.T) {
+	b := (&CopyFail{Message: "canceled"}).Encode(nil)
+	require.Equal(t, byte('f'), b[0])
+
+	decoded := &CopyFail{}
+	err := decoded.Decode(b[5:])
+	require.NoError(t, err)
+	require.Equal(t, &CopyFail{Message: "canceled"}, decoded)
+
+	err = decoded.Decode(b[5 : len(b)-1])
+	require.Error(t, err)
+}
+
+func TestTransport_ReadCopyData(t *testing.T) {
+	var in []byte
+	in = (&pgproto3.CopyData{Data: []byte("1\tfoo\n2\t")}).Encode(in)
+	in = (&pgproto3.Flush{}).Encode(in)
+	in = (&pgproto3.CopyData{Data: []byte("bar\n")}).Encode(in)
+	in = (&pgproto3.Sync{}).Encode(in)
+	in = (&CopyDone{}).Encode(in)
+	in = (&CopyFail{Message: "canceled by user"}).Encode(in)
+	in = (&pgproto3.Query{String: "SELECT 1"}).Encode(in)
+
+	transport := NewTransport(struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewBuffer(in), ioutil.Discard})
+
+	data, err := transport.ReadCopyData()
+	require.NoError(t, err)
+	require.Equal(t, "1\tfoo\n2\t", string(data))
+
+	data, err = transport.ReadCopyData()
+	require.NoError(t, err)
+	require.Equal(t, "bar\n", string(data))
+
+	_, err = transport.ReadCopyData()
+	require.Equal(t, io.EOF, err)
+
+	_, err = transport.ReadCopyData()
+	require.Equal(t, &CopyFailError{"canceled by user"}, err)
+	require.Equal(t, "COPY from stdin failed: canceled by user", err.Error())
+
+	_, err = transport.ReadCopyData()
+	require.EqualError(t, err, "unexpected message type *pgproto3.Query during COPY from stdin")
+}
@@ -7,10 +7,20 @@ import (
 )
 
 // ParseComplete is sent when backend parsed a prepared statement successfully
-var ParseComplete = []byte{'1', 0, 0, 0, 4}
+var ParseComplete = []byte{MsgTypeParseComplete, 0, 0, 0, 4}
 
 // BindComplete is sent when backend prepared a portal and finished planning the query
-var BindComplete = []byte{'2', 0, 0, 0, 4}
+var BindComplete = []byte{MsgTypeBindComplete, 0, 0, 0, 4}
+
+// CloseComplete is sent when backend closed a prepared statement or portal
+var CloseComplete = []byte{MsgTypeCloseComplete, 0, 0, 0, 4}
+
+// NoData is sent when the described statement or portal doesn't return rows
+var NoData = []byte{MsgTypeNoData, 0, 0, 0, 4}
+
+// PortalSuspended is sent when Execute reached its row limit before the end of
+// the portal's rows
+var PortalSuspended = []byte{MsgTypePortalSuspended, 0, 0, 0, 4}
 
 // Describe message object types
 const (
@@ -18,10 +28,16 @@ const (
 	DescribePortal    = 'P'
 )
 
+// Close message object types
+const (
+	CloseStatement = 'S'
+	ClosePortal    = 'P'
+)
+
 // ParameterDescription is sent when backend received Describe message from frontend
 // with ObjectType = 'S' - requesting to describe prepared statement with a provided name
 func ParameterDescription(ps *nodes.PrepareStmt) (Message, error) {
-	res := []byte{'t'}
+	res := []byte{MsgTypeParameterDescription}
 	sp := len(res)
 	res = pgio.AppendInt32(res, -1)
 
@@ -42,14 +58,35 @@ type transaction struct {
 	transport *Transport
 	in        []pgproto3.FrontendMessage // TODO: asses if we need it after implementation of prepared statements and portals is done
 	out       []Message                  // TODO: add size limit
+	failed    bool                       // once an error is written, until Sync, see hasError
 }
 
-// NextFrontendMessage uses Transport to read the next message into the transaction's incoming messages buffer
+// NextFrontendMessage uses Transport to read the next message into the transaction's incoming messages buffer.
+// Once the transaction has failed, all of the messages are discarded until Sync (or Terminate), as the
+// protocol requires, so the failed transaction ends with a single ReadyForQuery.
 func (t *transaction) NextFrontendMessage() (msg pgproto3.FrontendMessage, err error) {
-	if msg, err = t.transport.readFrontendMessage(); err == nil {
+	for {
+		msg, err = t.transport.readFrontendMessage()
+		if err != nil {
+			return
+		}
+
+		if t.hasError() && !endsFailedTransaction(msg) {
+			continue
+		}
 		t.in = append(t.in, msg)
+		return
 	}
-	return
+}
+
+// endsFailedTransaction reports whether the message is handled after the
+// transaction has failed
+func endsFailedTransaction(msg pgproto3.FrontendMessage) bool {
+	switch msg.(type) {
+	case *pgproto3.Sync, *pgproto3.Terminate:
+		return true
+	}
+	return false
 }
 
 // Write writes the provided message into the transaction's outgoing messages buffer
@@ -58,11 +95,14 @@ func (t *transaction) Write(msg Message) error {
 		return nil
 	}
 	t.out = append(t.out, msg)
+	t.failed = msg.IsError()
 	return nil
 }
 
+// hasError reports whether an error was written, even if it was already
+// flushed (see Transport.Flush)
 func (t *transaction) hasError() bool {
-	return len(t.out) > 0 && t.out[len(t.out)-1].IsError()
+	return t.failed
 }
 
 func (t *transaction) flush() (err error) {
@@ -4,10 +4,49 @@ import (
 	"bufio"
 	"bytes"
 	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
 	"github.com/stretchr/testify/require"
 	"testing"
 )
 
+func TestExtendedQueryMessages(t *testing.T) {
+	tests := map[string]struct {
+		msg      []byte
+		expected []byte
+	}{
+		"ParseComplete":   {ParseComplete, []byte{'1', 0, 0, 0, 4}},
+		"BindComplete":    {BindComplete, []byte{'2', 0, 0, 0, 4}},
+		"CloseComplete":   {CloseComplete, []byte{'3', 0, 0, 0, 4}},
+		"NoData":          {NoData, []byte{'n', 0, 0, 0, 4}},
+		"PortalSuspended": {PortalSuspended, []byte{'s', 0, 0, 0, 4}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.expected, test.msg)
+		})
+	}
+}
+
+func TestParameterDescription(t *testing.T) {
+	msg, err := ParameterDescription(&nodes.PrepareStmt{
+		Argtypes: nodes.List{Items: []nodes.Node{
+			nodes.TypeName{TypeOid: 23},
+			nodes.TypeName{TypeOid: 25},
+		}},
+	})
+	require.NoError(t, err)
+
+	expected := []byte{
+		't',         // type
+		0, 0, 0, 14, // size
+		0, 2, // number of parameters
+		0, 0, 0, 23, // int4
+		0, 0, 0, 25, // text
+	}
+	require.Equal(t, expected, []byte(msg))
+}
+
 func TestTransaction_Read(t *testing.T) {
 	buf := bytes.Buffer{}
 	comm := bufio.NewReadWriter(bufio.NewReader(&buf), bufio.NewWriter(&buf))
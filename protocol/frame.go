@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"io"
+	"io/ioutil"
+)
+
+// frontendMessageTypes are the types of the frontend messages decoded by
+// pgproto3.Backend, after the startup
+var frontendMessageTypes = map[byte]bool{
+	MsgTypeBind:            true,
+	MsgTypeClose:           true,
+	MsgTypeDescribe:        true,
+	MsgTypeExecute:         true,
+	MsgTypeFlush:           true,
+	MsgTypeParse:           true,
+	MsgTypePasswordMessage: true,
+	MsgTypeQuery:           true,
+	MsgTypeSync:            true,
+	MsgTypeTerminate:       true,
+}
+
+// transportMessageTypes are the types of the frontend messages that aren't
+// decoded by pgproto3.Backend, but by the Transport itself
+var transportMessageTypes = map[byte]func() pgproto3.FrontendMessage{
+	MsgTypeFunctionCall: func() pgproto3.FrontendMessage { return &FunctionCall{} },
+	MsgTypeCopyData:     func() pgproto3.FrontendMessage { return &pgproto3.CopyData{} },
+	MsgTypeCopyDone:     func() pgproto3.FrontendMessage { return &CopyDone{} },
+	MsgTypeCopyFail:     func() pgproto3.FrontendMessage { return &CopyFail{} },
+}
+
+// substituteMessage replaces the messages of types that pgproto3.Backend
+// doesn't decode, see frameReader
+var substituteMessage = []byte{MsgTypeFlush, 0, 0, 0, 4}
+
+// frame is a message read by frameReader in place of pgproto3.Backend
+type frame struct {
+	typ  byte
+	body []byte // nil for unsupported types, which are discarded
+}
+
+// frameReader reads the frontend messages from the underlying reader, a
+// message at a time, checking the lengths in their headers before they're
+// decoded, since the decoder allocates the entire message upfront.
+//
+// Messages of types that the decoder doesn't support, which it fails to skip,
+// are replaced by a Flush message, and recorded by their position in the
+// stream, to be decoded by the Transport or reported as unsupported once
+// they're received (see Transport.receive).
+//
+// It also records the errors of the underlying reader, to tell them apart
+// from the errors of decoding.
+type frameReader struct {
+	r   io.Reader
+	err error // of the underlying reader, or a ProtocolError
+	max int
+
+	pending     []byte        // the header of the current message, not read yet
+	remaining   int           // bytes of the current message's body not read yet
+	count       int           // the number of messages read so far
+	substituted map[int]frame // the replaced messages, by number
+}
+
+func (r *frameReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	defer func() {
+		if err != nil && r.err == nil {
+			r.err = err
+		}
+	}()
+
+	if len(r.pending) == 0 && r.remaining == 0 {
+		err = r.readHeader()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(r.pending) > 0 {
+		n = copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err = r.r.Read(p)
+	r.remaining -= n
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readHeader reads the header of the next message, discarding the entire
+// message if it's of an unsupported type
+func (r *frameReader) readHeader() error {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r.r, header)
+	if err != nil {
+		return err
+	}
+
+	length := int(int32(binary.BigEndian.Uint32(header[1:])))
+	if length < 4 || length > r.max {
+		return &ProtocolError{fmt.Sprintf("invalid message length %d", length)}
+	}
+
+	r.count++
+	if frontendMessageTypes[header[0]] {
+		r.pending, r.remaining = header, length-4
+		return nil
+	}
+
+	f := frame{typ: header[0]}
+	if transportMessageTypes[f.typ] != nil {
+		f.body = make([]byte, length-4)
+		_, err = io.ReadFull(r.r, f.body)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, r.r, int64(length-4))
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	r.substituted[r.count] = f
+	r.pending = substituteMessage
+	return nil
+}
+
+// unsupportedMessage is the error of receiving a message of an unsupported
+// type, which is reported to the client without ending the session
+type unsupportedMessage byte
+
+func (e unsupportedMessage) Error() string {
+	return fmt.Sprintf("unsupported frontend message type '%c'", byte(e))
+}
+
+// Code returns the SQLSTATE of protocol_violation
+func (e unsupportedMessage) Code() string { return "08P01" }
@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgio"
+)
+
+// FunctionCall is the fast-path message for calling a function by its OID,
+// which isn't decoded by pgproto3.Backend. A nil argument is NULL.
+// see: https://www.postgresql.org/docs/current/protocol-flow.html#id-1.10.5.7.6
+type FunctionCall struct {
+	Function         uint32
+	ArgFormatCodes   []int16
+	Arguments        [][]byte
+	ResultFormatCode int16
+}
+
+// Frontend identifies this message as sendable by the frontend
+func (*FunctionCall) Frontend() {}
+
+// Decode decodes src into dst. src must contain the complete message with the
+// exception of the initial 1 byte message type identifier and 4 byte message
+// length.
+func (dst *FunctionCall) Decode(src []byte) error {
+	*dst = FunctionCall{}
+	rp := 0
+
+	next := func(n int) ([]byte, error) {
+		if n < 0 || len(src)-rp < n {
+			return nil, fmt.Errorf("invalid FunctionCall message format")
+		}
+		b := src[rp : rp+n]
+		rp += n
+		return b, nil
+	}
+
+	b, err := next(6)
+	if err != nil {
+		return err
+	}
+	dst.Function = binary.BigEndian.Uint32(b)
+	count := int(binary.BigEndian.Uint16(b[4:]))
+
+	for i := 0; i < count; i++ {
+		b, err = next(2)
+		if err != nil {
+			return err
+		}
+		dst.ArgFormatCodes = append(dst.ArgFormatCodes, int16(binary.BigEndian.Uint16(b)))
+	}
+
+	b, err = next(2)
+	if err != nil {
+		return err
+	}
+	count = int(binary.BigEndian.Uint16(b))
+
+	for i := 0; i < count; i++ {
+		b, err = next(4)
+		if err != nil {
+			return err
+		}
+		size := int(int32(binary.BigEndian.Uint32(b)))
+		if size == -1 {
+			dst.Arguments = append(dst.Arguments, nil)
+			continue
+		}
+
+		b, err = next(size)
+		if err != nil {
+			return err
+		}
+		dst.Arguments = append(dst.Arguments, b)
+	}
+
+	b, err = next(2)
+	if err != nil {
+		return err
+	}
+	dst.ResultFormatCode = int16(binary.BigEndian.Uint16(b))
+
+	if rp != len(src) {
+		return fmt.Errorf("invalid FunctionCall message format")
+	}
+	return nil
+}
+
+// Encode appends the message to dst and returns the new buffer
+func (src *FunctionCall) Encode(dst []byte) []byte {
+	dst = append(dst, MsgTypeFunctionCall)
+	sp := len(dst)
+	dst = pgio.AppendInt32(dst, -1)
+
+	dst = pgio.AppendUint32(dst, src.Function)
+	dst = pgio.AppendUint16(dst, uint16(len(src.ArgFormatCodes)))
+	for _, fc := range src.ArgFormatCodes {
+		dst = pgio.AppendInt16(dst, fc)
+	}
+
+	dst = pgio.AppendUint16(dst, uint16(len(src.Arguments)))
+	for _, arg := range src.Arguments {
+		if arg == nil {
+			dst = pgio.AppendInt32(dst, -1)
+			continue
+		}
+		dst = pgio.AppendInt32(dst, int32(len(arg)))
+		dst = append(dst, arg...)
+	}
+	dst = pgio.AppendInt16(dst, src.ResultFormatCode)
+
+	pgio.SetInt32(dst[sp:], int32(len(dst[sp:])))
+	return dst
+}
+
+// FunctionCallResponse is sent with the result of a FunctionCall. A nil result
+// is NULL.
+func FunctionCallResponse(result []byte) Message {
+	msg := []byte{MsgTypeFunctionCallResponse, 0, 0, 0, 0}
+	if result == nil {
+		msg = pgio.AppendInt32(msg, -1)
+	} else {
+		msg = pgio.AppendInt32(msg, int32(len(result)))
+		msg = append(msg, result...)
+	}
+
+	// write the length
+	binary.BigEndian.PutUint32(msg[1:5], uint32(len(msg)-1))
+	return msg
+}
@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestFunctionCall(t *testing.T) {
+	t.Run("encode and decode", func(t *testing.T) {
+		msg := &FunctionCall{
+			Function:         1000,
+			ArgFormatCodes:   []int16{0, 1},
+			Arguments:        [][]byte{[]byte("foo"), nil},
+			ResultFormatCode: 1,
+		}
+
+		b := msg.Encode(nil)
+		require.Equal(t, byte('F'), b[0])
+
+		decoded := &FunctionCall{}
+		err := decoded.Decode(b[5:])
+		require.NoError(t, err)
+		require.Equal(t, msg, decoded)
+	})
+
+	t.Run("invalid format", func(t *testing.T) {
+		b := (&FunctionCall{Function: 1000, Arguments: [][]byte{[]byte("foo")}}).Encode(nil)
+		for _, body := range [][]byte{b[5 : len(b)-1], append(b[5:], 0)} {
+			err := (&FunctionCall{}).Decode(body)
+			require.Error(t, err)
+		}
+	})
+}
+
+func TestFunctionCallResponse(t *testing.T) {
+	for _, result := range [][]byte{[]byte("foo"), {}} {
+		res := &pgproto3.FunctionCallResponse{}
+		err := res.Decode(FunctionCallResponse(result)[5:])
+		require.NoError(t, err)
+		require.Equal(t, result, res.Result)
+	}
+
+	// NULL
+	require.Equal(t, Message{'V', 0, 0, 0, 8, 0xff, 0xff, 0xff, 0xff}, FunctionCallResponse(nil))
+}
@@ -0,0 +1,65 @@
+//go:build go1.18
+// +build go1.18
+
+package protocol
+
+import (
+	"bytes"
+	"github.com/jackc/pgx/pgproto3"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// FuzzReadFrontendMessage feeds arbitrary bytes to the handshake and to the
+// transport, expecting them to either succeed or fail with a ProtocolError
+func FuzzReadFrontendMessage(f *testing.F) {
+	f.Add((&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	}).Encode(nil))
+	f.Add((&pgproto3.Query{String: "SELECT 1"}).Encode(nil))
+	f.Add((&pgproto3.Parse{Name: "stmt", Query: "SELECT $1", ParameterOIDs: []uint32{23}}).Encode(nil))
+	f.Add((&pgproto3.Bind{PreparedStatement: "stmt", Parameters: [][]byte{[]byte("1")}}).Encode(nil))
+	f.Add((&pgproto3.Describe{ObjectType: 'S', Name: "stmt"}).Encode(nil))
+	f.Add((&pgproto3.Execute{Portal: ""}).Encode(nil))
+	f.Add((&pgproto3.Sync{}).Encode(nil))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		res, err := NewHandshake(bytes.NewBuffer(data)).Init()
+		if err == nil {
+			if res.IsCancel() {
+				_, _, err = res.CancelKeyData()
+			} else {
+				_, err = res.StartupArgs()
+			}
+		}
+		expectProtocolError(t, err)
+
+		transport := NewTransport(struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewBuffer(data), ioutil.Discard})
+		transport.SetMaxMessageLength(1 << 16)
+		for {
+			_, _, err := transport.NextFrontendMessage()
+			if err != nil {
+				expectProtocolError(t, err)
+				return
+			}
+		}
+	})
+}
+
+// expectProtocolError fails unless the error is a ProtocolError, or an error
+// of reading past the end of the data
+func expectProtocolError(t *testing.T, err error) {
+	switch err.(type) {
+	case nil, *ProtocolError:
+		return
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return
+	}
+	t.Fatalf("unexpected error: %#v", err)
+}
@@ -1,9 +1,20 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"github.com/jackc/pgx/pgproto3"
 	"io"
+	"strings"
+)
+
+// the bounds of the lengths of messages read during the handshake, which are
+// checked before allocating them, like postgres does
+const (
+	minStartupPacketLength = 8     // length and version
+	maxStartupPacketLength = 10000 // like MAX_STARTUP_PACKET_LENGTH
+	maxAuthMessageLength   = 65535 // like PG_MAX_AUTH_TOKEN_LENGTH
 )
 
 // NewHandshake crates an Handshake
@@ -15,25 +26,125 @@ func NewHandshake(rw io.ReadWriter) *Handshake {
 type Handshake struct {
 	rw     io.ReadWriter
 	passed bool
+
+	// upgrade switches the connection to TLS, see EnableTLS
+	upgrade func() error
+	strict  bool   // see SetStrictFraming
+	tracer  Tracer // see SetTracer
+}
+
+// SetTracer sets a Tracer to observe the messages read and written by the
+// Handshake, like Transport.SetTracer, starting with the startup message. The
+// passwords of the frontend aren't traced, nor is the single byte response to
+// SSLRequest, which isn't a message.
+func (h *Handshake) SetTracer(tracer Tracer) {
+	h.tracer = tracer
+}
+
+// SetStrictFraming enables the validation of the framing of every message
+// written by the Handshake, like Transport.SetStrictFraming
+func (h *Handshake) SetStrictFraming(strict bool) {
+	h.strict = strict
+}
+
+// EnableTLS accepts the SSLRequest of the frontend, instead of declining it,
+// and calls upgrade to perform the TLS handshake on the underlying connection
+// once the frontend is told to proceed. The connection read and written by
+// the Handshake must be encrypted from then on.
+func (h *Handshake) EnableTLS(upgrade func() error) {
+	h.upgrade = upgrade
 }
 
 // Write implements MessageReadWriter
 func (h *Handshake) Write(m Message) error {
+	if h.strict {
+		mustValidate(m)
+	}
+	if h.tracer != nil {
+		h.tracer.Backend(m)
+	}
 	_, err := h.rw.Write(m)
 	return err
 }
 
 // Read implements MessageReadWriter
 func (h *Handshake) Read() (Message, error) {
+	// send out buffered messages the client is waiting for before reading
+	err := flush(h.rw)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Message
 	if h.passed {
-		return h.readTypedMessage()
+		m, err = h.readTypedMessage()
+	} else {
+		m, err = h.readRawMessage()
+	}
+	if err == nil && h.tracer != nil {
+		h.tracer.Frontend(handshakeMessage(m, h.passed))
+	}
+	return m, err
+}
+
+// SSLRequest is the startup packet requesting TLS, as traced by the Handshake
+type SSLRequest struct{}
+
+// Frontend identifies this message as sendable by the frontend
+func (*SSLRequest) Frontend() {}
+
+// CancelRequest is the startup packet requesting to cancel the running query
+// of another session, as traced by the Handshake
+type CancelRequest struct {
+	ProcessID int32
+	SecretKey int32
+}
+
+// Frontend identifies this message as sendable by the frontend
+func (*CancelRequest) Frontend() {}
+
+// UnexpectedMessage is a message of a type that isn't expected during the
+// handshake, traced by its type alone
+type UnexpectedMessage struct {
+	Type byte
+}
+
+// Frontend identifies this message as sendable by the frontend
+func (*UnexpectedMessage) Frontend() {}
+
+// handshakeMessage decodes a message read by the Handshake for its Tracer.
+// The password messages are traced without their contents.
+func handshakeMessage(m Message, typed bool) pgproto3.FrontendMessage {
+	if typed {
+		if m.Type() == MsgTypePasswordMessage {
+			return &pgproto3.PasswordMessage{}
+		}
+		return &UnexpectedMessage{m.Type()}
+	}
+
+	switch {
+	case m.IsTLSRequest():
+		return &SSLRequest{}
+	case m.IsCancel():
+		pid, secret, _ := m.CancelKeyData()
+		return &CancelRequest{pid, secret}
 	}
-	return h.readRawMessage()
+
+	// the parameters are traced as sent, even when they're malformed
+	msg := &pgproto3.StartupMessage{
+		ProtocolVersion: binary.BigEndian.Uint32(m[4:8]),
+		Parameters:      make(map[string]string),
+	}
+	fields := bytes.Split(m[8:], []byte{0})
+	for i := 0; i+1 < len(fields) && len(fields[i]) > 0; i += 2 {
+		msg.Parameters[string(fields[i])] = string(fields[i+1])
+	}
+	return msg
 }
 
 // Init receives and validates the very first message from the frontend per session.
-// it may send message back to the frontend if needed to skip SSL request since it
-// currently not supported.
+// it may send message back to the frontend to respond to an SSL request, which is
+// declined unless TLS is enabled (see EnableTLS).
 //
 // once done, Init must not be called again, or error will be returned.
 func (h *Handshake) Init() (res Message, err error) {
@@ -54,24 +165,35 @@ func (h *Handshake) Init() (res Message, err error) {
 
 	// ssl request. see: SSLRequest in https://www.postgresql.org/docs/current/protocol-message-formats.html
 	if res.IsTLSRequest() {
-		// currently we don't support TLS.
-		_, err = h.rw.Write(TLSResponse(false))
+		_, err = h.rw.Write(TLSResponse(h.upgrade != nil))
 		if err != nil {
 			return nil, err
 		}
 
+		if h.upgrade != nil {
+			err = flush(h.rw)
+			if err == nil {
+				err = h.upgrade()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		res, err = h.Read()
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	// newer minor versions are negotiated down to 3.0, see
+	// NegotiateProtocolVersion
 	v, err := res.StartupVersion()
 	if err != nil {
 		return nil, err
 	}
-	if v != "3.0" {
-		return nil, fmt.Errorf("unsupported protocol version %s", v)
+	if !strings.HasPrefix(v, "3.") {
+		return nil, &ProtocolError{fmt.Sprintf("unsupported protocol version %s", v)}
 	}
 
 	h.passed = true
@@ -105,8 +227,23 @@ func (h *Handshake) readRawMessage() ([]byte, error) {
 		return nil, err
 	}
 
+	// clients of other protocols, like browsers, are told off in their own
+	// protocol rather than with an error they can't read
+	if !h.passed {
+		if err := foreignProtocol(lenBytes); err != nil {
+			h.rw.Write(err.response)
+			return nil, err
+		}
+	}
+
 	// convert the 4-bytes to int
 	length := int(binary.BigEndian.Uint32(lenBytes))
+	if !h.passed && (length < minStartupPacketLength || length > maxStartupPacketLength) {
+		return nil, &ProtocolError{"invalid length of startup packet"}
+	}
+	if h.passed && (length < 4 || length > maxAuthMessageLength) {
+		return nil, &ProtocolError{"invalid message length"}
+	}
 
 	// read the remaining bytes in the message
 	res := make([]byte, length)
@@ -120,3 +257,46 @@ func (h *Handshake) readRawMessage() ([]byte, error) {
 	copy(res[:4], lenBytes)
 	return res, nil
 }
+
+// ForeignProtocolError reports a client that connected with another protocol,
+// like a web browser sending an HTTP request, or a client starting a TLS
+// handshake without requesting it first. It's detected by the first bytes of
+// the startup packet, which are never a valid length, and the client is sent a
+// minimal response in its own protocol before the connection is closed.
+type ForeignProtocolError struct {
+	Protocol string
+	response []byte
+}
+
+func (e *ForeignProtocolError) Error() string {
+	return fmt.Sprintf("invalid startup packet: received %s instead of the postgres protocol", e.Protocol)
+}
+
+// httpMethods are the prefixes of HTTP requests, as the first 4 bytes
+var httpMethods = []string{"GET ", "POST", "PUT ", "HEAD", "DELE", "OPTI", "PATC", "CONN", "TRAC"}
+
+// httpResponse is sent to HTTP clients, like web browsers
+var httpResponse = []byte("HTTP/1.0 400 Bad Request\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Connection: close\r\n" +
+	"\r\n" +
+	"This is a PostgreSQL server, connect to it with a PostgreSQL client.\n")
+
+// tlsAlert is a fatal handshake_failure alert, sent to TLS clients
+var tlsAlert = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x28}
+
+// foreignProtocol detects the protocols of common mistaken clients by the first
+// 4 bytes they send
+func foreignProtocol(b []byte) *ForeignProtocolError {
+	// a TLS record of the ClientHello handshake
+	if b[0] == 0x16 && b[1] == 0x03 {
+		return &ForeignProtocolError{"TLS", tlsAlert}
+	}
+
+	for _, method := range httpMethods {
+		if string(b) == method {
+			return &ForeignProtocolError{"HTTP", httpResponse}
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"github.com/stretchr/testify/require"
+	"io"
 	"testing"
 )
 
@@ -66,3 +67,114 @@ func TestHandshake_Init(t *testing.T) {
 		require.Error(t, err, "expected second call to handshake.Init() to return an error")
 	})
 }
+
+func TestHandshake_invalidLength(t *testing.T) {
+	tests := map[string][]byte{
+		"empty startup packet":     {0, 0, 0, 0},
+		"short startup packet":     {0, 0, 0, 4},
+		"oversized startup packet": {0, 1, 0, 0},
+		"negative length":          {0xff, 0xff, 0xff, 0xff},
+	}
+
+	for name, msg := range tests {
+		t.Run(name, func(t *testing.T) {
+			handshake := NewHandshake(bytes.NewBuffer(msg))
+			_, err := handshake.Init()
+			require.Error(t, err)
+			require.IsType(t, &ProtocolError{}, err)
+		})
+	}
+
+	t.Run("typed message", func(t *testing.T) {
+		handshake := NewHandshake(bytes.NewBuffer([]byte{'p', 0, 0, 0, 2}))
+		handshake.passed = true
+		_, err := handshake.Read()
+		require.Error(t, err)
+		require.IsType(t, &ProtocolError{}, err)
+	})
+}
+
+func TestHandshake_foreignProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       []byte
+		protocol string
+		response []byte
+	}{
+		{"http", []byte("GET / HTTP/1.1\r\nHost: localhost:5432\r\n\r\n"), "HTTP", httpResponse},
+		{"http post", []byte("POST /api HTTP/1.1\r\n"), "HTTP", httpResponse},
+		{"tls", []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01, 0xfc}, "TLS", tlsAlert},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			handshake := NewHandshake(struct {
+				io.Reader
+				io.Writer
+			}{bytes.NewBuffer(test.in), out})
+
+			_, err := handshake.Init()
+			require.Error(t, err)
+			require.IsType(t, &ForeignProtocolError{}, err)
+			require.Equal(t, test.protocol, err.(*ForeignProtocolError).Protocol)
+			require.Equal(t, test.response, out.Bytes())
+		})
+	}
+
+	t.Run("after ssl request", func(t *testing.T) {
+		in := []byte{0, 0, 0, 8, 4, 210, 22, 47, 0x16, 0x03, 0x01, 0x02, 0x00}
+		out := &bytes.Buffer{}
+		handshake := NewHandshake(struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewBuffer(in), out})
+
+		_, err := handshake.Init()
+		require.IsType(t, &ForeignProtocolError{}, err)
+		require.Equal(t, append([]byte{'N'}, tlsAlert...), out.Bytes())
+	})
+}
+
+// TestHandshake_malformed feeds the handshake with all of the truncations of
+// valid startup packets, with their lengths and bytes mangled, expecting
+// errors rather than panics
+func TestHandshake_malformed(t *testing.T) {
+	packets := [][]byte{
+		{0, 0, 0, 19, 0, 3, 0, 0, 'u', 's', 'e', 'r', 0, 'a', 'l', 'i', 'c', 'e', 0, 0},
+		{0, 0, 0, 16, 4, 210, 22, 46, 0, 0, 0, 1, 0, 0, 0, 2}, // cancel
+		{0, 0, 0, 8, 4, 210, 22, 47},                          // ssl
+	}
+
+	for _, packet := range packets {
+		for n := 0; n <= len(packet); n++ {
+			for _, mangle := range []func([]byte){
+				func([]byte) {},
+				func(b []byte) {
+					if len(b) > 3 {
+						b[3] = byte(n)
+					}
+				},
+				func(b []byte) {
+					if len(b) > 0 {
+						b[len(b)-1] ^= 0xff
+					}
+				},
+			} {
+				msg := append([]byte{}, packet[:n]...)
+				mangle(msg)
+				require.NotPanics(t, func() {
+					res, err := NewHandshake(bytes.NewBuffer(msg)).Init()
+					if err != nil {
+						return
+					}
+					if res.IsCancel() {
+						res.CancelKeyData()
+					} else {
+						res.StartupArgs()
+					}
+				}, "packet: %v", msg)
+			}
+		}
+	}
+}
@@ -1,14 +1,15 @@
 package protocol
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/jackc/pgx/pgproto3"
 )
 
-// frontend message types
-const (
-	Terminate = 'X'
-)
+// Terminate is the type of the Terminate message.
+//
+// Deprecated: use MsgTypeTerminate
+const Terminate = MsgTypeTerminate
 
 // Message is just an alias for a slice of bytes that exposes common operations on
 // Postgres' client-server protocol messages.
@@ -16,6 +17,21 @@ const (
 // for postgres specific list of message formats
 type Message []byte
 
+// ProtocolError reports a malformed message sent by the frontend, after which
+// the session can't proceed. It's sent to the frontend as a FATAL
+// protocol_violation (08P01) error, see ErrorResponse.
+type ProtocolError struct {
+	Message string
+}
+
+func (e *ProtocolError) Error() string { return e.Message }
+
+// Code returns the SQLSTATE of protocol_violation
+func (e *ProtocolError) Code() string { return "08P01" }
+
+// Severity returns FATAL, since the session can't proceed
+func (e *ProtocolError) Severity() string { return "FATAL" }
+
 // Type returns a string (single-char) representing the message type. The full
 // list of available types is available in the aforementioned documentation.
 func (m Message) Type() byte {
@@ -26,9 +42,31 @@ func (m Message) Type() byte {
 	return b
 }
 
+// Validate checks the framing of the message: a type followed by a length that
+// matches the rest of the message. See Transport.SetStrictFraming.
+func (m Message) Validate() error {
+	if len(m) < 5 {
+		return fmt.Errorf("message of %d bytes is shorter than its header", len(m))
+	}
+
+	length := int64(binary.BigEndian.Uint32(m[1:5]))
+	if length != int64(len(m)-1) {
+		return fmt.Errorf("'%c' message declares a length of %d, but it's %d bytes long", m.Type(), length, len(m)-1)
+	}
+	return nil
+}
+
+// mustValidate panics if the framing of the message is invalid, see
+// Transport.SetStrictFraming
+func mustValidate(m Message) {
+	if err := m.Validate(); err != nil {
+		panic(fmt.Sprintf("invalid message framing: %v", err))
+	}
+}
+
 // IsError determines if the message is an ErrorResponse
 func (m Message) IsError() bool {
-	return m.Type() == 'E'
+	return m.Type() == MsgTypeErrorResponse
 }
 
 // ErrorResponse parses message of type error and returns an object describes it
@@ -38,7 +76,7 @@ func (m Message) ErrorResponse() (res *pgproto3.ErrorResponse, err error) {
 		return
 	}
 	res = &pgproto3.ErrorResponse{}
-	err = res.Decode(m[4:])
+	err = res.Decode(m[5:]) // skip the type and length
 	return
 }
 
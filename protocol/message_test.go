@@ -1,6 +1,9 @@
 package protocol
 
 import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
 	"github.com/stretchr/testify/require"
 	"testing"
 )
@@ -30,3 +33,114 @@ func TestType(t *testing.T) {
 		require.Equal(t, expectedType, mt)
 	})
 }
+
+func TestErrorResponse(t *testing.T) {
+	t.Run("error message", func(t *testing.T) {
+		m := ErrorResponse(fmt.Errorf("boom"))
+		res, err := m.ErrorResponse()
+
+		require.NoError(t, err)
+		require.Equal(t, "ERROR", res.Severity)
+		require.Equal(t, "XX000", res.Code)
+		require.Equal(t, "boom", res.Message)
+	})
+
+	t.Run("all fields", func(t *testing.T) {
+		m := ErrorResponse(&richErr{})
+		res, err := m.ErrorResponse()
+
+		require.NoError(t, err)
+		require.Equal(t, &pgproto3.ErrorResponse{
+			Severity:       "ERROR",
+			Code:           "23505",
+			Message:        "duplicate key value violates unique constraint",
+			Detail:         "Key (email)=(a@b.c) already exists.",
+			Hint:           "Use another email",
+			Position:       7,
+			Where:          "SQL function \"foo\"",
+			SchemaName:     "public",
+			TableName:      "users",
+			ColumnName:     "email",
+			DataTypeName:   "text",
+			ConstraintName: "users_email_key",
+		}, res)
+	})
+
+	t.Run("fields order", func(t *testing.T) {
+		m := ErrorResponse(fmt.Errorf("boom"))
+		require.Equal(t, "E\x00\x00\x00\x19SERROR\x00CXX000\x00Mboom\x00\x00", string(m))
+	})
+
+	t.Run("not an error message", func(t *testing.T) {
+		_, err := Message(ReadyForQuery).ErrorResponse()
+		require.EqualError(t, err, "message is not an error message")
+	})
+}
+
+type richErr struct{}
+
+func (*richErr) Error() string          { return "duplicate key value violates unique constraint" }
+func (*richErr) Code() string           { return "23505" }
+func (*richErr) Detail() string         { return "Key (email)=(a@b.c) already exists." }
+func (*richErr) Hint() string           { return "Use another email" }
+func (*richErr) Position() int          { return 7 }
+func (*richErr) Where() string          { return "SQL function \"foo\"" }
+func (*richErr) SchemaName() string     { return "public" }
+func (*richErr) TableName() string      { return "users" }
+func (*richErr) ColumnName() string     { return "email" }
+func (*richErr) DataTypeName() string   { return "text" }
+func (*richErr) ConstraintName() string { return "users_email_key" }
+
+func TestMessage_Validate(t *testing.T) {
+	t.Run("invalid", func(t *testing.T) {
+		for _, m := range []Message{
+			{},
+			{'Z', 0, 0, 0},
+			{'Z', 0, 0, 0, 4, 'I'},
+			{'Z', 0, 0, 0, 6, 'I'},
+			{'C', 0xff, 0xff, 0xff, 0xff},
+		} {
+			require.Error(t, m.Validate(), "%v", []byte(m))
+		}
+	})
+
+	// all of the constructed messages must be framed properly
+	paramDesc, err := ParameterDescription(&nodes.PrepareStmt{
+		Argtypes: nodes.List{Items: []nodes.Node{
+			nodes.TypeName{TypeOid: 23},
+		}},
+	})
+	require.NoError(t, err)
+
+	messages := map[string]Message{
+		"ParseComplete":            ParseComplete,
+		"BindComplete":             BindComplete,
+		"CloseComplete":            CloseComplete,
+		"ParameterDescription":     paramDesc,
+		"ReadyForQuery":            ReadyForQuery,
+		"ReadyForQueryStatus":      ReadyForQueryStatus('T'),
+		"EmptyQueryResponse":       EmptyQueryResponse,
+		"NoData":                   NoData,
+		"PortalSuspended":          PortalSuspended,
+		"AuthenticationOK":         AuthenticationOK,
+		"Authentication":           Authentication(AuthGSSContinue, []byte("tok")),
+		"RowDescription":           RowDescription([]string{"a", "b"}, []string{"TEXT", "INT4"}),
+		"DataRow":                  DataRow([]string{"a", "", "ccc"}),
+		"DataRowBytes":             DataRowBytes([][]byte{[]byte("a"), nil}),
+		"CommandComplete":          CommandComplete("SELECT 1"),
+		"NotificationResponse":     NotificationResponse(1, "channel", "payload"),
+		"ErrorResponse":            ErrorResponse(fmt.Errorf("boom")),
+		"NoticeResponse":           NoticeResponse(fmt.Errorf("hey")),
+		"BackendKeyData":           BackendKeyData(1, 2),
+		"NegotiateProtocolVersion": NegotiateProtocolVersion(0, []string{"_pq_.foo"}),
+		"ParameterStatus":          ParameterStatus("client_encoding", "UTF8"),
+		"FunctionCallResponse":     FunctionCallResponse([]byte("result")),
+		"FunctionCallResponseNull": FunctionCallResponse(nil),
+		"CopyInResponse":           CopyInResponse(CopyBinaryFormat, 3),
+	}
+	for name, m := range messages {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, m.Validate())
+		})
+	}
+}
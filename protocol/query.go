@@ -3,39 +3,74 @@ package protocol
 import (
 	"encoding/binary"
 	"fmt"
+	"github.com/jackc/pgx/pgio"
 )
 
 // TypesOid maps between a type name to its corresponding OID
 var TypesOid = map[string]int{
-	"BOOL":       16,
-	"BYTEA":      17,
-	"CHAR":       18,
-	"INT8":       20,
-	"INT2":       21,
-	"INT4":       23,
-	"TEXT":       25,
-	"JSON":       114,
-	"XML":        142,
-	"FLOAT4":     700,
-	"FLOAT8":     701,
-	"VARCHAR":    1043,
-	"DATE":       1082,
-	"TIME":       1083,
-	"TIMESTAMP":  1114,
-	"TIMESTAMPZ": 1184,
-	"INTERVAL":   1186,
-	"NUMERIC":    1700,
-	"JSONB":      3802,
-	"ANY":        2276,
+	"BOOL":        16,
+	"BYTEA":       17,
+	"CHAR":        18,
+	"INT8":        20,
+	"INT2":        21,
+	"INT4":        23,
+	"TEXT":        25,
+	"JSON":        114,
+	"XML":         142,
+	"FLOAT4":      700,
+	"FLOAT8":      701,
+	"VARCHAR":     1043,
+	"DATE":        1082,
+	"TIME":        1083,
+	"TIMESTAMP":   1114,
+	"TIMESTAMPTZ": 1184,
+	"TIMESTAMPZ":  1184, // misspelled, kept for compatibility
+	"INTERVAL":    1186,
+	"NUMERIC":     1700,
+	"JSONB":       3802,
+	"ANY":         2276,
+
+	// arrays, named after their elements like in pg_type
+	"_BOOL":        1000,
+	"_BYTEA":       1001,
+	"_INT2":        1005,
+	"_INT4":        1007,
+	"_TEXT":        1009,
+	"_VARCHAR":     1015,
+	"_INT8":        1016,
+	"_FLOAT4":      1021,
+	"_FLOAT8":      1022,
+	"_TIMESTAMP":   1115,
+	"_DATE":        1182,
+	"_TIMESTAMPTZ": 1185,
+	"_NUMERIC":     1231,
 }
 
 // ReadyForQuery is sent whenever the backend is ready for a new query cycle.
-var ReadyForQuery = []byte{'Z', 0, 0, 0, 5, 'I'}
+var ReadyForQuery = ReadyForQueryStatus('I')
+
+// ReadyForQueryStatus is like ReadyForQuery, with the provided transaction
+// status indicator: 'I' when idle, 'T' in a transaction block or 'E' in a
+// failed transaction block
+func ReadyForQueryStatus(status byte) Message {
+	return []byte{MsgTypeReadyForQuery, 0, 0, 0, 5, status}
+}
+
+// EmptyQueryResponse is sent instead of CommandComplete when the query string
+// is empty
+var EmptyQueryResponse = []byte{MsgTypeEmptyQueryResponse, 0, 0, 0, 4}
 
 // RowDescription is a message indicating that DataRow messages are about to
 // be transmitted and delivers their schema (column names/types)
 func RowDescription(cols, types []string) Message {
-	msg := []byte{'T' /* LEN = */, 0, 0, 0, 0 /* NUM FIELDS = */, 0, 0}
+	return RowDescriptionFormats(cols, types, nil)
+}
+
+// RowDescriptionFormats is a RowDescription with the format codes of the
+// columns, as requested by the Bind of a portal. Columns without a format code
+// are in the text format.
+func RowDescriptionFormats(cols, types []string, formats []int16) Message {
+	msg := []byte{MsgTypeRowDescription /* LEN = */, 0, 0, 0, 0 /* NUM FIELDS = */, 0, 0}
 	binary.BigEndian.PutUint16(msg[5:], uint16(len(cols)))
 
 	for i, c := range cols {
@@ -56,7 +91,13 @@ func RowDescription(cols, types []string) Message {
 		msg = append(msg, oid...)
 		msg = append(msg, 0, 0)       // data type size
 		msg = append(msg, 0, 0, 0, 0) // type modifier
-		msg = append(msg, 0, 0)       // format code (text = 0, binary = 1)
+
+		// format code (text = 0, binary = 1)
+		format := int16(0)
+		if i < len(formats) {
+			format = formats[i]
+		}
+		msg = append(msg, byte(format>>8), byte(format))
 	}
 
 	// write the length
@@ -66,23 +107,49 @@ func RowDescription(cols, types []string) Message {
 
 // DataRow is sent for every row of resulted row set
 func DataRow(vals []string) Message {
-	msg := []byte{'D' /* LEN = */, 0, 0, 0, 0 /* NUM VALS = */, 0, 0}
-	binary.BigEndian.PutUint16(msg[5:], uint16(len(vals)))
+	size := 7 // type, length and number of values
+	for _, v := range vals {
+		size += 4 + len(v)
+	}
+
+	msg := make([]byte, 7, size)
+	msg[0] = MsgTypeDataRow
+	binary.BigEndian.PutUint32(msg[1:5], uint32(size-1))
+	binary.BigEndian.PutUint16(msg[5:7], uint16(len(vals)))
+	for _, v := range vals {
+		msg = pgio.AppendInt32(msg, int32(len(v)))
+		msg = append(msg, v...)
+	}
+	return msg
+}
 
+// DataRowBytes is like DataRow, with values that are already encoded as bytes.
+// A nil value is NULL, unlike an empty one. The values are copied, so their
+// memory may be reused once it returns.
+func DataRowBytes(vals [][]byte) Message {
+	size := 7 // type, length and number of values
 	for _, v := range vals {
-		b := append(make([]byte, 4), []byte(v)...)
-		binary.BigEndian.PutUint32(b[0:4], uint32(len(b)-4))
-		msg = append(msg, b...)
+		size += 4 + len(v)
 	}
 
-	// write the length
-	binary.BigEndian.PutUint32(msg[1:5], uint32(len(msg)-1))
+	msg := make([]byte, 7, size)
+	msg[0] = MsgTypeDataRow
+	binary.BigEndian.PutUint32(msg[1:5], uint32(size-1))
+	binary.BigEndian.PutUint16(msg[5:7], uint16(len(vals)))
+	for _, v := range vals {
+		if v == nil {
+			msg = pgio.AppendInt32(msg, -1) // NULL, without bytes
+			continue
+		}
+		msg = pgio.AppendInt32(msg, int32(len(v)))
+		msg = append(msg, v...)
+	}
 	return msg
 }
 
 // CommandComplete is sent when query was fully executed and cursor reached the end of the row set
 func CommandComplete(tag string) Message {
-	msg := []byte{'C', 0, 0, 0, 0}
+	msg := []byte{MsgTypeCommandComplete, 0, 0, 0, 0}
 	msg = append(msg, []byte(tag)...)
 	msg = append(msg, 0) // NULL TERMINATED
 
@@ -91,14 +158,46 @@ func CommandComplete(tag string) Message {
 	return msg
 }
 
+// NotificationResponse is sent to deliver a notification, raised by the
+// session with the provided pid, to a session listening on the channel
+func NotificationResponse(pid int32, channel, payload string) Message {
+	msg := []byte{MsgTypeNotificationResponse, 0, 0, 0, 0}
+	msg = pgio.AppendInt32(msg, pid)
+	msg = append(msg, []byte(channel)...)
+	msg = append(msg, 0) // NULL TERMINATED
+	msg = append(msg, []byte(payload)...)
+	msg = append(msg, 0) // NULL TERMINATED
+
+	// write the length
+	binary.BigEndian.PutUint32(msg[1:5], uint32(len(msg)-1))
+	return msg
+}
+
 // ErrorResponse is sent whenever error has occurred
 func ErrorResponse(err error) Message {
-	msg := []byte{'E', 0, 0, 0, 0}
+	return fieldsMessage(MsgTypeErrorResponse, "ERROR", "XX000", err)
+}
+
+// NoticeResponse is sent to deliver a non-fatal message, like a warning, to the
+// client without interrupting the query. The provided error is encoded like in
+// ErrorResponse, except that it defaults to the NOTICE severity and 00000
+// (successful_completion) code.
+func NoticeResponse(err error) Message {
+	return fieldsMessage(MsgTypeNoticeResponse, "NOTICE", "00000", err)
+}
+
+// fieldsOrder is the order of the fields of ErrorResponse and NoticeResponse
+var fieldsOrder = []byte("SCMDHPWstcdn")
+
+// fieldsMessage creates a message of the provided type with the fields of the
+// provided error, used for both ErrorResponse and NoticeResponse.
+func fieldsMessage(typ byte, severity, code string, err error) Message {
+	msg := []byte{typ, 0, 0, 0, 0}
 
 	// https://www.postgresql.org/docs/9.3/static/protocol-error-fields.html
 	fields := map[string]string{
-		"S": "ERROR", // Severity
-		"C": "XX000",
+		"S": severity,
+		"C": code,
 		"M": err.Error(),
 	}
 
@@ -142,8 +241,40 @@ func ErrorResponse(err error) Message {
 		fields["P"] = fmt.Sprintf("%d", errPosition.Position())
 	}
 
-	for k, v := range fields {
-		msg = append(msg, byte(k[0]))
+	// context and the associated database objects
+	optional := map[string]func() string{}
+	if e, ok := err.(interface{ Where() string }); ok {
+		optional["W"] = e.Where
+	}
+	if e, ok := err.(interface{ SchemaName() string }); ok {
+		optional["s"] = e.SchemaName
+	}
+	if e, ok := err.(interface{ TableName() string }); ok {
+		optional["t"] = e.TableName
+	}
+	if e, ok := err.(interface{ ColumnName() string }); ok {
+		optional["c"] = e.ColumnName
+	}
+	if e, ok := err.(interface{ DataTypeName() string }); ok {
+		optional["d"] = e.DataTypeName
+	}
+	if e, ok := err.(interface{ ConstraintName() string }); ok {
+		optional["n"] = e.ConstraintName
+	}
+	for k, f := range optional {
+		if v := f(); v != "" {
+			fields[k] = v
+		}
+	}
+
+	// the fields are written in the same order as postgres does, rather than
+	// in the random order of the map, for the messages to be deterministic
+	for _, k := range fieldsOrder {
+		v, ok := fields[string(k)]
+		if !ok {
+			continue
+		}
+		msg = append(msg, k)
 		msg = append(msg, []byte(v)...)
 		msg = append(msg, 0) // NULL TERMINATED
 	}
@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
 	"github.com/stretchr/testify/require"
 	"testing"
 )
@@ -10,6 +12,22 @@ func TestReadyMsg(t *testing.T) {
 	require.Equal(t, []byte{'Z', 0, 0, 0, 5, 'I'}, []byte(msg))
 }
 
+func TestReadyForQueryStatus(t *testing.T) {
+	for _, status := range []byte{'I', 'T', 'E'} {
+		msg := ReadyForQueryStatus(status)
+		require.Equal(t, []byte{'Z', 0, 0, 0, 5, status}, []byte(msg))
+
+		res := &pgproto3.ReadyForQuery{}
+		require.NoError(t, res.Decode(msg[5:]))
+		require.Equal(t, status, res.TxStatus)
+	}
+	require.Equal(t, ReadyForQuery, []byte(ReadyForQueryStatus('I')))
+}
+
+func TestEmptyQueryResponse(t *testing.T) {
+	require.Equal(t, []byte{'I', 0, 0, 0, 4}, EmptyQueryResponse)
+}
+
 func TestCompleteMsg(t *testing.T) {
 	msg := CommandComplete("meh")
 	expectedMsg := []byte{
@@ -21,3 +39,83 @@ func TestCompleteMsg(t *testing.T) {
 
 	require.Equal(t, expectedMsg, []byte(msg))
 }
+
+func TestDataRow(t *testing.T) {
+	expectedMsg := []byte{
+		'D',         // type
+		0, 0, 0, 17, // size
+		0, 2, // number of values
+		0, 0, 0, 3, 'f', 'o', 'o', // first value
+		0, 0, 0, 0, // second value, empty
+	}
+
+	require.Equal(t, expectedMsg, []byte(DataRow([]string{"foo", ""})))
+	require.Equal(t, expectedMsg, []byte(DataRowBytes([][]byte{[]byte("foo"), {}})))
+
+	t.Run("null", func(t *testing.T) {
+		expectedMsg := []byte{
+			'D',         // type
+			0, 0, 0, 17, // size
+			0, 2, // number of values
+			0xff, 0xff, 0xff, 0xff, // first value, NULL
+			0, 0, 0, 1, 'a', // second value
+		}
+		msg := DataRowBytes([][]byte{nil, []byte("a")})
+		require.Equal(t, expectedMsg, []byte(msg))
+
+		row := &pgproto3.DataRow{}
+		require.NoError(t, row.Decode(msg[5:]))
+		require.Nil(t, row.Values[0])
+	})
+}
+
+func TestRowDescription(t *testing.T) {
+	msg := RowDescription([]string{"a", "b", "c"}, []string{"INT4", "_INT4", ""})
+
+	desc := &pgproto3.RowDescription{}
+	require.NoError(t, desc.Decode(msg[5:]))
+	require.Len(t, desc.Fields, 3)
+	require.Equal(t, uint32(23), desc.Fields[0].DataTypeOID)
+	require.Equal(t, uint32(1007), desc.Fields[1].DataTypeOID)
+	require.Equal(t, uint32(25), desc.Fields[2].DataTypeOID, "expected text by default")
+	for _, field := range desc.Fields {
+		require.Equal(t, int16(0), field.Format)
+	}
+}
+
+func TestRowDescriptionFormats(t *testing.T) {
+	msg := RowDescriptionFormats([]string{"a", "b", "c"}, []string{"INT4", "TEXT", "INT8"}, []int16{1, 0})
+
+	desc := &pgproto3.RowDescription{}
+	require.NoError(t, desc.Decode(msg[5:]))
+	require.Len(t, desc.Fields, 3)
+	require.Equal(t, int16(1), desc.Fields[0].Format)
+	require.Equal(t, int16(0), desc.Fields[1].Format)
+	require.Equal(t, int16(0), desc.Fields[2].Format, "expected text without a format code")
+}
+
+func TestNotificationResponse(t *testing.T) {
+	msg := NotificationResponse(7, "foo", "bar")
+	expectedMsg := []byte{
+		'A',         // type
+		0, 0, 0, 16, // size
+		0, 0, 0, 7, // pid
+		'f', 'o', 'o', 0, // channel
+		'b', 'a', 'r', 0, // payload
+	}
+
+	require.Equal(t, expectedMsg, []byte(msg))
+}
+
+func TestNoticeResponse(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		msg := NoticeResponse(fmt.Errorf("meh"))
+		require.Equal(t, byte('N'), msg.Type())
+
+		res := &pgproto3.NoticeResponse{}
+		require.NoError(t, res.Decode(msg[5:]))
+		require.Equal(t, "NOTICE", res.Severity)
+		require.Equal(t, "00000", res.Code)
+		require.Equal(t, "meh", res.Message)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"strings"
 )
 
 // StartupVersion returns the protocol version supported by the client. The version is
@@ -15,6 +16,10 @@ func (m Message) StartupVersion() (string, error) {
 		return "", fmt.Errorf("expected untyped startup message, got: %q", m.Type())
 	}
 
+	if len(m) < 8 {
+		return "", &ProtocolError{"invalid length of startup packet"}
+	}
+
 	major := int(binary.BigEndian.Uint16(m[4:6]))
 	minor := int(binary.BigEndian.Uint16(m[6:8]))
 	return fmt.Sprintf("%d.%d", major, minor), nil
@@ -25,53 +30,124 @@ func (m Message) StartupVersion() (string, error) {
 // requested database name, user name, charset and additional connection
 // defaults that may be used by the server. These arguments are encoded as pairs
 // of key-values, terminated by a NULL character.
+//
+// The run-time parameters set in the "options" argument (like
+// "-c search_path=foo") are also added to the map as individual arguments,
+// unless they're explicitly set by another argument.
 func (m Message) StartupArgs() (map[string]interface{}, error) {
 	if m.Type() != 0 {
 		return nil, fmt.Errorf("expected untyped startup message, got: %q", m.Type())
 	}
 
+	if len(m) < 8 {
+		return nil, &ProtocolError{"invalid length of startup packet"}
+	}
 	buff := m[8:] // skip the length (4-bytes) and version (4-bytes)
 
-	// first create a single long list of strings, combining both keys and
-	// values alternately
-	var strings []string
-	for len(buff) > 0 {
-
-		// search for the next NULL terminator
+	// the pairs are followed by a terminator, so an empty key marks the end
+	args := make(map[string]interface{})
+	for {
 		idx := bytes.IndexByte(buff, 0)
 		if idx == -1 {
-			break // none found, we're done.
+			return nil, &ProtocolError{"invalid startup packet layout: expected terminator as last byte"}
+		}
+		key := string(buff[:idx])
+		buff = buff[idx+1:]
+		if key == "" {
+			break
 		}
 
-		// convert it to a string and append to the list
-		strings = append(strings, string(buff[:idx]))
-
-		// skip to the next terminator index for the next string
+		idx = bytes.IndexByte(buff, 0)
+		if idx == -1 {
+			return nil, &ProtocolError{fmt.Sprintf("invalid startup packet layout: missing value for parameter \"%s\"", key)}
+		}
+		args[key] = string(buff[:idx])
 		buff = buff[idx+1:]
 	}
+	if len(buff) > 0 {
+		return nil, &ProtocolError{"invalid startup packet layout: expected terminator as last byte"}
+	}
 
-	// convert the list of strings to a map for key-value
-	// all even indexes are keys, odd are values
-	args := make(map[string]interface{})
-	for i := 0; i < len(strings)-1; i += 2 {
-		args[strings[i]] = strings[i+1]
+	options, _ := args["options"].(string)
+	for k, v := range parseOptions(options) {
+		if _, ok := args[k]; !ok {
+			args[k] = v
+		}
 	}
 
 	return args, nil
 }
 
+// parseOptions parses the command-line style options string of the startup
+// message into the run-time parameters it sets. Parameters are set with either
+// "-c name=value", "--name=value" or just "name=value", separated by spaces.
+// Like libpq, a backslash escapes the following character, so spaces and
+// backslashes within values are written as "\ " and "\\". Other switches
+// are ignored.
+func parseOptions(options string) map[string]string {
+	// split into words by the unescaped spaces
+	var words []string
+	var word []byte
+	escaped := false
+	for i := 0; i < len(options); i++ {
+		c := options[i]
+		switch {
+		case escaped:
+			word = append(word, c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if len(word) > 0 {
+				words = append(words, string(word))
+				word = nil
+			}
+		default:
+			word = append(word, c)
+		}
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+
+	params := map[string]string{}
+	for i := 0; i < len(words); i++ {
+		var param string
+		switch w := words[i]; {
+		case w == "-c" && i+1 < len(words):
+			i++
+			param = words[i]
+		case strings.HasPrefix(w, "--"):
+			param = w[2:]
+		case strings.HasPrefix(w, "-c"):
+			param = w[2:]
+		case !strings.HasPrefix(w, "-"):
+			param = w
+		default:
+			continue
+		}
+
+		idx := strings.IndexByte(param, '=')
+		if idx <= 0 {
+			continue
+		}
+		name := strings.Replace(param[:idx], "-", "_", -1)
+		params[name] = param[idx+1:]
+	}
+	return params
+}
+
 // IsTLSRequest determines if this startup message is actually a request to open
 // a TLS connection, in which case the version number is a special, predefined
-// value of "1234.5679"
+// value of "1234.5679" (ProtocolSSLRequest)
 func (m Message) IsTLSRequest() bool {
-	v, _ := m.StartupVersion()
-	return v == "1234.5679"
+	return m.startupCode() == ProtocolSSLRequest
 }
 
 // IsTerminate determines if the current message is a notification that the
 // client has terminated the connection upon user-request.
 func (m Message) IsTerminate() bool {
-	return m.Type() == Terminate
+	return m.Type() == MsgTypeTerminate
 }
 
 // TLSResponse creates a new single byte message indicating if the server
@@ -82,19 +158,79 @@ func TLSResponse(supported bool) Message {
 	return Message([]byte{b})
 }
 
+// Authentication request types, see Authentication
+const (
+	AuthOK           = 0
+	AuthClearText    = 3
+	AuthMD5          = 5
+	AuthGSS          = 7
+	AuthGSSContinue  = 8
+	AuthSASL         = 10
+	AuthSASLContinue = 11
+	AuthSASLFinal    = 12
+)
+
+// AuthenticationOK is sent when the client is authenticated
+var AuthenticationOK = Authentication(AuthOK, nil)
+
+// Authentication creates a new message requesting the provided type of
+// authentication from the client, followed by its data, like the salt of
+// AuthMD5 or the token of AuthGSSContinue
+func Authentication(authType int32, data []byte) Message {
+	msg := []byte{MsgTypeAuthentication, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[5:9], uint32(authType))
+	msg = append(msg, data...)
+
+	// write the length
+	binary.BigEndian.PutUint32(msg[1:5], uint32(len(msg)-1))
+	return msg
+}
+
 // BackendKeyData creates a new message providing the client with a process ID and
 // secret key that it can later use to cancel running queries
 func BackendKeyData(pid int32, secret int32) Message {
-	msg := []byte{'K', 0, 0, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0}
+	msg := []byte{MsgTypeBackendKeyData, 0, 0, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0}
 	binary.BigEndian.PutUint32(msg[5:9], uint32(pid))
 	binary.BigEndian.PutUint32(msg[9:13], uint32(secret))
 	return msg
 }
 
+// StartupMinorVersion returns the minor version of the protocol requested by
+// the client, like 0 for 3.0
+func (m Message) StartupMinorVersion() int {
+	if len(m) < 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(m[6:8]))
+}
+
+// LatestMinorVersion is the newest minor version of protocol 3 supported by
+// the server. Clients requesting a newer one are negotiated down to it, see
+// NegotiateProtocolVersion.
+const LatestMinorVersion = 0
+
+// NegotiateProtocolVersion creates a new message informing the client that the
+// server only supports protocol 3 up to the provided minor version, without the
+// listed protocol extension parameters (the _pq_ startup parameters). It's sent
+// in response to a startup message requesting a newer minor version or
+// unsupported extensions, after which the startup proceeds as usual.
+func NegotiateProtocolVersion(minor int32, unsupported []string) Message {
+	msg := []byte{MsgTypeNegotiateProtocolVersion, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[5:9], uint32(minor))
+	binary.BigEndian.PutUint32(msg[9:13], uint32(len(unsupported)))
+	for _, name := range unsupported {
+		msg = append(msg, name...)
+		msg = append(msg, 0)
+	}
+
+	// write the length
+	binary.BigEndian.PutUint32(msg[1:5], uint32(len(msg)-1))
+	return msg
+}
+
 // IsCancel returns whether the message is a cancel message or not
 func (m Message) IsCancel() bool {
-	v, _ := m.StartupVersion()
-	return v == "1234.5678"
+	return m.startupCode() == ProtocolCancelRequest
 }
 
 // CancelKeyData returns the key data of a cancel message
@@ -102,6 +238,9 @@ func (m Message) CancelKeyData() (int32, int32, error) {
 	if !m.IsCancel() {
 		return -1, -1, fmt.Errorf("not a cancel message")
 	}
+	if len(m) != 16 {
+		return -1, -1, &ProtocolError{"invalid length of cancel request"}
+	}
 
 	pid := int32(binary.BigEndian.Uint32(m[8:12]))
 	secret := int32(binary.BigEndian.Uint32(m[12:16]))
@@ -112,7 +251,7 @@ func (m Message) CancelKeyData() (int32, int32, error) {
 func ParameterStatus(name, value string) Message {
 	length := /* TYPE+LEN */ 5 + len(name) + len(value) + /* TERMINATORS */ 2
 	msg := make([]byte, length)
-	msg[0] = 'S'
+	msg[0] = MsgTypeParameterStatus
 	copy(msg[5:], name)
 	copy(msg[length-len(value)-1:], value)
 
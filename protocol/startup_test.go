@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"encoding/binary"
+	"github.com/jackc/pgx/pgproto3"
 	"github.com/stretchr/testify/require"
 	"testing"
 )
@@ -63,15 +64,73 @@ func TestStartupArgs(t *testing.T) {
 	t.Run("untyped message, no params", func(t *testing.T) {
 		m := &Message{
 			0, 0, 0, 9,
-			1, 2, 3, 4,
-			5, // this is an extra byte without a null terminator
+			0, 3, 0, 0,
+			0, // terminator
 		}
 
 		args, err := m.StartupArgs()
-		expectedArgs := make(map[string]interface{})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{}, args)
+	})
 
+	malformed := map[string]Message{
+		"too short":           {0, 0, 0, 6, 0, 3},
+		"no terminator":       {0, 0, 0, 8, 0, 3, 0, 0},
+		"unterminated key":    {0, 0, 0, 12, 0, 3, 0, 0, 'u', 's', 'e', 'r'},
+		"missing value":       {0, 0, 0, 14, 0, 3, 0, 0, 'u', 's', 'e', 'r', 0, 0},
+		"unterminated value":  {0, 0, 0, 15, 0, 3, 0, 0, 'u', 's', 'e', 'r', 0, 'a', 'l'},
+		"bytes after the end": {0, 0, 0, 11, 0, 3, 0, 0, 0, 'x', 0},
+		"missing terminator":  {0, 0, 0, 16, 0, 3, 0, 0, 'u', 's', 'e', 'r', 0, 'a', 'l', 0},
+		"unterminated byte":   {0, 0, 0, 9, 0, 3, 0, 0, 5},
+	}
+	for name, m := range malformed {
+		t.Run(name, func(t *testing.T) {
+			_, err := m.StartupArgs()
+			require.Error(t, err)
+			require.IsType(t, &ProtocolError{}, err)
+		})
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		options  string
+		expected map[string]string
+	}{
+		{"", map[string]string{}},
+		{"-c search_path=foo", map[string]string{"search_path": "foo"}},
+		{"-cgeqo=off   --application-name=psql", map[string]string{"geqo": "off", "application_name": "psql"}},
+		{"statement_timeout=5s", map[string]string{"statement_timeout": "5s"}},
+		{`-c application_name=my\ app`, map[string]string{"application_name": "my app"}},
+		{`-c search_path=a\\b`, map[string]string{"search_path": `a\b`}},
+		{"-c x=a=b -c y=", map[string]string{"x": "a=b", "y": ""}},
+		{`-d 5 -c broken =nameless trailing=\`, map[string]string{"trailing": ""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.options, func(t *testing.T) {
+			require.Equal(t, test.expected, parseOptions(test.options))
+		})
+	}
+
+	t.Run("startup args", func(t *testing.T) {
+		m := Message((&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters: map[string]string{
+				"user":        "postgres",
+				"search_path": "bar",
+				"options":     "-c search_path=foo -c tenant=acme",
+			},
+		}).Encode(nil))
+
+		args, err := m.StartupArgs()
 		require.NoError(t, err)
-		require.Equal(t, expectedArgs, args)
+		require.Equal(t, map[string]interface{}{
+			"user":        "postgres",
+			"search_path": "bar", // explicit arguments take precedence
+			"tenant":      "acme",
+			"options":     "-c search_path=foo -c tenant=acme",
+		}, args)
 	})
 }
 
@@ -123,6 +182,22 @@ func TestTlsResponseMsg(t *testing.T) {
 	})
 }
 
+func TestAuthentication(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		require.Equal(t, Message{'R', 0, 0, 0, 8, 0, 0, 0, 0}, AuthenticationOK)
+	})
+
+	t.Run("with data", func(t *testing.T) {
+		expectedMessage := Message{
+			'R',
+			0, 0, 0, 11, // length
+			0, 0, 0, 8, // gss continue auth type
+			116, 111, 107, // 'tok'
+		}
+		require.Equal(t, expectedMessage, Authentication(AuthGSSContinue, []byte("tok")))
+	})
+}
+
 func TestKeyDataMsg(t *testing.T) {
 	m := BackendKeyData(1325119140, 942490198)
 	expectedMessage := Message{75, 0, 0, 0, 12, 78, 251, 182, 164, 56, 45, 66, 86}
@@ -188,3 +263,17 @@ func TestParameterStatus(t *testing.T) {
 
 	require.Equal(t, expectedMessage, m)
 }
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	m := NegotiateProtocolVersion(1, []string{"_pq_.foo", "_pq_.bar"})
+	expectedMessage := Message{
+		'v',
+		0, 0, 0, 30,
+		0, 0, 0, 1,
+		0, 0, 0, 2,
+		'_', 'p', 'q', '_', '.', 'f', 'o', 'o', 0,
+		'_', 'p', 'q', '_', '.', 'b', 'a', 'r', 0,
+	}
+
+	require.Equal(t, expectedMessage, m)
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"io"
+	"strings"
+)
+
+// Tracer observes all of the messages passing through a Transport, which is
+// useful for debugging the wire protocol against real drivers. Frontend is
+// called for every message read from the client and Backend for every message
+// written to the client. Backend may be called from other goroutines for
+// asynchronous messages (see Transport.WriteAsync).
+type Tracer interface {
+	Frontend(msg pgproto3.FrontendMessage)
+	Backend(m Message)
+}
+
+// NewTextTracer creates a Tracer that writes a human-readable, single line
+// summary of every message to w. Frontend messages are prefixed with "->" and
+// backend messages with "<-".
+func NewTextTracer(w io.Writer) Tracer {
+	return &textTracer{w}
+}
+
+type textTracer struct {
+	w io.Writer
+}
+
+func (t *textTracer) Frontend(msg pgproto3.FrontendMessage) {
+	name := fmt.Sprintf("%T", msg)
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "*pgproto3."), "*protocol.")
+	fmt.Fprintf(t.w, "-> %s %+v\n", name, msg)
+}
+
+func (t *textTracer) Backend(m Message) {
+	name := BackendMessageName(m.Type())
+	if m.IsError() || m.Type() == MsgTypeNoticeResponse {
+		res := &pgproto3.ErrorResponse{} // notices share the same fields
+		if err := res.Decode(m[5:]); err == nil {
+			fmt.Fprintf(t.w, "<- %s %s %s: %s\n", name, res.Severity, res.Code, res.Message)
+			return
+		}
+	}
+	fmt.Fprintf(t.w, "<- %s (%d bytes)\n", name, len(m))
+}
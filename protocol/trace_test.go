@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestTextTracer(t *testing.T) {
+	t.Run("frontend message", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		NewTextTracer(buf).Frontend(&pgproto3.Query{String: "SELECT 1"})
+		require.Equal(t, "-> Query &{String:SELECT 1}\n", buf.String())
+	})
+
+	t.Run("backend message", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		NewTextTracer(buf).Backend(ReadyForQuery)
+		require.Equal(t, "<- ReadyForQuery (6 bytes)\n", buf.String())
+	})
+
+	t.Run("error message", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		NewTextTracer(buf).Backend(ErrorResponse(fmt.Errorf("boom")))
+		require.Equal(t, "<- ErrorResponse ERROR XX000: boom\n", buf.String())
+	})
+
+	t.Run("notice message", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		NewTextTracer(buf).Backend(NoticeResponse(fmt.Errorf("meh")))
+		require.Equal(t, "<- NoticeResponse NOTICE 00000: meh\n", buf.String())
+	})
+}
+
+func TestTransport_SetTracer(t *testing.T) {
+	f, b := net.Pipe()
+	frontend, err := pgproto3.NewFrontend(f, f)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	transport := NewTransport(b)
+	transport.SetTracer(NewTextTracer(buf))
+
+	go func() {
+		_, err := frontend.Receive()
+		require.NoError(t, err)
+		err = frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+		require.NoError(t, err)
+	}()
+
+	_, _, err = transport.NextFrontendMessage()
+	require.NoError(t, err)
+	require.Equal(t, "<- ReadyForQuery (6 bytes)\n-> Query &{String:SELECT 1}\n", buf.String())
+}
+
+func TestHandshake_SetTracer(t *testing.T) {
+	buf := bytes.Buffer{}
+	comm := bufio.NewReadWriter(bufio.NewReader(&buf), bufio.NewWriter(&buf))
+	handshake := NewHandshake(comm)
+	trace := &bytes.Buffer{}
+	handshake.SetTracer(NewTextTracer(trace))
+
+	_, err := comm.Write([]byte{
+		0, 0, 0, 18, // length
+		0, 3, 0, 0, // 3.0
+		'u', 's', 'e', 'r', 0, 'b', 'o', 'b', 0, 0,
+		'p', 0, 0, 0, 11, 's', 'e', 'c', 'r', 'e', 't', 0, // password
+	})
+	require.NoError(t, err)
+	require.NoError(t, comm.Flush())
+
+	_, err = handshake.Init()
+	require.NoError(t, err)
+	require.NoError(t, handshake.Write(Authentication(AuthClearText, nil)))
+	_, err = handshake.Read()
+	require.NoError(t, err)
+
+	expected := "-> StartupMessage &{ProtocolVersion:196608 Parameters:map[user:bob]}\n" +
+		"<- Authentication (9 bytes)\n" +
+		"-> PasswordMessage &{Password:}\n"
+	require.Equal(t, expected, trace.String())
+}
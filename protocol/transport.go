@@ -1,8 +1,11 @@
 package protocol
 
 import (
+	"errors"
+	"fmt"
 	"github.com/jackc/pgx/pgproto3"
 	"io"
+	"sync"
 )
 
 // TransactionState is used as a return with every message read for commit and rollback implementation
@@ -21,12 +24,36 @@ const (
 	TransactionFailed
 )
 
+// ErrTerminated is returned by NextFrontendMessage once the transport has sent
+// its final message, see Terminate
+var ErrTerminated = errors.New("connection terminated by the server")
+
+// flusher is implemented by buffered writers that hold outgoing data until
+// explicitly flushed.
+type flusher interface {
+	Flush() error
+}
+
+// flush sends out any buffered data held by w, if it's buffered
+func flush(w io.Writer) error {
+	if f, ok := w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// maxMessageLength is the default limit of the length of frontend messages,
+// like PQ_LARGE_MESSAGE_LIMIT of postgres
+const maxMessageLength = 1 << 30
+
 // NewTransport creates a Transport
 func NewTransport(rw io.ReadWriter) *Transport {
-	b, _ := pgproto3.NewBackend(rw, nil)
+	r := &frameReader{r: rw, max: maxMessageLength, substituted: map[int]frame{}}
+	b, _ := pgproto3.NewBackend(r, nil)
 	return &Transport{
-		w: rw,
-		r: b,
+		w:      rw,
+		r:      b,
+		frames: r,
 	}
 }
 
@@ -34,7 +61,65 @@ func NewTransport(rw io.ReadWriter) *Transport {
 type Transport struct {
 	w           io.Writer
 	r           *pgproto3.Backend
+	frames      *frameReader
+	received    int // the number of messages received, see frameReader
 	transaction *transaction
+	tracer      Tracer
+	strict      bool        // see SetStrictFraming
+	status      func() byte // see SetTransactionStatus
+
+	errorResponse func(error) Message // see SetErrorResponse
+
+	// mu guards the writer against asynchronous messages written from other
+	// goroutines (see WriteAsync) while the transport is idle.
+	mu    sync.Mutex
+	idle  bool
+	async []Message
+	final func() Message // creates the message sent instead of the next ReadyForQuery, see Terminate
+}
+
+// SetMaxMessageLength sets the maximum length, in bytes, of the messages read
+// from the frontend. Longer messages are rejected with a ProtocolError before
+// they're read. Defaults to 1GB.
+func (t *Transport) SetMaxMessageLength(n int) {
+	t.frames.max = n
+}
+
+// SetStrictFraming enables the validation of the framing of every message
+// written by the Transport (see Message.Validate), panicking on messages whose
+// declared length is wrong, which would otherwise corrupt the stream. It's
+// meant for catching bugs in the construction of messages during development.
+func (t *Transport) SetStrictFraming(strict bool) {
+	t.strict = strict
+}
+
+// SetTracer sets a Tracer to observe all of the messages read and written by
+// the Transport. A nil Tracer disables tracing.
+func (t *Transport) SetTracer(tracer Tracer) {
+	t.tracer = tracer
+}
+
+// SetTransactionStatus sets the function reporting the transaction status
+// indicator of each ReadyForQuery (see ReadyForQueryStatus), which is called
+// once the frontend message before it is handled. Defaults to idle.
+func (t *Transport) SetTransactionStatus(status func() byte) {
+	t.status = status
+}
+
+// SetErrorResponse sets the function creating the ErrorResponse of the errors
+// detected by the Transport itself, like malformed or unsupported messages,
+// for localizing them. Defaults to ErrorResponse.
+func (t *Transport) SetErrorResponse(errorResponse func(error) Message) {
+	t.errorResponse = errorResponse
+}
+
+// errorMessage creates the ErrorResponse of an error detected by the
+// Transport, see SetErrorResponse
+func (t *Transport) errorMessage(err error) Message {
+	if t.errorResponse != nil {
+		return t.errorResponse(err)
+	}
+	return ErrorResponse(err)
 }
 
 func (t *Transport) beginTransaction() {
@@ -57,11 +142,15 @@ func (t *Transport) endTransaction() (err error) {
 func (t *Transport) NextFrontendMessage() (msg pgproto3.FrontendMessage, ts TransactionState, err error) {
 	if t.transaction == nil {
 		// when not in transaction, client waits for ReadyForQuery before sending next message
-		err = t.Write(ReadyForQuery)
+		err = t.waitForQuery()
 		if err != nil {
 			return
 		}
 		msg, err = t.readFrontendMessage()
+
+		t.mu.Lock()
+		t.idle = false
+		t.mu.Unlock()
 	} else {
 		msg, err = t.transaction.NextFrontendMessage()
 	}
@@ -73,10 +162,50 @@ func (t *Transport) NextFrontendMessage() (msg pgproto3.FrontendMessage, ts Tran
 	return
 }
 
+// waitForQuery sends out all of the pending asynchronous messages followed by
+// a ReadyForQuery, and marks the transport as idle until the next message is
+// read.
+func (t *Transport) waitForQuery() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, m := range t.async {
+		err = t.write(m)
+		if err != nil {
+			return
+		}
+	}
+	t.async = nil
+
+	if t.final != nil {
+		err = t.write(t.final())
+		if err == nil {
+			err = flush(t.w)
+		}
+		if err == nil {
+			err = ErrTerminated
+		}
+		return
+	}
+
+	ready := Message(ReadyForQuery)
+	if t.status != nil {
+		ready = ReadyForQueryStatus(t.status())
+	}
+	err = t.write(ready)
+	if err != nil {
+		return
+	}
+
+	err = flush(t.w)
+	t.idle = err == nil
+	return
+}
+
 func (t *Transport) affectTransaction(msg pgproto3.FrontendMessage) (ts TransactionState, err error) {
 	if t.transaction == nil {
 		switch msg.(type) {
-		case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe:
+		case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close:
 			t.beginTransaction()
 			ts = InTransaction
 		default:
@@ -104,7 +233,97 @@ func (t *Transport) affectTransaction(msg pgproto3.FrontendMessage) (ts Transact
 }
 
 func (t *Transport) readFrontendMessage() (pgproto3.FrontendMessage, error) {
-	return t.r.Receive()
+	for {
+		// the client may be waiting for the messages written so far before
+		// sending its next message, so they must be sent before blocking on
+		// read
+		t.mu.Lock()
+		err := flush(t.w)
+		t.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err := t.receive()
+		if pe, ok := err.(*ProtocolError); ok {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.write(t.errorMessage(pe)) == nil {
+				flush(t.w)
+			}
+			return nil, err
+		}
+		if um, ok := err.(unsupportedMessage); ok {
+			err = t.rejectMessage(um)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err == nil && t.tracer != nil {
+			t.tracer.Frontend(msg)
+		}
+		return msg, err
+	}
+}
+
+// rejectMessage reports the message of an unsupported type to the client,
+// without ending the session. Within the extended protocol, the transaction
+// fails and the following messages are discarded until Sync. Otherwise, the
+// client is ready for its next query.
+func (t *Transport) rejectMessage(err unsupportedMessage) error {
+	if t.transaction != nil {
+		return t.transaction.Write(t.errorMessage(err))
+	}
+
+	err1 := t.write(t.errorMessage(err))
+	if err1 != nil {
+		return err1
+	}
+	return t.waitForQuery()
+}
+
+// receive reads the next message from the frontend. Malformed messages, which
+// the decoder either rejects or panics on, are reported as a ProtocolError,
+// and messages of unsupported types as an unsupportedMessage.
+func (t *Transport) receive() (msg pgproto3.FrontendMessage, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg, err = nil, &ProtocolError{fmt.Sprintf("invalid frontend message: %v", r)}
+		}
+	}()
+
+	msg, err = t.r.Receive()
+	if err == nil {
+		t.received++
+		if f, ok := t.frames.substituted[t.received]; ok {
+			delete(t.frames.substituted, t.received)
+			return decodeFrame(f)
+		}
+		return msg, nil
+	}
+	if pe, ok := t.frames.err.(*ProtocolError); ok {
+		return nil, pe
+	}
+	if t.frames.err == nil {
+		return nil, &ProtocolError{err.Error()}
+	}
+	return nil, err
+}
+
+// decodeFrame decodes a message substituted by the frameReader
+func decodeFrame(f frame) (pgproto3.FrontendMessage, error) {
+	newMessage := transportMessageTypes[f.typ]
+	if newMessage == nil {
+		return nil, unsupportedMessage(f.typ)
+	}
+
+	msg := newMessage()
+	err := msg.Decode(f.body)
+	if err != nil {
+		return nil, &ProtocolError{err.Error()}
+	}
+	return msg, nil
 }
 
 // Write writes the provided message to the client connection
@@ -115,7 +334,82 @@ func (t *Transport) Write(m Message) error {
 	return t.write(m)
 }
 
+// Flush sends out any messages buffered by the underlying writer, if it's
+// buffered, along with the messages written so far within the extended query
+// transaction, which are otherwise held until Sync, as the Flush message
+// requires. The writer is also flushed implicitly before reading the next
+// frontend message.
+func (t *Transport) Flush() error {
+	if t.transaction != nil {
+		err := t.transaction.flush()
+		if err != nil {
+			return err
+		}
+	}
+	return flush(t.w)
+}
+
+// WriteAsync writes an asynchronous message, like NotificationResponse, that
+// isn't a part of any query cycle. It's safe to call from any goroutine. When
+// the transport is idle, waiting for the next query, the message is sent out
+// immediately. Otherwise it's held until the current query cycle is complete
+// and sent right before the next ReadyForQuery.
+func (t *Transport) WriteAsync(m Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.idle {
+		t.async = append(t.async, m)
+		return nil
+	}
+
+	err := t.write(m)
+	if err != nil {
+		return err
+	}
+	return flush(t.w)
+}
+
+// Terminate ends the session gracefully from any goroutine by sending a final
+// message, like a FATAL error, once the current query cycle is complete. When
+// the transport is idle, waiting for the next query, the message is sent out
+// immediately and Terminate returns true, in which case the caller should close
+// the connection to stop waiting. Otherwise the message is sent instead of the
+// next ReadyForQuery, and NextFrontendMessage returns ErrTerminated.
+func (t *Transport) Terminate(m Message) (bool, error) {
+	return t.terminate(func() Message { return m })
+}
+
+// TerminateError is like Terminate, with the ErrorResponse of the error as the
+// final message (see SetErrorResponse). It's created once it's sent, by the
+// goroutine that sends it, while the transport isn't handling a query.
+func (t *Transport) TerminateError(err error) (bool, error) {
+	return t.terminate(func() Message { return t.errorMessage(err) })
+}
+
+func (t *Transport) terminate(final func() Message) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.final = final
+	if !t.idle {
+		return false, nil
+	}
+
+	err := t.write(final())
+	if err == nil {
+		err = flush(t.w)
+	}
+	return true, err
+}
+
 func (t *Transport) write(m Message) error {
+	if t.strict {
+		mustValidate(m)
+	}
+	if t.tracer != nil {
+		t.tracer.Backend(m)
+	}
 	_, err := t.w.Write(m)
 	return err
 }
@@ -1,11 +1,13 @@
 package protocol
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/jackc/pgx/pgproto3"
 	pgstories "github.com/panoplyio/pg-stories"
 	"github.com/stretchr/testify/require"
 	"io"
+	"io/ioutil"
 	"net"
 	"testing"
 	"time"
@@ -174,5 +176,368 @@ func TestTransport_Read(t *testing.T) {
 
 			require.Nil(t, transport.transaction, "expected protocol to end transaction")
 		})
+
+		t.Run("skips messages until sync", func(t *testing.T) {
+			f, b := net.Pipe()
+
+			transport := NewTransport(b)
+
+			received := make(chan pgproto3.FrontendMessage, 10)
+			go func() {
+				for {
+					m, ts, err := transport.NextFrontendMessage()
+					require.NoError(t, err)
+					received <- m
+
+					err = nil
+					switch m.(type) {
+					case *pgproto3.Parse:
+						err = transport.Write(ParseComplete)
+					case *pgproto3.Bind:
+						err = transport.Write(ErrorResponse(fmt.Errorf("dosn't matter")))
+					case *pgproto3.Sync:
+						if len(received) == 3 {
+							require.Equal(t, TransactionFailed, ts)
+						}
+					}
+					require.NoError(t, err)
+				}
+			}()
+
+			err := runStory(t, f, []pgstories.Step{
+				&pgstories.Response{BackendMessage: &pgproto3.ReadyForQuery{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Parse{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Bind{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Describe{ObjectType: 'P'}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Execute{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Parse{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Sync{}},
+				&pgstories.Response{BackendMessage: &pgproto3.ParseComplete{}},
+				&pgstories.Response{BackendMessage: &pgproto3.ErrorResponse{}},
+				&pgstories.Response{BackendMessage: &pgproto3.ReadyForQuery{}},
+
+				// the next sync isn't in a transaction, and gets its own ReadyForQuery
+				&pgstories.Command{FrontendMessage: &pgproto3.Sync{}},
+				&pgstories.Response{BackendMessage: &pgproto3.ReadyForQuery{}},
+			})
+			require.NoError(t, err)
+
+			require.IsType(t, &pgproto3.Parse{}, <-received)
+			require.IsType(t, &pgproto3.Bind{}, <-received)
+			require.IsType(t, &pgproto3.Sync{}, <-received)
+			require.IsType(t, &pgproto3.Sync{}, <-received)
+			require.Len(t, received, 0, "expected the messages after the error to be skipped")
+		})
+	})
+}
+
+func TestTransport_WriteAsync(t *testing.T) {
+	f, b := net.Pipe()
+
+	frontend, err := pgproto3.NewFrontend(f, f)
+	require.NoError(t, err)
+
+	transport := NewTransport(b)
+
+	// not idle yet, so the message is held until the next ReadyForQuery
+	err = transport.WriteAsync(NotificationResponse(1, "foo", "queued"))
+	require.NoError(t, err)
+
+	go func() {
+		_, _, err := transport.NextFrontendMessage()
+		require.NoError(t, err)
+	}()
+
+	m, err := frontend.Receive()
+	require.NoError(t, err)
+	require.Equal(t, &pgproto3.NotificationResponse{PID: 1, Channel: "foo", Payload: "queued"}, m)
+
+	m, err = frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.ReadyForQuery{}, m)
+
+	// now idle, waiting for the next message, so it's sent out immediately
+	go func() {
+		err := transport.WriteAsync(NotificationResponse(1, "foo", "immediate"))
+		require.NoError(t, err)
+	}()
+
+	m, err = frontend.Receive()
+	require.NoError(t, err)
+	require.Equal(t, &pgproto3.NotificationResponse{PID: 1, Channel: "foo", Payload: "immediate"}, m)
+
+	err = frontend.Send(&pgproto3.Terminate{})
+	require.NoError(t, err)
+}
+
+func TestTransport_Terminate(t *testing.T) {
+	t.Run("not idle", func(t *testing.T) {
+		f, b := net.Pipe()
+
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+
+		transport := NewTransport(b)
+
+		// the final message is sent instead of the next ReadyForQuery
+		idle, err := transport.Terminate(ErrorResponse(fmt.Errorf("bye")))
+		require.NoError(t, err)
+		require.False(t, idle)
+
+		done := make(chan error)
+		go func() {
+			_, _, err := transport.NextFrontendMessage()
+			done <- err
+		}()
+
+		m, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ErrorResponse{}, m)
+		require.Equal(t, ErrTerminated, <-done)
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		f, b := net.Pipe()
+
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+
+		transport := NewTransport(b)
+		go transport.NextFrontendMessage()
+
+		m, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ReadyForQuery{}, m)
+
+		// sent out immediately
+		go func() {
+			idle, err := transport.Terminate(ErrorResponse(fmt.Errorf("bye")))
+			require.NoError(t, err)
+			require.True(t, idle)
+		}()
+
+		m, err = frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ErrorResponse{}, m)
+		b.Close()
+	})
+}
+
+func TestTransport_malformedMessages(t *testing.T) {
+	tests := map[string][]byte{
+		"negative length":   {'Q', 0xff, 0xff, 0xff, 0xff},
+		"short length":      {'Q', 0, 0, 0, 3},
+		"oversized message": {'Q', 0, 0, 4, 1, 'S'},
+		"invalid format":    {'D', 0, 0, 0, 4},
+		"invalid parameter": {'B', 0, 0, 0, 16, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xfe, 0, 0},
+	}
+
+	for name, msg := range tests {
+		t.Run(name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			transport := NewTransport(struct {
+				io.Reader
+				io.Writer
+			}{bytes.NewBuffer(msg), out})
+			transport.SetMaxMessageLength(1024)
+
+			_, _, err := transport.NextFrontendMessage()
+			require.Error(t, err)
+			require.IsType(t, &ProtocolError{}, err)
+
+			frontend, err := pgproto3.NewFrontend(out, nil)
+			require.NoError(t, err)
+			_, err = frontend.Receive() // ReadyForQuery
+			require.NoError(t, err)
+			res, err := frontend.Receive()
+			require.NoError(t, err)
+			require.Equal(t, "FATAL", res.(*pgproto3.ErrorResponse).Severity)
+			require.Equal(t, "08P01", res.(*pgproto3.ErrorResponse).Code)
+		})
+	}
+
+	t.Run("preceding messages", func(t *testing.T) {
+		msg := append((&pgproto3.Query{String: "SELECT 1"}).Encode(nil), 'Q', 0xff, 0xff, 0xff, 0xff)
+		transport := NewTransport(struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewBuffer(msg), ioutil.Discard})
+
+		res, _, err := transport.NextFrontendMessage()
+		require.NoError(t, err)
+		require.Equal(t, &pgproto3.Query{String: "SELECT 1"}, res)
+
+		_, _, err = transport.NextFrontendMessage()
+		require.IsType(t, &ProtocolError{}, err)
+	})
+
+	t.Run("connection closed", func(t *testing.T) {
+		transport := NewTransport(struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewBuffer([]byte{'Q', 0, 0}), ioutil.Discard})
+
+		_, _, err := transport.NextFrontendMessage()
+		require.Error(t, err)
+		require.IsType(t, io.ErrUnexpectedEOF, err)
+	})
+}
+
+func TestTransport_unsupportedMessages(t *testing.T) {
+	unsupported := []byte{'z', 0, 0, 0, 6, 0, 1}
+	query := (&pgproto3.Query{String: "SELECT 1"}).Encode(nil)
+
+	// reads the messages sent by the transport, up to the next ReadyForQuery
+	untilReady := func(t *testing.T, frontend *pgproto3.Frontend) (res []pgproto3.BackendMessage) {
+		for {
+			m, err := frontend.Receive()
+			require.NoError(t, err)
+			if e, ok := m.(*pgproto3.ErrorResponse); ok {
+				m = &pgproto3.ErrorResponse{Severity: e.Severity, Code: e.Code, Message: e.Message}
+			}
+			res = append(res, m)
+			if _, ok := m.(*pgproto3.ReadyForQuery); ok {
+				return
+			}
+		}
+	}
+
+	expectedErr := &pgproto3.ErrorResponse{
+		Severity: "ERROR",
+		Code:     "08P01",
+		Message:  "unsupported frontend message type 'z'",
+	}
+
+	t.Run("simple", func(t *testing.T) {
+		in := append(append([]byte{}, unsupported...), query...)
+		out := &bytes.Buffer{}
+		transport := NewTransport(struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewBuffer(in), out})
+
+		msg, ts, err := transport.NextFrontendMessage()
+		require.NoError(t, err)
+		require.Equal(t, NotInTransaction, ts)
+		require.Equal(t, &pgproto3.Query{String: "SELECT 1"}, msg)
+
+		frontend, err := pgproto3.NewFrontend(out, nil)
+		require.NoError(t, err)
+		require.Equal(t, []pgproto3.BackendMessage{
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		}, untilReady(t, frontend))
+		require.Equal(t, []pgproto3.BackendMessage{
+			expectedErr,
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		}, untilReady(t, frontend))
+	})
+
+	t.Run("extended", func(t *testing.T) {
+		var in []byte
+		in = (&pgproto3.Parse{Query: "SELECT 1"}).Encode(in)
+		in = append(in, unsupported...)
+		in = (&pgproto3.Bind{}).Encode(in)
+		in = (&pgproto3.Sync{}).Encode(in)
+		in = append(in, query...)
+
+		out := &bytes.Buffer{}
+		transport := NewTransport(struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewBuffer(in), out})
+
+		msg, ts, err := transport.NextFrontendMessage()
+		require.NoError(t, err)
+		require.Equal(t, InTransaction, ts)
+		require.IsType(t, &pgproto3.Parse{}, msg)
+		require.NoError(t, transport.Write(ParseComplete))
+
+		// the Bind is skipped, up to the Sync
+		msg, ts, err = transport.NextFrontendMessage()
+		require.NoError(t, err)
+		require.Equal(t, TransactionFailed, ts)
+		require.IsType(t, &pgproto3.Sync{}, msg)
+
+		// the session is still alive
+		msg, ts, err = transport.NextFrontendMessage()
+		require.NoError(t, err)
+		require.Equal(t, NotInTransaction, ts)
+		require.IsType(t, &pgproto3.Query{}, msg)
+
+		frontend, err := pgproto3.NewFrontend(out, nil)
+		require.NoError(t, err)
+		untilReady(t, frontend)
+		require.Equal(t, []pgproto3.BackendMessage{
+			&pgproto3.ParseComplete{},
+			expectedErr,
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		}, untilReady(t, frontend))
+	})
+}
+
+func TestTransport_strictFraming(t *testing.T) {
+	transport := NewTransport(&bytes.Buffer{})
+	require.NoError(t, transport.Write(CommandComplete("SELECT 1")))
+	require.NoError(t, transport.Write(Message{'C', 0, 0, 0, 4, 'x'}), "expected no validation by default")
+
+	transport.SetStrictFraming(true)
+	require.NoError(t, transport.Write(CommandComplete("SELECT 1")))
+	require.Panics(t, func() {
+		transport.Write(Message{'C', 0, 0, 0, 4, 'x'})
+	})
+
+	handshake := NewHandshake(&bytes.Buffer{})
+	handshake.SetStrictFraming(true)
+	require.Panics(t, func() {
+		handshake.Write(Message{'R', 0, 0, 0, 4, 0, 0, 0, 0})
+	})
+}
+
+func TestTransport_SetTransactionStatus(t *testing.T) {
+	f, b := net.Pipe()
+	defer f.Close()
+
+	frontend, err := pgproto3.NewFrontend(f, f)
+	require.NoError(t, err)
+
+	transport := NewTransport(b)
+	transport.SetTransactionStatus(func() byte { return 'T' })
+	go transport.NextFrontendMessage()
+
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'T'}, msg)
+}
+
+func TestTransport_SetErrorResponse(t *testing.T) {
+	f, b := net.Pipe()
+	defer f.Close()
+
+	frontend, err := pgproto3.NewFrontend(f, f)
+	require.NoError(t, err)
+
+	transport := NewTransport(b)
+	transport.SetErrorResponse(func(err error) Message {
+		return ErrorResponse(fmt.Errorf("localized: %s", err))
 	})
+	go transport.NextFrontendMessage()
+
+	_, err = frontend.Receive()
+	require.NoError(t, err)
+
+	// the errors detected by the transport
+	_, err = f.Write([]byte{'?', 0, 0, 0, 4})
+	require.NoError(t, err)
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.Equal(t, "localized: unsupported frontend message type '?'", msg.(*pgproto3.ErrorResponse).Message)
+
+	_, err = frontend.Receive()
+	require.NoError(t, err)
+
+	// and the final error of TerminateError
+	go transport.TerminateError(fmt.Errorf("bye"))
+	msg, err = frontend.Receive()
+	require.NoError(t, err)
+	require.Equal(t, "localized: bye", msg.(*pgproto3.ErrorResponse).Message)
 }
@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// backend message types, see Message.Type
+const (
+	MsgTypeAuthentication           = 'R'
+	MsgTypeBackendKeyData           = 'K'
+	MsgTypeBindComplete             = '2'
+	MsgTypeCloseComplete            = '3'
+	MsgTypeCommandComplete          = 'C'
+	MsgTypeCopyInResponse           = 'G'
+	MsgTypeCopyOutResponse          = 'H'
+	MsgTypeDataRow                  = 'D'
+	MsgTypeEmptyQueryResponse       = 'I'
+	MsgTypeErrorResponse            = 'E'
+	MsgTypeFunctionCallResponse     = 'V'
+	MsgTypeNegotiateProtocolVersion = 'v'
+	MsgTypeNoData                   = 'n'
+	MsgTypeNoticeResponse           = 'N'
+	MsgTypeNotificationResponse     = 'A'
+	MsgTypeParameterDescription     = 't'
+	MsgTypeParameterStatus          = 'S'
+	MsgTypeParseComplete            = '1'
+	MsgTypePortalSuspended          = 's'
+	MsgTypeReadyForQuery            = 'Z'
+	MsgTypeRowDescription           = 'T'
+)
+
+// frontend message types. Some of them share their type with backend messages,
+// like Execute and ErrorResponse.
+const (
+	MsgTypeBind            = 'B'
+	MsgTypeClose           = 'C'
+	MsgTypeCopyData        = 'd'
+	MsgTypeCopyDone        = 'c'
+	MsgTypeCopyFail        = 'f'
+	MsgTypeDescribe        = 'D'
+	MsgTypeExecute         = 'E'
+	MsgTypeFlush           = 'H'
+	MsgTypeFunctionCall    = 'F'
+	MsgTypeParse           = 'P'
+	MsgTypePasswordMessage = 'p'
+	MsgTypeQuery           = 'Q'
+	MsgTypeSync            = 'S'
+	MsgTypeTerminate       = 'X'
+)
+
+// protocol codes of the untyped startup messages, in place of the version
+// number of a StartupMessage
+const (
+	ProtocolVersion3      = 196608   // 3.0
+	ProtocolCancelRequest = 80877102 // 1234.5678
+	ProtocolSSLRequest    = 80877103 // 1234.5679
+	ProtocolGSSENCRequest = 80877104 // 1234.5680
+)
+
+// backendMessageNames maps backend message types to their names as they appear
+// in the protocol documentation
+var backendMessageNames = map[byte]string{
+	MsgTypeAuthentication:           "Authentication",
+	MsgTypeBackendKeyData:           "BackendKeyData",
+	MsgTypeBindComplete:             "BindComplete",
+	MsgTypeCloseComplete:            "CloseComplete",
+	MsgTypeCommandComplete:          "CommandComplete",
+	MsgTypeCopyInResponse:           "CopyInResponse",
+	MsgTypeDataRow:                  "DataRow",
+	MsgTypeEmptyQueryResponse:       "EmptyQueryResponse",
+	MsgTypeErrorResponse:            "ErrorResponse",
+	MsgTypeFunctionCallResponse:     "FunctionCallResponse",
+	MsgTypeNegotiateProtocolVersion: "NegotiateProtocolVersion",
+	MsgTypeNoData:                   "NoData",
+	MsgTypeNoticeResponse:           "NoticeResponse",
+	MsgTypeNotificationResponse:     "NotificationResponse",
+	MsgTypeParameterDescription:     "ParameterDescription",
+	MsgTypeParameterStatus:          "ParameterStatus",
+	MsgTypeParseComplete:            "ParseComplete",
+	MsgTypePortalSuspended:          "PortalSuspended",
+	MsgTypeReadyForQuery:            "ReadyForQuery",
+	MsgTypeRowDescription:           "RowDescription",
+}
+
+// frontendMessageNames maps frontend message types to their names as they
+// appear in the protocol documentation
+var frontendMessageNames = map[byte]string{
+	MsgTypeBind:            "Bind",
+	MsgTypeClose:           "Close",
+	MsgTypeCopyData:        "CopyData",
+	MsgTypeCopyDone:        "CopyDone",
+	MsgTypeCopyFail:        "CopyFail",
+	MsgTypeDescribe:        "Describe",
+	MsgTypeExecute:         "Execute",
+	MsgTypeFlush:           "Flush",
+	MsgTypeFunctionCall:    "FunctionCall",
+	MsgTypeParse:           "Parse",
+	MsgTypePasswordMessage: "PasswordMessage",
+	MsgTypeQuery:           "Query",
+	MsgTypeSync:            "Sync",
+	MsgTypeTerminate:       "Terminate",
+}
+
+// BackendMessageName returns the name of the backend message type, like
+// "ReadyForQuery" for 'Z', or the quoted type if it's unknown
+func BackendMessageName(typ byte) string {
+	if name, ok := backendMessageNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("%q", typ)
+}
+
+// FrontendMessageName returns the name of the frontend message type, like
+// "Query" for 'Q', or the quoted type if it's unknown. The untyped startup
+// messages are named by StartupMessageName.
+func FrontendMessageName(typ byte) string {
+	if name, ok := frontendMessageNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("%q", typ)
+}
+
+// StartupMessageName returns the name of the untyped startup message by its
+// protocol code, like "SSLRequest", or "StartupMessage" for a protocol version
+func (m Message) StartupMessageName() string {
+	switch m.startupCode() {
+	case ProtocolCancelRequest:
+		return "CancelRequest"
+	case ProtocolSSLRequest:
+		return "SSLRequest"
+	case ProtocolGSSENCRequest:
+		return "GSSENCRequest"
+	}
+	return "StartupMessage"
+}
+
+// startupCode returns the protocol code of the untyped startup message, which
+// is either the protocol version or one of the request codes
+func (m Message) startupCode() uint32 {
+	if m.Type() != 0 || len(m) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(m[4:8])
+}
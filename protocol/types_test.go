@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMessageTypes(t *testing.T) {
+	t.Run("backend", func(t *testing.T) {
+		for typ, msg := range map[byte]pgproto3.BackendMessage{
+			MsgTypeAuthentication:       &pgproto3.Authentication{},
+			MsgTypeBackendKeyData:       &pgproto3.BackendKeyData{},
+			MsgTypeCommandComplete:      &pgproto3.CommandComplete{},
+			MsgTypeDataRow:              &pgproto3.DataRow{},
+			MsgTypeErrorResponse:        &pgproto3.ErrorResponse{},
+			MsgTypeNoticeResponse:       &pgproto3.NoticeResponse{},
+			MsgTypeParameterDescription: &pgproto3.ParameterDescription{},
+			MsgTypeParameterStatus:      &pgproto3.ParameterStatus{},
+			MsgTypeReadyForQuery:        &pgproto3.ReadyForQuery{TxStatus: 'I'},
+			MsgTypeRowDescription:       &pgproto3.RowDescription{},
+		} {
+			require.Equal(t, typ, msg.Encode(nil)[0], "%T", msg)
+		}
+	})
+
+	t.Run("frontend", func(t *testing.T) {
+		for typ, msg := range map[byte]pgproto3.FrontendMessage{
+			MsgTypeBind:            &pgproto3.Bind{},
+			MsgTypeClose:           &pgproto3.Close{},
+			MsgTypeDescribe:        &pgproto3.Describe{},
+			MsgTypeExecute:         &pgproto3.Execute{},
+			MsgTypeParse:           &pgproto3.Parse{},
+			MsgTypePasswordMessage: &pgproto3.PasswordMessage{},
+			MsgTypeQuery:           &pgproto3.Query{},
+			MsgTypeSync:            &pgproto3.Sync{},
+			MsgTypeTerminate:       &pgproto3.Terminate{},
+		} {
+			require.Equal(t, typ, msg.Encode(nil)[0], "%T", msg)
+		}
+	})
+}
+
+func TestMessageNames(t *testing.T) {
+	require.Equal(t, "ReadyForQuery", BackendMessageName(ReadyForQuery[0]))
+	require.Equal(t, "ErrorResponse", BackendMessageName(MsgTypeErrorResponse))
+	require.Equal(t, "'x'", BackendMessageName('x'))
+
+	require.Equal(t, "Execute", FrontendMessageName(MsgTypeErrorResponse))
+	require.Equal(t, "PasswordMessage", FrontendMessageName(MsgTypePasswordMessage))
+	require.Equal(t, "'x'", FrontendMessageName('x'))
+}
+
+func TestStartupMessageName(t *testing.T) {
+	startup := func(code uint32) Message {
+		m := Message{0, 0, 0, 8, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(m[4:], code)
+		return m
+	}
+
+	require.Equal(t, "StartupMessage", startup(ProtocolVersion3).StartupMessageName())
+	require.Equal(t, "CancelRequest", startup(ProtocolCancelRequest).StartupMessageName())
+	require.Equal(t, "SSLRequest", startup(ProtocolSSLRequest).StartupMessageName())
+	require.Equal(t, "GSSENCRequest", startup(ProtocolGSSENCRequest).StartupMessageName())
+
+	require.True(t, startup(ProtocolSSLRequest).IsTLSRequest())
+	require.True(t, startup(ProtocolCancelRequest).IsCancel())
+	require.False(t, startup(ProtocolVersion3).IsTLSRequest())
+}
@@ -0,0 +1,115 @@
+package pgsrv
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxProxyHeaderLength is the maximum length of a PROXY protocol v1 header,
+// including the CRLF
+const maxProxyHeaderLength = 107
+
+// wrapConn replaces the connection with the one returned by the ConnWrapper,
+// within the auth timeout, closing it if the wrapper fails
+func (s *server) wrapConn(conn net.Conn) (net.Conn, error) {
+	if s.authTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.authTimeout))
+	}
+
+	wrapped, addr, err := s.connWrapper(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if s.authTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+	if addr != nil {
+		wrapped = &addrConn{wrapped, addr}
+	}
+	return wrapped, nil
+}
+
+// addrConn overrides the remote address of the connection, see ConnWrapper
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.addr }
+
+// ProxyProtocol is a ConnWrapper that reads the header of version 1 of the
+// PROXY protocol, sent by load balancers like HAProxy ahead of the client's
+// data, and reports the address of the client that it carries. Connections
+// without the header are rejected, so it must only be used when all of the
+// connections pass through the proxy. See:
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+func ProxyProtocol(conn net.Conn) (net.Conn, net.Addr, error) {
+	r := bufio.NewReaderSize(conn, maxProxyHeaderLength)
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol header: too long")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr, err := parseProxyHeader(string(line))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the client's data may already be buffered
+	return &readerConn{conn, r}, addr, nil
+}
+
+// parseProxyHeader parses the header line of the PROXY protocol, like
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", and returns the source
+// address. It's nil for UNKNOWN connections, like health checks of the proxy.
+func parseProxyHeader(line string) (net.Addr, error) {
+	if !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid PROXY protocol header: missing CRLF")
+	}
+
+	fields := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("invalid PROXY protocol header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("invalid PROXY protocol header: unsupported protocol %s", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid PROXY protocol header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid PROXY protocol header: invalid address")
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol header: invalid port %s", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readerConn reads from the reader in place of the connection, since it holds
+// some of the connection's data
+type readerConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) { return c.r.Read(p) }
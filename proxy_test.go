@@ -0,0 +1,134 @@
+package pgsrv
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseProxyHeader(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 5432\r\n", "192.168.0.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4000 5432\r\n", "[2001:db8::1]:4000"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			addr, err := parseProxyHeader(test.line)
+			require.NoError(t, err)
+			if test.expected == "" {
+				require.Nil(t, addr)
+			} else {
+				require.Equal(t, test.expected, addr.String())
+			}
+		})
+	}
+
+	invalid := []string{
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 5432\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 5432\r\n",
+		"PROXY TCP6 192.168.0.1 192.168.0.11 56324 5432\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 65536 5432\r\n",
+		"PROXY UDP4 192.168.0.1 192.168.0.11 56324 5432\r\n",
+		"PROXY\r\n",
+		"GET / HTTP/1.1\r\n",
+	}
+	for _, line := range invalid {
+		t.Run(line, func(t *testing.T) {
+			_, err := parseProxyHeader(line)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	t.Run("header", func(t *testing.T) {
+		f, b := net.Pipe()
+		go func() {
+			fmt.Fprint(f, "PROXY TCP4 10.0.0.1 10.0.0.2 1234 5432\r\nstartup")
+			f.Close()
+		}()
+
+		conn, addr, err := ProxyProtocol(b)
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.1:1234", addr.String())
+
+		data, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "startup", string(data))
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		f, b := net.Pipe()
+		go fmt.Fprint(f, "PROXY TCP4 "+string(make([]byte, maxProxyHeaderLength))+"\r\n")
+		defer f.Close()
+
+		_, _, err := ProxyProtocol(b)
+		require.Error(t, err)
+	})
+}
+
+func TestServer_connWrapper(t *testing.T) {
+	t.Run("remote address", func(t *testing.T) {
+		srv := New(&mockQueryer{}, WithConnWrapper(ProxyProtocol)).(*server)
+		conn := dialServer(t, srv)
+		defer conn.Close()
+
+		fmt.Fprint(conn, "PROXY TCP4 10.0.0.1 10.0.0.2 1234 5432\r\n")
+		frontend, err := pgproto3.NewFrontend(conn, conn)
+		require.NoError(t, err)
+		err = frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres"},
+		})
+		require.NoError(t, err)
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				break
+			}
+		}
+
+		sessions := srv.Sessions()
+		require.Len(t, sessions, 1)
+		require.Equal(t, "10.0.0.1:1234", sessions[0].RemoteAddr.String())
+	})
+
+	t.Run("filtered by the remote address", func(t *testing.T) {
+		filter, err := AllowCIDRs("10.0.0.0/8")
+		require.NoError(t, err)
+		srv := New(&mockQueryer{}, WithConnWrapper(ProxyProtocol), WithConnFilter(filter))
+
+		conn := dialServer(t, srv)
+		defer conn.Close()
+		fmt.Fprint(conn, "PROXY TCP4 192.168.0.1 10.0.0.2 1234 5432\r\n")
+
+		frontend, err := pgproto3.NewFrontend(conn, conn)
+		require.NoError(t, err)
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+		require.Equal(t, "28000", msg.(*pgproto3.ErrorResponse).Code)
+	})
+
+	t.Run("error closes the connection", func(t *testing.T) {
+		srv := New(&mockQueryer{}, WithConnWrapper(ProxyProtocol), WithAuthTimeout(time.Second))
+		conn := dialServer(t, srv)
+		defer conn.Close()
+
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\n")
+		_, err := conn.Read(make([]byte, 1))
+		require.Error(t, err)
+	})
+}
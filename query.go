@@ -4,71 +4,297 @@ import (
 	"context"
 	"database/sql/driver"
 	"fmt"
-	parser "github.com/lfittl/pg_query_go"
 	nodes "github.com/lfittl/pg_query_go/nodes"
 	"github.com/panoplyio/pgsrv/protocol"
 	"io"
+	"runtime/debug"
+	"strings"
+	"time"
 )
 
 type query struct {
-	transport *protocol.Transport
-	queryer   Queryer
-	execer    Execer
-	sql       string
-	numCols   int
+	transport   *protocol.Transport
+	parser      Parser
+	queryer     Queryer
+	execer      Execer
+	executor    Executor    // set when the backend implements it
+	copier      CopyHandler // set when the backend implements it
+	raw         RawQueryer  // set in raw sql mode, see WithRawSQLMode
+	logger      Logger
+	errorMapper ErrorMapper
+	localize    func(error) error // see session.localize
+	failed      func()            // called on errors, see session.fail
+	encoding    *clientEncoding
+	middlewares []QueryMiddleware
+	rewriter    ASTRewriter
+	parseNotice ParseNotice
+	readOnly    bool // see WithReadOnly
+	sql         string
+	portal      *portal // set when executing a portal, see runPortal
+
+	// queryTimeout is the server's limit on the time for executing each
+	// statement, see statementTimeout
+	queryTimeout time.Duration
+
+	// maxRows limits the number of rows of each result, see WithMaxResultRows
+	maxRows    int
+	strictRows bool
+
+	// batchSize is the number of rows flushed at once, see WithStreamBatchSize
+	batchSize int
+
+	// spanTracer traces the statements, with their sql strings redacted by
+	// redactSQL, see WithSpanTracer
+	spanTracer SpanTracer
+	redactSQL  func(sql string) string
 }
 
-// Run the query using the Server's defined queryer
-func (q *query) Run(sess Session) error {
+// Run the query using the Server's defined queryer, within the provided
+// context, which is canceled to abort the query (see Session.CancelQuery)
+func (q *query) Run(ctx context.Context, sess Session) error {
+	// add the session to the context, cast to the Session interface just for
+	// compile time verification that the interface is implemented.
+	ctx = context.WithValue(ctx, sessionCtxKey, sess)
+	ctx = context.WithValue(ctx, sqlCtxKey, q.sql)
+
+	// the backend parses the raw sql by itself, unless it's obviously empty
+	if q.raw != nil {
+		if isEmptyQuery(q.sql) {
+			return q.transport.Write(protocol.EmptyQueryResponse)
+		}
+		return q.runRaw(ctx, sess)
+	}
+
 	// parse the query
-	ast, err := parser.Parse(q.sql)
+	parser := q.parser
+	if parser == nil {
+		parser = defaultParser
+	}
+	stmts, err := parser.Parse(q.sql)
 	if err != nil {
-		return q.transport.Write(protocol.ErrorResponse(err))
+		return q.transport.Write(q.errorResponse(err))
 	}
+	ctx = context.WithValue(ctx, astCtxKey, stmts)
 
-	// add the session to the context, cast to the Session interface just for
-	// compile time verification that the interface is implemented.
-	ctx := context.Background()
+	// a query of no statements, like "" or ";;", is answered with a single
+	// EmptyQueryResponse, like postgres does, while the empty statements
+	// between the statements of a query are omitted by the parser and
+	// produce no response, so "SELECT 1;; SELECT 2;" has just two results
+	if len(stmts) == 0 {
+		return q.transport.Write(protocol.EmptyQueryResponse)
+	}
+
+	if q.parseNotice != nil {
+		err = q.writeNotices(q.parseNotice(q.sql, stmts))
+		if err != nil {
+			return err
+		}
+	}
+
+	// execute all of the statements
+	for _, stmt := range stmts {
+		err = q.handle(ctx, sess, stmt)
+		if err != nil {
+			return q.transport.Write(q.errorResponse(err))
+		}
+	}
+	return nil
+}
+
+// runPortal executes the statement of the portal, with its parameters already
+// bound, see session.execute
+func (q *query) runPortal(ctx context.Context, sess Session, stmt Statement) error {
 	ctx = context.WithValue(ctx, sessionCtxKey, sess)
 	ctx = context.WithValue(ctx, sqlCtxKey, q.sql)
-	ctx = context.WithValue(ctx, astCtxKey, ast)
+	ctx = context.WithValue(ctx, astCtxKey, Statements{stmt})
 
-	// execute all of the statements
-	for _, stmt := range ast.Statements {
-		rawStmt, isRaw := stmt.(nodes.RawStmt)
-		if isRaw {
-			stmt = rawStmt.Stmt
-		}
-
-		// determine if it's a query or command
-		switch v := stmt.(type) {
-		case nodes.PrepareStmt:
-			s, ok := sess.(*session)
-			// only session implementation is capable of storing prepared stmts
-			if ok {
-				// we just store the statement and don't do anything
-				s.storePreparedStatement(&v)
-			} else {
-				return Unsupported("prepared statements")
-			}
-		case nodes.SelectStmt, nodes.VariableShowStmt:
-			err = q.Query(ctx, stmt)
+	err := q.handle(ctx, sess, stmt)
+	if err != nil {
+		return q.transport.Write(q.errorResponse(err))
+	}
+	return nil
+}
+
+// handle executes a single statement out of the query through the chain of
+// middlewares, see WithQueryMiddleware, once it's rewritten by the
+// ASTRewriter
+func (q *query) handle(ctx context.Context, sess Session, stmt Statement) error {
+	handler := func(ctx context.Context, stmt Statement) error {
+		return q.runStatement(ctx, sess, stmt)
+	}
+	for i := len(q.middlewares) - 1; i >= 0; i-- {
+		handler = q.middlewares[i](handler)
+	}
+
+	ctx, end := q.startSpan(ctx, statementKindNames[stmt.Kind])
+	err := q.rewrite(&stmt)
+	if err == nil {
+		err = handler(ctx, stmt)
+	}
+	end(err)
+	return err
+}
+
+// rewrite replaces the node of the statement with the one returned by the
+// ASTRewriter, if there's one
+func (q *query) rewrite(stmt *Statement) error {
+	if q.rewriter == nil {
+		return nil
+	}
+	n, err := q.rewriter(stmt.Node)
+	if err != nil {
+		return err
+	}
+	if n != nil {
+		stmt.Node = n
+	}
+	return nil
+}
+
+// runStatement executes a single statement out of the query, within the
+// statement's timeout
+func (q *query) runStatement(ctx context.Context, sess Session, stmt Statement) (err error) {
+	ctx = context.WithValue(ctx, stmtCtxKey, stmt.Node)
+	ctx, cancel := q.withTimeout(ctx, sess)
+	defer cancel()
+
+	// a failed transaction block accepts nothing but its end
+	err = checkAborted(sess, stmt.Node)
+	if err != nil {
+		return err
+	}
+
+	// reject the statements that may write in read-only mode, or in a
+	// read-only transaction
+	if q.readOnly || transactionReadOnly(sess) {
+		err = checkReadOnly(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	// determine if it's a query or command
+	switch stmt.Kind {
+	case PrepareStatement:
+		err = q.prepared(ctx, sess, stmt.Node)
+	case NotificationStatement:
+		err = q.notification(sess, stmt.Node)
+	case SetStatement:
+		v, ok := stmt.Node.(nodes.VariableSetStmt)
+		if !ok {
+			err = q.Exec(ctx, stmt.Node)
+		} else if v.Name != nil && *v.Name == "client_encoding" {
+			err = q.setClientEncoding(sess, v)
+		} else {
+			err = q.set(ctx, sess, v)
+		}
+	case DiscardStatement:
+		err = q.discard(ctx, sess, stmt.Node)
+	case TransactionStatement:
+		err = q.transaction(ctx, sess, stmt.Node)
+	case CursorStatement:
+		err = q.cursorStatement(ctx, sess, stmt.Node)
+	case ShowStatement:
+		v, ok := stmt.Node.(nodes.VariableShowStmt)
+		if ok {
+			err = q.show(ctx, sess, v)
+		} else {
+			err = q.Query(ctx, stmt.Node)
+		}
+	default:
+		c, ok := stmt.Node.(nodes.CopyStmt)
+		switch {
+		case ok && q.copier != nil && copyFromStdin(c):
+			err = q.copyFrom(ctx, c)
+		case ok && copyToStdout(c):
+			err = q.copyTo(ctx, c)
 		default:
-			err = q.Exec(ctx, stmt)
+			err = q.execute(ctx, stmt)
 		}
+	}
+	return
+}
 
-		if err != nil {
-			return q.transport.Write(protocol.ErrorResponse(err))
+// execute executes a query or a command. The backend determines whether it
+// returns rows when it's an Executor, otherwise it's executed by the Queryer or
+// the Execer according to its kind.
+func (q *query) execute(ctx context.Context, stmt Statement) (err error) {
+	if q.executor == nil {
+		if stmt.Kind == QueryStatement {
+			return q.Query(ctx, stmt.Node)
 		}
+		return q.Exec(ctx, stmt.Node)
 	}
-	return nil
+
+	defer q.recoverPanic(&err)
+
+	rows, res, err := q.executor.Execute(ctx, stmt.Node)
+	if err != nil {
+		return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
+	}
+	return q.result(ctx, rows, res, stmt.Node)
 }
 
-func (q *query) Query(ctx context.Context, n nodes.Node) error {
+// result sends the rows returned by the backend, or the command tag when it
+// determined that it's a command by returning nil rows
+func (q *query) result(ctx context.Context, rows driver.Rows, res driver.Result, n nodes.Node) error {
+	if rows == nil {
+		if res == nil {
+			res = driver.RowsAffected(0)
+		}
+		return q.complete(ctx, res, n)
+	}
+	return q.writeRows(ctx, rows)
+}
+
+// runRaw executes the entire sql string, without parsing it, in raw sql mode
+func (q *query) runRaw(ctx context.Context, sess Session) (err error) {
+	ctx, end := q.startSpan(ctx, "")
+	defer func() { end(err) }()
+	defer q.recoverPanic(&err)
+
+	ctx, cancel := q.withTimeout(ctx, sess)
+	defer cancel()
+
+	rows, res, err := q.raw.QueryRaw(ctx, q.sql)
+	if err != nil {
+		return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
+	}
+	return q.result(ctx, rows, res, nil)
+}
+
+// isEmptyQuery reports whether the sql string has no statements, as it
+// consists of white space and semicolons only. Other empty queries, like
+// comments, are left for the parser of the backend in raw sql mode.
+func isEmptyQuery(sql string) bool {
+	return strings.Trim(sql, " \t\n\r\f;") == ""
+}
+
+// withTimeout returns a context that expires after the statement's timeout,
+// if there's one
+func (q *query) withTimeout(ctx context.Context, sess Session) (context.Context, context.CancelFunc) {
+	if timeout := q.statementTimeout(sess); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (q *query) Query(ctx context.Context, n nodes.Node) (err error) {
+	defer q.recoverPanic(&err)
+
 	rows, err := q.queryer.Query(ctx, n)
 	if err != nil {
-		return q.transport.Write(protocol.ErrorResponse(err))
+		return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
 	}
+	return q.writeRows(ctx, rows)
+}
+
+// writeRows sends the rows returned by the backend to the client, followed by
+// the command tag
+func (q *query) writeRows(ctx context.Context, rows driver.Rows) (err error) {
+	// the rows are closed when they're complete, or aborted, like when the
+	// client stopped reading them (see WithWriteTimeout)
+	defer rows.Close()
 
 	// build columns from the provided columns list
 	cols := rows.Columns()
@@ -78,45 +304,124 @@ func (q *query) Query(ctx context.Context, n nodes.Node) error {
 		types[i] = rowsTypes.ColumnTypeDatabaseTypeName(i)
 	}
 
-	err = q.transport.Write(protocol.RowDescription(cols, types))
-	if err != nil {
-		return err
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i], err = q.encoding.encode(col)
+		if err != nil {
+			return q.transport.Write(q.errorResponse(err))
+		}
+	}
+
+	// the rows of a portal are in the formats requested by Bind, and are
+	// described by Describe rather than by Execute (see session.describe)
+	var formats []int16
+	if q.portal != nil {
+		formats, err = resultFormats(q.portal.resultFormats, len(cols))
+		if err != nil {
+			return q.transport.Write(q.errorResponse(err))
+		}
+	}
+	if q.portal == nil {
+		err = q.transport.Write(protocol.RowDescriptionFormats(names, types, formats))
+		if err != nil {
+			return err
+		}
 	}
 
 	count := 0
 	row := make([]driver.Value, len(cols))
-	strings := make([]string, len(cols))
+	encoder := &rowEncoder{encoding: q.encoding, types: types, formats: formats}
+	if sess, ok := ctx.Value(sessionCtxKey).(Session); ok {
+		encoder.format = sessionValueFormat(sess)
+	}
+
+	// in strict mode, the rows are held until the result is known to be
+	// within the limit
+	var held []protocol.Message
 	for {
-		err = rows.Next(row)
+		// abort when the statement times out, even if the backend doesn't
+		err = ctx.Err()
+		if err == nil {
+			err = rows.Next(row)
+		}
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return q.transport.Write(protocol.ErrorResponse(err))
+			return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
 		}
 
-		// convert the values to string
-		for i, v := range row {
-			strings[i] = fmt.Sprintf("%v", v)
+		if q.maxRows > 0 && count == q.maxRows {
+			err = ProgramLimitExceeded("query result exceeds the limit of %d rows", q.maxRows)
+			return q.transport.Write(q.errorResponse(err))
 		}
 
-		err = q.transport.Write(protocol.DataRow(strings))
+		// convert the values to text, in the client encoding
+		msg, err := encoder.encode(row)
 		if err != nil {
-			return err
+			return q.transport.Write(q.errorResponse(err))
 		}
 
 		count++
+		if q.strictRows && q.maxRows > 0 {
+			held = append(held, msg)
+			continue
+		}
+
+		err = q.writeRow(msg, count)
+		if err != nil {
+			return err
+		}
 	}
 
-	tag := fmt.Sprintf("SELECT %d", count)
-	return q.transport.Write(protocol.CommandComplete(tag))
+	for i, msg := range held {
+		err = q.writeRow(msg, i+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = q.writeWarnings(rows)
+	if err != nil {
+		return err
+	}
+
+	spanFromContext(ctx).setRows(count)
+	n, _ := ctx.Value(stmtCtxKey).(nodes.Node)
+	return q.transport.Write(protocol.CommandComplete(rowsTag(n, count)))
+}
+
+// rowsTag returns the command tag of a statement that returned rows, which is
+// SELECT unless the rows were returned by a command, like INSERT RETURNING
+func rowsTag(n nodes.Node, count int) string {
+	switch n.(type) {
+	case nodes.InsertStmt:
+		// oid in INSERT is not implemented; defaults to 0
+		return fmt.Sprintf("INSERT 0 %d", count)
+	case nodes.UpdateStmt:
+		return fmt.Sprintf("UPDATE %d", count)
+	case nodes.DeleteStmt:
+		return fmt.Sprintf("DELETE %d", count)
+	case nodes.ExplainStmt:
+		return "EXPLAIN"
+	case nodes.FetchStmt:
+		return fmt.Sprintf("FETCH %d", count)
+	}
+	return fmt.Sprintf("SELECT %d", count)
 }
 
-func (q *query) Exec(ctx context.Context, n nodes.Node) error {
+func (q *query) Exec(ctx context.Context, n nodes.Node) (err error) {
+	defer q.recoverPanic(&err)
+
 	res, err := q.execer.Exec(ctx, n)
 	if err != nil {
-		return q.transport.Write(protocol.ErrorResponse(err))
+		return q.transport.Write(q.errorResponse(q.backendError(ctx, err)))
 	}
+	return q.complete(ctx, res, n)
+}
 
+// complete sends the command tag of the executed statement to the client
+func (q *query) complete(ctx context.Context, res driver.Result, n nodes.Node) error {
+	spanFromContext(ctx).setRowsAffected(res)
 	t, ok := res.(ResultTag)
 	if !ok {
 		t = &tagger{res, n}
@@ -124,16 +429,112 @@ func (q *query) Exec(ctx context.Context, n nodes.Node) error {
 
 	tag, err := t.Tag()
 	if err != nil {
-		return q.transport.Write(protocol.ErrorResponse(err))
+		return q.transport.Write(q.errorResponse(err))
+	}
+
+	err = q.writeWarnings(res)
+	if err != nil {
+		return err
 	}
 	return q.transport.Write(protocol.CommandComplete(tag))
 }
 
+// writeWarnings sends the warnings of the rows or the result of a statement,
+// when they implement WarningProvider
+func (q *query) writeWarnings(v interface{}) error {
+	if wp, ok := v.(WarningProvider); ok {
+		return q.writeNotices(wp.Warnings())
+	}
+	return nil
+}
+
+// writeNotices sends the notices to the client, as warnings by default
+func (q *query) writeNotices(notices []Notice) error {
+	for _, n := range notices {
+		severity := n.Severity
+		if severity == "" {
+			severity = SeverityWarning
+		}
+		notice := q.encoding.encodeErr(noticeError(severity, n.Code, n.Message))
+		err := q.transport.Write(protocol.NoticeResponse(notice))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backendError returns the error to report for a failure of the backend,
+// translated by the ErrorMapper, if there's one
+func (q *query) backendError(ctx context.Context, err error) error {
+	err = canceled(ctx, err)
+	if q.errorMapper != nil {
+		if mapped := q.errorMapper(err); mapped != nil {
+			err = mapped
+		}
+	}
+	spanFromContext(ctx).recordError(err)
+	return err
+}
+
+// writeRow writes the n-th DataRow of the result, flushing the rows written so
+// far at the end of every batch, see WithStreamBatchSize. The rows of a portal
+// are flushed too, rather than held until Sync, see Transport.Flush.
+func (q *query) writeRow(msg protocol.Message, n int) error {
+	err := q.transport.Write(msg)
+	if err == nil && q.batchSize > 0 && n%q.batchSize == 0 {
+		err = q.transport.Flush()
+	}
+	return err
+}
+
+// errorResponse creates the ErrorResponse of the error, localized and converted
+// to the client encoding
+func (q *query) errorResponse(err error) protocol.Message {
+	if q.failed != nil {
+		q.failed()
+	}
+	if q.localize != nil {
+		err = q.localize(err)
+	}
+	return q.encoding.errorResponse(err)
+}
+
+// recoverPanic is deferred by the methods calling into the backend. It converts
+// a panic into an internal error sent to the client, keeping the session alive
+// despite bugs in the backend.
+func (q *query) recoverPanic(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	if q.logger != nil {
+		q.logger.Printf("pgsrv: panic while serving query %q: %v\n%s", q.sql, r, debug.Stack())
+	}
+	*err = q.transport.Write(q.errorResponse(InternalError("%v", r)))
+}
+
 // QueryFromContext returns the sql string as saved in the given context
 func QueryFromContext(ctx context.Context) string {
 	return ctx.Value(sqlCtxKey).(string)
 }
 
+// ASTFromContext returns all of the statements of the entire sql string, as
+// parsed by the Parser and saved in the given context
+func ASTFromContext(ctx context.Context) (Statements, bool) {
+	ast, ok := ctx.Value(astCtxKey).(Statements)
+	return ast, ok
+}
+
+// StatementFromContext returns the statement currently executed, out of all
+// of the statements in the sql string, as saved in the given context. It's the
+// same node passed to the Queryer or Execer.
+func StatementFromContext(ctx context.Context) (nodes.Node, bool) {
+	stmt, ok := ctx.Value(stmtCtxKey).(nodes.Node)
+	return stmt, ok
+}
+
 // implements the CommandComplete tag according to the spec as described at the
 // link below. When there's no suitable tag according to the spec, "UPDATE" is
 // used instead.
@@ -143,56 +544,111 @@ type tagger struct {
 	Node nodes.Node
 }
 
+// rowCountTags are the tags of the commands that carry the number of rows they
+// processed, like "UPDATE 3". The rest of the commands, like most of the DDL
+// and utility commands, are tagged without a number, like "CREATE TABLE".
+var rowCountTags = map[string]bool{
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+	"SELECT": true,
+	"COPY":   true,
+	"FETCH":  true,
+	"MOVE":   true,
+}
+
+// dropTags are the command tags of the DROP statements, by the type of the
+// dropped objects
+var dropTags = map[nodes.ObjectType]string{
+	nodes.OBJECT_TABLE:         "DROP TABLE",
+	nodes.OBJECT_VIEW:          "DROP VIEW",
+	nodes.OBJECT_MATVIEW:       "DROP MATERIALIZED VIEW",
+	nodes.OBJECT_INDEX:         "DROP INDEX",
+	nodes.OBJECT_SEQUENCE:      "DROP SEQUENCE",
+	nodes.OBJECT_SCHEMA:        "DROP SCHEMA",
+	nodes.OBJECT_FUNCTION:      "DROP FUNCTION",
+	nodes.OBJECT_TYPE:          "DROP TYPE",
+	nodes.OBJECT_DOMAIN:        "DROP DOMAIN",
+	nodes.OBJECT_TRIGGER:       "DROP TRIGGER",
+	nodes.OBJECT_EXTENSION:     "DROP EXTENSION",
+	nodes.OBJECT_FOREIGN_TABLE: "DROP FOREIGN TABLE",
+}
+
 func (res *tagger) Tag() (tag string, err error) {
-	// allow commands to not specify number of rows affected
-	skipResults := false
-	switch res.Node.(type) {
+	tag = commandTag(res.Node)
+	if !rowCountTags[tag] {
+		return tag, nil
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return tag, err
+	}
+	if tag == "INSERT" {
+		// oid in INSERT is not implemented; defaults to 0
+		return fmt.Sprintf("INSERT 0 %d", affected), nil
+	}
+	return fmt.Sprintf("%s %d", tag, affected), nil
+}
+
+// commandTag returns the tag of the command, without the number of rows
+func commandTag(n nodes.Node) string {
+	switch v := n.(type) {
 	case nodes.VariableSetStmt:
-		skipResults = true
-		kind := res.Node.(nodes.VariableSetStmt).Kind
-		switch kind {
+		switch v.Kind {
 		case nodes.VAR_SET_VALUE, nodes.VAR_SET_CURRENT, nodes.VAR_SET_DEFAULT, nodes.VAR_SET_MULTI:
-			tag = "SET"
+			return "SET"
 		case nodes.VAR_RESET, nodes.VAR_RESET_ALL:
-			tag = "RESET"
+			return "RESET"
 		default:
-			tag = "???"
+			return "???"
 		}
 	case nodes.InsertStmt:
-		// oid in INSERT is not implemented; defaults to 0
-		tag = "INSERT 0"
+		return "INSERT"
 	case nodes.CreateTableAsStmt:
-		tag = "SELECT" // follows the spec
+		return "SELECT" // follows the spec
 	case nodes.DeleteStmt:
-		tag = "DELETE"
+		return "DELETE"
+	case nodes.UpdateStmt:
+		return "UPDATE"
 	case nodes.FetchStmt:
-		tag = "FETCH"
+		if v.Ismove {
+			return "MOVE"
+		}
+		return "FETCH"
 	case nodes.CopyStmt:
-		tag = "COPY"
+		return "COPY"
 	case nodes.VacuumStmt:
-		skipResults = true
-		tag = "VACUUM"
+		return "VACUUM"
 	case nodes.CreateRoleStmt:
-		skipResults = true
-		tag = "CREATE ROLE"
+		return "CREATE ROLE"
 	case nodes.ViewStmt:
-		skipResults = true
-		tag = "CREATE VIEW"
+		return "CREATE VIEW"
 	case nodes.CreateStmt:
-		skipResults = true
-		tag = "CREATE TABLE"
-	case nodes.UpdateStmt:
-		tag = "UPDATE"
-	default:
-		tag = "UPDATE"
-	}
-
-	if !skipResults {
-		affected, err := res.RowsAffected()
-		if err != nil {
-			return tag, err
+		return "CREATE TABLE"
+	case nodes.CreateSchemaStmt:
+		return "CREATE SCHEMA"
+	case nodes.IndexStmt:
+		return "CREATE INDEX"
+	case nodes.AlterTableStmt:
+		return "ALTER TABLE"
+	case nodes.DropStmt:
+		if tag, ok := dropTags[v.RemoveType]; ok {
+			return tag
 		}
-		tag = fmt.Sprintf("%s %d", tag, affected)
+		return "DROP"
+	case nodes.TruncateStmt:
+		return "TRUNCATE TABLE"
+	case nodes.GrantStmt:
+		if v.IsGrant {
+			return "GRANT"
+		}
+		return "REVOKE"
+	case nodes.DiscardStmt:
+		return discardTags[v.Target]
+	case nodes.TransactionStmt:
+		return transactionTags[v.Kind]
+	default:
+		return "UPDATE"
 	}
-	return tag, nil
 }
@@ -0,0 +1,819 @@
+package pgsrv
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+type panickingQueryer struct{}
+
+func (*panickingQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	panic("oops")
+}
+
+func (*panickingQueryer) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
+	panic("oops")
+}
+
+type panickingRowsQueryer struct{}
+
+func (*panickingRowsQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return &panickingRows{}, nil
+}
+
+type panickingRows struct{ mockRows }
+
+func (*panickingRows) Next(dest []driver.Value) error { panic("oops") }
+
+// rowsQueryer returns the same rows for every query
+type rowsQueryer struct{ rows driver.Rows }
+
+func (q *rowsQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return q.rows, nil
+}
+
+type mockLogger struct {
+	logs []string
+}
+
+func (l *mockLogger) Printf(format string, v ...interface{}) {
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+func TestQuery_recoverPanic(t *testing.T) {
+	tests := map[string]struct {
+		queryer  Queryer
+		run      func(q *query) error
+		expected []pgproto3.BackendMessage
+	}{
+		"query": {
+			queryer:  &panickingQueryer{},
+			run:      func(q *query) error { return q.Query(context.Background(), nodes.SelectStmt{}) },
+			expected: []pgproto3.BackendMessage{&pgproto3.ErrorResponse{}},
+		},
+		"exec": {
+			queryer:  &panickingQueryer{},
+			run:      func(q *query) error { return q.Exec(context.Background(), nodes.InsertStmt{}) },
+			expected: []pgproto3.BackendMessage{&pgproto3.ErrorResponse{}},
+		},
+		"rows iteration": {
+			queryer:  &panickingRowsQueryer{},
+			run:      func(q *query) error { return q.Query(context.Background(), nodes.SelectStmt{}) },
+			expected: []pgproto3.BackendMessage{&pgproto3.RowDescription{}, &pgproto3.ErrorResponse{}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			logger := &mockLogger{}
+			q := &query{
+				transport: protocol.NewTransport(buf),
+				queryer:   test.queryer,
+				logger:    logger,
+				sql:       "SELECT 1",
+			}
+			q.execer, _ = test.queryer.(Execer)
+
+			err := test.run(q)
+			require.NoError(t, err, "expected the panic to be reported to the client")
+
+			frontend, err := pgproto3.NewFrontend(buf, nil)
+			require.NoError(t, err)
+			for _, expected := range test.expected {
+				msg, err := frontend.Receive()
+				require.NoError(t, err)
+				require.IsType(t, expected, msg)
+			}
+
+			require.Len(t, logger.logs, 1)
+			require.Contains(t, logger.logs[0], "panic while serving query \"SELECT 1\": oops")
+		})
+	}
+
+	t.Run("error response", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		q := &query{transport: protocol.NewTransport(buf), queryer: &panickingQueryer{}}
+
+		err := q.Query(context.Background(), nodes.SelectStmt{})
+		require.NoError(t, err)
+
+		msg, err := protocol.Message(buf.Bytes()).ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "XX000", msg.Code)
+		require.Equal(t, "oops", msg.Message)
+	})
+}
+
+type failingQueryer struct{ err error }
+
+func (q *failingQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return nil, q.err
+}
+
+type wrappedErr struct{ err error }
+
+func (e *wrappedErr) Error() string { return "wrapped: " + e.err.Error() }
+func (e *wrappedErr) Unwrap() error { return e.err }
+
+func TestQuery_structuredError(t *testing.T) {
+	pgErr := &Error{Code: "23505", Message: "duplicate key", Detail: "Key (id)=(1) already exists.", ConstraintName: "pk"}
+	for name, e := range map[string]error{"error": pgErr, "wrapped error": &wrappedErr{pgErr}} {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			q := &query{transport: protocol.NewTransport(buf), queryer: &failingQueryer{e}}
+
+			err := q.Query(context.Background(), nodes.SelectStmt{})
+			require.NoError(t, err)
+
+			msg, err := protocol.Message(buf.Bytes()).ErrorResponse()
+			require.NoError(t, err)
+			require.Equal(t, "ERROR", msg.Severity)
+			require.Equal(t, "23505", msg.Code)
+			require.Equal(t, "duplicate key", msg.Message)
+			require.Equal(t, "Key (id)=(1) already exists.", msg.Detail)
+			require.Equal(t, "pk", msg.ConstraintName)
+			require.Equal(t, int32(0), msg.Position)
+		})
+	}
+}
+
+func TestQuery_errorMapper(t *testing.T) {
+	errNotFound := fmt.Errorf("not found")
+	mapper := func(err error) *Error {
+		if err == errNotFound {
+			return &Error{Severity: "ERROR", Code: "P0002", Message: "no data found", Hint: "check the id"}
+		}
+		return nil
+	}
+
+	t.Run("mapped", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		q := &query{transport: protocol.NewTransport(buf), queryer: &failingQueryer{errNotFound}, errorMapper: mapper}
+
+		err := q.Query(context.Background(), nodes.SelectStmt{})
+		require.NoError(t, err)
+
+		msg, err := protocol.Message(buf.Bytes()).ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "ERROR", msg.Severity)
+		require.Equal(t, "P0002", msg.Code)
+		require.Equal(t, "no data found", msg.Message)
+		require.Equal(t, "check the id", msg.Hint)
+	})
+
+	t.Run("not mapped", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		q := &query{transport: protocol.NewTransport(buf), queryer: &failingQueryer{fmt.Errorf("oops")}, errorMapper: mapper}
+
+		err := q.Query(context.Background(), nodes.SelectStmt{})
+		require.NoError(t, err)
+
+		msg, err := protocol.Message(buf.Bytes()).ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "XX000", msg.Code)
+		require.Equal(t, "oops", msg.Message)
+	})
+
+	t.Run("server option", func(t *testing.T) {
+		srv := New(&failingQueryer{errNotFound}, WithErrorMapper(mapper)).(*server)
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "SELECT 1")
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "P0002", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+// contextQueryer records the statements and ASTs found in the contexts of the
+// queries it serves
+type contextQueryer struct {
+	stmts []nodes.Node
+	nodes []nodes.Node
+	asts  []int
+}
+
+func (q *contextQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	stmt, ok := StatementFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("missing statement")
+	}
+	ast, ok := ASTFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("missing AST")
+	}
+
+	q.stmts = append(q.stmts, stmt)
+	q.nodes = append(q.nodes, n)
+	q.asts = append(q.asts, len(ast))
+	return &mockRows{}, nil
+}
+
+func TestQuery_context(t *testing.T) {
+	t.Run("statements", func(t *testing.T) {
+		queryer := &contextQueryer{}
+		q := &query{
+			transport: protocol.NewTransport(&bytes.Buffer{}),
+			queryer:   queryer,
+			sql:       "SELECT 1; SELECT 2",
+		}
+
+		err := q.Run(context.Background(), &session{})
+		require.NoError(t, err)
+		require.Len(t, queryer.stmts, 2)
+		require.Equal(t, queryer.nodes, queryer.stmts)
+		require.Equal(t, []int{2, 2}, queryer.asts)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, ok := ASTFromContext(context.Background())
+		require.False(t, ok)
+		_, ok = StatementFromContext(context.Background())
+		require.False(t, ok)
+	})
+}
+
+// rawSQLQueryer executes raw sql, returning rows for SELECT and a result for
+// anything else
+type rawSQLQueryer struct {
+	mockQueryer
+	sql []string
+}
+
+func (q *rawSQLQueryer) QueryRaw(ctx context.Context, sql string) (driver.Rows, driver.Result, error) {
+	q.sql = append(q.sql, sql)
+	if strings.HasPrefix(sql, "SELECT") {
+		return &mockRows{rows: 1}, nil, nil
+	}
+	if strings.HasPrefix(sql, "FAIL") {
+		return nil, nil, fmt.Errorf("failed")
+	}
+	return nil, driver.RowsAffected(3), nil
+}
+
+func TestQuery_raw(t *testing.T) {
+	queryer := &rawSQLQueryer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	WithRawSQLMode()(srv)
+	frontend, _ := connect(t, srv)
+
+	t.Run("query", func(t *testing.T) {
+		sendQuery(t, frontend, "SELECT dialect-specific stuff")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		msg := receive(t, frontend, &pgproto3.CommandComplete{})
+		require.Equal(t, "SELECT 1", string(msg.(*pgproto3.CommandComplete).CommandTag))
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("command", func(t *testing.T) {
+		sendQuery(t, frontend, "MERGE whatever; INSERT more")
+		msg := receive(t, frontend, &pgproto3.CommandComplete{})
+		require.Equal(t, "UPDATE 3", string(msg.(*pgproto3.CommandComplete).CommandTag))
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("error", func(t *testing.T) {
+		sendQuery(t, frontend, "FAIL")
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "failed", msg.(*pgproto3.ErrorResponse).Message)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		sendQuery(t, frontend, " ; ;")
+		receive(t, frontend, &pgproto3.EmptyQueryResponse{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	require.Equal(t, []string{"SELECT dialect-specific stuff", "MERGE whatever; INSERT more", "FAIL"}, queryer.sql)
+
+	t.Run("not implemented", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+		WithRawSQLMode()(srv)
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+// countQueryer returns results of n rows
+type countQueryer struct {
+	n uint8
+}
+
+func (q *countQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return &mockRows{rows: q.n}, nil
+}
+
+func TestQuery_maxResultRows(t *testing.T) {
+	// run sends the query and returns the number of rows received, along with
+	// the error, if any
+	run := func(t *testing.T, srv *server) (int, *pgproto3.ErrorResponse) {
+		frontend, _ := connect(t, srv)
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+
+		count := 0
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			switch v := msg.(type) {
+			case *pgproto3.DataRow:
+				require.Equal(t, fmt.Sprintf("row %d", count), string(v.Values[0]))
+				count++
+				continue
+			case *pgproto3.ErrorResponse:
+				receive(t, frontend, &pgproto3.ReadyForQuery{})
+				return count, v
+			}
+			require.IsType(t, &pgproto3.CommandComplete{}, msg)
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+			return count, nil
+		}
+	}
+
+	tests := []struct {
+		name     string
+		rows     uint8
+		strict   bool
+		expected int
+		exceeded bool
+	}{
+		{"within the limit", 3, false, 3, false},
+		{"exceeded", 5, false, 3, true},
+		{"within the limit, strict", 3, true, 3, false},
+		{"exceeded, strict", 5, true, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := &server{
+				authenticator:    &noPasswordAuthenticator{},
+				queryer:          &countQueryer{test.rows},
+				maxResultRows:    3,
+				strictResultRows: test.strict,
+			}
+
+			count, errRes := run(t, srv)
+			require.Equal(t, test.expected, count)
+			if !test.exceeded {
+				require.Nil(t, errRes)
+				return
+			}
+			require.NotNil(t, errRes)
+			require.Equal(t, "54000", errRes.Code)
+			require.Equal(t, "query result exceeds the limit of 3 rows", errRes.Message)
+		})
+	}
+}
+
+func TestQuery_rowsRouting(t *testing.T) {
+	queryer := &recordingQueryer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	frontend, _ := connect(t, srv)
+
+	tests := []struct {
+		sql  string
+		node nodes.Node
+		tag  string
+	}{
+		{"EXPLAIN SELECT 1", nodes.ExplainStmt{}, "EXPLAIN"},
+		{"WITH x AS (SELECT 1) SELECT * FROM x", nodes.SelectStmt{}, "SELECT 0"},
+		{"VALUES (1), (2)", nodes.SelectStmt{}, "SELECT 0"},
+		{"INSERT INTO t VALUES (1) RETURNING id", nodes.InsertStmt{}, "INSERT 0 0"},
+		{"UPDATE t SET a = 1 RETURNING id", nodes.UpdateStmt{}, "UPDATE 0"},
+		{"DELETE FROM t RETURNING id", nodes.DeleteStmt{}, "DELETE 0"},
+	}
+
+	for i, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			sendQuery(t, frontend, test.sql)
+			receive(t, frontend, &pgproto3.RowDescription{})
+			msg := receive(t, frontend, &pgproto3.CommandComplete{})
+			require.Equal(t, test.tag, string(msg.(*pgproto3.CommandComplete).CommandTag))
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+			require.Len(t, queryer.nodes, i+1)
+			require.IsType(t, test.node, queryer.nodes[i])
+		})
+	}
+}
+
+// executingQueryer determines by itself which statements return rows: INSERT
+// and SELECT return a single row, while other statements are commands
+type executingQueryer struct{}
+
+func (*executingQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return nil, fmt.Errorf("unexpected Query")
+}
+
+func (*executingQueryer) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
+	return nil, fmt.Errorf("unexpected Exec")
+}
+
+func (*executingQueryer) Execute(ctx context.Context, n nodes.Node) (driver.Rows, driver.Result, error) {
+	switch n.(type) {
+	case nodes.InsertStmt, nodes.SelectStmt:
+		return &mockRows{rows: 1}, nil, nil
+	case nodes.DropStmt:
+		return nil, nil, UndefinedTable("t")
+	}
+	return nil, driver.RowsAffected(0), nil
+}
+
+func TestQuery_executor(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &executingQueryer{}}
+	frontend, _ := connect(t, srv)
+
+	tests := []struct {
+		sql  string
+		rows bool
+		tag  string
+	}{
+		{"SELECT 1", true, "SELECT 1"},
+		{"INSERT INTO t", true, "INSERT 0 1"},
+		{"CREATE TABLE t", false, "CREATE TABLE"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			sendQuery(t, frontend, test.sql)
+			if test.rows {
+				receive(t, frontend, &pgproto3.RowDescription{})
+				receive(t, frontend, &pgproto3.DataRow{})
+			}
+			msg := receive(t, frontend, &pgproto3.CommandComplete{})
+			require.Equal(t, test.tag, string(msg.(*pgproto3.CommandComplete).CommandTag))
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		sendQuery(t, frontend, "DROP TABLE t")
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "42P01", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+// tenantFilter is an ASTRewriter that adds a filter by the tenant to the WHERE
+// clause of SELECTs, and rejects DROPs
+func tenantFilter(n nodes.Node) (nodes.Node, error) {
+	switch v := n.(type) {
+	case nodes.SelectStmt:
+		tenant := nodes.A_Expr{
+			Kind:  nodes.AEXPR_OP,
+			Name:  nodes.List{Items: []nodes.Node{nodes.String{Str: "="}}},
+			Lexpr: nodes.ColumnRef{Fields: nodes.List{Items: []nodes.Node{nodes.String{Str: "tenant_id"}}}},
+			Rexpr: nodes.A_Const{Val: nodes.String{Str: "acme"}},
+		}
+		if v.WhereClause == nil {
+			v.WhereClause = tenant
+		} else {
+			v.WhereClause = nodes.BoolExpr{Boolop: nodes.AND_EXPR, Args: nodes.List{Items: []nodes.Node{v.WhereClause, tenant}}}
+		}
+		return v, nil
+	case nodes.DropStmt:
+		return nil, InsufficientPrivilege("DROP is not allowed")
+	}
+	return nil, nil
+}
+
+func TestQuery_astRewriter(t *testing.T) {
+	queryer := &recordingQueryer{}
+	var seen []nodes.Node // by the middleware
+	middleware := func(next QueryHandler) QueryHandler {
+		return func(ctx context.Context, stmt Statement) error {
+			seen = append(seen, stmt.Node)
+			return next(ctx, stmt)
+		}
+	}
+	srv := New(queryer, WithASTRewriter(tenantFilter), WithQueryMiddleware(middleware)).(*server)
+	frontend, _ := connect(t, srv)
+
+	// run sends the sql and returns the command tag, or the code of the error
+	run := func(t *testing.T, sql string) (result string) {
+		sendQuery(t, frontend, sql)
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			switch v := msg.(type) {
+			case *pgproto3.CommandComplete:
+				result = v.CommandTag
+			case *pgproto3.ErrorResponse:
+				result = v.Code
+			case *pgproto3.ReadyForQuery:
+				return result
+			}
+		}
+	}
+
+	t.Run("adds a where clause", func(t *testing.T) {
+		queryer.nodes, seen = nil, nil
+		require.Equal(t, "SELECT 0", run(t, "SELECT * FROM orders"))
+
+		require.Len(t, queryer.nodes, 1)
+		where := queryer.nodes[0].(nodes.SelectStmt).WhereClause
+		require.IsType(t, nodes.A_Expr{}, where)
+		require.Equal(t, nodes.A_Const{Val: nodes.String{Str: "acme"}}, where.(nodes.A_Expr).Rexpr)
+		require.Equal(t, queryer.nodes, seen)
+	})
+
+	t.Run("leaves other statements", func(t *testing.T) {
+		queryer.nodes, seen = nil, nil
+		require.Equal(t, "INSERT 0 1", run(t, "INSERT INTO orders VALUES (1)"))
+		require.Len(t, queryer.nodes, 1)
+		require.IsType(t, nodes.InsertStmt{}, queryer.nodes[0])
+	})
+
+	t.Run("prepared statements", func(t *testing.T) {
+		queryer.nodes, seen = nil, nil
+		require.Equal(t, "PREPARE", run(t, "PREPARE q AS SELECT $1"))
+		require.Equal(t, "SELECT 0", run(t, "EXECUTE q (1)"))
+		require.Len(t, queryer.nodes, 1)
+		require.NotNil(t, queryer.nodes[0].(nodes.SelectStmt).WhereClause)
+	})
+
+	t.Run("rejects", func(t *testing.T) {
+		queryer.nodes, seen = nil, nil
+		require.Equal(t, "42501", run(t, "DROP TABLE orders; SELECT 1"))
+		require.Empty(t, queryer.nodes)
+		require.Empty(t, seen)
+	})
+}
+
+func TestTagger(t *testing.T) {
+	tests := []struct {
+		name string
+		node nodes.Node
+		tag  string
+	}{
+		// commands with a row count
+		{"INSERT", nodes.InsertStmt{}, "INSERT 0 3"},
+		{"UPDATE", nodes.UpdateStmt{}, "UPDATE 3"},
+		{"DELETE", nodes.DeleteStmt{}, "DELETE 3"},
+		{"CREATE TABLE AS", nodes.CreateTableAsStmt{}, "SELECT 3"},
+		{"COPY", nodes.CopyStmt{}, "COPY 3"},
+		{"FETCH", nodes.FetchStmt{}, "FETCH 3"},
+		{"MOVE", nodes.FetchStmt{Ismove: true}, "MOVE 3"},
+		{"unknown", nodes.SelectStmt{}, "UPDATE 3"},
+
+		// commands without a row count
+		{"CREATE TABLE", nodes.CreateStmt{}, "CREATE TABLE"},
+		{"CREATE VIEW", nodes.ViewStmt{}, "CREATE VIEW"},
+		{"CREATE ROLE", nodes.CreateRoleStmt{}, "CREATE ROLE"},
+		{"CREATE SCHEMA", nodes.CreateSchemaStmt{}, "CREATE SCHEMA"},
+		{"CREATE INDEX", nodes.IndexStmt{}, "CREATE INDEX"},
+		{"ALTER TABLE", nodes.AlterTableStmt{}, "ALTER TABLE"},
+		{"DROP TABLE", nodes.DropStmt{RemoveType: nodes.OBJECT_TABLE}, "DROP TABLE"},
+		{"DROP VIEW", nodes.DropStmt{RemoveType: nodes.OBJECT_VIEW}, "DROP VIEW"},
+		{"DROP other", nodes.DropStmt{RemoveType: nodes.OBJECT_CAST}, "DROP"},
+		{"TRUNCATE", nodes.TruncateStmt{}, "TRUNCATE TABLE"},
+		{"GRANT", nodes.GrantStmt{IsGrant: true}, "GRANT"},
+		{"REVOKE", nodes.GrantStmt{}, "REVOKE"},
+		{"VACUUM", nodes.VacuumStmt{}, "VACUUM"},
+		{"SET", nodes.VariableSetStmt{Kind: nodes.VAR_SET_VALUE}, "SET"},
+		{"RESET", nodes.VariableSetStmt{Kind: nodes.VAR_RESET_ALL}, "RESET"},
+		{"DISCARD", nodes.DiscardStmt{Target: nodes.DISCARD_ALL}, "DISCARD ALL"},
+		{"BEGIN", nodes.TransactionStmt{Kind: nodes.TRANS_STMT_BEGIN}, "BEGIN"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tag, err := (&tagger{driver.RowsAffected(3), test.node}).Tag()
+			require.NoError(t, err)
+			require.Equal(t, test.tag, tag)
+		})
+	}
+
+	t.Run("unknown row count", func(t *testing.T) {
+		_, err := (&tagger{driver.ResultNoRows, nodes.UpdateStmt{}}).Tag()
+		require.Error(t, err)
+
+		// not needed by commands without a row count
+		tag, err := (&tagger{driver.ResultNoRows, nodes.CreateStmt{}}).Tag()
+		require.NoError(t, err)
+		require.Equal(t, "CREATE TABLE", tag)
+	})
+}
+
+// warningRows are rows that collect a warning as they're read
+type warningRows struct {
+	mockRows
+	warnings []Notice
+}
+
+func (r *warningRows) Next(dest []driver.Value) error {
+	err := r.mockRows.Next(dest)
+	if err == nil {
+		r.warnings = append(r.warnings, Notice{Message: fmt.Sprintf("read %v", dest[0])})
+	}
+	return err
+}
+
+func (r *warningRows) Warnings() []Notice { return r.warnings }
+
+// warningResult is a command's result with warnings
+type warningResult struct {
+	driver.Result
+	warnings []Notice
+}
+
+func (r warningResult) Warnings() []Notice { return r.warnings }
+
+// warningQueryer returns results with warnings
+type warningQueryer struct{}
+
+func (warningQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return &warningRows{mockRows: mockRows{rows: 2}}, nil
+}
+
+func (warningQueryer) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
+	return warningResult{driver.RowsAffected(1), []Notice{
+		{Message: "index not used"},
+		{Severity: SeverityNotice, Code: "00000", Message: "relation exists, skipping"},
+	}}, nil
+}
+
+func TestQuery_warnings(t *testing.T) {
+	srv := New(warningQueryer{}).(*server)
+	frontend, _ := connect(t, srv)
+
+	t.Run("rows", func(t *testing.T) {
+		sendQuery(t, frontend, "SELECT * FROM t")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.DataRow{})
+
+		// the warnings collected while reading the rows
+		for _, message := range []string{"read row 0", "read row 1"} {
+			msg := receive(t, frontend, &pgproto3.NoticeResponse{}).(*pgproto3.NoticeResponse)
+			require.Equal(t, "WARNING", msg.Severity)
+			require.Equal(t, "01000", msg.Code)
+			require.Equal(t, message, msg.Message)
+		}
+		msg := receive(t, frontend, &pgproto3.CommandComplete{})
+		require.Equal(t, "SELECT 2", msg.(*pgproto3.CommandComplete).CommandTag)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("result", func(t *testing.T) {
+		sendQuery(t, frontend, "INSERT INTO t VALUES (1)")
+		msg := receive(t, frontend, &pgproto3.NoticeResponse{}).(*pgproto3.NoticeResponse)
+		require.Equal(t, "WARNING", msg.Severity)
+		require.Equal(t, "index not used", msg.Message)
+
+		msg = receive(t, frontend, &pgproto3.NoticeResponse{}).(*pgproto3.NoticeResponse)
+		require.Equal(t, "NOTICE", msg.Severity)
+		require.Equal(t, "00000", msg.Code)
+		require.Equal(t, "relation exists, skipping", msg.Message)
+
+		complete := receive(t, frontend, &pgproto3.CommandComplete{})
+		require.Equal(t, "INSERT 0 1", complete.(*pgproto3.CommandComplete).CommandTag)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+func TestQuery_emptyStatements(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+	frontend, _ := connect(t, srv)
+
+	// responses sends the sql and returns the types of the messages of its
+	// response, up to ReadyForQuery
+	responses := func(t *testing.T, sql string) (types []string) {
+		sendQuery(t, frontend, sql)
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			switch msg.(type) {
+			case *pgproto3.EmptyQueryResponse:
+				types = append(types, "EmptyQueryResponse")
+			case *pgproto3.CommandComplete:
+				types = append(types, "CommandComplete")
+			case *pgproto3.ErrorResponse:
+				types = append(types, "ErrorResponse")
+			case *pgproto3.ReadyForQuery:
+				return types
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		sql      string
+		expected []string
+	}{
+		{"empty", "", []string{"EmptyQueryResponse"}},
+		{"white space", " \n\t", []string{"EmptyQueryResponse"}},
+		{"all empty", ";;", []string{"EmptyQueryResponse"}},
+		{"leading empty", ";SELECT 1", []string{"CommandComplete"}},
+		{"trailing empty", "SELECT 1;;", []string{"CommandComplete"}},
+		{"empty between", "SELECT 1;; SELECT 2;", []string{"CommandComplete", "CommandComplete"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, responses(t, test.sql))
+		})
+	}
+}
+
+func TestWithParseNotice(t *testing.T) {
+	var parsed []Statements
+	lint := func(sql string, stmts Statements) []Notice {
+		parsed = append(parsed, stmts)
+		if strings.Contains(sql, "SELECT *") {
+			return []Notice{{Message: "SELECT * is discouraged"}}
+		}
+		return nil
+	}
+	srv := New(&mockQueryer{}, WithParseNotice(lint)).(*server)
+	frontend, _ := connect(t, srv)
+
+	t.Run("notice", func(t *testing.T) {
+		parsed = nil
+		sendQuery(t, frontend, "SELECT * FROM t; SELECT 1")
+		msg := receive(t, frontend, &pgproto3.NoticeResponse{}).(*pgproto3.NoticeResponse)
+		require.Equal(t, "WARNING", msg.Severity)
+		require.Equal(t, "01000", msg.Code)
+		require.Equal(t, "SELECT * is discouraged", msg.Message)
+
+		// once, before the results of all of the statements
+		for i := 0; i < 2; i++ {
+			receive(t, frontend, &pgproto3.RowDescription{})
+			receive(t, frontend, &pgproto3.DataRow{})
+			receive(t, frontend, &pgproto3.CommandComplete{})
+		}
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		require.Len(t, parsed, 1)
+		require.Len(t, parsed[0], 2)
+		require.Equal(t, QueryStatement, parsed[0][0].Kind)
+	})
+
+	t.Run("no notice", func(t *testing.T) {
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+// TestQuery_columnsMismatch verifies that rows with more or less values than
+// the columns of the result fail the query, rather than corrupting the stream
+func TestQuery_columnsMismatch(t *testing.T) {
+	cols := []ColumnDesc{{Name: "a", TypeName: "TEXT"}, {Name: "b", TypeName: "TEXT"}}
+	stream := &chanStream{rows: make(chan []interface{}, 2)}
+	stream.rows <- []interface{}{int64(1), "a"}
+	stream.rows <- []interface{}{int64(2)}
+	close(stream.rows)
+
+	tests := []struct {
+		name     string
+		rows     driver.Rows
+		expected string
+	}{
+		{
+			"more values",
+			RowsFromValues(cols, [][]interface{}{{"1", "a"}, {"2", "b", "c"}}),
+			"expected 2 values in row, got 3",
+		},
+		{
+			"less values",
+			StreamRows(context.Background(), stream),
+			"expected 2 values in row, got 1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			q := &query{transport: protocol.NewTransport(buf), queryer: &rowsQueryer{test.rows}}
+			require.NoError(t, q.Query(context.Background(), nodes.SelectStmt{}))
+
+			frontend, err := pgproto3.NewFrontend(buf, nil)
+			require.NoError(t, err)
+			receive(t, frontend, &pgproto3.RowDescription{})
+			row := receive(t, frontend, &pgproto3.DataRow{}).(*pgproto3.DataRow)
+			require.Len(t, row.Values, 2)
+
+			msg := receive(t, frontend, &pgproto3.ErrorResponse{}).(*pgproto3.ErrorResponse)
+			require.Equal(t, "XX000", msg.Code)
+			require.Equal(t, test.expected, msg.Message)
+			require.Zero(t, buf.Len(), "expected nothing after the error")
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package pgsrv
+
+import (
+	nodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+// checkReadOnly rejects the statements that may write with a
+// read_only_sql_transaction error. Only the queries, the statements handled by
+// the server, like SET or SHOW, and the commands that only read, like COPY TO,
+// are allowed. Commands unknown to the server are assumed to write, while
+// queries are assumed to only read unless they're known to write, like INSERT
+// RETURNING.
+func checkReadOnly(stmt Statement) error {
+	switch stmt.Kind {
+	case QueryStatement:
+		if !writes(stmt.Node) {
+			return nil
+		}
+	case CommandStatement:
+		if !writes(stmt.Node) && readOnlyCommand(stmt.Node) {
+			return nil
+		}
+	case CursorStatement:
+		if v, ok := stmt.Node.(nodes.DeclareCursorStmt); !ok || !writes(v.Query) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return ReadOnlySQLTransaction("cannot execute %s in a read-only transaction", commandName(stmt.Node))
+}
+
+// writes returns whether the statement is known to write, including queries
+// with a data-modifying WITH clause and EXPLAIN of such statements
+func writes(n nodes.Node) bool {
+	switch v := n.(type) {
+	case nodes.InsertStmt, nodes.UpdateStmt, nodes.DeleteStmt:
+		return true
+	case nodes.SelectStmt:
+		if v.WithClause == nil {
+			return false
+		}
+		for _, item := range v.WithClause.Ctes.Items {
+			if cte, ok := item.(nodes.CommonTableExpr); ok && writes(cte.Ctequery) {
+				return true
+			}
+		}
+	case nodes.ExplainStmt:
+		return writes(v.Query)
+	}
+	return false
+}
+
+// readOnlyCommand returns whether the command is known to only read
+func readOnlyCommand(n nodes.Node) bool {
+	switch v := n.(type) {
+	case nodes.FetchStmt, nodes.ExplainStmt:
+		return true
+	case nodes.CopyStmt:
+		return !v.IsFrom
+	}
+	return false
+}
+
+// commandName returns the name of the command, as reported when it's rejected
+// by checkReadOnly
+func commandName(n nodes.Node) string {
+	switch v := n.(type) {
+	case nodes.InsertStmt:
+		return "INSERT"
+	case nodes.UpdateStmt:
+		return "UPDATE"
+	case nodes.DeleteStmt:
+		return "DELETE"
+	case nodes.CopyStmt:
+		return "COPY FROM"
+	case nodes.CreateStmt:
+		return "CREATE TABLE"
+	case nodes.CreateTableAsStmt:
+		return "CREATE TABLE AS"
+	case nodes.ViewStmt:
+		return "CREATE VIEW"
+	case nodes.CreateRoleStmt:
+		return "CREATE ROLE"
+	case nodes.CreateSchemaStmt:
+		return "CREATE SCHEMA"
+	case nodes.IndexStmt:
+		return "CREATE INDEX"
+	case nodes.AlterTableStmt:
+		return "ALTER TABLE"
+	case nodes.DropStmt:
+		return "DROP"
+	case nodes.TruncateStmt:
+		return "TRUNCATE TABLE"
+	case nodes.GrantStmt:
+		return "GRANT"
+	case nodes.VacuumStmt:
+		return "VACUUM"
+	case nodes.ExplainStmt:
+		return commandName(v.Query)
+	case nodes.DeclareCursorStmt:
+		return commandName(v.Query)
+	case nodes.SelectStmt:
+		// the data-modifying statement of the WITH clause
+		if v.WithClause != nil {
+			for _, item := range v.WithClause.Ctes.Items {
+				if cte, ok := item.(nodes.CommonTableExpr); ok && writes(cte.Ctequery) {
+					return commandName(cte.Ctequery)
+				}
+			}
+		}
+	}
+	return "command"
+}
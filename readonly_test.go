@@ -0,0 +1,110 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCheckReadOnly(t *testing.T) {
+	allowed := []Statement{
+		{QueryStatement, nodes.SelectStmt{}},
+		{ShowStatement, nodes.VariableShowStmt{}},
+		{SetStatement, nodes.VariableSetStmt{}},
+		{TransactionStatement, nodes.TransactionStmt{}},
+		{CommandStatement, nodes.CopyStmt{IsFrom: false}},
+		{CommandStatement, nodes.FetchStmt{}},
+		{QueryStatement, nodes.ExplainStmt{Query: nodes.SelectStmt{}}},
+		{QueryStatement, rawSQL("SELECT 1")},
+	}
+	for _, stmt := range allowed {
+		require.NoError(t, checkReadOnly(stmt), "%T", stmt.Node)
+	}
+
+	cte := func(n nodes.Node) *nodes.WithClause {
+		return &nodes.WithClause{Ctes: nodes.List{Items: []nodes.Node{nodes.CommonTableExpr{Ctequery: n}}}}
+	}
+	returning := nodes.List{Items: []nodes.Node{nodes.ResTarget{}}}
+	queries := []struct {
+		node nodes.Node
+		name string
+	}{
+		{nodes.InsertStmt{ReturningList: returning}, "INSERT"},
+		{nodes.DeleteStmt{ReturningList: returning}, "DELETE"},
+		{nodes.SelectStmt{WithClause: cte(nodes.UpdateStmt{})}, "UPDATE"},
+		{nodes.ExplainStmt{Query: nodes.SelectStmt{WithClause: cte(nodes.DeleteStmt{})}}, "DELETE"},
+	}
+	for _, query := range queries {
+		err := checkReadOnly(Statement{QueryStatement, query.node})
+		require.Error(t, err, "%+v", query.node)
+		require.Equal(t, "cannot execute "+query.name+" in a read-only transaction", err.Error())
+	}
+	require.NoError(t, checkReadOnly(Statement{QueryStatement, nodes.SelectStmt{WithClause: cte(nodes.SelectStmt{})}}))
+
+	rejected := map[string]nodes.Node{
+		"INSERT":       nodes.InsertStmt{},
+		"UPDATE":       nodes.UpdateStmt{},
+		"DELETE":       nodes.DeleteStmt{},
+		"COPY FROM":    nodes.CopyStmt{IsFrom: true},
+		"CREATE TABLE": nodes.CreateStmt{},
+		"DROP":         nodes.DropStmt{},
+		"command":      rawSQL("VACUUM"),
+	}
+	for name, n := range rejected {
+		t.Run(name, func(t *testing.T) {
+			err := checkReadOnly(Statement{statementKind(n), n})
+			require.Error(t, err)
+			require.Equal(t, "25006", fromErr(err).C)
+			require.Equal(t, "cannot execute "+name+" in a read-only transaction", err.Error())
+		})
+	}
+}
+
+func TestQuery_readOnly(t *testing.T) {
+	queryer := &recordingQueryer{}
+	srv := New(queryer, WithReadOnly())
+	frontend, _ := connect(t, srv.(*server))
+
+	for _, sql := range []string{"SELECT 1", "SET foo = 'bar'", "COPY t TO STDOUT", "PREPARE ins AS INSERT INTO t"} {
+		t.Run(sql, func(t *testing.T) {
+			sendQuery(t, frontend, sql)
+			for {
+				msg, err := frontend.Receive()
+				require.NoError(t, err)
+				_, isErr := msg.(*pgproto3.ErrorResponse)
+				require.False(t, isErr, "unexpected error: %+v", msg)
+				if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+					break
+				}
+			}
+		})
+	}
+
+	for _, sql := range []string{"UPDATE t", "INSERT INTO t", "COPY t FROM STDIN", "DROP TABLE t", "EXECUTE ins"} {
+		t.Run(sql, func(t *testing.T) {
+			sendQuery(t, frontend, sql)
+			msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+			require.Equal(t, "25006", msg.(*pgproto3.ErrorResponse).Code)
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+		})
+	}
+	require.Len(t, queryer.nodes, 3, "expected only SELECT, SET and COPY TO to reach the backend")
+}
+
+func TestQuery_readOnlyTransaction(t *testing.T) {
+	queryer := &recordingQueryer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	frontend, _ := connect(t, srv)
+
+	exec := func(t *testing.T, sql string, expected pgproto3.BackendMessage) {
+		sendQuery(t, frontend, sql)
+		receive(t, frontend, expected)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+
+	exec(t, "BEGIN READ ONLY", &pgproto3.CommandComplete{})
+	exec(t, "INSERT INTO t", &pgproto3.ErrorResponse{})
+	exec(t, "COMMIT", &pgproto3.CommandComplete{})
+	exec(t, "INSERT INTO t", &pgproto3.CommandComplete{})
+}
@@ -0,0 +1,105 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// ColumnDesc describes a column of the rows returned by RowsFromValues
+type ColumnDesc struct {
+	Name string
+
+	// TypeName is the name of the postgres type of the column, like "INT4".
+	// When empty, it's inferred from the first non-nil value of the column,
+	// like in RowsFromStructs, and columns of only nil values are text.
+	TypeName string
+}
+
+// RowsFromValues returns the rows of values computed in memory, with a value
+// per column in each of the rows.
+func RowsFromValues(columns []ColumnDesc, rows [][]interface{}) driver.Rows {
+	cols := make([]ColumnDesc, len(columns))
+	copy(cols, columns)
+	for i := range cols {
+		if cols[i].TypeName != "" {
+			continue
+		}
+		for _, row := range rows {
+			if i < len(row) && row[i] != nil {
+				cols[i].TypeName = fieldTypeName(reflect.TypeOf(row[i]))
+				break
+			}
+		}
+	}
+	return &valueRows{columns: cols, rows: rows}
+}
+
+// RowsFromMaps returns the rows of maps from column names to values, computed
+// in memory. The columns are all of the keys of the maps, sorted by name, and
+// the keys missing from a row are nil. Their types are inferred like in
+// RowsFromValues.
+func RowsFromMaps(rows []map[string]interface{}) driver.Rows {
+	var names []string
+	seen := map[string]bool{}
+	for _, row := range rows {
+		for k := range row {
+			if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	columns := make([]ColumnDesc, len(names))
+	values := make([][]interface{}, len(rows))
+	for i, name := range names {
+		columns[i].Name = name
+	}
+	for i, row := range rows {
+		values[i] = make([]interface{}, len(names))
+		for j, name := range names {
+			values[i][j] = row[name]
+		}
+	}
+	return RowsFromValues(columns, values)
+}
+
+// valueRows implements driver.Rows over rows of values
+type valueRows struct {
+	columns []ColumnDesc
+	rows    [][]interface{}
+	next    int
+}
+
+func (r *valueRows) Columns() []string {
+	cols := make([]string, len(r.columns))
+	for i, c := range r.columns {
+		cols[i] = c.Name
+	}
+	return cols
+}
+
+func (r *valueRows) ColumnTypeDatabaseTypeName(i int) string {
+	return r.columns[i].TypeName
+}
+
+func (r *valueRows) Close() error { return nil }
+
+func (r *valueRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+
+	row := r.rows[r.next]
+	r.next++
+	if len(row) != len(dest) {
+		return InternalError("expected %d values in row, got %d", len(dest), len(row))
+	}
+	for i, v := range row {
+		dest[i] = v
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+// readRows reads all of the rows
+func readRows(t *testing.T, rows driver.Rows) [][]driver.Value {
+	var res [][]driver.Value
+	for {
+		dest := make([]driver.Value, len(rows.Columns()))
+		err := rows.Next(dest)
+		if err == io.EOF {
+			return res
+		}
+		require.NoError(t, err)
+		res = append(res, dest)
+	}
+}
+
+// columnTypes returns the type names of all of the columns
+func columnTypes(rows driver.Rows) []string {
+	types := make([]string, len(rows.Columns()))
+	for i := range types {
+		types[i] = rows.(driver.RowsColumnTypeDatabaseTypeName).ColumnTypeDatabaseTypeName(i)
+	}
+	return types
+}
+
+func TestRowsFromValues(t *testing.T) {
+	columns := []ColumnDesc{{Name: "id"}, {Name: "name"}, {Name: "mixed"}, {Name: "nulls"}, {Name: "score", TypeName: "NUMERIC"}}
+	values := [][]interface{}{
+		{int32(1), nil, 1.5, nil, "1.5"},
+		{int32(2), "bob", "x", nil, "2"},
+	}
+
+	rows := RowsFromValues(columns, values)
+	require.Equal(t, []string{"id", "name", "mixed", "nulls", "score"}, rows.Columns())
+	require.Equal(t, []string{"INT4", "TEXT", "FLOAT8", "", "NUMERIC"}, columnTypes(rows))
+	require.Equal(t, [][]driver.Value{
+		{int32(1), nil, 1.5, nil, "1.5"},
+		{int32(2), "bob", "x", nil, "2"},
+	}, readRows(t, rows))
+	require.Empty(t, columns[0].TypeName, "expected the columns to remain unmodified")
+
+	t.Run("null columns on the wire", func(t *testing.T) {
+		rows := RowsFromValues([]ColumnDesc{{Name: "id"}, {Name: "nulls"}}, [][]interface{}{
+			{int32(1), nil},
+			{int32(2), nil},
+		})
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &rowsQueryer{rows}}
+		frontend, _ := connect(t, srv)
+		sendQuery(t, frontend, "SELECT * FROM t")
+
+		msg := receive(t, frontend, &pgproto3.RowDescription{}).(*pgproto3.RowDescription)
+		require.Equal(t, uint32(25), msg.Fields[1].DataTypeOID, "expected text for a column of NULLs")
+		for _, id := range []string{"1", "2"} {
+			row := receive(t, frontend, &pgproto3.DataRow{}).(*pgproto3.DataRow)
+			require.Equal(t, [][]byte{[]byte(id), nil}, row.Values)
+		}
+		receive(t, frontend, &pgproto3.CommandComplete{})
+	})
+
+	t.Run("wrong number of values", func(t *testing.T) {
+		rows := RowsFromValues([]ColumnDesc{{Name: "a"}}, [][]interface{}{{1, 2}})
+		err := rows.Next(make([]driver.Value, 1))
+		require.Error(t, err)
+		require.Equal(t, "XX000", fromErr(err).C)
+	})
+}
+
+func TestRowsFromMaps(t *testing.T) {
+	rows := RowsFromMaps([]map[string]interface{}{
+		{"name": "alice", "id": int64(1)},
+		{"id": int64(2), "active": true},
+	})
+
+	require.Equal(t, []string{"active", "id", "name"}, rows.Columns())
+	require.Equal(t, []string{"BOOL", "INT8", "TEXT"}, columnTypes(rows))
+	require.Equal(t, [][]driver.Value{
+		{nil, int64(1), "alice"},
+		{true, int64(2), nil},
+	}, readRows(t, rows))
+}
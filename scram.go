@@ -0,0 +1,498 @@
+package pgsrv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/panoplyio/pgsrv/protocol"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the SASL mechanisms of SCRAM authentication, see RFC 5802 and RFC 7677
+const (
+	scramSHA256     = "SCRAM-SHA-256"
+	scramSHA256Plus = "SCRAM-SHA-256-PLUS" // with channel binding
+)
+
+// scramIterations is the iteration count of the salted passwords derived from
+// raw passwords, like the default scram_iterations of postgres
+const scramIterations = 4096
+
+// scramSaltLength is the length of the salts of the credentials derived from
+// raw passwords, like the default of postgres
+const scramSaltLength = 16
+
+// tlsServerEndPoint is the only supported channel binding type, see
+// tlsServerEndPointData
+const tlsServerEndPoint = "tls-server-end-point"
+
+// SCRAMPasswords returns a PasswordProvider for SCRAM-SHA-256 authentication
+// of the users with the provided passwords, keyed by user name. A password may
+// also be a verifier, like postgres stores in pg_authid, in the form of
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>, which doesn't
+// reveal the password. Raw passwords are used as is, without SASLprep, which
+// only affects non-ASCII passwords. Embedding it in the Queryer (as an
+// anonymous PasswordProvider field) enables SCRAM authentication, along with
+// SCRAM-SHA-256-PLUS over TLS.
+func SCRAMPasswords(passwords map[string]string) PasswordProvider {
+	return SCRAMPasswordFunc(func(user string) (string, error) {
+		password, ok := passwords[user]
+		if !ok {
+			return "", ErrUnknownUser
+		}
+		return password, nil
+	})
+}
+
+// SCRAMPasswordFunc is like SCRAMPasswords, with the passwords or verifiers
+// returned by the provided function, like from a database. Returning
+// ErrUnknownUser rejects the user, while other errors fail the authentication,
+// like when the database is unavailable.
+func SCRAMPasswordFunc(lookup func(user string) (string, error)) PasswordProvider {
+	return &scramPasswordProvider{lookup}
+}
+
+// scramPasswordProvider is a password provider for SCRAM authentication, that
+// returns the passwords or verifiers of the users as is
+type scramPasswordProvider struct {
+	lookup func(user string) (string, error)
+}
+
+// Type implements PasswordProvider.
+func (pp *scramPasswordProvider) Type() AuthType {
+	return SCRAM
+}
+
+func (pp *scramPasswordProvider) GetPassword(user string) ([]byte, error) {
+	password, err := pp.lookup(user)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(password), nil
+}
+
+// channelAuthenticator is an authenticator that may bind the authentication
+// to the TLS channel of the connection, with the tls-server-end-point channel
+// binding data, which is nil on unencrypted connections.
+type channelAuthenticator interface {
+	authenticateChannel(binding []byte, rw protocol.MessageReadWriter, args map[string]interface{}) error
+}
+
+// scramAuthenticator authenticates the clients with SCRAM-SHA-256, or with
+// SCRAM-SHA-256-PLUS over TLS, binding the authentication to the TLS channel,
+// which defeats a man in the middle that terminates the TLS connection.
+//
+// It requires a PasswordProvider implementation that provides the passwords
+// or verifiers of the users, see SCRAMPasswords.
+type scramAuthenticator struct {
+	pp PasswordProvider
+
+	// the random secret of the salts derived from the user names, see salt
+	mu     sync.Mutex
+	secret []byte
+}
+
+// authenticate authenticates without channel binding, see authenticateChannel
+func (a *scramAuthenticator) authenticate(rw protocol.MessageReadWriter, args map[string]interface{}) error {
+	return a.authenticateChannel(nil, rw, args)
+}
+
+func (a *scramAuthenticator) authenticateChannel(binding []byte, rw protocol.MessageReadWriter, args map[string]interface{}) error {
+	// channel binding is offered only over TLS, and preferred
+	mechanisms := scramSHA256 + "\x00"
+	if binding != nil {
+		mechanisms = scramSHA256Plus + "\x00" + mechanisms
+	}
+	err := rw.Write(protocol.Authentication(protocol.AuthSASL, []byte(mechanisms+"\x00")))
+	if err != nil {
+		return err
+	}
+
+	m, err := rw.Read()
+	if err != nil {
+		return err
+	}
+	if m.Type() != protocol.MsgTypePasswordMessage {
+		return reportFatal(rw, errorf("", errExpectedPassword, m.Type()))
+	}
+	mechanism, clientFirst, err := extractSASLInitialResponse(m)
+	if err != nil {
+		return reportFatal(rw, err)
+	}
+
+	ex := &scramExchange{binding: binding}
+	err = ex.readClientFirst(mechanism, clientFirst)
+	if err != nil {
+		return reportFatal(rw, err)
+	}
+
+	// unknown users go through the entire exchange with made up credentials,
+	// to avoid revealing them, and are rejected like wrong passwords
+	user, _ := args["user"].(string)
+	password, err := a.pp.GetPassword(user)
+	if errors.Is(err, ErrUnknownUser) {
+		ex.rejected = true
+		password, err = nil, nil
+	}
+	if err != nil {
+		return reportFatal(rw, passwordLookupError(rw, user, err))
+	}
+	salt, err := a.salt(user)
+	if err != nil {
+		return reportFatal(rw, err)
+	}
+	ex.creds, err = parseSCRAMCredentials(string(password), salt)
+	if err != nil {
+		return reportFatal(rw, err)
+	}
+
+	serverFirst, err := ex.serverFirst()
+	if err != nil {
+		return reportFatal(rw, err)
+	}
+	err = rw.Write(protocol.Authentication(protocol.AuthSASLContinue, []byte(serverFirst)))
+	if err != nil {
+		return err
+	}
+
+	m, err = rw.Read()
+	if err != nil {
+		return err
+	}
+	if m.Type() != protocol.MsgTypePasswordMessage {
+		return reportFatal(rw, errorf("", errExpectedPassword, m.Type()))
+	}
+	serverFinal, err := ex.readClientFinal(string(m[5:]))
+	if err == errSCRAMProof {
+		err = InvalidPassword(errWrongPassword, user)
+	}
+	if err != nil {
+		return reportFatal(rw, err)
+	}
+
+	err = rw.Write(protocol.Authentication(protocol.AuthSASLFinal, []byte(serverFinal)))
+	if err != nil {
+		return err
+	}
+	return rw.Write(protocol.AuthenticationOK)
+}
+
+// salt returns the salt of the credentials that are derived from a raw
+// password, or made up for an unknown user, which is the HMAC of the user name
+// by a random secret of the server, like the mock salt of postgres. Like the
+// salt of a stored verifier, it's the same on every attempt, so it doesn't
+// reveal whether the user exists.
+func (a *scramAuthenticator) salt(user string) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.secret == nil {
+		secret, err := randomBytes(sha256.Size)
+		if err != nil {
+			return nil, err
+		}
+		a.secret = secret
+	}
+	return scramHMAC(a.secret, user)[:scramSaltLength], nil
+}
+
+// extractSASLInitialResponse extracts the selected mechanism and the data of
+// a provided SASLInitialResponse 'p' message
+func extractSASLInitialResponse(m protocol.Message) (string, string, error) {
+	err := ProtocolViolation("invalid SASLInitialResponse message")
+	body := m[5:]
+	idx := bytes.IndexByte(body, 0)
+	if idx == -1 || len(body) < idx+5 {
+		return "", "", err
+	}
+	mechanism := string(body[:idx])
+	data := body[idx+5:]
+
+	// a length of -1 indicates that there's no data
+	length := int32(binary.BigEndian.Uint32(body[idx+1 : idx+5]))
+	if length == -1 {
+		length = 0
+	}
+	if int(length) != len(data) {
+		return "", "", err
+	}
+	return mechanism, string(data), nil
+}
+
+// scramCredentials are the credentials of a user that are required for
+// verifying the client, without the password itself
+type scramCredentials struct {
+	salt       []byte
+	iterations int
+	storedKey  []byte
+	serverKey  []byte
+}
+
+// parseSCRAMCredentials parses a verifier stored by postgres, see
+// SCRAMPasswords, or derives the credentials from a raw password, with the
+// provided salt
+func parseSCRAMCredentials(password string, salt []byte) (*scramCredentials, error) {
+	if !strings.HasPrefix(password, scramSHA256+"$") {
+		salted := scramHi([]byte(password), salt, scramIterations)
+		clientKey := scramHMAC(salted, "Client Key")
+		storedKey := sha256.Sum256(clientKey)
+		return &scramCredentials{salt, scramIterations, storedKey[:], scramHMAC(salted, "Server Key")}, nil
+	}
+
+	err := InternalError("invalid SCRAM verifier")
+	parts := strings.Split(strings.TrimPrefix(password, scramSHA256+"$"), "$")
+	if len(parts) != 2 {
+		return nil, err
+	}
+	iterSalt := strings.SplitN(parts[0], ":", 2)
+	keys := strings.SplitN(parts[1], ":", 2)
+	if len(iterSalt) != 2 || len(keys) != 2 {
+		return nil, err
+	}
+
+	creds := &scramCredentials{}
+	var err1, err2, err3, err4 error
+	creds.iterations, err1 = strconv.Atoi(iterSalt[0])
+	creds.salt, err2 = base64.StdEncoding.DecodeString(iterSalt[1])
+	creds.storedKey, err3 = base64.StdEncoding.DecodeString(keys[0])
+	creds.serverKey, err4 = base64.StdEncoding.DecodeString(keys[1])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || creds.iterations < 1 ||
+		len(creds.storedKey) != sha256.Size || len(creds.serverKey) != sha256.Size {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// errSCRAMProof is the error of a client proof that doesn't match the
+// credentials of the user, which is reported as a wrong password
+var errSCRAMProof = errors.New("invalid SCRAM client proof")
+
+// scramExchange is the state of the SCRAM exchange with the client, between
+// its messages
+type scramExchange struct {
+	binding  []byte // the channel binding data of the connection, if it's encrypted
+	creds    *scramCredentials
+	rejected bool // the user is unknown, see authenticateChannel
+
+	gs2Header       string // as sent by the client, and expected in its final message
+	clientFirstBare string
+	serverFirstMsg  string
+	nonce           string // of the client and the server
+}
+
+// readClientFirst reads the client-first-message, with the gs2 header that
+// negotiates channel binding:
+//
+//	p=tls-server-end-point,,n=user,r=nonce
+//
+// Clients may only bind the authentication to the channel with the -PLUS
+// mechanism. Clients that support channel binding, but think the server
+// doesn't (y), are rejected, since it's a downgrade by a man in the middle.
+func (ex *scramExchange) readClientFirst(mechanism, msg string) error {
+	switch {
+	case mechanism == scramSHA256:
+	case mechanism == scramSHA256Plus && ex.binding != nil:
+	default:
+		return ProtocolViolation("client selected an invalid SASL authentication mechanism")
+	}
+
+	malformed := func(detail string, args ...interface{}) error {
+		return WithDetail(ProtocolViolation("malformed SCRAM message"), detail, args...)
+	}
+
+	// gs2-header = gs2-cbind-flag "," [ authzid ] ","
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return malformed("Unexpected end of input.")
+	}
+	flag, authzid := parts[0], parts[1]
+	switch {
+	case strings.HasPrefix(flag, "p="):
+		if mechanism != scramSHA256Plus {
+			return malformed("The client selected SCRAM-SHA-256 without channel binding, but the SCRAM message includes channel binding data.")
+		}
+		if cbType := strings.TrimPrefix(flag, "p="); cbType != tlsServerEndPoint {
+			return ProtocolViolation("unsupported SCRAM channel-binding type \"%s\"", cbType)
+		}
+	case flag == "y" && ex.binding != nil:
+		return WithDetail(ProtocolViolation("SCRAM channel binding negotiation error"),
+			"The client supports SCRAM channel binding but thinks the server does not. However, this server does support channel binding.")
+	case flag == "y", flag == "n":
+		if mechanism == scramSHA256Plus {
+			return malformed("The client selected SCRAM-SHA-256-PLUS, but the SCRAM message does not include channel binding data.")
+		}
+	default:
+		return malformed("Unexpected channel-binding flag \"%s\".", flag)
+	}
+	if authzid != "" {
+		return Unsupported("authorization identity in SCRAM authentication")
+	}
+	ex.gs2Header = flag + "," + authzid + ","
+
+	// client-first-message-bare = [ reserved-mext "," ] username "," nonce
+	// the user name is ignored, in favor of the user of the startup message
+	ex.clientFirstBare = parts[2]
+	attrs := strings.Split(ex.clientFirstBare, ",")
+	if strings.HasPrefix(attrs[0], "m=") {
+		return Unsupported("SCRAM extension in the client-first-message")
+	}
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return malformed("Expected the user name and nonce attributes.")
+	}
+	ex.nonce = strings.TrimPrefix(attrs[1], "r=")
+	if ex.nonce == "" {
+		return malformed("The nonce is empty.")
+	}
+	return nil
+}
+
+// serverFirst returns the server-first-message, with the nonce of the client
+// followed by the nonce of the server, the salt and the iteration count
+func (ex *scramExchange) serverFirst() (string, error) {
+	nonce, err := randomBytes(18)
+	if err != nil {
+		return "", err
+	}
+	ex.nonce += base64.StdEncoding.EncodeToString(nonce)
+	ex.serverFirstMsg = fmt.Sprintf("r=%s,s=%s,i=%d",
+		ex.nonce, base64.StdEncoding.EncodeToString(ex.creds.salt), ex.creds.iterations)
+	return ex.serverFirstMsg, nil
+}
+
+// readClientFinal reads the client-final-message, verifying its channel
+// binding, nonce and proof, and returns the server-final-message:
+//
+//	c=channel-binding,r=nonce,p=proof
+//
+// The channel binding is the base64 of the gs2 header, followed by the channel
+// binding data, when the client bound the authentication to the channel.
+func (ex *scramExchange) readClientFinal(msg string) (string, error) {
+	attrs := strings.Split(msg, ",")
+	last := len(attrs) - 1
+	if len(attrs) < 3 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") ||
+		!strings.HasPrefix(attrs[last], "p=") {
+		return "", WithDetail(ProtocolViolation("malformed SCRAM message"), "Expected the channel binding, nonce and proof attributes.")
+	}
+
+	expected := []byte(ex.gs2Header)
+	if strings.HasPrefix(ex.gs2Header, "p=") {
+		expected = append(expected, ex.binding...)
+	}
+	binding, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(attrs[0], "c="))
+	if err != nil || !hmac.Equal(expected, binding) {
+		return "", WithDetail(ProtocolViolation("SCRAM channel binding check failed"),
+			"The channel binding of the client doesn't match the connection.")
+	}
+
+	if strings.TrimPrefix(attrs[1], "r=") != ex.nonce {
+		return "", WithDetail(ProtocolViolation("invalid SCRAM response"), "Nonce does not match.")
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(attrs[last], "p="))
+	if err != nil || len(proof) != sha256.Size {
+		return "", WithDetail(ProtocolViolation("malformed SCRAM message"), "Malformed proof in client-final-message.")
+	}
+
+	// ClientKey = ClientProof XOR HMAC(StoredKey, AuthMessage), and the
+	// StoredKey is its hash
+	authMessage := ex.clientFirstBare + "," + ex.serverFirstMsg + "," +
+		strings.Join(attrs[:last], ",")
+	signature := scramHMAC(ex.creds.storedKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ signature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if ex.rejected || !hmac.Equal(storedKey[:], ex.creds.storedKey) {
+		return "", errSCRAMProof
+	}
+
+	serverSignature := scramHMAC(ex.creds.serverKey, authMessage)
+	return "v=" + base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+// scramHi is the Hi() function of SCRAM, which is PBKDF2 with HMAC-SHA-256 and
+// a single block
+func scramHi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	res := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range res {
+			res[j] ^= u[j]
+		}
+	}
+	return res
+}
+
+// scramHMAC returns the HMAC-SHA-256 of the message with the key
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// tlsServerEndPointData returns the tls-server-end-point channel binding data
+// of the server certificate (RFC 5929), which is its hash by the hash function
+// of its signature algorithm, where MD5 and SHA-1 are replaced by SHA-256. It's
+// nil when the hash function isn't known, like for Ed25519, in which case
+// channel binding isn't offered.
+func tlsServerEndPointData(der []byte) []byte {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil
+	}
+
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.DSAWithSHA256, x509.ECDSAWithSHA256:
+		h = sha256.New()
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		h = sha512.New()
+	default:
+		return nil
+	}
+	h.Write(der)
+	return h.Sum(nil)
+}
+
+// selectCertificate selects the certificate presented to the client like
+// crypto/tls does, either by the GetCertificate of the configuration, or out
+// of its Certificates
+func selectCertificate(certs []tls.Certificate, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if getCertificate != nil && (len(certs) == 0 || hello.ServerName != "") {
+		cert, err := getCertificate(hello)
+		if cert != nil || err != nil {
+			return cert, err
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("tls: no certificates configured")
+	}
+	if len(certs) == 1 {
+		return &certs[0], nil
+	}
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return &certs[0], nil
+}
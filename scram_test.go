@@ -0,0 +1,358 @@
+package pgsrv
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// the example exchange of RFC 7677, for user "user" with password "pencil"
+const (
+	rfc7677Verifier = "SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$" +
+		"WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU="
+	rfc7677Nonce       = "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	rfc7677ServerFirst = "r=" + rfc7677Nonce + ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal = "c=biws,r=" + rfc7677Nonce + ",p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func TestSCRAMExchange(t *testing.T) {
+	creds, err := parseSCRAMCredentials(rfc7677Verifier, nil)
+	require.NoError(t, err)
+	require.Equal(t, 4096, creds.iterations)
+
+	// the credentials derived from the password are the ones of the verifier
+	salted := scramHi([]byte("pencil"), creds.salt, creds.iterations)
+	storedKey := sha256.Sum256(scramHMAC(salted, "Client Key"))
+	require.Equal(t, creds.storedKey, storedKey[:])
+	require.Equal(t, creds.serverKey, scramHMAC(salted, "Server Key"))
+
+	exchange := func(t *testing.T) *scramExchange {
+		ex := &scramExchange{creds: creds}
+		require.NoError(t, ex.readClientFirst(scramSHA256, "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+		ex.nonce = rfc7677Nonce
+		ex.serverFirstMsg = rfc7677ServerFirst
+		return ex
+	}
+
+	t.Run("valid proof", func(t *testing.T) {
+		serverFinal, err := exchange(t).readClientFinal(rfc7677ClientFinal)
+		require.NoError(t, err)
+		require.Equal(t, rfc7677ServerFinal, serverFinal)
+	})
+
+	t.Run("invalid proof", func(t *testing.T) {
+		msg := strings.Replace(rfc7677ClientFinal, "p=dHzb", "p=dHzc", 1)
+		_, err := exchange(t).readClientFinal(msg)
+		require.Equal(t, errSCRAMProof, err)
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		ex := exchange(t)
+		ex.rejected = true
+		_, err := ex.readClientFinal(rfc7677ClientFinal)
+		require.Equal(t, errSCRAMProof, err)
+	})
+
+	t.Run("wrong nonce", func(t *testing.T) {
+		msg := strings.Replace(rfc7677ClientFinal, "r=rOpr", "r=xOpr", 1)
+		_, err := exchange(t).readClientFinal(msg)
+		require.EqualError(t, err, "invalid SCRAM response")
+	})
+
+	t.Run("invalid verifiers", func(t *testing.T) {
+		for _, verifier := range []string{
+			"SCRAM-SHA-256$",
+			"SCRAM-SHA-256$4096:salt",
+			"SCRAM-SHA-256$x:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU=",
+			"SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d:wfPL",
+		} {
+			_, err := parseSCRAMCredentials(verifier, nil)
+			require.Error(t, err, verifier)
+		}
+	})
+}
+
+func TestSCRAMExchange_readClientFirst(t *testing.T) {
+	binding := []byte("binding")
+	tests := []struct {
+		name      string
+		binding   []byte // nil without TLS
+		mechanism string
+		msg       string
+		code      string // of the error, if any
+	}{
+		{"without channel binding", nil, scramSHA256, "n,,n=,r=abc", ""},
+		{"client supporting channel binding", nil, scramSHA256, "y,,n=,r=abc", ""},
+		{"plus without TLS", nil, scramSHA256Plus, "p=tls-server-end-point,,n=,r=abc", "08P01"},
+		{"unknown mechanism", nil, "SCRAM-SHA-1", "n,,n=,r=abc", "08P01"},
+		{"binding without plus", binding, scramSHA256, "p=tls-server-end-point,,n=,r=abc", "08P01"},
+		{"channel binding", binding, scramSHA256Plus, "p=tls-server-end-point,,n=,r=abc", ""},
+		{"no binding with plus", binding, scramSHA256Plus, "n,,n=,r=abc", "08P01"},
+		{"unsupported binding type", binding, scramSHA256Plus, "p=tls-unique,,n=,r=abc", "08P01"},
+		{"downgrade", binding, scramSHA256, "y,,n=,r=abc", "08P01"},
+		{"not supporting channel binding over TLS", binding, scramSHA256, "n,,n=,r=abc", ""},
+		{"authorization identity", nil, scramSHA256, "n,a=admin,n=,r=abc", "0A000"},
+		{"extension", nil, scramSHA256, "n,,m=ext,n=,r=abc", "0A000"},
+		{"invalid flag", nil, scramSHA256, "x,,n=,r=abc", "08P01"},
+		{"missing nonce", nil, scramSHA256, "n,,n=", "08P01"},
+		{"empty nonce", nil, scramSHA256, "n,,n=,r=", "08P01"},
+		{"missing header", nil, scramSHA256, "n=,r=abc", "08P01"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ex := &scramExchange{binding: test.binding}
+			err := ex.readClientFirst(test.mechanism, test.msg)
+			if test.code == "" {
+				require.NoError(t, err)
+				require.Equal(t, "abc", ex.nonce)
+			} else {
+				require.Error(t, err)
+				require.Equal(t, test.code, fromErr(err).C)
+			}
+		})
+	}
+}
+
+// scramAuthenticate authenticates with SCRAM over the frontend, once the
+// startup message was sent, with the provided mechanism and gs2 header, and
+// the channel binding data that follows the header in the channel binding of
+// the client. It returns the mechanisms offered by the server, and the message
+// that ended the exchange: AuthenticationOK, or an ErrorResponse.
+func scramAuthenticate(t *testing.T, frontend *pgproto3.Frontend, password, mechanism, gs2Header string, binding []byte) ([]string, pgproto3.BackendMessage) {
+	msg := receive(t, frontend, &pgproto3.Authentication{}).(*pgproto3.Authentication)
+	require.Equal(t, uint32(pgproto3.AuthTypeSASL), msg.Type)
+	mechanisms := msg.SASLAuthMechanisms
+
+	clientFirstBare := "n=,r=fyko+d2lbbFgONRv9qkxdawL"
+	err := frontend.Send(&pgproto3.SASLInitialResponse{AuthMechanism: mechanism, Data: []byte(gs2Header + clientFirstBare)})
+	require.NoError(t, err)
+
+	res, err := frontend.Receive()
+	require.NoError(t, err)
+	if _, ok := res.(*pgproto3.ErrorResponse); ok {
+		return mechanisms, res
+	}
+	require.Equal(t, uint32(pgproto3.AuthTypeSASLContinue), res.(*pgproto3.Authentication).Type)
+	serverFirst := string(res.(*pgproto3.Authentication).SASLData)
+
+	attrs := strings.Split(serverFirst, ",")
+	require.Len(t, attrs, 3)
+	nonce := strings.TrimPrefix(attrs[0], "r=")
+	require.True(t, strings.HasPrefix(nonce, "fyko+d2lbbFgONRv9qkxdawL"))
+	salt, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(attrs[1], "s="))
+	require.NoError(t, err)
+	iterations, err := strconv.Atoi(strings.TrimPrefix(attrs[2], "i="))
+	require.NoError(t, err)
+
+	// ClientProof = ClientKey XOR HMAC(H(ClientKey), AuthMessage)
+	channelBinding := append([]byte(gs2Header), binding...)
+	clientFinal := "c=" + base64.StdEncoding.EncodeToString(channelBinding) + ",r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinal
+	salted := scramHi([]byte(password), salt, iterations)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := scramHMAC(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	clientFinal += ",p=" + base64.StdEncoding.EncodeToString(proof)
+	require.NoError(t, frontend.Send(&pgproto3.SASLResponse{Data: []byte(clientFinal)}))
+
+	res, err = frontend.Receive()
+	require.NoError(t, err)
+	if _, ok := res.(*pgproto3.ErrorResponse); ok {
+		return mechanisms, res
+	}
+
+	// the server proves that it knows the password too
+	require.Equal(t, uint32(pgproto3.AuthTypeSASLFinal), res.(*pgproto3.Authentication).Type)
+	serverSignature := scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+	require.Equal(t, "v="+base64.StdEncoding.EncodeToString(serverSignature), string(res.(*pgproto3.Authentication).SASLData))
+
+	res, err = frontend.Receive()
+	require.NoError(t, err)
+	return mechanisms, res
+}
+
+func TestServer_SCRAM(t *testing.T) {
+	pp := SCRAMPasswords(map[string]string{"alice": "secret", "user": rfc7677Verifier})
+	ca := newTestCA(t)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, x509.ExtKeyUsageServerAuth, "localhost", "localhost")}}
+	srv := New(&passwordQueryer{PasswordProvider: pp}, WithTLSConfig(serverTLS))
+
+	// startUp starts up as the user, over TLS when tlsConfig is provided,
+	// and returns the frontend along with the channel binding data of the
+	// server certificate
+	startUp := func(t *testing.T, user string, tlsConfig *tls.Config) (*pgproto3.Frontend, []byte) {
+		var conn net.Conn = dialServer(t, srv)
+		var binding []byte
+		if tlsConfig != nil {
+			_, err := conn.Write([]byte{0, 0, 0, 8, 4, 210, 22, 47})
+			require.NoError(t, err)
+			res := make([]byte, 1)
+			_, err = io.ReadFull(conn, res)
+			require.NoError(t, err)
+			require.Equal(t, "S", string(res))
+
+			tlsConn := tls.Client(conn, tlsConfig)
+			require.NoError(t, tlsConn.Handshake())
+			hash := sha256.Sum256(tlsConn.ConnectionState().PeerCertificates[0].Raw)
+			conn, binding = tlsConn, hash[:]
+		}
+
+		frontend, err := pgproto3.NewFrontend(conn, conn)
+		require.NoError(t, err)
+		require.NoError(t, frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": user},
+		}))
+		return frontend, binding
+	}
+
+	// requireError requires the message to be an ErrorResponse of the code
+	requireError := func(t *testing.T, code string, msg pgproto3.BackendMessage) *pgproto3.ErrorResponse {
+		require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+		res := msg.(*pgproto3.ErrorResponse)
+		require.Equal(t, "FATAL", res.Severity)
+		require.Equal(t, code, res.Code, res.Message)
+		return res
+	}
+	clientTLS := &tls.Config{RootCAs: ca.pool, ServerName: "localhost"}
+
+	t.Run("without TLS", func(t *testing.T) {
+		frontend, _ := startUp(t, "alice", nil)
+		mechanisms, msg := scramAuthenticate(t, frontend, "secret", scramSHA256, "n,,", nil)
+		require.Equal(t, []string{scramSHA256}, mechanisms)
+		require.Equal(t, &pgproto3.Authentication{Type: pgproto3.AuthTypeOk}, msg)
+	})
+
+	t.Run("verifier", func(t *testing.T) {
+		frontend, _ := startUp(t, "user", nil)
+		_, msg := scramAuthenticate(t, frontend, "pencil", scramSHA256, "n,,", nil)
+		require.Equal(t, &pgproto3.Authentication{Type: pgproto3.AuthTypeOk}, msg)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		frontend, _ := startUp(t, "alice", nil)
+		_, msg := scramAuthenticate(t, frontend, "wrong", scramSHA256, "n,,", nil)
+		res := requireError(t, "28P01", msg)
+		require.Equal(t, "password does not match for user \"alice\"", res.Message)
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		frontend, _ := startUp(t, "bob", nil)
+		_, msg := scramAuthenticate(t, frontend, "secret", scramSHA256, "n,,", nil)
+		requireError(t, "28P01", msg)
+	})
+
+	t.Run("salts", func(t *testing.T) {
+		// salt returns the salt of the server-first-message of the user
+		salt := func(t *testing.T, user string) string {
+			frontend, _ := startUp(t, user, nil)
+			receive(t, frontend, &pgproto3.Authentication{})
+			err := frontend.Send(&pgproto3.SASLInitialResponse{AuthMechanism: scramSHA256, Data: []byte("n,,n=,r=abc")})
+			require.NoError(t, err)
+			msg := receive(t, frontend, &pgproto3.Authentication{}).(*pgproto3.Authentication)
+			attrs := strings.Split(string(msg.SASLData), ",")
+			require.Len(t, attrs, 3)
+			return strings.TrimPrefix(attrs[1], "s=")
+		}
+
+		// like the salts of verifiers, the salts of unknown users and raw
+		// passwords are the same on every attempt
+		require.Equal(t, "W22ZaJ0SNY7soEsUEjb6gQ==", salt(t, "user"))
+		require.Equal(t, salt(t, "bob"), salt(t, "bob"))
+		require.Equal(t, salt(t, "alice"), salt(t, "alice"))
+		require.NotEqual(t, salt(t, "bob"), salt(t, "carol"))
+	})
+
+	t.Run("plus without TLS", func(t *testing.T) {
+		frontend, _ := startUp(t, "alice", nil)
+		_, msg := scramAuthenticate(t, frontend, "secret", scramSHA256Plus, "p=tls-server-end-point,,", nil)
+		requireError(t, "08P01", msg)
+	})
+
+	t.Run("channel binding", func(t *testing.T) {
+		frontend, binding := startUp(t, "alice", clientTLS)
+		mechanisms, msg := scramAuthenticate(t, frontend, "secret", scramSHA256Plus, "p=tls-server-end-point,,", binding)
+		require.Equal(t, []string{scramSHA256Plus, scramSHA256}, mechanisms)
+		require.Equal(t, &pgproto3.Authentication{Type: pgproto3.AuthTypeOk}, msg)
+	})
+
+	t.Run("without channel binding over TLS", func(t *testing.T) {
+		frontend, _ := startUp(t, "alice", clientTLS)
+		_, msg := scramAuthenticate(t, frontend, "secret", scramSHA256, "n,,", nil)
+		require.Equal(t, &pgproto3.Authentication{Type: pgproto3.AuthTypeOk}, msg)
+	})
+
+	t.Run("another channel", func(t *testing.T) {
+		// like the certificate of a man in the middle
+		frontend, binding := startUp(t, "alice", clientTLS)
+		binding[0]++
+		_, msg := scramAuthenticate(t, frontend, "secret", scramSHA256Plus, "p=tls-server-end-point,,", binding)
+		res := requireError(t, "08P01", msg)
+		require.Equal(t, "SCRAM channel binding check failed", res.Message)
+	})
+
+	t.Run("downgrade", func(t *testing.T) {
+		frontend, _ := startUp(t, "alice", clientTLS)
+		_, msg := scramAuthenticate(t, frontend, "secret", scramSHA256, "y,,", nil)
+		res := requireError(t, "08P01", msg)
+		require.Equal(t, "SCRAM channel binding negotiation error", res.Message)
+	})
+
+	t.Run("binding of another header", func(t *testing.T) {
+		// the client-first-message doesn't request channel binding, while the
+		// client-final-message does
+		frontend, binding := startUp(t, "alice", clientTLS)
+		_, msg := scramAuthenticate(t, frontend, "secret", scramSHA256, "n,,", binding)
+		requireError(t, "08P01", msg)
+	})
+}
+
+func TestServer_SCRAM_lookupFailure(t *testing.T) {
+	pp := SCRAMPasswordFunc(func(user string) (string, error) {
+		return "", errors.New("connection refused")
+	})
+	logger := &mockLogger{}
+	srv := New(&passwordQueryer{PasswordProvider: pp}, WithLogger(logger))
+
+	conn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(serverConn) }()
+	frontend, err := pgproto3.NewFrontend(conn, conn)
+	require.NoError(t, err)
+	require.NoError(t, frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice"},
+	}))
+
+	// the cause is logged, rather than revealed to the client
+	_, msg := scramAuthenticate(t, frontend, "secret", scramSHA256, "n,,", nil)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+	require.Equal(t, "XX000", msg.(*pgproto3.ErrorResponse).Code)
+	require.Equal(t, "could not get the password of user \"alice\"", msg.(*pgproto3.ErrorResponse).Message)
+	require.Error(t, <-done)
+	require.Contains(t, logger.logs, "pgsrv: could not get the password of user \"alice\": connection refused")
+}
+
+func TestTLSServerEndPointData(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, x509.ExtKeyUsageServerAuth, "localhost")
+
+	// signed with ECDSA and SHA-256
+	hash := sha256.Sum256(cert.Certificate[0])
+	require.Equal(t, hash[:], tlsServerEndPointData(cert.Certificate[0]))
+	require.Nil(t, tlsServerEndPointData([]byte("invalid")))
+}
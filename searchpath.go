@@ -0,0 +1,117 @@
+package pgsrv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// defaultSearchPath is the search_path of sessions that didn't set it
+const defaultSearchPath = `"$user", public`
+
+// SearchPathFromContext returns the schemas of the search_path of the session
+// in the given context, in order, as set at startup or by SET search_path, or
+// ["$user", "public"] by default. It's read when called, so it reflects a SET
+// by a previous statement of the same sql string. "$user" is left for the
+// backend to resolve, as the schema of the name of the user, if it exists.
+func SearchPathFromContext(ctx context.Context) ([]string, bool) {
+	sess, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		return nil, false
+	}
+
+	value, ok := sess.Get("search_path").(string)
+	if !ok {
+		value = defaultSearchPath
+	}
+	path, err := parseSearchPath(value)
+	if err != nil {
+		return nil, false
+	}
+	return path, true
+}
+
+// parseSearchPath parses the value of search_path, as reported by SHOW: the
+// schemas separated by commas, where the unquoted ones are folded to lower
+// case, and the double-quoted ones are kept as is. The empty "" is skipped.
+func parseSearchPath(value string) ([]string, error) {
+	var path []string
+	for s := strings.TrimSpace(value); s != ""; {
+		var schema string
+		quoted := s[0] == '"'
+		if quoted {
+			// a quoted identifier, where "" stands for a quote
+			end := 1
+			for ; end < len(s); end++ {
+				if s[end] == '"' {
+					if end+1 < len(s) && s[end+1] == '"' {
+						end++
+						continue
+					}
+					break
+				}
+			}
+			if end == len(s) {
+				return nil, fmt.Errorf("unterminated quoted identifier")
+			}
+			schema = strings.Replace(s[1:end], `""`, `"`, -1)
+			s = strings.TrimSpace(s[end+1:])
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			schema = strings.ToLower(strings.TrimSpace(s[:end]))
+			s = s[end:]
+		}
+
+		if !quoted && schema == "" {
+			return nil, fmt.Errorf("invalid list syntax")
+		}
+		if schema != "" {
+			// "" is an empty path, like SET search_path = ''
+			path = append(path, schema)
+		}
+
+		if s == "" {
+			break
+		}
+		if s[0] != ',' {
+			return nil, fmt.Errorf("invalid list syntax")
+		}
+		s = strings.TrimSpace(s[1:])
+		if s == "" {
+			return nil, fmt.Errorf("invalid list syntax")
+		}
+	}
+	return path, nil
+}
+
+// formatSearchPath formats the schemas of search_path like SHOW reports it,
+// quoting the names that aren't lower case identifiers, like "$user"
+func formatSearchPath(path []string) string {
+	names := make([]string, len(path))
+	for i, schema := range path {
+		names[i] = schema
+		if !isPlainIdentifier(schema) {
+			names[i] = `"` + strings.Replace(schema, `"`, `""`, -1) + `"`
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// isPlainIdentifier reports whether the name is an identifier that doesn't
+// need quoting, which starts with a lower case letter or an underscore,
+// followed by lower case letters, digits, underscores or dollar signs
+func isPlainIdentifier(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c == '_':
+		case i > 0 && (c >= '0' && c <= '9' || c == '$'):
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
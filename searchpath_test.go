@@ -0,0 +1,115 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// searchPathQueryer records the search_path in the context of every query
+type searchPathQueryer struct {
+	paths [][]string
+}
+
+func (q *searchPathQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	path, ok := SearchPathFromContext(ctx)
+	if !ok {
+		return nil, InternalError("no search_path in context")
+	}
+	q.paths = append(q.paths, path)
+	return &mockRows{}, nil
+}
+
+func TestSearchPathFromContext(t *testing.T) {
+	// run sends the sql and reads the responses up to ReadyForQuery, returning
+	// the values of the rows
+	run := func(t *testing.T, frontend *pgproto3.Frontend, sql string) (values []string) {
+		sendQuery(t, frontend, sql)
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			switch v := msg.(type) {
+			case *pgproto3.DataRow:
+				values = append(values, string(v.Values[0]))
+			case *pgproto3.ErrorResponse:
+				t.Fatal(v.Message)
+			case *pgproto3.ReadyForQuery:
+				return values
+			}
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		queryer := &searchPathQueryer{}
+		frontend, _ := connect(t, New(queryer).(*server))
+
+		run(t, frontend, "SELECT * FROM t")
+		require.Equal(t, [][]string{{"$user", "public"}}, queryer.paths)
+		require.Equal(t, []string{`"$user", public`}, run(t, frontend, "SHOW search_path"))
+	})
+
+	t.Run("set", func(t *testing.T) {
+		queryer := &searchPathQueryer{}
+		frontend, _ := connect(t, New(queryer).(*server))
+
+		run(t, frontend, "SET search_path = foo")
+		run(t, frontend, "SELECT * FROM t")
+		require.Equal(t, [][]string{{"foo"}}, queryer.paths)
+		require.Equal(t, []string{"foo"}, run(t, frontend, "SHOW search_path"))
+
+		// visible to the following statements of the same sql string
+		queryer.paths = nil
+		run(t, frontend, `SET search_path = "Tenant 1", public; SELECT * FROM t`)
+		require.Equal(t, [][]string{{"Tenant 1", "public"}}, queryer.paths)
+		require.Equal(t, []string{`"Tenant 1", public`}, run(t, frontend, "SHOW search_path"))
+
+		queryer.paths = nil
+		run(t, frontend, "RESET search_path")
+		run(t, frontend, "SELECT * FROM t")
+		require.Equal(t, [][]string{{"$user", "public"}}, queryer.paths)
+	})
+
+	t.Run("startup", func(t *testing.T) {
+		queryer := &searchPathQueryer{}
+		srv := New(queryer).(*server)
+		frontend, _ := connectWith(t, srv, map[string]string{"user": "postgres", "search_path": `Foo, "Bar"`})
+
+		run(t, frontend, "SELECT * FROM t")
+		require.Equal(t, [][]string{{"foo", "Bar"}}, queryer.paths)
+	})
+
+	t.Run("without a session", func(t *testing.T) {
+		_, ok := SearchPathFromContext(context.Background())
+		require.False(t, ok)
+	})
+}
+
+func TestParseSearchPath(t *testing.T) {
+	tests := []struct {
+		value string
+		path  []string
+	}{
+		{`"$user", public`, []string{"$user", "public"}},
+		{`foo`, []string{"foo"}},
+		{` Foo ,bar`, []string{"foo", "bar"}},
+		{`"a ""quoted"" name", b`, []string{`a "quoted" name`, "b"}},
+		{`""`, nil},
+		{``, nil},
+	}
+	for _, test := range tests {
+		path, err := parseSearchPath(test.value)
+		require.NoError(t, err, test.value)
+		require.Equal(t, test.path, path, test.value)
+	}
+
+	for _, value := range []string{`foo,`, `,foo`, `"foo`, `"foo" bar`} {
+		_, err := parseSearchPath(value)
+		require.Error(t, err, value)
+	}
+
+	require.Equal(t, `"$user", public, "Tenant 1", "a ""b"""`, formatSearchPath([]string{"$user", "public", "Tenant 1", `a "b"`}))
+	require.Equal(t, `""`, formatSearchPath([]string{""}))
+}
@@ -2,23 +2,27 @@ package pgsrv
 
 import (
 	"context"
-	"fmt"
+	"database/sql/driver"
 	"github.com/jackc/pgx/pgproto3"
 	"github.com/jackc/pgx/pgtype"
-	parser "github.com/lfittl/pg_query_go"
 	nodes "github.com/lfittl/pg_query_go/nodes"
 	"github.com/panoplyio/pgsrv/protocol"
 	"io"
+	"math"
 	"math/rand"
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var allSessions sync.Map
 
 type portal struct {
 	srcPreparedStatement string
-	parameters           [][]byte
+	parameters           []driver.Value // decoded by their types, see decodeParameters
+	resultFormats        []int16        // as sent by Bind, see resultFormats
 }
 
 // Session represents a single client-connection, and handles all of the
@@ -28,23 +32,71 @@ type portal struct {
 // for postgres protocol and startup handshake process
 type session struct {
 	Server       *server
+	listener     *listener // that accepted the connection, see AddListener
 	Conn         io.ReadWriteCloser
+	transport    *protocol.Transport
+	queryer      Queryer // the backend serving this session
+	encoding     *clientEncoding
 	ConnInfo     *pgtype.ConnInfo
 	Args         map[string]interface{}
-	Secret       int32 // used for cancelling requests
+	defaults     map[string]interface{} // startup values of Args, for RESET
+	Secret       int32                  // used for cancelling requests
+	pid          int32
 	Ctx          context.Context
 	CancelFunc   context.CancelFunc
 	initialized  bool
 	stmts        map[string]*nodes.PrepareStmt
 	pendingStmts map[string]*nodes.PrepareStmt
 	portals      map[string]*portal
+	cursors      map[string]*cursor // declared with DECLARE CURSOR
+	tx           *transactionMode   // the current transaction block, if any
+	aborted      bool               // the transaction block failed, see fail()
+	userData     interface{}
+	connected    bool // the OnConnect hook succeeded, see disconnect()
+	span         Span // of the entire session, see WithSpanTracer
+
+	// cancels the context of the current query, see CancelQuery
+	cancelMu    sync.Mutex
+	cancelQuery context.CancelFunc
+
+	// the activity of the session, see Server.Sessions()
+	activityMu sync.Mutex
+	user       string
+	database   string
+	appName    string
+	state      SessionState
+	query      string
+	queryStart time.Time
+
+	// terminated by the server, see terminate(). Guards the transport too.
+	terminated bool
+
+	// set atomically once the session is torn down, see unregister. writeMu
+	// is held across checking it and writing, see NoticeErr.
+	closed  int32
+	writeMu sync.Mutex
 }
 
 func (s *session) startUp() error {
+	// bound the entire startup phase, until the client is authenticated
+	if s.Server.authTimeout > 0 {
+		err := s.setReadDeadline(time.Now().Add(s.Server.authTimeout))
+		if err != nil {
+			return err
+		}
+	}
+
 	handshake := protocol.NewHandshake(s.Conn)
+	handshake.SetStrictFraming(s.Server.strictFraming)
+	handshake.SetTracer(s.Server.tracer)
+	if config := s.tlsConfig(); config != nil {
+		if bc, ok := s.Conn.(*bufferedConn); ok {
+			handshake.EnableTLS(func() error { return bc.startTLS(config) })
+		}
+	}
 	msg, err := handshake.Init()
 	if err != nil {
-		return err
+		return s.reportProtocolError(handshake, err)
 	}
 
 	if msg.IsCancel() {
@@ -54,11 +106,8 @@ func (s *session) startUp() error {
 		}
 
 		s, ok := allSessions.Load(pid)
-		if !ok || s == nil {
-			_, cancelFunc := context.WithCancel(context.Background())
-			cancelFunc()
-		} else if s.(*session).Secret == secret {
-			s.(*session).CancelFunc() // intentionally doesn't report success to frontend
+		if ok && s != nil && s.(*session).Secret == secret {
+			s.(*session).CancelQuery() // intentionally doesn't report success to frontend
 		}
 
 		return nil // disconnect.
@@ -66,49 +115,265 @@ func (s *session) startUp() error {
 
 	s.Args, err = msg.StartupArgs()
 	if err != nil {
+		return s.reportProtocolError(handshake, err)
+	}
+
+	// the authenticators rely on the user, like postgres does
+	if user, _ := s.Args["user"].(string); user == "" {
+		err = WithSeverity(InvalidAuthorizationSpecification("no PostgreSQL user name specified in startup packet"), fatalSeverity)
+		handshake.Write(protocol.ErrorResponse(fromErr(s.localize(err))))
 		return err
 	}
 
+	// newer minor versions and protocol extensions are negotiated before
+	// authenticating, compression only applies to buffered connections
+	compressor, unsupported := s.Server.negotiateExtensions(s.Args)
+	if _, ok := s.Conn.(*bufferedConn); !ok && compressor != nil {
+		compressor, unsupported = nil, append(unsupported, compressionParam)
+	}
+	if msg.StartupMinorVersion() > protocol.LatestMinorVersion || len(unsupported) > 0 {
+		err = handshake.Write(protocol.NegotiateProtocolVersion(protocol.LatestMinorVersion, unsupported))
+		if err != nil {
+			return err
+		}
+	}
+
+	s.defaults = map[string]interface{}{}
+	for k, v := range s.Args {
+		s.defaults[k] = v
+	}
+
+	// enforce the connection policy before authenticating
+	if s.Server.requireTLS {
+		err = s.requireTLS()
+		if err != nil {
+			err = WithSeverity(err, fatalSeverity)
+			handshake.Write(protocol.ErrorResponse(fromErr(s.localize(err))))
+			return err
+		}
+	}
+
+	if s.Server.startupValidator != nil {
+		err = s.Server.startupValidator(s.Args)
+		if err != nil {
+			e := *fromErr(err) // copy, to avoid modifying the validator's error
+			if e.C == "" {
+				e.C = "28000" // invalid_authorization_specification
+			}
+			err = WithSeverity(&e, fatalSeverity)
+			handshake.Write(protocol.ErrorResponse(fromErr(s.localize(err))))
+			return err
+		}
+	}
+
+	if s.Server.verifyCertUser {
+		err = s.verifyCertUser()
+		if err != nil {
+			err = WithSeverity(err, fatalSeverity)
+			handshake.Write(protocol.ErrorResponse(fromErr(s.localize(err))))
+			return err
+		}
+	}
+
 	// handle authentication
-	err = s.Server.authenticator.authenticate(handshake, s.Args)
+	auth := s.authenticator()
+	rw := &localizedReadWriter{handshake, s.localize, s.Server.logger}
+	switch a := auth.(type) {
+	case connAuthenticator:
+		err = a.authenticateConn(s.netConn(), rw, s.Args)
+	case channelAuthenticator:
+		err = a.authenticateChannel(s.tlsServerEndPoint(), rw, s.Args)
+	default:
+		err = auth.authenticate(rw, s.Args)
+	}
+	if isTimeout(err) {
+		err = WithSeverity(QueryCanceled("canceling authentication due to timeout"), fatalSeverity)
+		handshake.Write(protocol.ErrorResponse(fromErr(s.localize(err))))
+		return err
+	}
+	if err != nil {
+		return s.reportProtocolError(handshake, err)
+	}
+
+	// the authenticated user may not be permitted to use the database
+	err = s.authorize()
 	if err != nil {
+		handshake.Write(protocol.ErrorResponse(fromErr(s.localize(err))))
 		return err
 	}
 
-	err = handshake.Write(protocol.ParameterStatus("client_encoding", "utf8"))
+	if s.Server.authTimeout > 0 {
+		err = s.setReadDeadline(time.Time{})
+		if err != nil {
+			return err
+		}
+	}
+
+	// bind the session to the backend serving the requested database
+	s.queryer = s.Server.queryer
+	if s.Server.router != nil {
+		database, _ := s.Args["database"].(string)
+		s.queryer = s.Server.router(database)
+		if s.queryer == nil {
+			err = WithSeverity(InvalidCatalogName(database), fatalSeverity)
+			handshake.Write(protocol.ErrorResponse(fromErr(s.localize(err))))
+			return err
+		}
+	}
+
+	// transcode the text exchanged with the client to the requested encoding
+	if name, ok := s.Args["client_encoding"].(string); ok {
+		s.encoding, err = newClientEncoding(name)
+		if err != nil {
+			err = WithSeverity(err, fatalSeverity)
+			handshake.Write(protocol.ErrorResponse(fromErr(s.localize(err))))
+			return err
+		}
+	}
+
+	err = s.initDateStyle()
 	if err != nil {
+		err = WithSeverity(err, fatalSeverity)
+		handshake.Write(protocol.ErrorResponse(fromErr(s.localize(err))))
 		return err
 	}
 
-	// generate cancellation pid and secret for this session
-	s.Secret = rand.Int31()
+	appName, _ := s.Args["application_name"].(string)
+	version := s.Server.version()
+	params := [][2]string{
+		{"application_name", appName},
+		{"client_encoding", s.encoding.Name()},
+		{"DateStyle", s.dateStyle().String()},
+		{"integer_datetimes", "on"},
+		{"server_version", version},
+		{"server_version_num", serverVersionNum(version)},
+	}
+	params = append(params, s.Server.extraParameterStatus(params)...)
+	for _, param := range params {
+		err = handshake.Write(protocol.ParameterStatus(param[0], param[1]))
+		if err != nil {
+			return err
+		}
+	}
 
-	pid := rand.Int31()
-	for s1, ok := allSessions.Load(pid); ok && s1 != nil; pid++ {
-		s1, ok = allSessions.Load(pid)
+	// acknowledge the compression, which applies to all of the messages that
+	// follow it
+	if compressor != nil {
+		err = handshake.Write(protocol.ParameterStatus(compressionParam, compressor.Name()))
+		if err != nil {
+			return err
+		}
+		err = s.Conn.(*bufferedConn).compress(compressor)
+		if err != nil {
+			return err
+		}
 	}
 
-	allSessions.Store(pid, s)
-	defer allSessions.Delete(pid)
+	// generate cancellation pid and secret for this session
+	pid, secret := newCancelKey()
+	s.Secret = secret
+	s.user, _ = s.Args["user"].(string)
+	s.database, _ = s.Args["database"].(string)
+	s.appName = appName
+
+	// the session remains registered until it ends, see unregister(). Taken
+	// pids are skipped atomically, since sessions start up concurrently, and
+	// they wrap around to remain positive, like postgres pids.
+	for {
+		s.pid = pid
+		if _, taken := allSessions.LoadOrStore(pid, s); !taken {
+			break
+		}
+		if pid == math.MaxInt32 {
+			pid = 0
+		}
+		pid++
+	}
 
 	// notify the client of the pid and secret to be passed back when it wishes
 	// to interrupt this session
-	s.Ctx, s.CancelFunc = context.WithCancel(context.Background())
-	err = handshake.Write(protocol.BackendKeyData(pid, s.Secret))
+	s.Ctx, s.CancelFunc = context.WithCancel(s.startSessionSpan(s.baseContext()))
+	err = handshake.Write(protocol.BackendKeyData(s.pid, s.Secret))
 	if err != nil {
 		return err
 	}
 
-	s.ConnInfo = pgtype.NewConnInfo()
+	s.ConnInfo = newConnInfo()
+
+	// allow the embedder to prepare for serving the session
+	if s.Server.onConnect != nil {
+		err = s.Server.onConnect(s)
+		if err != nil {
+			err = WithSeverity(err, fatalSeverity)
+			handshake.Write(protocol.ErrorResponse(fromErr(s.localize(err))))
+			return err
+		}
+	}
+	s.connected = true
+	return nil
+}
+
+// newCancelKey generates the pid and secret of a session, which the client
+// passes back in a CancelRequest. It's replaced in tests that expect the exact
+// messages of the startup.
+var newCancelKey = func() (pid, secret int32) {
+	return rand.Int31n(math.MaxInt32) + 1, rand.Int31()
+}
+
+// newConnInfo creates a ConnInfo with all of the supported data types
+// registered (see protocol.TypesOid)
+func newConnInfo() *pgtype.ConnInfo {
+	ci := pgtype.NewConnInfo()
 	for k, v := range protocol.TypesOid {
-		s.ConnInfo.RegisterDataType(pgtype.DataType{Name: strings.ToLower(k), OID: pgtype.OID(v), Value: &pgtype.GenericText{}})
+		if k == "TIMESTAMPZ" {
+			continue // the misspelled alias of TIMESTAMPTZ
+		}
+		ci.RegisterDataType(pgtype.DataType{Name: strings.ToLower(k), OID: pgtype.OID(v), Value: &pgtype.GenericText{}})
 	}
+	return ci
+}
 
-	return nil
+// disconnect calls the OnDisconnect hook when the session ends, if it was
+// successfully connected
+func (s *session) disconnect() {
+	if !s.connected || s.Server.onDisconnect == nil {
+		return
+	}
+	s.connected = false
+	s.Server.onDisconnect(s)
+}
+
+// unregister removes the session from the registry of all sessions, making
+// its pid available to other sessions.
+func (s *session) unregister() {
+	s.writeMu.Lock()
+	atomic.StoreInt32(&s.closed, 1)
+	s.writeMu.Unlock()
+
+	s1, ok := allSessions.Load(s.pid)
+	if ok && s1 == s {
+		allSessions.Delete(s.pid)
+	}
+	s.Server.broker.unlistenAll(s)
+
+	// drop the prepared statements, portals and cursors of the session
+	s.stmts = nil
+	s.pendingStmts = nil
+	s.portals = nil
+	s.closeCursors(func(*cursor) bool { return true })
+
+	// the session's context ends with it, along with its queries
+	if s.CancelFunc != nil {
+		s.CancelFunc()
+	}
+	s.endSessionSpan()
 }
 
 // Handle a connection session
 func (s *session) Serve() error {
+	defer s.unregister()
+	defer s.disconnect()
+
 	err := s.startUp()
 	if err != nil {
 		return err
@@ -118,19 +383,43 @@ func (s *session) Serve() error {
 	s.pendingStmts = map[string]*nodes.PrepareStmt{}
 	s.portals = map[string]*portal{}
 	t := protocol.NewTransport(s.Conn)
+	t.SetTracer(s.Server.tracer)
+	t.SetStrictFraming(s.Server.strictFraming)
+	t.SetTransactionStatus(s.transactionStatus)
+	t.SetErrorResponse(func(e error) protocol.Message {
+		return s.encoding.errorResponse(s.localize(e))
+	})
+	s.activityMu.Lock()
+	s.transport = t
+	s.activityMu.Unlock()
+
+	bc, _ := s.Conn.(*bufferedConn)
+	if bc != nil {
+		bc.setTimeouts(s.Server.readTimeout, s.Server.writeTimeout, s.Server.slowClient)
+	}
 
 	// query-cycle
 	for {
+		if bc != nil {
+			bc.awaitMessage()
+		}
 		msg, ts, err := t.NextFrontendMessage()
 		if err != nil {
 			return err
 		}
 
 		s.handleTransactionState(ts)
+		s.activate(msg)
 		err = s.handleFrontendMessage(t, msg)
+		s.deactivate()
 		if err != nil {
 			return err
 		}
+
+		// the client disconnected gracefully
+		if _, ok := msg.(*pgproto3.Terminate); ok {
+			return nil
+		}
 	}
 }
 
@@ -141,22 +430,39 @@ func (s *session) handleFrontendMessage(t *protocol.Transport, msg pgproto3.Fron
 		s.Conn.Close()
 		return nil // client terminated intentionally
 	case *pgproto3.Query:
-		q := &query{
-			transport: t,
-			sql:       v.String,
-			queryer:   s.Server,
-			execer:    s.Server,
+		var sql string
+		err = s.checkQueryLength(v.String)
+		if err == nil {
+			sql, err = s.encoding.decode(v.String)
 		}
-		err = q.Run(s)
+		if err != nil {
+			res = append(res, s.errorResponse(err))
+			break
+		}
+
+		q := s.newQuery(t, sql)
+		ctx, done := s.queryContext()
+		unwatch := s.watchQuery(done)
+		err = q.Run(ctx, s)
+		unwatch()
+		done()
 	case *pgproto3.Describe:
 		res, err = s.describe(v)
 	case *pgproto3.Parse:
 		res, err = s.prepare(v)
 	case *pgproto3.Bind:
 		res, err = s.bind(v)
+	case *pgproto3.Execute:
+		err = s.execute(t, v)
+	case *pgproto3.Close:
+		res, err = s.close(v)
+	case *protocol.FunctionCall:
+		err = s.functionCall(t, v)
 	case *pgproto3.Sync:
+	case *pgproto3.Flush:
+		err = t.Flush()
 	default:
-		res = append(res, protocol.ErrorResponse(Unsupported("message type")))
+		res = append(res, s.errorResponse(Unsupported("message type")))
 	}
 	for _, m := range res {
 		err = t.Write(m)
@@ -167,6 +473,36 @@ func (s *session) handleFrontendMessage(t *protocol.Transport, msg pgproto3.Fron
 	return
 }
 
+// newQuery creates the query of the sql, executed by the session with the
+// settings of its server
+func (s *session) newQuery(t *protocol.Transport, sql string) *query {
+	return &query{
+		transport:    t,
+		sql:          sql,
+		parser:       s.Server.parser,
+		raw:          s.rawQueryer(),
+		queryer:      s,
+		execer:       s,
+		executor:     s.executor(),
+		copier:       s.copyHandler(),
+		logger:       s.Server.logger,
+		errorMapper:  s.Server.errorMapper,
+		localize:     s.localize,
+		failed:       s.fail,
+		encoding:     s.encoding,
+		middlewares:  s.Server.middlewares,
+		rewriter:     s.Server.rewriter,
+		parseNotice:  s.Server.parseNotice,
+		spanTracer:   s.Server.spanTracer,
+		redactSQL:    s.Server.redactSQL,
+		readOnly:     s.Server.readOnly,
+		queryTimeout: s.Server.queryTimeout,
+		maxRows:      s.Server.maxResultRows,
+		batchSize:    s.Server.streamBatchSize,
+		strictRows:   s.Server.strictResultRows,
+	}
+}
+
 func (s *session) handleTransactionState(state protocol.TransactionState) {
 	switch state {
 	case protocol.InTransaction, protocol.NotInTransaction:
@@ -184,30 +520,53 @@ func (s *session) handleTransactionState(state protocol.TransactionState) {
 }
 
 func (s *session) prepare(parseMsg *pgproto3.Parse) (res []protocol.Message, err error) {
-	var tree parser.ParsetreeList
-	tree, err = parser.Parse(parseMsg.Query)
+	err = s.checkQueryLength(parseMsg.Query)
 	if err != nil {
-		res = append(res, protocol.ErrorResponse(SyntaxError(err.Error())))
+		res = append(res, s.errorResponse(err))
+		return res, nil
+	}
+
+	sql, err := s.encoding.decode(parseMsg.Query)
+	if err != nil {
+		res = append(res, s.errorResponse(err))
+		return res, nil
+	}
+
+	stmts, err := s.Server.parse(sql)
+	if err != nil {
+		res = append(res, s.errorResponse(SyntaxError(err.Error())))
 		return
 	}
 
+	// a statement of no query, like "" or ";", is answered with an
+	// EmptyQueryResponse once it's executed (see execute), while multiple
+	// statements can't be prepared together, like in postgres
+	var stmt nodes.Node
+	switch len(stmts) {
+	case 0:
+	case 1:
+		stmt = stmts[0].Node
+	default:
+		res = append(res, s.errorResponse(SyntaxError("cannot insert multiple commands into a prepared statement")))
+		return res, nil
+	}
+
+	// clients may leave some or all of the parameter types unspecified
+	oids, err := s.parameterTypes(stmt, parseMsg.ParameterOIDs)
+	if err != nil {
+		res = append(res, s.errorResponse(err))
+		return res, nil
+	}
+
 	ps := nodes.PrepareStmt{
-		Query:    tree.Statements[0],
-		Argtypes: nodes.List{Items: make([]nodes.Node, len(parseMsg.ParameterOIDs))},
+		Query:    stmt,
+		Argtypes: nodes.List{Items: make([]nodes.Node, len(oids))},
 	}
-	for i, p := range parseMsg.ParameterOIDs {
-		dt, ok := s.ConnInfo.DataTypeForOID(pgtype.OID(p))
-		if !ok {
-			res = append(res, protocol.ErrorResponse(fmt.Errorf("cache lookup failed for type %d", p)))
-			return
-		}
-		ps.Argtypes.Items[i] = nodes.TypeName{
-			TypeOid: nodes.Oid(p),
-			Names: nodes.List{
-				Items: []nodes.Node{
-					nodes.String{Str: dt.Name},
-				},
-			},
+	for i, p := range oids {
+		ps.Argtypes.Items[i], err = s.typeNameForOID(p)
+		if err != nil {
+			res = append(res, s.errorResponse(err))
+			return res, nil
 		}
 	}
 
@@ -216,11 +575,105 @@ func (s *session) prepare(parseMsg *pgproto3.Parse) (res []protocol.Message, err
 	} else {
 		ps.Name = &parseMsg.Name
 	}
+	err = s.checkStatementsLimit(parseMsg.Name)
+	if err != nil {
+		res = append(res, s.errorResponse(err))
+		return res, nil
+	}
 	s.storePreparedStatement(&ps)
 	res = append(res, protocol.ParseComplete)
 	return
 }
 
+// rawQueryer returns the backend of the session in raw sql mode, if it's able
+// to execute raw sql (see WithRawSQLMode)
+func (s *session) rawQueryer() RawQueryer {
+	if !s.Server.rawSQL {
+		return nil
+	}
+	raw, _ := s.queryer.(RawQueryer)
+	return raw
+}
+
+// executor returns the backend's Executor, if it implements it
+func (s *session) executor() Executor {
+	executor, _ := s.queryer.(Executor)
+	return executor
+}
+
+// copyHandler returns the backend's CopyHandler, if it implements it
+func (s *session) copyHandler() CopyHandler {
+	copier, _ := s.queryer.(CopyHandler)
+	return copier
+}
+
+// checkQueryLength rejects queries longer than the configured maximum, before
+// they're parsed (see WithMaxQueryLength)
+func (s *session) checkQueryLength(sql string) error {
+	max := s.Server.maxQueryLength
+	if max > 0 && len(sql) > max {
+		return ProgramLimitExceeded("query string is too long (%d bytes, maximum is %d)", len(sql), max)
+	}
+	return nil
+}
+
+// checkStatementsLimit rejects a new named prepared statement once the session
+// has the maximum number of them (see WithMaxPreparedStatements). Replacing an
+// existing statement, or the unnamed one, isn't limited.
+func (s *session) checkStatementsLimit(name string) error {
+	if name == "" {
+		return nil
+	}
+	max := s.Server.maxPreparedStmts
+	if max <= 0 {
+		return nil
+	}
+	if _, exists := s.preparedStatement(name); exists {
+		return nil
+	}
+
+	count := 0
+	for k := range s.stmts {
+		if _, pending := s.pendingStmts[k]; !pending && k != "" {
+			count++
+		}
+	}
+	for k := range s.pendingStmts {
+		if k != "" {
+			count++
+		}
+	}
+	if count >= max {
+		return ProgramLimitExceeded("too many prepared statements (maximum is %d)", max)
+	}
+	return nil
+}
+
+// checkPortalsLimit rejects a new named portal once the session has the
+// maximum number of them (see WithMaxPortals). Replacing an existing portal, or
+// the unnamed one, isn't limited.
+func (s *session) checkPortalsLimit(name string) error {
+	if name == "" {
+		return nil
+	}
+	max := s.Server.maxPortals
+	if max <= 0 {
+		return nil
+	}
+	if _, exists := s.portals[name]; exists {
+		return nil
+	}
+
+	count := len(s.portals)
+	if _, exists := s.portals[""]; exists {
+		count--
+	}
+	if count >= max {
+		return ProgramLimitExceeded("too many portals (maximum is %d)", max)
+	}
+	return nil
+}
+
 func (s *session) storePreparedStatement(ps *nodes.PrepareStmt) {
 	name := ""
 	if ps.Name != nil {
@@ -229,11 +682,21 @@ func (s *session) storePreparedStatement(ps *nodes.PrepareStmt) {
 	s.pendingStmts[name] = ps
 }
 
+// preparedStatement returns the named prepared statement, including the ones
+// parsed earlier in the current extended query, which are pending until Sync
+func (s *session) preparedStatement(name string) (*nodes.PrepareStmt, bool) {
+	if ps, ok := s.pendingStmts[name]; ok {
+		return ps, true
+	}
+	ps, ok := s.stmts[name]
+	return ps, ok
+}
+
 func (s *session) describe(describeMsg *pgproto3.Describe) (res []protocol.Message, err error) {
 	switch describeMsg.ObjectType {
 	case protocol.DescribeStatement:
-		if ps, ok := s.stmts[describeMsg.Name]; !ok {
-			res = append(res, protocol.ErrorResponse(InvalidSQLStatementName(describeMsg.Name)))
+		if ps, ok := s.preparedStatement(describeMsg.Name); !ok {
+			res = append(res, s.errorResponse(InvalidSQLStatementName(describeMsg.Name)))
 		} else {
 			var msg protocol.Message
 			msg, err = protocol.ParameterDescription(ps)
@@ -241,31 +704,369 @@ func (s *session) describe(describeMsg *pgproto3.Describe) (res []protocol.Messa
 				return
 			}
 			res = append(res, msg)
-			// TODO: add a RowDescription message. this will require access to the backend
+
+			// the parameters aren't bound yet, so they're described as NULL
+			var stmt nodes.Node
+			if ps.Query != nil {
+				params := make([]driver.Value, len(ps.Argtypes.Items))
+				stmt, err = bindParams(ps, parameterNodes(params))
+			}
+			if err == nil {
+				msg, err = s.describeResult(stmt, nil)
+			}
+			if err != nil {
+				return []protocol.Message{s.errorResponse(err)}, nil
+			}
+			res = append(res, msg)
 		}
 	case protocol.DescribePortal:
-		err = Unsupported("object type '%c'", describeMsg.ObjectType)
+		msg, err := s.describePortal(describeMsg.Name)
+		if err != nil {
+			msg = s.errorResponse(err)
+		}
+		res = append(res, msg)
 	default:
-		err = ProtocolViolation(fmt.Sprintf("invalid DESCRIBE message subtype '%c'", describeMsg.ObjectType))
+		err = ProtocolViolation("invalid DESCRIBE message subtype '%c'", describeMsg.ObjectType)
 	}
 	return
 }
 
+// describePortal returns the RowDescription of the rows of the portal, in the
+// result formats requested by Bind, or NoData when it returns no rows
+func (s *session) describePortal(name string) (protocol.Message, error) {
+	p, ok := s.portals[name]
+	if !ok {
+		return nil, missingPortal(name)
+	}
+
+	ps, ok := s.preparedStatement(p.srcPreparedStatement)
+	if !ok {
+		return nil, InvalidSQLStatementName(p.srcPreparedStatement)
+	}
+	if ps.Query == nil {
+		return protocol.NoData, nil
+	}
+	stmt, err := bindParams(ps, parameterNodes(p.parameters))
+	if err != nil {
+		return nil, err
+	}
+	return s.describeResult(stmt, p.resultFormats)
+}
+
 func (s *session) bind(bindMsg *pgproto3.Bind) (res []protocol.Message, err error) {
-	_, exist := s.stmts[bindMsg.PreparedStatement]
+	ps, exist := s.preparedStatement(bindMsg.PreparedStatement)
 	if !exist {
-		res = append(res, protocol.ErrorResponse(InvalidSQLStatementName(bindMsg.PreparedStatement)))
+		msg := "prepared statement \"%s\" does not exist"
+		res = append(res, s.errorResponse(ProtocolViolation(msg, bindMsg.PreparedStatement)))
 		return
 	}
+
+	params, err := decodeParameters(s.argTypeOIDs(ps), bindMsg.ParameterFormatCodes, bindMsg.Parameters)
+	if err == nil {
+		err = checkResultFormats(bindMsg.ResultFormatCodes)
+	}
+	if err != nil {
+		res = append(res, s.errorResponse(err))
+		return res, nil
+	}
+
+	err = s.checkPortalsLimit(bindMsg.DestinationPortal)
+	if err != nil {
+		res = append(res, s.errorResponse(err))
+		return res, nil
+	}
+
 	s.portals[bindMsg.DestinationPortal] = &portal{
 		srcPreparedStatement: bindMsg.PreparedStatement,
-		parameters:           bindMsg.Parameters,
+		parameters:           params,
+		resultFormats:        bindMsg.ResultFormatCodes,
 	}
 	res = append(res, protocol.BindComplete)
 	return
 }
 
+// execute runs the statement of a portal created by Bind, with its parameters
+// bound, and sends its rows in the result formats requested by Bind. A missing
+// portal is reported as a protocol violation, since the client sent the
+// Execute out of order. The row limit of the Execute isn't supported, so the
+// portal always runs to completion.
+func (s *session) execute(t *protocol.Transport, executeMsg *pgproto3.Execute) error {
+	p, ok := s.portals[executeMsg.Portal]
+	if !ok {
+		return t.Write(s.errorResponse(missingPortal(executeMsg.Portal)))
+	}
+
+	// portals aren't suspended, so all of their rows are sent at once, which
+	// a client that limits them doesn't expect
+	if executeMsg.MaxRows > 0 {
+		return t.Write(s.errorResponse(Unsupported("row limit of Execute")))
+	}
+
+	// the statement may have been closed since the portal was bound
+	ps, ok := s.preparedStatement(p.srcPreparedStatement)
+	if !ok {
+		return t.Write(s.errorResponse(InvalidSQLStatementName(p.srcPreparedStatement)))
+	}
+	if ps.Query == nil {
+		return t.Write(protocol.EmptyQueryResponse)
+	}
+	stmt, err := bindParams(ps, parameterNodes(p.parameters))
+	if err != nil {
+		return t.Write(s.errorResponse(err))
+	}
+
+	q := s.newQuery(t, "")
+	q.portal = p
+	ctx, done := s.queryContext()
+	unwatch := s.watchQuery(done)
+	err = q.runPortal(ctx, s, Statement{Kind: statementKind(stmt), Node: stmt})
+	unwatch()
+	done()
+	return err
+}
+
+// missingPortal is the error of a message referencing a portal that wasn't
+// created by Bind
+func missingPortal(name string) error {
+	return ProtocolViolation("portal \"%s\" does not exist", name)
+}
+
+// close drops a prepared statement or portal. Closing one that doesn't exist,
+// including the unnamed ones, isn't an error.
+func (s *session) close(closeMsg *pgproto3.Close) (res []protocol.Message, err error) {
+	switch closeMsg.ObjectType {
+	case protocol.CloseStatement:
+		delete(s.stmts, closeMsg.Name)
+		delete(s.pendingStmts, closeMsg.Name)
+	case protocol.ClosePortal:
+		delete(s.portals, closeMsg.Name)
+	default:
+		err = ProtocolViolation("invalid CLOSE message subtype '%c'", closeMsg.ObjectType)
+		return
+	}
+	res = append(res, protocol.CloseComplete)
+	return
+}
+
+// implements Queryer
+func (s *session) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	if sq, ok := s.queryer.(StreamQueryer); ok {
+		stream, err := sq.QueryStream(ctx, n)
+		if err != nil {
+			return nil, err
+		}
+		return StreamRows(ctx, stream), nil
+	}
+	return s.queryer.Query(ctx, n)
+}
+
+// implements Execer
+func (s *session) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
+	execer, ok := s.queryer.(Execer)
+	if !ok {
+		return nil, Unsupported("commands execution. Read-only mode.")
+	}
+
+	return execer.Exec(ctx, n)
+}
+
 func (s *session) Set(k string, v interface{}) { s.Args[k] = v }
 func (s *session) Get(k string) interface{}    { return s.Args[k] }
 func (s *session) Del(k string)                { delete(s.Args, k) }
 func (s *session) All() map[string]interface{} { return s.Args }
+func (s *session) PID() int32                  { return s.pid }
+func (s *session) UserData() interface{}       { return s.userData }
+func (s *session) SetUserData(v interface{})   { s.userData = v }
+
+// CancelQuery implements Session
+func (s *session) CancelQuery() {
+	s.cancelMu.Lock()
+	defer s.cancelMu.Unlock()
+	if s.cancelQuery != nil {
+		s.cancelQuery()
+	}
+}
+
+// baseContext returns the root context of the session, see WithBaseContext
+func (s *session) baseContext() context.Context {
+	if s.Server.baseContext != nil {
+		if ctx := s.Server.baseContext(s.netConn()); ctx != nil {
+			return ctx
+		}
+	}
+	return context.Background()
+}
+
+// queryContext returns the context of a new query, derived from the session's
+// context, which is canceled by CancelQuery until the returned function is
+// called once it's complete
+func (s *session) queryContext() (context.Context, func()) {
+	parent := s.Ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	s.cancelMu.Lock()
+	s.cancelQuery = cancel
+	s.cancelMu.Unlock()
+
+	return ctx, func() {
+		s.cancelMu.Lock()
+		s.cancelQuery = nil
+		s.cancelMu.Unlock()
+		cancel()
+	}
+}
+
+func (s *session) Notice(severity, code, message string) {
+	// failing to write indicates a broken connection, which is reported by
+	// the query that follows
+	s.NoticeErr(severity, code, message)
+}
+
+func (s *session) NoticeErr(severity, code, message string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.isClosed() {
+		return ErrSessionClosed
+	}
+
+	notice := s.encoding.encodeErr(noticeError(severity, code, message))
+	return s.transport.Write(protocol.NoticeResponse(notice))
+}
+
+// noticeError returns the error sent in the NoticeResponse of a notice
+func noticeError(severity, code, message string) Err {
+	if code == "" && severity == SeverityWarning {
+		code = "01000" // warning
+	}
+	return &err{S: severity, C: code, M: message, P: -1}
+}
+
+func (s *session) Notify(channel, payload string) error {
+	if s.isClosed() {
+		return ErrSessionClosed
+	}
+	return s.Server.broker.notify(s.pid, channel, payload)
+}
+
+// isClosed returns whether the session was torn down, see ErrSessionClosed
+func (s *session) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+// watchQuery cancels the running query once the client is too slow to read its
+// results, see WithSlowClientTimeout, until the returned function is called
+func (s *session) watchQuery(cancel context.CancelFunc) func() {
+	bc, ok := s.Conn.(*bufferedConn)
+	if !ok {
+		return func() {}
+	}
+	return bc.watchQuery(cancel)
+}
+
+// netConn returns the client connection underlying the buffering, if any
+func (s *session) netConn() net.Conn {
+	switch conn := s.Conn.(type) {
+	case *bufferedConn:
+		return conn.Conn
+	case net.Conn:
+		return conn
+	}
+	return nil
+}
+
+// reportProtocolError sends the error to the client if it's due to a malformed
+// message during the startup, and returns it
+func (s *session) reportProtocolError(handshake *protocol.Handshake, err error) error {
+	if pe, ok := err.(*protocol.ProtocolError); ok {
+		handshake.Write(protocol.ErrorResponse(fromErr(s.localize(pe))))
+	}
+	return err
+}
+
+// localize returns a copy of the error generated by the server with its message
+// translated to the lc_messages of the session, see WithMessageLocalizer. The
+// rest of the errors are returned as is.
+func (s *session) localize(e error) error {
+	if s.Server == nil {
+		return e
+	}
+	locale, _ := s.Args["lc_messages"].(string)
+	return s.Server.localize(e, locale)
+}
+
+// localize returns a copy of the error generated by the server with its message
+// translated to the locale, see session.localize
+func (srv *server) localize(e error, locale string) error {
+	if srv.localizer == nil {
+		return e
+	}
+	res, ok := e.(*err)
+	if !ok {
+		res, ok = protocolViolation(e)
+	}
+	if !ok || res.f == "" {
+		return e
+	}
+
+	code := res.C
+	if code == "" {
+		code = "XX000" // internal_error, like it's reported
+	}
+	msg := srv.localizer(locale, code, res.f, res.args...)
+	if msg == "" {
+		return e
+	}
+
+	localized := *res
+	localized.M = msg
+	return &localized
+}
+
+// protocolViolation converts the protocol violations detected by the protocol
+// package, like malformed messages, for localizing them by their text
+func protocolViolation(e error) (*err, bool) {
+	coder, ok := e.(interface {
+		Code() string
+	})
+	if !ok || coder.Code() != "08P01" {
+		return nil, false
+	}
+	res := fromErr(e)
+	res.f = res.M
+	return res, true
+}
+
+// errorResponse creates the ErrorResponse of the error, localized and converted
+// to the client encoding
+func (s *session) errorResponse(e error) protocol.Message {
+	s.fail()
+	return s.encoding.errorResponse(s.localize(e))
+}
+
+// setReadDeadline sets the deadline for reading from the client connection,
+// if it supports deadlines. A zero value clears the deadline.
+func (s *session) setReadDeadline(t time.Time) error {
+	conn := s.netConn()
+	if conn == nil {
+		return nil
+	}
+	return conn.SetReadDeadline(t)
+}
+
+// isTimeout reports whether the error is due to an expired deadline
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func (s *session) RemoteAddr() net.Addr {
+	conn, ok := s.Conn.(interface {
+		RemoteAddr() net.Addr
+	})
+	if !ok {
+		return nil
+	}
+	return conn.RemoteAddr()
+}
@@ -14,9 +14,13 @@ import (
 	"github.com/panoplyio/pgsrv/protocol"
 	"github.com/stretchr/testify/require"
 	"io"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -205,7 +209,7 @@ func TestSession_handleTransactionState(t *testing.T) {
 func TestSession_prepare(t *testing.T) {
 	t.Run("parses and stores statements", func(t *testing.T) {
 		query := "SELECT 1"
-		sess := &session{pendingStmts: map[string]*nodes.PrepareStmt{}}
+		sess := &session{Server: &server{}, pendingStmts: map[string]*nodes.PrepareStmt{}}
 		msgs, err := sess.prepare(&pgproto3.Parse{
 			Name:  testStmtName,
 			Query: query,
@@ -217,7 +221,7 @@ func TestSession_prepare(t *testing.T) {
 	})
 	t.Run("parses and stores statements with parameters", func(t *testing.T) {
 		query := "SELECT $1"
-		sess := &session{pendingStmts: map[string]*nodes.PrepareStmt{}}
+		sess := &session{Server: &server{}, pendingStmts: map[string]*nodes.PrepareStmt{}}
 		sess.ConnInfo = pgtype.NewConnInfo()
 		sess.ConnInfo.RegisterDataType(pgtype.DataType{Name: "test", OID: pgtype.OID(333), Value: &pgtype.GenericText{}})
 		msgs, err := sess.prepare(&pgproto3.Parse{
@@ -235,7 +239,7 @@ func TestSession_prepare(t *testing.T) {
 	t.Run("fails to parse invalid statements", func(t *testing.T) {
 		testStmtName := "test"
 		query := "invalid"
-		sess := &session{pendingStmts: map[string]*nodes.PrepareStmt{}}
+		sess := &session{Server: &server{}, pendingStmts: map[string]*nodes.PrepareStmt{}}
 		msgs, err := sess.prepare(&pgproto3.Parse{
 			Name:  testStmtName,
 			Query: query,
@@ -249,6 +253,52 @@ func TestSession_prepare(t *testing.T) {
 		require.Equal(t, "syntax error at or near \"invalid\"", errorRes.Message[0:33])
 		require.Nil(t, sess.pendingStmts[testStmtName])
 	})
+	t.Run("rejects statements that are too long", func(t *testing.T) {
+		sess := &session{Server: &server{maxQueryLength: 8}, pendingStmts: map[string]*nodes.PrepareStmt{}}
+		msgs, err := sess.prepare(&pgproto3.Parse{Name: testStmtName, Query: "SELECT 12"})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		errorRes, err := msgs[0].ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "54000", errorRes.Code)
+		require.Nil(t, sess.pendingStmts[testStmtName])
+	})
+	t.Run("empty statements", func(t *testing.T) {
+		for _, query := range []string{"", ";"} {
+			sess := &session{Server: &server{}, pendingStmts: map[string]*nodes.PrepareStmt{}}
+			msgs, err := sess.prepare(&pgproto3.Parse{Name: testStmtName, Query: query})
+			require.NoError(t, err)
+			require.Equal(t, []protocol.Message{protocol.ParseComplete}, msgs)
+			require.NotNil(t, sess.pendingStmts[testStmtName])
+			require.Nil(t, sess.pendingStmts[testStmtName].Query)
+		}
+
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+		frontend, _ := connect(t, srv)
+		for _, msg := range []pgproto3.FrontendMessage{
+			&pgproto3.Parse{Query: ";"},
+			&pgproto3.Bind{},
+			&pgproto3.Execute{},
+			&pgproto3.Sync{},
+		} {
+			require.NoError(t, frontend.Send(msg))
+		}
+		receive(t, frontend, &pgproto3.ParseComplete{})
+		receive(t, frontend, &pgproto3.BindComplete{})
+		receive(t, frontend, &pgproto3.EmptyQueryResponse{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+	t.Run("rejects multiple statements", func(t *testing.T) {
+		sess := &session{Server: &server{}, pendingStmts: map[string]*nodes.PrepareStmt{}}
+		msgs, err := sess.prepare(&pgproto3.Parse{Name: testStmtName, Query: "select 1; select 2"})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		errorRes, err := msgs[0].ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "42601", errorRes.Code)
+		require.Equal(t, "cannot insert multiple commands into a prepared statement", errorRes.Message)
+		require.Nil(t, sess.pendingStmts[testStmtName])
+	})
 }
 
 func TestSession_bind(t *testing.T) {
@@ -286,7 +336,7 @@ func TestSession_bind(t *testing.T) {
 		require.True(t, msgs[0].IsError())
 		errorRes, err := msgs[0].ErrorResponse()
 		require.NoError(t, err)
-		require.Equal(t, "26000", errorRes.Code)
+		require.Equal(t, "08P01", errorRes.Code)
 		require.Equal(t, "prepared statement \"other\" does not exist", errorRes.Message[0:41])
 		require.Len(t, sess.portals, 0)
 	})
@@ -319,12 +369,15 @@ func TestSession_describe(t *testing.T) {
 			Name:       testStmtName,
 		})
 		require.NoError(t, err)
-		require.Len(t, msgs, 1)
+		require.Len(t, msgs, 2)
 		msg := pgproto3.ParameterDescription{}
 		err = msg.Decode(msgs[0][5:])
 		require.NoError(t, err)
 		require.Len(t, msg.ParameterOIDs, 1)
 		require.Equal(t, uint32(16), msg.ParameterOIDs[0])
+
+		// the statement isn't a query, so it returns no rows
+		require.Equal(t, protocol.Message(protocol.NoData), msgs[1])
 	})
 }
 
@@ -407,6 +460,461 @@ func filterStartupMessages(msg pgproto3.BackendMessage) bool {
 
 const TestDataFolder = "testdata"
 
+func TestSession_close(t *testing.T) {
+	newSession := func() *session {
+		other := "other"
+		return &session{
+			stmts: map[string]*nodes.PrepareStmt{
+				testStmtName: {Name: &testStmtName},
+				"":           {},
+			},
+			pendingStmts: map[string]*nodes.PrepareStmt{other: {Name: &other}},
+			portals:      map[string]*portal{"": {}, "portal": {}},
+		}
+	}
+
+	tests := map[string]struct {
+		msg     *pgproto3.Close
+		stmts   []string
+		pending []string
+		portals []string
+	}{
+		"named statement": {
+			msg:     &pgproto3.Close{ObjectType: 'S', Name: testStmtName},
+			stmts:   []string{""},
+			pending: []string{"other"},
+			portals: []string{"", "portal"},
+		},
+		"pending statement": {
+			msg:     &pgproto3.Close{ObjectType: 'S', Name: "other"},
+			stmts:   []string{"", testStmtName},
+			portals: []string{"", "portal"},
+		},
+		"unnamed statement": {
+			msg:     &pgproto3.Close{ObjectType: 'S'},
+			stmts:   []string{testStmtName},
+			pending: []string{"other"},
+			portals: []string{"", "portal"},
+		},
+		"nonexistent statement": {
+			msg:     &pgproto3.Close{ObjectType: 'S', Name: "nonexistent"},
+			stmts:   []string{"", testStmtName},
+			pending: []string{"other"},
+			portals: []string{"", "portal"},
+		},
+		"named portal": {
+			msg:     &pgproto3.Close{ObjectType: 'P', Name: "portal"},
+			stmts:   []string{"", testStmtName},
+			pending: []string{"other"},
+			portals: []string{""},
+		},
+		"unnamed portal": {
+			msg:     &pgproto3.Close{ObjectType: 'P'},
+			stmts:   []string{"", testStmtName},
+			pending: []string{"other"},
+			portals: []string{"portal"},
+		},
+	}
+
+	keys := func(m interface{}) []string {
+		var res []string
+		switch m := m.(type) {
+		case map[string]*nodes.PrepareStmt:
+			for k := range m {
+				res = append(res, k)
+			}
+		case map[string]*portal:
+			for k := range m {
+				res = append(res, k)
+			}
+		}
+		sort.Strings(res)
+		return res
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			sess := newSession()
+			msgs, err := sess.close(test.msg)
+			require.NoError(t, err)
+			require.Equal(t, []protocol.Message{protocol.CloseComplete}, msgs)
+
+			require.Equal(t, test.stmts, keys(sess.stmts))
+			require.Equal(t, test.pending, keys(sess.pendingStmts))
+			require.Equal(t, test.portals, keys(sess.portals))
+		})
+	}
+
+	t.Run("invalid object type", func(t *testing.T) {
+		_, err := newSession().close(&pgproto3.Close{ObjectType: 'X'})
+		require.Error(t, err)
+		require.Equal(t, "08P01", fromErr(err).C)
+	})
+
+	t.Run("protocol", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+		frontend, _ := connect(t, srv)
+
+		require.NoError(t, frontend.Send(&pgproto3.Close{ObjectType: 'S', Name: "nonexistent"}))
+		require.NoError(t, frontend.Send(&pgproto3.Sync{}))
+		receive(t, frontend, &pgproto3.CloseComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+func TestSession_protocolViolations(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+
+	// expectViolation sends the messages followed by Sync, and expects them to
+	// fail with a protocol violation
+	expectViolation := func(t *testing.T, frontend *pgproto3.Frontend, msgs ...pgproto3.FrontendMessage) {
+		for _, msg := range append(msgs, &pgproto3.Sync{}) {
+			require.NoError(t, frontend.Send(msg))
+		}
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "08P01", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+
+	t.Run("bind without parse", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		expectViolation(t, frontend, &pgproto3.Bind{PreparedStatement: "missing"})
+	})
+
+	t.Run("execute without bind", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		expectViolation(t, frontend, &pgproto3.Execute{Portal: "missing"})
+	})
+
+	t.Run("describe without bind", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		expectViolation(t, frontend, &pgproto3.Describe{ObjectType: 'P', Name: "missing"})
+	})
+
+	t.Run("bind after parse", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		require.NoError(t, frontend.Send(&pgproto3.Parse{Name: "stmt", Query: "SELECT 1"}))
+		require.NoError(t, frontend.Send(&pgproto3.Bind{PreparedStatement: "stmt"}))
+		require.NoError(t, frontend.Send(&pgproto3.Sync{}))
+		receive(t, frontend, &pgproto3.ParseComplete{})
+		receive(t, frontend, &pgproto3.BindComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("messages are ignored until sync", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		expectViolation(t, frontend,
+			&pgproto3.Bind{PreparedStatement: "missing"},
+			&pgproto3.Parse{Name: "stmt", Query: "SELECT 1"},
+		)
+
+		// the statement wasn't prepared
+		require.NoError(t, frontend.Send(&pgproto3.Describe{ObjectType: 'S', Name: "stmt"}))
+		require.NoError(t, frontend.Send(&pgproto3.Sync{}))
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "26000", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("execute with a row limit", func(t *testing.T) {
+		// the portal can't be suspended, so it isn't executed at all
+		frontend, _ := connect(t, srv)
+		msgs := []pgproto3.FrontendMessage{
+			&pgproto3.Parse{Query: "SELECT 1"},
+			&pgproto3.Bind{},
+			&pgproto3.Execute{MaxRows: 2},
+			&pgproto3.Sync{},
+		}
+		for _, msg := range msgs {
+			require.NoError(t, frontend.Send(msg))
+		}
+		receive(t, frontend, &pgproto3.ParseComplete{})
+		receive(t, frontend, &pgproto3.BindComplete{})
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "0A000", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+// typedQueryer returns a single row of typed columns, and records the node of
+// the query
+type typedQueryer struct {
+	n nodes.Node
+}
+
+func (q *typedQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	q.n = n
+	cols := []ColumnDesc{{"id", "INT4"}, {"name", "TEXT"}, {"score", "FLOAT8"}}
+	return RowsFromValues(cols, [][]interface{}{{int32(7), "bob", 1.5}}), nil
+}
+
+func TestSession_execute(t *testing.T) {
+	queryer := &typedQueryer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	score := encodeBinary(t, &pgtype.Float8{Float: 1.5, Status: pgtype.Present})
+
+	// execute binds the portal with the result formats, and executes it
+	execute := func(t *testing.T, frontend *pgproto3.Frontend, formats []int16, describe bool) {
+		msgs := []pgproto3.FrontendMessage{
+			&pgproto3.Parse{Query: "SELECT id, name, score FROM t WHERE id = $1", ParameterOIDs: []uint32{pgtype.Int4OID}},
+			&pgproto3.Bind{Parameters: [][]byte{[]byte("7")}, ResultFormatCodes: formats},
+		}
+		if describe {
+			msgs = append(msgs, &pgproto3.Describe{ObjectType: protocol.DescribePortal})
+		}
+		msgs = append(msgs, &pgproto3.Execute{}, &pgproto3.Sync{})
+		for _, msg := range msgs {
+			require.NoError(t, frontend.Send(msg))
+		}
+		receive(t, frontend, &pgproto3.ParseComplete{})
+		receive(t, frontend, &pgproto3.BindComplete{})
+	}
+
+	t.Run("mixed formats", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		execute(t, frontend, []int16{binaryFormat, textFormat, binaryFormat}, true)
+
+		desc := receive(t, frontend, &pgproto3.RowDescription{}).(*pgproto3.RowDescription)
+		var formats []int16
+		for _, field := range desc.Fields {
+			formats = append(formats, field.Format)
+		}
+		require.Equal(t, []int16{binaryFormat, textFormat, binaryFormat}, formats)
+
+		row := receive(t, frontend, &pgproto3.DataRow{}).(*pgproto3.DataRow)
+		require.Equal(t, [][]byte{{0, 0, 0, 7}, []byte("bob"), score}, row.Values)
+		msg := receive(t, frontend, &pgproto3.CommandComplete{})
+		require.Equal(t, "SELECT 1", msg.(*pgproto3.CommandComplete).CommandTag)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		// the parameter was bound to the query
+		var params []nodes.Node
+		replaceNodes(queryer.n, func(n nodes.Node) (nodes.Node, bool) {
+			if c, ok := n.(nodes.A_Const); ok {
+				params = append(params, c.Val)
+			}
+			_, ok := n.(nodes.ParamRef)
+			require.False(t, ok, "unbound parameter")
+			return nil, false
+		})
+		require.Contains(t, params, nodes.Integer{Ival: 7})
+	})
+
+	t.Run("single format", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		execute(t, frontend, []int16{binaryFormat}, false)
+
+		row := receive(t, frontend, &pgproto3.DataRow{}).(*pgproto3.DataRow)
+		require.Equal(t, [][]byte{{0, 0, 0, 7}, []byte("bob"), score}, row.Values)
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("text format", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		execute(t, frontend, nil, true)
+
+		desc := receive(t, frontend, &pgproto3.RowDescription{}).(*pgproto3.RowDescription)
+		for _, field := range desc.Fields {
+			require.Equal(t, int16(textFormat), field.Format)
+		}
+		row := receive(t, frontend, &pgproto3.DataRow{}).(*pgproto3.DataRow)
+		require.Equal(t, [][]byte{[]byte("7"), []byte("bob"), []byte("1.5")}, row.Values)
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("wrong number of formats", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		execute(t, frontend, []int16{binaryFormat, textFormat}, false)
+
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "08P01", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+// describingQueryer is a typedQueryer that describes the results of the
+// statements, recording the described nodes
+type describingQueryer struct {
+	typedQueryer
+	described []nodes.Node
+}
+
+func (q *describingQueryer) DescribeResult(ctx context.Context, n nodes.Node) ([]ColumnDesc, error) {
+	q.described = append(q.described, n)
+	return []ColumnDesc{{"total", "INT8"}}, nil
+}
+
+func TestSession_describeResult(t *testing.T) {
+	queryer := &typedQueryer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	query := "SELECT id, name, score FROM t WHERE id = $1"
+
+	// describe sends the messages followed by Describe and Sync, and returns
+	// the response to the Describe
+	describe := func(t *testing.T, frontend *pgproto3.Frontend, objectType byte, msgs ...pgproto3.FrontendMessage) pgproto3.BackendMessage {
+		msgs = append(msgs, &pgproto3.Describe{ObjectType: objectType}, &pgproto3.Sync{})
+		for _, msg := range msgs {
+			require.NoError(t, frontend.Send(msg))
+		}
+		receive(t, frontend, &pgproto3.ParseComplete{})
+		if objectType == protocol.DescribePortal {
+			receive(t, frontend, &pgproto3.BindComplete{})
+		} else {
+			receive(t, frontend, &pgproto3.ParameterDescription{})
+		}
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+		return msg
+	}
+
+	// fields returns the names, type OIDs and formats of the described fields
+	fields := func(t *testing.T, msg pgproto3.BackendMessage) ([]string, []uint32, []int16) {
+		require.IsType(t, &pgproto3.RowDescription{}, msg)
+		var names []string
+		var oids []uint32
+		var formats []int16
+		for _, field := range msg.(*pgproto3.RowDescription).Fields {
+			names = append(names, field.Name)
+			oids = append(oids, field.DataTypeOID)
+			formats = append(formats, field.Format)
+		}
+		return names, oids, formats
+	}
+
+	t.Run("statement", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		msg := describe(t, frontend, protocol.DescribeStatement, &pgproto3.Parse{Query: query})
+		names, oids, formats := fields(t, msg)
+		require.Equal(t, []string{"id", "name", "score"}, names)
+		require.Equal(t, []uint32{pgtype.Int4OID, pgtype.TextOID, pgtype.Float8OID}, oids)
+		require.Equal(t, []int16{textFormat, textFormat, textFormat}, formats)
+
+		// the parameter isn't bound yet, so it's queried as NULL
+		var params []nodes.Node
+		replaceNodes(queryer.n, func(n nodes.Node) (nodes.Node, bool) {
+			if c, ok := n.(nodes.A_Const); ok {
+				params = append(params, c.Val)
+			}
+			return nil, false
+		})
+		require.Contains(t, params, nodes.Null{})
+	})
+
+	t.Run("portal", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		msg := describe(t, frontend, protocol.DescribePortal,
+			&pgproto3.Parse{Query: query},
+			&pgproto3.Bind{Parameters: [][]byte{[]byte("7")}, ResultFormatCodes: []int16{binaryFormat}},
+		)
+		names, _, formats := fields(t, msg)
+		require.Equal(t, []string{"id", "name", "score"}, names)
+		require.Equal(t, []int16{binaryFormat, binaryFormat, binaryFormat}, formats)
+	})
+
+	t.Run("no data", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		for _, sql := range []string{"CREATE TABLE t (id int)", "BEGIN", "SET search_path = public", ""} {
+			msg := describe(t, frontend, protocol.DescribeStatement, &pgproto3.Parse{Query: sql})
+			require.IsType(t, &pgproto3.NoData{}, msg, sql)
+			msg = describe(t, frontend, protocol.DescribePortal, &pgproto3.Parse{Query: sql}, &pgproto3.Bind{})
+			require.IsType(t, &pgproto3.NoData{}, msg, sql)
+		}
+	})
+
+	t.Run("show", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		msg := describe(t, frontend, protocol.DescribeStatement, &pgproto3.Parse{Query: "SHOW application_name"})
+		names, oids, _ := fields(t, msg)
+		require.Equal(t, []string{"application_name"}, names)
+		require.Equal(t, []uint32{pgtype.TextOID}, oids)
+	})
+
+	t.Run("returning without a describer", func(t *testing.T) {
+		frontend, _ := connect(t, srv)
+		require.NoError(t, frontend.Send(&pgproto3.Parse{Query: "INSERT INTO t VALUES (1) RETURNING id"}))
+		require.NoError(t, frontend.Send(&pgproto3.Describe{ObjectType: protocol.DescribeStatement}))
+		require.NoError(t, frontend.Send(&pgproto3.Sync{}))
+		receive(t, frontend, &pgproto3.ParseComplete{})
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "0A000", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("result describer", func(t *testing.T) {
+		queryer := &describingQueryer{}
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+		frontend, _ := connect(t, srv)
+		msg := describe(t, frontend, protocol.DescribeStatement, &pgproto3.Parse{Query: "INSERT INTO t VALUES (1) RETURNING count(*)"})
+		names, oids, _ := fields(t, msg)
+		require.Equal(t, []string{"total"}, names)
+		require.Equal(t, []uint32{pgtype.Int8OID}, oids)
+		require.Len(t, queryer.described, 1)
+		require.Nil(t, queryer.n, "the statement isn't executed")
+	})
+}
+
+func TestSession_flush(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &typedQueryer{}}
+	frontend, _ := connect(t, srv)
+
+	// the client waits for the replies to the messages before Flush, like
+	// pipelining drivers do, without ending the transaction with Sync
+	msgs := []pgproto3.FrontendMessage{
+		&pgproto3.Parse{Query: "SELECT id, name, score FROM t WHERE id = $1"},
+		&pgproto3.Describe{ObjectType: protocol.DescribeStatement},
+		&pgproto3.Flush{},
+	}
+	for _, msg := range msgs {
+		require.NoError(t, frontend.Send(msg))
+	}
+	receive(t, frontend, &pgproto3.ParseComplete{})
+	receive(t, frontend, &pgproto3.ParameterDescription{})
+	receive(t, frontend, &pgproto3.RowDescription{})
+
+	// an error that was flushed still fails the transaction, discarding the
+	// messages until Sync
+	msgs = []pgproto3.FrontendMessage{
+		&pgproto3.Parse{Query: "SELEC 1"},
+		&pgproto3.Flush{},
+	}
+	for _, msg := range msgs {
+		require.NoError(t, frontend.Send(msg))
+	}
+	receive(t, frontend, &pgproto3.ErrorResponse{})
+
+	msgs = []pgproto3.FrontendMessage{
+		&pgproto3.Parse{Query: "SELECT 1"},
+		&pgproto3.Sync{},
+	}
+	for _, msg := range msgs {
+		require.NoError(t, frontend.Send(msg))
+	}
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+}
+
+func TestSession_strictFraming(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}, strictFraming: true}
+	frontend, pid := connect(t, srv)
+	require.NotZero(t, pid)
+
+	sendQuery(t, frontend, "SELECT 1")
+	receive(t, frontend, &pgproto3.RowDescription{})
+	receive(t, frontend, &pgproto3.DataRow{})
+	receive(t, frontend, &pgproto3.CommandComplete{})
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+	require.NoError(t, frontend.Send(&pgproto3.Parse{Name: "stmt", Query: "SELECT 1"}))
+	require.NoError(t, frontend.Send(&pgproto3.Describe{ObjectType: 'S', Name: "stmt"}))
+	require.NoError(t, frontend.Send(&pgproto3.Sync{}))
+	receive(t, frontend, &pgproto3.ParseComplete{})
+	receive(t, frontend, &pgproto3.ParameterDescription{})
+	receive(t, frontend, &pgproto3.RowDescription{})
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+}
+
 func TestSession_Serve(t *testing.T) {
 	t.Skip("extended query flow is still under development so we skip the tests")
 
@@ -487,6 +995,23 @@ func (m *mockConn) Close() error {
 	return nil
 }
 
+func TestSession_tracer(t *testing.T) {
+	trace := &bytes.Buffer{}
+	srv := &server{
+		authenticator: &noPasswordAuthenticator{},
+		queryer:       &mockQueryer{},
+		tracer:        protocol.NewTextTracer(trace),
+	}
+	connect(t, srv)
+
+	// the handshake is traced from the startup message
+	lines := strings.Split(strings.TrimSuffix(trace.String(), "\n"), "\n")
+	require.True(t, len(lines) > 2, trace.String())
+	require.Equal(t, "-> StartupMessage &{ProtocolVersion:196608 Parameters:map[user:postgres]}", lines[0])
+	require.Equal(t, "<- Authentication (9 bytes)", lines[1])
+	require.Equal(t, "<- ReadyForQuery (6 bytes)", lines[len(lines)-1])
+}
+
 func TestSession_startUp(t *testing.T) {
 	srv := server{
 		authenticator: &noPasswordAuthenticator{},
@@ -496,8 +1021,10 @@ func TestSession_startUp(t *testing.T) {
 	t.Run("protocol version 3.0", func(t *testing.T) {
 		s := session{Server: &srv, Conn: &mockConn{b: buf}}
 		buf.Write([]byte{
-			0, 0, 0, 8, // length
+			0, 0, 0, 23, // length
 			0, 3, 0, 0, // 3.0
+			'u', 's', 'e', 'r', 0, 'p', 'o', 's', 't', 'g', 'r', 'e', 's', 0,
+			0, // terminator
 		})
 		err := s.startUp()
 		require.NoError(t, err)
@@ -509,20 +1036,234 @@ func TestSession_startUp(t *testing.T) {
 		require.NoError(t, err)
 		require.IsType(t, &pgproto3.Authentication{}, msg)
 
+		msg, err = reader.Receive()
+		require.NoError(t, err)
+		require.Equal(t, &pgproto3.ParameterStatus{Name: "application_name", Value: ""}, msg)
+
 		msg, err = reader.Receive()
 		require.NoError(t, err)
 		require.IsType(t, &pgproto3.ParameterStatus{}, msg)
 		require.Equal(t, "client_encoding", msg.(*pgproto3.ParameterStatus).Name)
-		require.Equal(t, "utf8", msg.(*pgproto3.ParameterStatus).Value)
+		require.Equal(t, "UTF8", msg.(*pgproto3.ParameterStatus).Value)
+
+		msg, err = reader.Receive()
+		require.NoError(t, err)
+		require.Equal(t, &pgproto3.ParameterStatus{Name: "DateStyle", Value: "ISO, YMD"}, msg)
+
+		msg, err = reader.Receive()
+		require.NoError(t, err)
+		require.Equal(t, &pgproto3.ParameterStatus{Name: "integer_datetimes", Value: "on"}, msg)
+
+		msg, err = reader.Receive()
+		require.NoError(t, err)
+		require.Equal(t, &pgproto3.ParameterStatus{Name: "server_version", Value: "10.5"}, msg)
+
+		msg, err = reader.Receive()
+		require.NoError(t, err)
+		require.Equal(t, &pgproto3.ParameterStatus{Name: "server_version_num", Value: "100005"}, msg)
 
 		msg, err = reader.Receive()
 		require.NoError(t, err)
 		require.IsType(t, &pgproto3.BackendKeyData{}, msg)
+		require.Equal(t, uint32(s.PID()), msg.(*pgproto3.BackendKeyData).ProcessID)
+
+		registered, ok := allSessions.Load(s.PID())
+		require.True(t, ok, "expected session to remain registered after startup")
+		require.Equal(t, &s, registered)
+
+		s.unregister()
+		_, ok = allSessions.Load(s.PID())
+		require.False(t, ok)
+	})
+
+	t.Run("taken pids", func(t *testing.T) {
+		defer func(f func() (int32, int32)) { newCancelKey = f }(newCancelKey)
+		newCancelKey = func() (int32, int32) { return math.MaxInt32, 42 }
+
+		// the pids wrap around past the largest int32, skipping 0
+		taken := &session{}
+		allSessions.Store(int32(math.MaxInt32), taken)
+		allSessions.Store(int32(1), taken)
+		defer allSessions.Delete(int32(math.MaxInt32))
+		defer allSessions.Delete(int32(1))
+
+		buf := &bytes.Buffer{}
+		s := session{Server: &srv, Conn: &mockConn{b: buf}}
+		buf.Write([]byte{
+			0, 0, 0, 23, // length
+			0, 3, 0, 0, // 3.0
+			'u', 's', 'e', 'r', 0, 'p', 'o', 's', 't', 'g', 'r', 'e', 's', 0,
+			0, // terminator
+		})
+		require.NoError(t, s.startUp())
+		defer s.unregister()
+
+		require.Equal(t, int32(2), s.PID())
+		registered, _ := allSessions.Load(int32(2))
+		require.Equal(t, &s, registered)
+	})
+
+	t.Run("database routing", func(t *testing.T) {
+		analytics := &mockQueryer{}
+		srv := server{
+			authenticator: &noPasswordAuthenticator{},
+			queryer:       &mockQueryer{},
+			router: func(database string) Queryer {
+				if database == "analytics" {
+					return analytics
+				}
+				return nil
+			},
+		}
+		startupMsg := func(database string) []byte {
+			return (&pgproto3.StartupMessage{
+				ProtocolVersion: pgproto3.ProtocolVersionNumber,
+				Parameters:      map[string]string{"user": "postgres", "database": database},
+			}).Encode(nil)
+		}
+
+		t.Run("known database", func(t *testing.T) {
+			buf := bytes.NewBuffer(startupMsg("analytics"))
+			s := session{Server: &srv, Conn: &mockConn{b: buf}}
+			err := s.startUp()
+			require.NoError(t, err)
+			require.Equal(t, analytics, s.queryer)
+		})
+
+		t.Run("unknown database", func(t *testing.T) {
+			buf := bytes.NewBuffer(startupMsg("oltp"))
+			s := session{Server: &srv, Conn: &mockConn{b: buf}}
+			err := s.startUp()
+			require.EqualError(t, err, "database \"oltp\" does not exist")
+
+			reader, err := pgproto3.NewFrontend(buf, nil)
+			require.NoError(t, err)
+
+			msg, err := reader.Receive()
+			require.NoError(t, err)
+			require.IsType(t, &pgproto3.Authentication{}, msg)
+
+			msg, err = reader.Receive()
+			require.NoError(t, err)
+			require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+			require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+			require.Equal(t, "3D000", msg.(*pgproto3.ErrorResponse).Code)
+		})
+	})
+
+	t.Run("custom parameter status", func(t *testing.T) {
+		srv := New(&mockQueryer{},
+			WithParameterStatus(map[string]string{"pgsrv.product": "mydb", "server_version": "99"}),
+			WithParameterStatus(map[string]string{"pgsrv.features": "copy", "_pq_.compression": "none"}),
+		).(*server)
+
+		buf := bytes.NewBuffer((&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres"},
+		}).Encode(nil))
+		s := session{Server: srv, Conn: &mockConn{b: buf}}
+		err := s.startUp()
+		require.NoError(t, err)
+
+		reader, err := pgproto3.NewFrontend(buf, nil)
+		require.NoError(t, err)
+
+		params := map[string]string{}
+		var names []string
+		for {
+			msg, err := reader.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.BackendKeyData); ok {
+				break
+			}
+			if ps, ok := msg.(*pgproto3.ParameterStatus); ok {
+				params[ps.Name] = ps.Value
+				names = append(names, ps.Name)
+			}
+		}
+
+		// the standard parameters can't be replaced
+		require.Equal(t, "10.5", params["server_version"])
+		require.NotContains(t, params, "_pq_.compression")
+		require.Equal(t, "mydb", params["pgsrv.product"])
+		require.Equal(t, []string{"pgsrv.features", "pgsrv.product"}, names[len(names)-2:])
+	})
+
+	t.Run("unsupported client encoding", func(t *testing.T) {
+		buf := bytes.NewBuffer((&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres", "client_encoding": "EUC_JP"},
+		}).Encode(nil))
+		s := session{Server: &srv, Conn: &mockConn{b: buf}}
+		err := s.startUp()
+		require.EqualError(t, err, "invalid value for parameter \"client_encoding\": \"EUC_JP\"")
+
+		reader, err := pgproto3.NewFrontend(buf, nil)
+		require.NoError(t, err)
+
+		msg, err := reader.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.Authentication{}, msg)
+
+		msg, err = reader.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+		require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+		require.Equal(t, "22023", msg.(*pgproto3.ErrorResponse).Code)
+	})
+
+	t.Run("startup validation", func(t *testing.T) {
+		srv := server{
+			authenticator: &noPasswordAuthenticator{},
+			queryer:       &mockQueryer{},
+			startupValidator: func(args map[string]interface{}) error {
+				switch {
+				case args["tenant"] == nil:
+					return fmt.Errorf("missing tenant")
+				case args["tenant"] != "acme":
+					return InvalidCatalogName(args["tenant"].(string))
+				}
+				return nil
+			},
+		}
+		startupMsg := func(options string) []byte {
+			return (&pgproto3.StartupMessage{
+				ProtocolVersion: pgproto3.ProtocolVersionNumber,
+				Parameters:      map[string]string{"user": "postgres", "options": options},
+			}).Encode(nil)
+		}
+
+		t.Run("valid", func(t *testing.T) {
+			buf := bytes.NewBuffer(startupMsg("-c tenant=acme"))
+			s := session{Server: &srv, Conn: &mockConn{b: buf}}
+			err := s.startUp()
+			require.NoError(t, err)
+			require.Equal(t, "acme", s.Args["tenant"])
+		})
+
+		for options, code := range map[string]string{"": "28000", "--tenant=foo": "3D000"} {
+			t.Run(fmt.Sprintf("invalid %q", options), func(t *testing.T) {
+				buf := bytes.NewBuffer(startupMsg(options))
+				s := session{Server: &srv, Conn: &mockConn{b: buf}}
+				err := s.startUp()
+				require.Error(t, err)
+
+				reader, err := pgproto3.NewFrontend(buf, nil)
+				require.NoError(t, err)
+
+				// rejected before authentication
+				msg, err := reader.Receive()
+				require.NoError(t, err)
+				require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+				require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+				require.Equal(t, code, msg.(*pgproto3.ErrorResponse).Code)
+			})
+		}
 	})
 
 	t.Run("cancel", func(t *testing.T) {
 		canceled := false
-		s := session{Server: &srv, Secret: 123, Conn: &mockConn{b: buf}, CancelFunc: func() {
+		s := session{Server: &srv, Secret: 123, Conn: &mockConn{b: buf}, cancelQuery: func() {
 			canceled = true
 		}}
 		allSessions.Store(int32(1), &s)
@@ -538,4 +1279,671 @@ func TestSession_startUp(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, true, canceled)
 	})
+
+	t.Run("malformed startup packet", func(t *testing.T) {
+		buf := bytes.NewBuffer([]byte{
+			0, 0, 0, 12, // length
+			0, 3, 0, 0, // 3.0
+			'u', 's', 'e', 'r', // unterminated key
+		})
+		s := session{Server: &srv, Conn: &mockConn{b: buf}}
+		err := s.startUp()
+		require.Error(t, err)
+
+		reader, err := pgproto3.NewFrontend(buf, nil)
+		require.NoError(t, err)
+		msg, err := reader.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+		require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+		require.Equal(t, "08P01", msg.(*pgproto3.ErrorResponse).Code)
+	})
+
+	t.Run("missing user", func(t *testing.T) {
+		for name, params := range map[string]map[string]string{
+			"no user":    {"database": "postgres"},
+			"empty user": {"user": ""},
+		} {
+			t.Run(name, func(t *testing.T) {
+				buf := bytes.NewBuffer((&pgproto3.StartupMessage{
+					ProtocolVersion: pgproto3.ProtocolVersionNumber,
+					Parameters:      params,
+				}).Encode(nil))
+				srv := server{authenticator: &md5Authenticator{MD5Passwords(nil)}, queryer: &mockQueryer{}}
+				s := session{Server: &srv, Conn: &mockConn{b: buf}}
+				err := s.startUp()
+				require.Error(t, err)
+
+				// rejected before authentication
+				reader, err := pgproto3.NewFrontend(buf, nil)
+				require.NoError(t, err)
+				msg, err := reader.Receive()
+				require.NoError(t, err)
+				require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+				require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+				require.Equal(t, "28000", msg.(*pgproto3.ErrorResponse).Code)
+				require.Equal(t, "no PostgreSQL user name specified in startup packet", msg.(*pgproto3.ErrorResponse).Message)
+			})
+		}
+	})
+}
+
+func TestSession_RemoteAddr(t *testing.T) {
+	t.Run("network connection", func(t *testing.T) {
+		f, b := net.Pipe()
+		defer f.Close()
+		s := &session{Conn: newBufferedConn(b, defaultBufferSize, defaultBufferSize)}
+		require.Equal(t, b.RemoteAddr(), s.RemoteAddr())
+	})
+
+	t.Run("non-network connection", func(t *testing.T) {
+		s := &session{Conn: &mockConn{b: &bytes.Buffer{}}}
+		require.Nil(t, s.RemoteAddr())
+	})
+}
+
+// noticeQueryer sends notices before returning the rows and while they're read
+type noticeQueryer struct{}
+
+func (q *noticeQueryer) Query(ctx context.Context, n pg_query.Node) (driver.Rows, error) {
+	sess := ctx.Value(sessionCtxKey).(Session)
+	sess.Notice(SeverityWarning, "", "deprecated")
+	return &noticeRows{sess: sess, mockRows: mockRows{rows: 2}}, nil
+}
+
+type noticeRows struct {
+	mockRows
+	sess Session
+}
+
+func (r *noticeRows) Next(dest []driver.Value) error {
+	if r.pos == 1 {
+		r.sess.Notice(SeverityInfo, "", "halfway")
+	}
+	return r.mockRows.Next(dest)
+}
+
+func TestSession_Notice(t *testing.T) {
+	srv := &server{
+		authenticator: &noPasswordAuthenticator{},
+		queryer:       &noticeQueryer{},
+	}
+	frontend, _ := connect(t, srv)
+	sendQuery(t, frontend, "SELECT 1")
+
+	msg := receive(t, frontend, &pgproto3.NoticeResponse{})
+	require.Equal(t, "WARNING", msg.(*pgproto3.NoticeResponse).Severity)
+	require.Equal(t, "01000", msg.(*pgproto3.NoticeResponse).Code)
+	require.Equal(t, "deprecated", msg.(*pgproto3.NoticeResponse).Message)
+
+	receive(t, frontend, &pgproto3.RowDescription{})
+	receive(t, frontend, &pgproto3.DataRow{})
+
+	msg = receive(t, frontend, &pgproto3.NoticeResponse{})
+	require.Equal(t, "INFO", msg.(*pgproto3.NoticeResponse).Severity)
+	require.Equal(t, "00000", msg.(*pgproto3.NoticeResponse).Code)
+	require.Equal(t, "halfway", msg.(*pgproto3.NoticeResponse).Message)
+
+	receive(t, frontend, &pgproto3.DataRow{})
+	receive(t, frontend, &pgproto3.CommandComplete{})
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+}
+
+func TestSession_maxQueryLength(t *testing.T) {
+	srv := &server{
+		authenticator:  &noPasswordAuthenticator{},
+		queryer:        &mockQueryer{},
+		maxQueryLength: len("SELECT 1"),
+	}
+	frontend, _ := connect(t, srv)
+
+	t.Run("at the limit", func(t *testing.T) {
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("over the limit", func(t *testing.T) {
+		sendQuery(t, frontend, "SELECT 12")
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "54000", msg.(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, "query string is too long (9 bytes, maximum is 8)", msg.(*pgproto3.ErrorResponse).Message)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+func TestSession_maxPreparedStatements(t *testing.T) {
+	srv := New(&mockQueryer{}, WithMaxPreparedStatements(2), WithMaxPortals(1)).(*server)
+	frontend, _ := connect(t, srv)
+
+	// sync sends the messages followed by Sync, returning the responses up to
+	// ReadyForQuery, as the names of their types or the codes of the errors
+	sync := func(t *testing.T, msgs ...pgproto3.FrontendMessage) (responses []string) {
+		for _, msg := range append(msgs, &pgproto3.Sync{}) {
+			require.NoError(t, frontend.Send(msg))
+		}
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			switch v := msg.(type) {
+			case *pgproto3.ErrorResponse:
+				responses = append(responses, v.Code)
+			case *pgproto3.ReadyForQuery:
+				return responses
+			default:
+				responses = append(responses, reflect.TypeOf(msg).Elem().Name())
+			}
+		}
+	}
+
+	t.Run("statements", func(t *testing.T) {
+		require.Equal(t, []string{"ParseComplete", "ParseComplete"}, sync(t,
+			&pgproto3.Parse{Name: "s1", Query: "SELECT 1"},
+			&pgproto3.Parse{Name: "s2", Query: "SELECT 2"},
+		))
+
+		// the error discards the rest of the messages, up to Sync
+		require.Equal(t, []string{"54000"}, sync(t,
+			&pgproto3.Parse{Name: "s3", Query: "SELECT 3"},
+			&pgproto3.Parse{Query: "SELECT 3"},
+		))
+
+		// the unnamed statement and replacing a statement aren't limited
+		require.Equal(t, []string{"ParseComplete", "ParseComplete"}, sync(t,
+			&pgproto3.Parse{Query: "SELECT 3"},
+			&pgproto3.Parse{Name: "s2", Query: "SELECT 2"},
+		))
+
+		// closing a statement frees a slot
+		require.Equal(t, []string{"CloseComplete", "ParseComplete"}, sync(t,
+			&pgproto3.Close{ObjectType: 'S', Name: "s1"},
+			&pgproto3.Parse{Name: "s3", Query: "SELECT 3"},
+		))
+	})
+
+	t.Run("PREPARE", func(t *testing.T) {
+		sendQuery(t, frontend, "PREPARE s4 AS SELECT 4")
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "54000", msg.(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, "too many prepared statements (maximum is 2)", msg.(*pgproto3.ErrorResponse).Message)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		sendQuery(t, frontend, "DEALLOCATE s3")
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		sendQuery(t, frontend, "PREPARE s4 AS SELECT 4")
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("portals", func(t *testing.T) {
+		// the unnamed portal isn't limited
+		require.Equal(t, []string{"BindComplete", "BindComplete", "54000"}, sync(t,
+			&pgproto3.Bind{DestinationPortal: "p1", PreparedStatement: "s2"},
+			&pgproto3.Bind{PreparedStatement: "s2"},
+			&pgproto3.Bind{DestinationPortal: "p2", PreparedStatement: "s2"},
+		))
+
+		// closing a portal frees a slot
+		require.Equal(t, []string{"BindComplete", "CloseComplete", "BindComplete"}, sync(t,
+			&pgproto3.Bind{DestinationPortal: "p1", PreparedStatement: "s2"},
+			&pgproto3.Close{ObjectType: 'P', Name: "p1"},
+			&pgproto3.Bind{DestinationPortal: "p2", PreparedStatement: "s2"},
+		))
+	})
+}
+
+func TestSession_Terminate(t *testing.T) {
+	tests := map[string]struct {
+		disconnect func(t *testing.T, frontend *pgproto3.Frontend, conn net.Conn)
+		err        bool
+		logs       []string
+	}{
+		"terminate": {
+			disconnect: func(t *testing.T, frontend *pgproto3.Frontend, conn net.Conn) {
+				require.NoError(t, frontend.Send(&pgproto3.Terminate{}))
+			},
+		},
+		"unexpected disconnect": {
+			disconnect: func(t *testing.T, frontend *pgproto3.Frontend, conn net.Conn) {
+				require.NoError(t, conn.Close())
+			},
+			err:  true,
+			logs: []string{"pgsrv: connection from pipe closed unexpectedly"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			logger := &mockLogger{}
+			srv := &server{
+				authenticator: &noPasswordAuthenticator{},
+				queryer:       &mockQueryer{},
+				logger:        logger,
+			}
+
+			f, b := net.Pipe()
+			done := make(chan error)
+			go func() {
+				done <- srv.Serve(b)
+			}()
+
+			frontend, err := pgproto3.NewFrontend(f, f)
+			require.NoError(t, err)
+			err = frontend.Send(&pgproto3.StartupMessage{
+				ProtocolVersion: pgproto3.ProtocolVersionNumber,
+				Parameters:      map[string]string{"user": "postgres"},
+			})
+			require.NoError(t, err)
+
+			var pid int32
+			for {
+				msg, err := frontend.Receive()
+				require.NoError(t, err)
+				if v, ok := msg.(*pgproto3.BackendKeyData); ok {
+					pid = int32(v.ProcessID)
+				}
+				if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+					break
+				}
+			}
+
+			test.disconnect(t, frontend, f)
+			err = <-done
+			if test.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.logs, logger.logs)
+
+			_, ok := allSessions.Load(pid)
+			require.False(t, ok, "expected the session to be unregistered")
+		})
+	}
+}
+
+// userDataQueryer returns the user data of the session as the only value
+type userDataQueryer struct{}
+
+func (*userDataQueryer) Query(ctx context.Context, n pg_query.Node) (driver.Rows, error) {
+	sess := ctx.Value(sessionCtxKey).(Session)
+	return RowsFromValues([]ColumnDesc{{Name: "column1"}}, [][]interface{}{{sess.UserData()}}), nil
+}
+
+func TestSession_hooks(t *testing.T) {
+	type hooks struct {
+		connected    chan Session
+		disconnected chan Session
+	}
+	newServer := func(connectErr error) (*server, *hooks) {
+		h := &hooks{connected: make(chan Session, 2), disconnected: make(chan Session, 2)}
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &userDataQueryer{}}
+		WithOnConnect(func(sess Session) error {
+			sess.SetUserData("tenant")
+			h.connected <- sess
+			return connectErr
+		})(srv)
+		WithOnDisconnect(func(sess Session) {
+			h.disconnected <- sess
+		})(srv)
+		return srv, h
+	}
+
+	start := func(t *testing.T, srv *server) (*pgproto3.Frontend, net.Conn, chan error) {
+		f, b := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- srv.Serve(b)
+		}()
+
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+		err = frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres"},
+		})
+		require.NoError(t, err)
+		receive(t, frontend, &pgproto3.Authentication{})
+		return frontend, f, done
+	}
+
+	t.Run("terminate", func(t *testing.T) {
+		srv, h := newServer(nil)
+		frontend, _, done := start(t, srv)
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				break
+			}
+		}
+
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		msg := receive(t, frontend, &pgproto3.DataRow{})
+		require.Equal(t, "tenant", string(msg.(*pgproto3.DataRow).Values[0]))
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		require.NoError(t, frontend.Send(&pgproto3.Terminate{}))
+		require.NoError(t, <-done)
+
+		sess := <-h.connected
+		require.Equal(t, sess, <-h.disconnected)
+		require.Len(t, h.disconnected, 0, "expected a single disconnect")
+	})
+
+	t.Run("abrupt close", func(t *testing.T) {
+		srv, h := newServer(nil)
+		_, conn, done := start(t, srv)
+		<-h.connected
+		require.NoError(t, conn.Close())
+		require.Error(t, <-done)
+
+		require.Equal(t, "tenant", (<-h.disconnected).UserData())
+		require.Len(t, h.disconnected, 0, "expected a single disconnect")
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		srv, h := newServer(InvalidAuthorizationSpecification("no tenant"))
+		frontend, _, done := start(t, srv)
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if e, ok := msg.(*pgproto3.ErrorResponse); ok {
+				require.Equal(t, "FATAL", e.Severity)
+				require.Equal(t, "28000", e.Code)
+				require.Equal(t, "no tenant", e.Message)
+				break
+			}
+		}
+		require.Error(t, <-done)
+
+		<-h.connected
+		require.Len(t, h.disconnected, 0, "expected no disconnect after a failed connect")
+	})
+}
+
+// cancelableQueryer blocks until the query's context is done, after
+// signaling that it started, for queries other than SELECT 1
+type cancelableQueryer struct {
+	mockQueryer
+	started chan struct{}
+}
+
+func (q *cancelableQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	if sql, _ := ctx.Value(sqlCtxKey).(string); sql == "SELECT 1" {
+		return q.mockQueryer.Query(ctx, n)
+	}
+	q.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSession_CancelQuery(t *testing.T) {
+	queryer := &cancelableQueryer{started: make(chan struct{})}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+	frontend, pid := connect(t, srv)
+
+	s, ok := allSessions.Load(pid)
+	require.True(t, ok)
+	sess := s.(Session)
+
+	selectOne := func(t *testing.T) {
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		sess.CancelQuery()
+		selectOne(t)
+	})
+
+	t.Run("in-flight query", func(t *testing.T) {
+		sendQuery(t, frontend, "SELECT * FROM slow")
+		<-queryer.started
+		sess.CancelQuery()
+
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "57014", msg.(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, "canceling statement due to user request", msg.(*pgproto3.ErrorResponse).Message)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		// the following queries aren't affected
+		selectOne(t)
+	})
+
+	t.Run("rows ignoring the context", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &endlessQueryer{}}
+		frontend, pid := connect(t, srv)
+		s, _ := allSessions.Load(pid)
+
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		s.(Session).CancelQuery()
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.DataRow); ok {
+				continue
+			}
+			require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+			require.Equal(t, "57014", msg.(*pgproto3.ErrorResponse).Code)
+			break
+		}
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+// tenantKey is the key of the tenant ID in the base context of the session
+type tenantKey struct{}
+
+// tenantQueryer returns the tenant ID found in the context of the query
+type tenantQueryer struct{}
+
+func (tenantQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return RowsFromValues([]ColumnDesc{{Name: "tenant"}}, [][]interface{}{{tenant}}), nil
+}
+
+func TestSession_baseContext(t *testing.T) {
+	t.Run("values", func(t *testing.T) {
+		var remote net.Addr
+		srv := New(tenantQueryer{}, WithBaseContext(func(conn net.Conn) context.Context {
+			remote = conn.RemoteAddr()
+			return context.WithValue(context.Background(), tenantKey{}, "acme")
+		})).(*server)
+		frontend, _ := connect(t, srv)
+		require.NotNil(t, remote)
+
+		sendQuery(t, frontend, "SELECT current_tenant()")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		msg := receive(t, frontend, &pgproto3.DataRow{})
+		require.Equal(t, "acme", string(msg.(*pgproto3.DataRow).Values[0]))
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("cancels in-flight queries", func(t *testing.T) {
+		base, cancel := context.WithCancel(context.Background())
+		queryer := &cancelableQueryer{started: make(chan struct{})}
+		srv := New(queryer, WithBaseContext(func(net.Conn) context.Context { return base })).(*server)
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "SELECT * FROM slow")
+		<-queryer.started
+		cancel()
+
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "57014", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("canceled on disconnect", func(t *testing.T) {
+		srv := New(&mockQueryer{}).(*server)
+		frontend, pid := connect(t, srv)
+		s, ok := allSessions.Load(pid)
+		require.True(t, ok)
+		ctx := s.(*session).Ctx
+		require.NoError(t, ctx.Err())
+
+		require.NoError(t, frontend.Send(&pgproto3.Terminate{}))
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the session's context to be canceled")
+		}
+	})
+}
+
+func TestSession_localize(t *testing.T) {
+	// localizer translates to german, when requested
+	localizer := func(locale, code, defaultText string, args ...interface{}) string {
+		if locale != "de_DE" {
+			return ""
+		}
+		switch defaultText {
+		case errWrongPassword:
+			return fmt.Sprintf("Passwort stimmt nicht überein für Benutzer »%s«", args...)
+		case "prepared statement \"%s\" does not exist":
+			return fmt.Sprintf("vorbereitete Anweisung »%s« existiert nicht (%s)", args[0], code)
+		case "invalid value for parameter \"client_encoding\": \"%s\"":
+			return fmt.Sprintf("ungültiger Wert für Parameter »client_encoding«: »%s«", args...)
+		case "unsupported frontend message type '?'":
+			return fmt.Sprintf("nicht unterstützter Frontend-Nachrichtentyp '?' (%s)", code)
+		}
+		return ""
+	}
+
+	t.Run("auth failure", func(t *testing.T) {
+		pp := MD5Passwords(map[string]string{"alice": "secret"})
+		srv := New(&passwordQueryer{PasswordProvider: pp}, WithMessageLocalizer(localizer))
+		f, b := net.Pipe()
+		defer f.Close()
+		go srv.Serve(b)
+
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+		require.NoError(t, frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "alice", "lc_messages": "de_DE"},
+		}))
+		receive(t, frontend, &pgproto3.Authentication{})
+		require.NoError(t, frontend.Send(&pgproto3.PasswordMessage{Password: "md5wrong"}))
+
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{}).(*pgproto3.ErrorResponse)
+		require.Equal(t, "FATAL", msg.Severity)
+		require.Equal(t, "28P01", msg.Code)
+		require.Equal(t, "Passwort stimmt nicht überein für Benutzer »alice«", msg.Message)
+	})
+
+	t.Run("protocol violation", func(t *testing.T) {
+		srv := New(&mockQueryer{}, WithMessageLocalizer(localizer)).(*server)
+		frontend, _ := connectWith(t, srv, map[string]string{"user": "postgres", "lc_messages": "de_DE"})
+		require.NoError(t, frontend.Send(&pgproto3.Bind{PreparedStatement: "missing"}))
+		require.NoError(t, frontend.Send(&pgproto3.Sync{}))
+
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{}).(*pgproto3.ErrorResponse)
+		require.Equal(t, "08P01", msg.Code)
+		require.Equal(t, "vorbereitete Anweisung »missing« existiert nicht (08P01)", msg.Message)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("startup failure", func(t *testing.T) {
+		srv := New(&mockQueryer{}, WithMessageLocalizer(localizer))
+		f, b := net.Pipe()
+		defer f.Close()
+		go srv.Serve(b)
+
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+		require.NoError(t, frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres", "lc_messages": "de_DE", "client_encoding": "klingon"},
+		}))
+
+		receive(t, frontend, &pgproto3.Authentication{})
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{}).(*pgproto3.ErrorResponse)
+		require.Equal(t, "FATAL", msg.Severity)
+		require.Equal(t, "22023", msg.Code)
+		require.Equal(t, "ungültiger Wert für Parameter »client_encoding«: »klingon«", msg.Message)
+	})
+
+	t.Run("unsupported message", func(t *testing.T) {
+		srv := New(&mockQueryer{}, WithMessageLocalizer(localizer)).(*server)
+		f, b := net.Pipe()
+		defer f.Close()
+		go srv.Serve(b)
+
+		frontend, err := pgproto3.NewFrontend(f, f)
+		require.NoError(t, err)
+		require.NoError(t, frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres", "lc_messages": "de_DE"},
+		}))
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				break
+			}
+		}
+
+		_, err = f.Write([]byte{'?', 0, 0, 0, 4})
+		require.NoError(t, err)
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{}).(*pgproto3.ErrorResponse)
+		require.Equal(t, "08P01", msg.Code)
+		require.Equal(t, "nicht unterstützter Frontend-Nachrichtentyp '?' (08P01)", msg.Message)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("default locale", func(t *testing.T) {
+		srv := New(&mockQueryer{}, WithMessageLocalizer(localizer)).(*server)
+		frontend, _ := connect(t, srv)
+		require.NoError(t, frontend.Send(&pgproto3.Bind{PreparedStatement: "missing"}))
+		require.NoError(t, frontend.Send(&pgproto3.Sync{}))
+
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{}).(*pgproto3.ErrorResponse)
+		require.Equal(t, "08P01", msg.Code)
+		require.Equal(t, "prepared statement \"missing\" does not exist", msg.Message)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("backend errors", func(t *testing.T) {
+		s := &session{Server: &server{localizer: localizer}, Args: map[string]interface{}{"lc_messages": "de_DE"}}
+		err := UndefinedTable("missing")
+		require.Equal(t, err, s.localize(err))
+	})
+}
+
+func TestSession_closed(t *testing.T) {
+	srv := New(&mockQueryer{}).(*server)
+	frontend, pid := connect(t, srv)
+	v, ok := allSessions.Load(pid)
+	require.True(t, ok)
+	s := v.(*session)
+	require.NoError(t, s.Notify("foo", "open"))
+
+	require.NoError(t, frontend.Send(&pgproto3.Terminate{}))
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.isClosed() {
+		require.True(t, time.Now().Before(deadline), "expected the session to be closed")
+		time.Sleep(time.Millisecond)
+	}
+
+	// like a goroutine of the backend that outlived the session
+	require.Equal(t, ErrSessionClosed, s.Notify("foo", "closed"))
+	require.NotPanics(t, func() { s.Notice(SeverityWarning, "", "closed") })
+
+	errs := make(chan error)
+	go func() { errs <- s.NoticeErr(SeverityWarning, "", "closed") }()
+	require.Equal(t, ErrSessionClosed, <-errs)
 }
@@ -0,0 +1,103 @@
+package pgsrv
+
+import (
+	"context"
+	"fmt"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"sort"
+	"strings"
+)
+
+// startupParams are the startup parameters that aren't session variables, and
+// are therefore omitted from SHOW ALL
+var startupParams = map[string]bool{
+	"user":        true,
+	"database":    true,
+	"options":     true,
+	"replication": true,
+}
+
+// variableDescriptions are the descriptions of the well known variables, as
+// reported by SHOW ALL
+var variableDescriptions = map[string]string{
+	"application_name":              "Sets the application name to be reported in statistics and logs.",
+	"client_encoding":               "Sets the client's character set encoding.",
+	"datestyle":                     "Sets the display format for date and time values.",
+	"default_transaction_isolation": "Sets the transaction isolation level of each new transaction.",
+	"default_transaction_read_only": "Sets the default read-only status of new transactions.",
+	"extra_float_digits":            "Sets the number of digits displayed for floating-point values.",
+	"integer_datetimes":             "Datetimes are integer based.",
+	"lc_messages":                   "Sets the language in which messages are displayed.",
+	"search_path":                   "Sets the schema search order for names that are not schema-qualified.",
+	"server_version":                "Shows the server version.",
+	"server_version_num":            "Shows the server version as an integer.",
+	"statement_timeout":             "Sets the maximum allowed duration of any statement.",
+	"timezone":                      "Sets the time zone for displaying and interpreting time stamps.",
+	"transaction_isolation":         "Sets the current transaction's isolation level.",
+	"transaction_read_only":         "Sets the current transaction's read-only status.",
+}
+
+// show handles SHOW of the session variables. SHOW ALL lists all of them, while
+// SHOW of a single variable that isn't known to the server is passed on to the
+// backend.
+func (q *query) show(ctx context.Context, sess Session, stmt nodes.VariableShowStmt) error {
+	s, ok := sess.(*session)
+	// only session implementation knows the values reported by the server
+	if !ok || stmt.Name == nil {
+		return q.Query(ctx, stmt)
+	}
+
+	vars := s.variables()
+	name := strings.ToLower(*stmt.Name)
+	if name == "all" {
+		names := make([]string, 0, len(vars))
+		for k := range vars {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		values := make([][]interface{}, len(names))
+		for i, k := range names {
+			values[i] = []interface{}{k, vars[k], variableDescriptions[k]}
+		}
+		cols := []ColumnDesc{{Name: "name"}, {Name: "setting"}, {Name: "description"}}
+		return q.writeRows(ctx, RowsFromValues(cols, values))
+	}
+
+	value, ok := vars[name]
+	if !ok {
+		return q.Query(ctx, stmt)
+	}
+	return q.writeRows(ctx, RowsFromValues([]ColumnDesc{{Name: name}}, [][]interface{}{{value}}))
+}
+
+// variables returns the values of all of the session variables, including
+// the ones reported by the server, as strings
+func (s *session) variables() map[string]string {
+	vars := map[string]string{}
+	for k, v := range s.Args {
+		if !startupParams[k] {
+			vars[strings.ToLower(k)] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	version := s.Server.version()
+	vars["client_encoding"] = s.encoding.Name()
+	vars["server_version"] = version
+	vars["server_version_num"] = serverVersionNum(version)
+	vars["datestyle"] = s.dateStyle().String()
+	vars["integer_datetimes"] = "on"
+	if _, ok := vars["extra_float_digits"]; !ok {
+		vars["extra_float_digits"] = "1"
+	}
+	if _, ok := vars["search_path"]; !ok {
+		vars["search_path"] = defaultSearchPath
+	}
+
+	defaults, current := s.defaultTransactionMode(), s.transactionMode()
+	vars["default_transaction_isolation"] = defaults.isolation
+	vars["default_transaction_read_only"] = formatBool(defaults.readOnly)
+	vars["transaction_isolation"] = current.isolation
+	vars["transaction_read_only"] = formatBool(current.readOnly)
+	return vars
+}
@@ -0,0 +1,75 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestQuery_show(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+	frontend, _ := connectWith(t, srv, map[string]string{"user": "postgres", "application_name": "psql"})
+
+	sendQuery(t, frontend, "SET statement_timeout = '5s'")
+	receive(t, frontend, &pgproto3.CommandComplete{})
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+	t.Run("all", func(t *testing.T) {
+		sendQuery(t, frontend, "SHOW ALL")
+		msg := receive(t, frontend, &pgproto3.RowDescription{})
+		fields := msg.(*pgproto3.RowDescription).Fields
+		require.Len(t, fields, 3)
+		require.Equal(t, "name", fields[0].Name)
+		require.Equal(t, "setting", fields[1].Name)
+		require.Equal(t, "description", fields[2].Name)
+
+		var rows [][]string
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			row, ok := msg.(*pgproto3.DataRow)
+			if !ok {
+				require.IsType(t, &pgproto3.CommandComplete{}, msg)
+				break
+			}
+			rows = append(rows, []string{string(row.Values[0]), string(row.Values[1]), string(row.Values[2])})
+		}
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		require.Equal(t, [][]string{
+			{"application_name", "psql", "Sets the application name to be reported in statistics and logs."},
+			{"client_encoding", "UTF8", "Sets the client's character set encoding."},
+			{"datestyle", "ISO, YMD", "Sets the display format for date and time values."},
+			{"default_transaction_isolation", "read committed", "Sets the transaction isolation level of each new transaction."},
+			{"default_transaction_read_only", "off", "Sets the default read-only status of new transactions."},
+			{"extra_float_digits", "1", "Sets the number of digits displayed for floating-point values."},
+			{"integer_datetimes", "on", "Datetimes are integer based."},
+			{"search_path", "\"$user\", public", "Sets the schema search order for names that are not schema-qualified."},
+			{"server_version", "10.5", "Shows the server version."},
+			{"server_version_num", "100005", "Shows the server version as an integer."},
+			{"statement_timeout", "5s", "Sets the maximum allowed duration of any statement."},
+			{"transaction_isolation", "read committed", "Sets the current transaction's isolation level."},
+			{"transaction_read_only", "off", "Sets the current transaction's read-only status."},
+		}, rows)
+	})
+
+	t.Run("variable", func(t *testing.T) {
+		sendQuery(t, frontend, "SHOW application_name")
+		msg := receive(t, frontend, &pgproto3.RowDescription{})
+		require.Equal(t, "application_name", msg.(*pgproto3.RowDescription).Fields[0].Name)
+		msg = receive(t, frontend, &pgproto3.DataRow{})
+		require.Equal(t, "psql", string(msg.(*pgproto3.DataRow).Values[0]))
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("unknown variable", func(t *testing.T) {
+		sendQuery(t, frontend, "SHOW work_mem")
+		msg := receive(t, frontend, &pgproto3.RowDescription{})
+		require.Equal(t, "column1", msg.(*pgproto3.RowDescription).Fields[0].Name)
+		msg = receive(t, frontend, &pgproto3.DataRow{})
+		require.Equal(t, "row 0", string(msg.(*pgproto3.DataRow).Values[0]))
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
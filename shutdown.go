@@ -0,0 +1,113 @@
+package pgsrv
+
+import (
+	"context"
+	"github.com/panoplyio/pgsrv/protocol"
+	"net"
+	"sync"
+)
+
+func (s *server) ServeContext(ctx context.Context, ln net.Listener) error {
+	return s.serveContext(ctx, ln, nil)
+}
+
+// serveContext implements ServeContext, with the configuration of the
+// listener, if it was added with AddListener
+func (s *server) serveContext(ctx context.Context, ln net.Listener, l *listener) error {
+	// wake up the accept loop once the context is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+
+	set := &sessionSet{sessions: map[*session]bool{}}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				set.drain()
+				return nil
+			}
+			return err
+		}
+
+		set.wg.Add(1)
+		go func() {
+			defer set.wg.Done()
+			s.serve(conn, set, l)
+		}()
+	}
+}
+
+// sessionSet is the set of sessions served from the same listener, which are
+// drained together
+type sessionSet struct {
+	mu       sync.Mutex
+	sessions map[*session]bool
+	draining bool
+	wg       sync.WaitGroup // all of the connections, including rejected ones
+}
+
+// add adds the session to the set, unless it's already draining
+func (set *sessionSet) add(sess *session) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	if set.draining {
+		return false
+	}
+	set.sessions[sess] = true
+	return true
+}
+
+func (set *sessionSet) remove(sess *session) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	delete(set.sessions, sess)
+}
+
+// drain terminates all of the sessions, and waits for them to end
+func (set *sessionSet) drain() {
+	set.mu.Lock()
+	set.draining = true
+	for sess := range set.sessions {
+		sess.terminate()
+	}
+	set.mu.Unlock()
+
+	set.wg.Wait()
+}
+
+// terminate ends the session from any goroutine, once its current query is
+// complete, reporting the shutdown to the client as FATAL. Sessions that are
+// still starting up are disconnected immediately.
+func (s *session) terminate() {
+	s.activityMu.Lock()
+	s.terminated = true
+	t := s.transport
+	s.activityMu.Unlock()
+
+	// close the underlying connection, since the buffered one is used by the
+	// goroutine serving the session
+	if t == nil {
+		s.netConn().Close()
+		return
+	}
+
+	err := WithSeverity(AdminShutdown(), fatalSeverity)
+	idle, _ := t.TerminateError(err)
+	if idle {
+		s.netConn().Close()
+	}
+}
+
+func (s *session) isTerminated() bool {
+	s.activityMu.Lock()
+	defer s.activityMu.Unlock()
+	return s.terminated
+}
@@ -0,0 +1,113 @@
+package pgsrv
+
+import (
+	"context"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialFrontend connects to the listener and waits until the session is ready
+// for queries
+func dialFrontend(t *testing.T, ln net.Listener) *pgproto3.Frontend {
+	conn, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+	require.NoError(t, err)
+
+	frontend, err := pgproto3.NewFrontend(conn, conn)
+	require.NoError(t, err)
+	err = frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	})
+	require.NoError(t, err)
+
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			return frontend
+		}
+	}
+}
+
+// expectShutdown expects the session to be terminated by the server
+func expectShutdown(t *testing.T, frontend *pgproto3.Frontend) {
+	msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+	require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+	require.Equal(t, "57P01", msg.(*pgproto3.ErrorResponse).Code)
+
+	_, err := frontend.Receive()
+	require.Error(t, err, "expected the connection to be closed")
+}
+
+func TestServer_ServeContext(t *testing.T) {
+	listen := func(t *testing.T) net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		return ln
+	}
+
+	t.Run("terminates idle sessions", func(t *testing.T) {
+		ln := listen(t)
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- srv.ServeContext(ctx, ln)
+		}()
+
+		frontend := dialFrontend(t, ln)
+		cancel()
+
+		expectShutdown(t, frontend)
+		require.NoError(t, <-done)
+
+		_, err := net.Dial("tcp", ln.Addr().String())
+		require.Error(t, err, "expected the listener to be closed")
+	})
+
+	t.Run("completes active queries", func(t *testing.T) {
+		ln := listen(t)
+		queryer := &blockingQueryer{started: make(chan bool), release: make(chan bool)}
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- srv.ServeContext(ctx, ln)
+		}()
+
+		frontend := dialFrontend(t, ln)
+		sendQuery(t, frontend, "SELECT 1")
+		<-queryer.started
+		cancel()
+
+		select {
+		case <-done:
+			t.Fatal("expected to wait for the active query")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		queryer.release <- true
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		expectShutdown(t, frontend)
+		require.NoError(t, <-done)
+	})
+
+	t.Run("listener closed", func(t *testing.T) {
+		ln := listen(t)
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+
+		done := make(chan error)
+		go func() {
+			done <- srv.ServeContext(context.Background(), ln)
+		}()
+
+		require.NoError(t, ln.Close())
+		require.Error(t, <-done)
+	})
+}
@@ -2,15 +2,81 @@ package pgsrv
 
 import (
 	"context"
-	"database/sql/driver"
-	nodes "github.com/lfittl/pg_query_go/nodes"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/panoplyio/pgsrv/protocol"
+	"io"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// defaultMaxQueryLength is the default maximum length of queries sent by clients
+// (see WithMaxQueryLength)
+const defaultMaxQueryLength = 16 << 20
+
+// defaultStreamBatchSize is the default number of rows flushed at once (see
+// WithStreamBatchSize), picked by BenchmarkQuery_streamBatchSize
+const defaultStreamBatchSize = 100
+
 // implements the Server interface
 type server struct {
-	queryer       Queryer
-	authenticator authenticator
+	queryer          Queryer
+	parser           Parser
+	parseCacheSize   int
+	rawSQL           bool
+	authenticator    authenticator
+	readBufferSize   int
+	writeBufferSize  int
+	maxQueryLength   int
+	maxPreparedStmts int
+	maxPortals       int
+	queryTimeout     time.Duration
+	maxResultRows    int
+	streamBatchSize  int
+	strictResultRows bool
+	authTimeout      time.Duration
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	slowClient       time.Duration
+	tcpKeepAlive     time.Duration
+	serverVersion    string
+	parameterStatus  map[string]string
+	router           DatabaseRouter
+	startupValidator StartupValidator
+	errorMapper      ErrorMapper
+	localizer        MessageLocalizer
+	middlewares      []QueryMiddleware
+	rewriter         ASTRewriter
+	parseNotice      ParseNotice
+	readOnly         bool
+	connWrapper      ConnWrapper
+	baseContext      BaseContext
+	connFilter       ConnFilter
+	onConnect        OnConnectHook
+	onDisconnect     OnDisconnectHook
+	tracer           protocol.Tracer
+	spanTracer       SpanTracer
+	redactSQL        func(sql string) string
+	strictFraming    bool
+	compressors      []Compressor
+	tls              *tls.Config
+	clientCAs        *x509.CertPool
+	verifyCertUser   bool
+	requireTLS       bool
+	functionCaller   FunctionCaller
+	logger           Logger
+	broker           broker
+
+	// the listeners added with AddListener, served until Shutdown cancels
+	// their context
+	listenersMu   sync.Mutex
+	listeners     sync.WaitGroup
+	listenersCtx  context.Context
+	stopListeners context.CancelFunc
+	closed        bool
 }
 
 // New creates a Server object capable of handling postgres client connections.
@@ -19,35 +85,103 @@ type server struct {
 // executing SQL commands (see Execer).
 //
 // If queryer implements passwordProvider interface, a new server will be protected
-// with a new md5Authenticator.
-func New(queryer Queryer) Server {
+// with a new md5Authenticator. Otherwise, if it implements GSSProvider, clients
+// will be authenticated using GSSAPI.
+//
+// The server's behavior can be further customized with the provided options
+// (see Option).
+func New(queryer Queryer, opts ...Option) Server {
 	var auth authenticator
 	auth = &noPasswordAuthenticator{}
 	pp, ok := queryer.(PasswordProvider)
 	if ok {
-		switch pp.Type() {
-		case MD5:
-			auth = &md5Authenticator{pp}
-		case Plain:
-			auth = &clearTextAuthenticator{pp}
+		auth = passwordAuthenticator(pp)
+	} else if gp, ok := queryer.(GSSProvider); ok {
+		auth = &gssAuthenticator{gp}
+	} else if pm, ok := queryer.(PeerMapper); ok {
+		auth = &peerAuthenticator{pm}
+	}
+	s := &server{
+		queryer:         queryer,
+		authenticator:   auth,
+		readBufferSize:  defaultBufferSize,
+		writeBufferSize: defaultBufferSize,
+		maxQueryLength:  defaultMaxQueryLength,
+		streamBatchSize: defaultStreamBatchSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.parseCacheSize > 0 {
+		parser := s.parser
+		if parser == nil {
+			parser = defaultParser
 		}
+		s.parser = newParseCache(parser, s.parseCacheSize)
+	}
+	return s
+}
+
+// passwordAuthenticator authenticates the clients with the passwords of the
+// provider, in the method of its Type
+func passwordAuthenticator(pp PasswordProvider) authenticator {
+	switch pp.Type() {
+	case MD5:
+		return &md5Authenticator{pp}
+	case Plain:
+		return &clearTextAuthenticator{pp}
+	case SCRAM:
+		return &scramAuthenticator{pp: pp}
 	}
-	return &server{queryer, auth}
+	return &noPasswordAuthenticator{}
 }
 
-// implements Queryer
-func (s *server) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
-	return s.queryer.Query(ctx, n)
+// keepAliveConn is implemented by connections that support TCP keepalive, like
+// *net.TCPConn
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
 }
 
-// implements Execer
-func (s *server) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
-	execer, ok := s.queryer.(Execer)
-	if !ok {
-		return nil, Unsupported("commands execution. Read-only mode.")
+// setKeepAlive configures the TCP keepalive of the connection, see
+// WithTCPKeepAlive
+func (s *server) setKeepAlive(conn net.Conn) error {
+	kc, ok := conn.(keepAliveConn)
+	if !ok || s.tcpKeepAlive == 0 {
+		return nil
 	}
 
-	return execer.Exec(ctx, n)
+	if s.tcpKeepAlive < 0 {
+		return kc.SetKeepAlive(false)
+	}
+
+	err := kc.SetKeepAlive(true)
+	if err != nil {
+		return err
+	}
+	return kc.SetKeepAlivePeriod(s.tcpKeepAlive)
+}
+
+// extraParameterStatus returns the parameters set with WithParameterStatus,
+// sorted by name, except for the ones that would replace the standard
+// parameters, or the protocol extension parameters (_pq_.*)
+func (s *server) extraParameterStatus(standard [][2]string) [][2]string {
+	reserved := map[string]bool{}
+	for _, param := range standard {
+		reserved[strings.ToLower(param[0])] = true
+	}
+
+	var params [][2]string
+	for k, v := range s.parameterStatus {
+		name := strings.ToLower(k)
+		if reserved[name] || strings.HasPrefix(name, "_pq_.") {
+			continue
+		}
+		params = append(params, [2]string{k, v})
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i][0] < params[j][0] })
+	return params
 }
 
 func (s *server) Listen(laddr string) error {
@@ -55,7 +189,10 @@ func (s *server) Listen(laddr string) error {
 	if err != nil {
 		return err
 	}
+	return s.ServeListener(ln)
+}
 
+func (s *server) ServeListener(ln net.Listener) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -66,13 +203,69 @@ func (s *server) Listen(laddr string) error {
 	}
 }
 
+// Notify sends a notification to all of the sessions listening on the channel.
+// Since it isn't raised by any session, the notifying process ID reported to
+// the clients is 0.
+func (s *server) Notify(channel, payload string) error {
+	return s.broker.notify(0, channel, payload)
+}
+
 func (s *server) Serve(conn net.Conn) error {
-	defer conn.Close()
+	return s.serve(conn, nil, nil)
+}
 
-	sess := &session{Server: s, Conn: conn}
-	err := sess.Serve()
+// serve serves the connection, as a member of the set of sessions drained
+// together, if provided (see ServeContext), with the configuration of the
+// listener that accepted it, if it was added with AddListener
+func (s *server) serve(conn net.Conn, set *sessionSet, l *listener) error {
+	// keepalive is set on the accepted connection, since the wrapper hides it
+	err := s.setKeepAlive(conn)
 	if err != nil {
-		// TODO: Log it?
+		conn.Close()
+		return err
+	}
+
+	if s.connWrapper != nil {
+		conn, err = s.wrapConn(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.connFilter != nil {
+		err := s.connFilter(conn)
+		if err != nil {
+			s.rejectConn(conn, err)
+			return err
+		}
+	}
+
+	bc := newBufferedConn(conn, s.readBufferSize, s.writeBufferSize)
+	defer bc.Close()
+
+	sess := &session{Server: s, Conn: bc, listener: l}
+	if set != nil {
+		if !set.add(sess) {
+			return nil // draining
+		}
+		defer set.remove(sess)
+	}
+
+	err = sess.Serve()
+	if err != nil && sess.isTerminated() {
+		err = nil
+	}
+	if err != nil && s.logger != nil {
+		// clients are expected to send Terminate before disconnecting
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			s.logger.Printf("pgsrv: connection from %s closed unexpectedly", conn.RemoteAddr())
+		} else if _, ok := err.(*timeoutError); ok {
+			s.logger.Printf("pgsrv: connection from %s timed out: %v", conn.RemoteAddr(), err)
+		} else if _, ok := err.(*slowClientError); ok {
+			s.logger.Printf("pgsrv: connection from %s aborted: %v", conn.RemoteAddr(), err)
+		} else {
+			s.logger.Printf("pgsrv: connection from %s failed: %v", conn.RemoteAddr(), err)
+		}
 	}
 	return err
 }
@@ -0,0 +1,59 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+)
+
+// StreamRows adapts a RowStream to driver.Rows, for backends that need to
+// provide both. Reading the next row fails once the context is done, even if
+// the producer doesn't close the channel. If the stream implements
+// driver.RowsColumnTypeDatabaseTypeName or io.Closer, they're used for the
+// column types and for closing the rows respectively.
+func StreamRows(ctx context.Context, stream RowStream) driver.Rows {
+	return &streamRows{ctx: ctx, stream: stream}
+}
+
+type streamRows struct {
+	ctx    context.Context
+	stream RowStream
+}
+
+func (r *streamRows) Columns() []string { return r.stream.Columns() }
+
+func (r *streamRows) ColumnTypeDatabaseTypeName(i int) string {
+	types, ok := r.stream.(driver.RowsColumnTypeDatabaseTypeName)
+	if !ok {
+		return ""
+	}
+	return types.ColumnTypeDatabaseTypeName(i)
+}
+
+func (r *streamRows) Close() error {
+	if closer, ok := r.stream.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (r *streamRows) Next(dest []driver.Value) error {
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case row, ok := <-r.stream.Rows():
+		if !ok {
+			if err := r.stream.Err(); err != nil {
+				return err
+			}
+			return io.EOF
+		}
+		if len(row) != len(dest) {
+			return InternalError("expected %d values in row, got %d", len(dest), len(row))
+		}
+		for i, v := range row {
+			dest[i] = v
+		}
+		return nil
+	}
+}
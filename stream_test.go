@@ -0,0 +1,331 @@
+package pgsrv
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// chanStream is a RowStream of the rows sent on its channel
+type chanStream struct {
+	rows chan []interface{}
+	err  error
+}
+
+func (s *chanStream) Columns() []string          { return []string{"a", "b"} }
+func (s *chanStream) Rows() <-chan []interface{} { return s.rows }
+func (s *chanStream) Err() error                 { return s.err }
+
+// streamQueryer streams the provided number of rows for every query
+type streamQueryer struct {
+	mockQueryer
+	count int
+}
+
+func (q *streamQueryer) QueryStream(ctx context.Context, n nodes.Node) (RowStream, error) {
+	stream := &chanStream{rows: make(chan []interface{})}
+	go func() {
+		defer close(stream.rows)
+		for i := 0; i < q.count; i++ {
+			select {
+			case stream.rows <- []interface{}{int64(i), fmt.Sprintf("row %d", i)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stream, nil
+}
+
+func TestStreamRows(t *testing.T) {
+	t.Run("reads until closed", func(t *testing.T) {
+		stream := &chanStream{rows: make(chan []interface{}, 2)}
+		stream.rows <- []interface{}{int64(1), "a"}
+		close(stream.rows)
+
+		rows := StreamRows(context.Background(), stream)
+		require.Equal(t, []string{"a", "b"}, rows.Columns())
+
+		dest := make([]driver.Value, 2)
+		require.NoError(t, rows.Next(dest))
+		require.Equal(t, []driver.Value{int64(1), "a"}, dest)
+		require.Equal(t, io.EOF, rows.Next(dest))
+	})
+
+	t.Run("stream error", func(t *testing.T) {
+		stream := &chanStream{rows: make(chan []interface{}), err: fmt.Errorf("boom")}
+		close(stream.rows)
+
+		rows := StreamRows(context.Background(), stream)
+		require.EqualError(t, rows.Next(make([]driver.Value, 2)), "boom")
+	})
+
+	t.Run("wrong number of values", func(t *testing.T) {
+		stream := &chanStream{rows: make(chan []interface{}, 1)}
+		stream.rows <- []interface{}{int64(1)}
+
+		rows := StreamRows(context.Background(), stream)
+		require.Error(t, rows.Next(make([]driver.Value, 2)))
+	})
+
+	t.Run("context done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		rows := StreamRows(ctx, &chanStream{rows: make(chan []interface{})})
+		require.Equal(t, context.Canceled, rows.Next(make([]driver.Value, 2)))
+	})
+}
+
+func TestSession_QueryStream(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &streamQueryer{count: 3}}
+	frontend, _ := connect(t, srv)
+
+	sendQuery(t, frontend, "SELECT 1")
+	receive(t, frontend, &pgproto3.RowDescription{})
+	for i := 0; i < 3; i++ {
+		msg := receive(t, frontend, &pgproto3.DataRow{})
+		require.Equal(t, [][]byte{
+			[]byte(fmt.Sprintf("%d", i)),
+			[]byte(fmt.Sprintf("row %d", i)),
+		}, msg.(*pgproto3.DataRow).Values)
+	}
+	msg := receive(t, frontend, &pgproto3.CommandComplete{})
+	require.Equal(t, "SELECT 3", msg.(*pgproto3.CommandComplete).CommandTag)
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+}
+
+// flushRecorder records the data written to it, and where it was flushed
+type flushRecorder struct {
+	bytes.Buffer
+	flushes []int
+}
+
+func (r *flushRecorder) Flush() error {
+	r.flushes = append(r.flushes, r.Buffer.Len())
+	return nil
+}
+
+func TestQuery_streamBatchSize(t *testing.T) {
+	values := make([][]interface{}, 10)
+	for i := range values {
+		values[i] = []interface{}{fmt.Sprintf("row %d", i)}
+	}
+
+	// readRows reads the rows written, in order, and the number of rows
+	// written up to every flush
+	readRows := func(t *testing.T, w *flushRecorder) ([]string, []int) {
+		var rows []string
+		var batches []int
+		size := len(protocol.RowDescription([]string{"a"}, []string{"TEXT"}))
+		for _, n := range w.flushes {
+			batches = append(batches, (n-size)/len(protocol.DataRow([]string{"row 0"})))
+		}
+
+		frontend, err := pgproto3.NewFrontend(bytes.NewReader(w.Bytes()), nil)
+		require.NoError(t, err)
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			switch v := msg.(type) {
+			case *pgproto3.DataRow:
+				rows = append(rows, string(v.Values[0]))
+			case *pgproto3.CommandComplete:
+				return rows, batches
+			}
+		}
+	}
+
+	tests := []struct {
+		name      string
+		batchSize int
+		strict    bool
+		batches   []int
+	}{
+		{"batches", 3, false, []int{3, 6, 9}},
+		{"a single batch", 10, false, []int{10}},
+		{"disabled", 0, false, nil},
+		{"strict rows", 4, true, []int{4, 8}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &flushRecorder{}
+			q := &query{
+				transport:  protocol.NewTransport(w),
+				batchSize:  test.batchSize,
+				maxRows:    100,
+				strictRows: test.strict,
+			}
+			rows := RowsFromValues([]ColumnDesc{{Name: "a", TypeName: "TEXT"}}, values)
+			require.NoError(t, q.writeRows(context.Background(), rows))
+
+			res, batches := readRows(t, w)
+			require.Len(t, res, len(values))
+			for i, row := range res {
+				require.Equal(t, fmt.Sprintf("row %d", i), row)
+			}
+			require.Equal(t, test.batches, batches)
+		})
+	}
+}
+
+func TestQuery_copyToBatchSize(t *testing.T) {
+	values := make([][]interface{}, 10)
+	for i := range values {
+		values[i] = []interface{}{fmt.Sprintf("row %d", i)}
+	}
+	table := "t"
+	stmt := nodes.CopyStmt{Relation: &nodes.RangeVar{Relname: &table}}
+
+	tests := []struct {
+		name      string
+		batchSize int
+		batches   []int
+	}{
+		{"batches", 3, []int{3, 6, 9}},
+		{"a single batch", 10, []int{10}},
+		{"disabled", 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &flushRecorder{}
+			q := &query{
+				transport: protocol.NewTransport(w),
+				queryer:   &copyToQueryer{columns: []ColumnDesc{{Name: "a", TypeName: "TEXT"}}, rows: values},
+				batchSize: test.batchSize,
+			}
+			require.NoError(t, q.copyTo(context.Background(), stmt))
+
+			// the number of rows written up to every flush
+			var batches []int
+			size := len(protocol.CopyOutResponse(protocol.CopyTextFormat, 1))
+			for _, n := range w.flushes {
+				batches = append(batches, (n-size)/len(protocol.CopyData([]byte("row 0\n"))))
+			}
+			require.Equal(t, test.batches, batches)
+
+			frontend, err := pgproto3.NewFrontend(bytes.NewReader(w.Bytes()), nil)
+			require.NoError(t, err)
+			receive(t, frontend, &pgproto3.CopyOutResponse{})
+			for i := range values {
+				msg := receive(t, frontend, &pgproto3.CopyData{})
+				require.Equal(t, fmt.Sprintf("row %d\n", i), string(msg.(*pgproto3.CopyData).Data))
+			}
+			receive(t, frontend, &pgproto3.CopyDone{})
+			msg := receive(t, frontend, &pgproto3.CommandComplete{})
+			require.Equal(t, "COPY 10", msg.(*pgproto3.CommandComplete).CommandTag)
+		})
+	}
+}
+
+// gatedQueryer streams the rows of its first batch, and the rest of them once
+// its gate is closed
+type gatedQueryer struct {
+	mockQueryer
+	batch, count int
+	gate         chan struct{}
+}
+
+func (q *gatedQueryer) QueryStream(ctx context.Context, n nodes.Node) (RowStream, error) {
+	stream := &chanStream{rows: make(chan []interface{})}
+	go func() {
+		defer close(stream.rows)
+		for i := 0; i < q.count; i++ {
+			if i == q.batch {
+				<-q.gate
+			}
+			select {
+			case stream.rows <- []interface{}{int64(i), fmt.Sprintf("row %d", i)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stream, nil
+}
+
+func TestSession_executeBatchSize(t *testing.T) {
+	queryer := &gatedQueryer{batch: 3, count: 6, gate: make(chan struct{})}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: queryer, streamBatchSize: 3}
+	frontend, _ := connect(t, srv)
+
+	msgs := []pgproto3.FrontendMessage{
+		&pgproto3.Parse{Query: "SELECT 1"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	}
+	for _, msg := range msgs {
+		require.NoError(t, frontend.Send(msg))
+	}
+
+	// the first batch of rows is sent before the portal is done, rather than
+	// held until Sync
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		receive(t, frontend, &pgproto3.ParseComplete{})
+		receive(t, frontend, &pgproto3.BindComplete{})
+		for i := 0; i < 3; i++ {
+			receive(t, frontend, &pgproto3.DataRow{})
+		}
+	}()
+	select {
+	case <-first:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the first batch of rows before the rest of them")
+	}
+
+	close(queryer.gate)
+	for i := 3; i < 6; i++ {
+		msg := receive(t, frontend, &pgproto3.DataRow{})
+		require.Equal(t, fmt.Sprintf("row %d", i), string(msg.(*pgproto3.DataRow).Values[1]))
+	}
+	msg := receive(t, frontend, &pgproto3.CommandComplete{})
+	require.Equal(t, "SELECT 6", msg.(*pgproto3.CommandComplete).CommandTag)
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+}
+
+// BenchmarkQuery_streamBatchSize measures the throughput of sending a 10k rows
+// result over a loopback TCP connection, when flushing every batch of rows
+func BenchmarkQuery_streamBatchSize(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	for _, size := range []int{0, 1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("batch size %d", size), func(b *testing.B) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(b, err)
+			defer conn.Close()
+
+			bc := newBufferedConn(conn, defaultBufferSize, defaultBufferSize)
+			q := &query{transport: protocol.NewTransport(bc), batchSize: size}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				q.writeRows(context.Background(), &wideRows{10000})
+				bc.Flush()
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// RowsFromStructs returns the rows of a slice of structs (or pointers to
+// structs), with a column per exported field and a row per element, for
+// backends that already have their results at hand.
+//
+// The columns are named after the fields, in lower case, or by their pg tag,
+// like `pg:"created_at"`. Fields tagged with `pg:"-"` are omitted. The fields
+// of embedded structs are included as if they were fields of the outer struct.
+// The column types are derived from the field types, so that bool, the ints,
+// the floats, string, []byte and time.Time are reported to the client with
+// their matching postgres types, and slices of them as arrays. Other types are
+// reported as text. Nil pointers, including nil elements of the slice and nil
+// embedded structs, are NULL.
+func RowsFromStructs(slice interface{}) (driver.Rows, error) {
+	v := reflect.ValueOf(slice)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("expected a slice of structs, got %T", slice)
+	}
+
+	elem := v.Type().Elem()
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected a slice of structs, got %T", slice)
+	}
+
+	rows := &structRows{slice: v}
+	rows.addFields(elem, nil)
+	return rows, nil
+}
+
+// structField is a column of structRows
+type structField struct {
+	name     string
+	typeName string
+	index    []int // see reflect.Value.FieldByIndex
+}
+
+// structRows implements driver.Rows over a slice of structs
+type structRows struct {
+	slice  reflect.Value
+	fields []structField
+	next   int
+}
+
+// addFields adds the columns of the struct's fields, recursively for embedded
+// structs
+func (r *structRows) addFields(t reflect.Type, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("pg")
+		if tag == "-" {
+			continue
+		}
+
+		fieldIndex := append(append([]int{}, index...), i)
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && ft.Kind() == reflect.Struct && ft != timeType && tag == "" {
+			r.addFields(ft, fieldIndex)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+
+		name := tag
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		r.fields = append(r.fields, structField{name, fieldTypeName(f.Type), fieldIndex})
+	}
+}
+
+// fieldTypeName returns the name of the postgres type of the field type, or
+// an empty string for text
+func fieldTypeName(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return "TIMESTAMPTZ"
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "BOOL"
+	case reflect.Int8, reflect.Int16, reflect.Uint8:
+		return "INT2"
+	case reflect.Int32, reflect.Uint16:
+		return "INT4"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return "INT8"
+	case reflect.Float32:
+		return "FLOAT4"
+	case reflect.Float64:
+		return "FLOAT8"
+	case reflect.String:
+		return "TEXT"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "BYTEA"
+		}
+		if name := fieldTypeName(t.Elem()); name != "" && name[0] != '_' {
+			return "_" + name
+		}
+	}
+	return ""
+}
+
+func (r *structRows) Columns() []string {
+	cols := make([]string, len(r.fields))
+	for i, f := range r.fields {
+		cols[i] = f.name
+	}
+	return cols
+}
+
+func (r *structRows) ColumnTypeDatabaseTypeName(i int) string {
+	return r.fields[i].typeName
+}
+
+func (r *structRows) Close() error { return nil }
+
+func (r *structRows) Next(dest []driver.Value) error {
+	if r.next >= r.slice.Len() {
+		return io.EOF
+	}
+
+	elem := r.slice.Index(r.next)
+	r.next++
+	for i, f := range r.fields {
+		dest[i] = fieldValue(elem, f.index)
+	}
+	return nil
+}
+
+// fieldValue returns the value of the nested field, or nil if it's a nil
+// pointer or any of the structs containing it is
+func fieldValue(v reflect.Value, index []int) driver.Value {
+	for _, i := range index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return nil
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	return v.Interface()
+}
@@ -0,0 +1,127 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+	"time"
+)
+
+// structsQueryer returns the rows of its accounts for every query
+type structsQueryer struct {
+	accounts interface{}
+}
+
+func (q *structsQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return RowsFromStructs(q.accounts)
+}
+
+type audit struct {
+	CreatedAt time.Time `pg:"created_at"`
+}
+
+type owner struct {
+	Owner string
+}
+
+type account struct {
+	audit
+	*owner
+	ID      int64
+	Name    string `pg:"full_name"`
+	Balance *float64
+	Tags    []string
+	Secret  string `pg:"-"`
+	private int
+}
+
+func TestRowsFromStructs(t *testing.T) {
+	created := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	balance := 12.5
+	accounts := []*account{
+		{audit{created}, &owner{"alice"}, 1, "Alice", &balance, []string{"a", "b"}, "x", 0},
+		{audit{created}, nil, 2, "Bob", nil, nil, "y", 0},
+		nil,
+	}
+
+	rows, err := RowsFromStructs(accounts)
+	require.NoError(t, err)
+
+	cols := []string{"created_at", "owner", "id", "full_name", "balance", "tags"}
+	require.Equal(t, cols, rows.Columns())
+
+	types := rows.(driver.RowsColumnTypeDatabaseTypeName)
+	var typeNames []string
+	for i := range cols {
+		typeNames = append(typeNames, types.ColumnTypeDatabaseTypeName(i))
+	}
+	require.Equal(t, []string{"TIMESTAMPTZ", "TEXT", "INT8", "TEXT", "FLOAT8", "_TEXT"}, typeNames)
+
+	expected := [][]driver.Value{
+		{created, "alice", int64(1), "Alice", 12.5, []string{"a", "b"}},
+		{created, nil, int64(2), "Bob", nil, []string(nil)},
+		{nil, nil, nil, nil, nil, nil},
+	}
+	for _, row := range expected {
+		dest := make([]driver.Value, len(cols))
+		require.NoError(t, rows.Next(dest))
+		require.Equal(t, row, dest)
+	}
+	require.Equal(t, io.EOF, rows.Next(make([]driver.Value, len(cols))))
+
+	t.Run("not a slice of structs", func(t *testing.T) {
+		_, err := RowsFromStructs(account{})
+		require.Error(t, err)
+
+		_, err = RowsFromStructs([]int{1})
+		require.Error(t, err)
+	})
+
+	t.Run("query", func(t *testing.T) {
+		accounts := []struct {
+			ID   int32
+			Name string
+		}{{1, "alice"}}
+
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &structsQueryer{accounts}}
+		frontend, _ := connect(t, srv)
+		sendQuery(t, frontend, "SELECT * FROM accounts")
+
+		msg := receive(t, frontend, &pgproto3.RowDescription{}).(*pgproto3.RowDescription)
+		require.Equal(t, "id", msg.Fields[0].Name)
+		require.Equal(t, uint32(23), msg.Fields[0].DataTypeOID)
+		row := receive(t, frontend, &pgproto3.DataRow{}).(*pgproto3.DataRow)
+		require.Equal(t, [][]byte{[]byte("1"), []byte("alice")}, row.Values)
+		receive(t, frontend, &pgproto3.CommandComplete{})
+	})
+
+	t.Run("nil pointers", func(t *testing.T) {
+		name := "alice"
+		accounts := []struct {
+			Name *string
+			At   *time.Time
+		}{{&name, nil}, {nil, nil}}
+
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &structsQueryer{accounts}}
+		frontend, _ := connect(t, srv)
+		sendQuery(t, frontend, "SELECT * FROM accounts")
+
+		msg := receive(t, frontend, &pgproto3.RowDescription{}).(*pgproto3.RowDescription)
+		require.Equal(t, uint32(1184), msg.Fields[1].DataTypeOID, "expected timestamptz")
+		row := receive(t, frontend, &pgproto3.DataRow{}).(*pgproto3.DataRow)
+		require.Equal(t, [][]byte{[]byte("alice"), nil}, row.Values)
+		row = receive(t, frontend, &pgproto3.DataRow{}).(*pgproto3.DataRow)
+		require.Equal(t, [][]byte{nil, nil}, row.Values, "expected NULLs rather than <nil>")
+		receive(t, frontend, &pgproto3.CommandComplete{})
+	})
+
+	t.Run("arrays of times", func(t *testing.T) {
+		rows, err := RowsFromStructs([]struct{ Times []time.Time }{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"_TIMESTAMPTZ"}, columnTypes(rows))
+	})
+}
@@ -0,0 +1,114 @@
+package pgsrv
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/panoplyio/pgsrv/protocol"
+	"net"
+	"strings"
+)
+
+// tlsConfig returns the TLS configuration of client connections, if enabled,
+// requiring client certificates signed by the client CAs, if provided
+func (s *server) tlsConfig() *tls.Config {
+	return s.clientTLSConfig(s.tls)
+}
+
+// clientTLSConfig returns the provided TLS configuration, requiring client
+// certificates signed by the client CAs, if provided
+func (s *server) clientTLSConfig(config *tls.Config) *tls.Config {
+	if config == nil || s.clientCAs == nil {
+		return config
+	}
+
+	config = config.Clone()
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = s.clientCAs
+	return config
+}
+
+// startTLS performs the TLS handshake on the connection, once the client was
+// told to proceed with it, and encrypts the data read from and written to the
+// connection from then on
+func (c *bufferedConn) startTLS(config *tls.Config) error {
+	// the client must wait for the response before starting the handshake
+	if c.r.Buffered() > 0 {
+		return &protocol.ProtocolError{Message: "received unencrypted data after SSL request"}
+	}
+
+	// record the certificate presented to the client, for binding the
+	// authentication to the channel (see tlsServerEndPoint). Certificates
+	// selected by GetConfigForClient aren't recorded.
+	config = config.Clone()
+	certs, getCertificate := config.Certificates, config.GetCertificate
+	config.Certificates = nil
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := selectCertificate(certs, getCertificate, hello)
+		if cert != nil && len(cert.Certificate) > 0 {
+			c.serverCert = cert.Certificate[0]
+		}
+		return cert, err
+	}
+
+	conn := tls.Server(c.Conn, config)
+	err := conn.Handshake()
+	if err != nil {
+		return fmt.Errorf("TLS handshake failed: %v", err)
+	}
+
+	c.Conn = conn
+	c.r = bufio.NewReaderSize(conn, c.r.Size())
+	c.w = bufio.NewWriterSize(conn, c.w.Size())
+	return nil
+}
+
+// tlsServerEndPoint returns the tls-server-end-point channel binding data of
+// the session's connection, or nil when it isn't encrypted
+func (s *session) tlsServerEndPoint() []byte {
+	bc, ok := s.Conn.(*bufferedConn)
+	if !ok || bc.serverCert == nil {
+		return nil
+	}
+	return tlsServerEndPointData(bc.serverCert)
+}
+
+// requireTLS rejects the clients that didn't upgrade their connection to TLS
+// with an accepted SSLRequest, see WithRequireTLS
+func (s *session) requireTLS() error {
+	switch s.netConn().(type) {
+	case *tls.Conn, *net.UnixConn:
+		return nil
+	}
+	return InvalidAuthorizationSpecification("SSL connection is required")
+}
+
+// verifyCertUser verifies that the client presented a certificate for the
+// requested user, in its common name or one of its DNS names, see
+// WithClientCertUser
+func (s *session) verifyCertUser() error {
+	user, _ := s.Args["user"].(string)
+	err := InvalidAuthorizationSpecification("certificate authentication failed for user \"%s\"", user)
+
+	bc, ok := s.Conn.(*bufferedConn)
+	if !ok {
+		return err
+	}
+	conn, ok := bc.Conn.(*tls.Conn)
+	if !ok {
+		return err
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return err
+	}
+
+	names := append([]string{certs[0].Subject.CommonName}, certs[0].DNSNames...)
+	for _, name := range names {
+		if name != "" && strings.EqualFold(name, user) {
+			return nil
+		}
+	}
+	return err
+}
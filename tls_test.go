@@ -0,0 +1,334 @@
+package pgsrv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// testCA issues the certificates of the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool}
+}
+
+// issue creates a certificate for the common name and DNS names, signed by
+// the CA
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage, cn string, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startUpTLS requests TLS over the connection, and sends the startup message
+// over the encrypted connection, returning the first message that isn't a
+// part of a successful startup, or ReadyForQuery
+func startUpTLS(t *testing.T, conn net.Conn, config *tls.Config, user string) (pgproto3.BackendMessage, error) {
+	_, err := conn.Write([]byte{0, 0, 0, 8, 4, 210, 22, 47})
+	require.NoError(t, err)
+
+	res := make([]byte, 1)
+	_, err = io.ReadFull(conn, res)
+	require.NoError(t, err)
+	require.Equal(t, "S", string(res))
+
+	tlsConn := tls.Client(conn, config)
+	frontend, err := pgproto3.NewFrontend(tlsConn, tlsConn)
+	require.NoError(t, err)
+
+	err = frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": user},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := frontend.Receive()
+		if err != nil {
+			return nil, err
+		}
+		switch msg.(type) {
+		case *pgproto3.ReadyForQuery, *pgproto3.ErrorResponse:
+			return msg, nil
+		}
+	}
+}
+
+func TestServer_TLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, x509.ExtKeyUsageServerAuth, "localhost", "localhost")
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+
+	clientTLS := func(certs ...tls.Certificate) *tls.Config {
+		return &tls.Config{RootCAs: ca.pool, ServerName: "localhost", Certificates: certs}
+	}
+
+	t.Run("declined by default", func(t *testing.T) {
+		conn := dialServer(t, New(&mockQueryer{}))
+		defer conn.Close()
+
+		_, err := conn.Write([]byte{0, 0, 0, 8, 4, 210, 22, 47})
+		require.NoError(t, err)
+		res := make([]byte, 1)
+		_, err = io.ReadFull(conn, res)
+		require.NoError(t, err)
+		require.Equal(t, "N", string(res))
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		conn := dialServer(t, New(&mockQueryer{}, WithTLSConfig(serverTLS)))
+		defer conn.Close()
+
+		msg, err := startUpTLS(t, conn, clientTLS(), "postgres")
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ReadyForQuery{}, msg)
+	})
+
+	srv := New(&mockQueryer{},
+		WithTLSConfig(serverTLS),
+		WithClientCertificates(ca.pool),
+		WithClientCertUser(),
+	)
+
+	t.Run("client certificate", func(t *testing.T) {
+		for _, cert := range []tls.Certificate{
+			ca.issue(t, x509.ExtKeyUsageClientAuth, "alice"),
+			ca.issue(t, x509.ExtKeyUsageClientAuth, "", "alice"),
+		} {
+			conn := dialServer(t, srv)
+			msg, err := startUpTLS(t, conn, clientTLS(cert), "alice")
+			conn.Close()
+			require.NoError(t, err)
+			require.IsType(t, &pgproto3.ReadyForQuery{}, msg)
+		}
+	})
+
+	t.Run("certificate of another user", func(t *testing.T) {
+		conn := dialServer(t, srv)
+		defer conn.Close()
+
+		cert := ca.issue(t, x509.ExtKeyUsageClientAuth, "bob")
+		msg, err := startUpTLS(t, conn, clientTLS(cert), "alice")
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+		require.Equal(t, "28000", msg.(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+		require.Equal(t, `certificate authentication failed for user "alice"`, msg.(*pgproto3.ErrorResponse).Message)
+	})
+
+	t.Run("no certificate", func(t *testing.T) {
+		conn := dialServer(t, srv)
+		defer conn.Close()
+
+		_, err := startUpTLS(t, conn, clientTLS(), "alice")
+		require.Error(t, err)
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		conn := dialServer(t, srv)
+		defer conn.Close()
+
+		cert := newTestCA(t).issue(t, x509.ExtKeyUsageClientAuth, "alice")
+		_, err := startUpTLS(t, conn, clientTLS(cert), "alice")
+		require.Error(t, err)
+	})
+}
+
+// errSSLNotSupported is the error of libpq when the server declines the
+// SSLRequest under sslmode=require
+var errSSLNotSupported = errors.New("server does not support SSL, but SSL was required")
+
+// startUpSSLMode starts up a session over the connection like libpq does
+// under the sslmode: disable doesn't request TLS, prefer requests it and
+// proceeds unencrypted when it's declined, while require and verify-full
+// abort. It returns the first message that isn't a part of a successful
+// startup, or ReadyForQuery, and whether the connection is encrypted.
+func startUpSSLMode(t *testing.T, conn net.Conn, sslmode string, config *tls.Config) (pgproto3.BackendMessage, bool, error) {
+	rw := conn
+	if sslmode != "disable" {
+		_, err := conn.Write([]byte{0, 0, 0, 8, 4, 210, 22, 47})
+		require.NoError(t, err)
+
+		res := make([]byte, 1)
+		_, err = io.ReadFull(conn, res)
+		require.NoError(t, err)
+
+		switch {
+		case res[0] == 'S':
+			if sslmode != "verify-full" {
+				config = &tls.Config{InsecureSkipVerify: true}
+			}
+			tlsConn := tls.Client(conn, config)
+			err = tlsConn.Handshake()
+			if err != nil {
+				return nil, false, err
+			}
+			rw = tlsConn
+		case sslmode != "prefer":
+			return nil, false, errSSLNotSupported
+		}
+	}
+
+	frontend, err := pgproto3.NewFrontend(rw, rw)
+	require.NoError(t, err)
+	err = frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	})
+	require.NoError(t, err)
+
+	_, encrypted := rw.(*tls.Conn)
+	for {
+		msg, err := frontend.Receive()
+		if err != nil {
+			return nil, encrypted, err
+		}
+		switch msg.(type) {
+		case *pgproto3.ReadyForQuery, *pgproto3.ErrorResponse:
+			return msg, encrypted, nil
+		}
+	}
+}
+
+func TestServer_sslmode(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, x509.ExtKeyUsageServerAuth, "localhost", "localhost")
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	clientTLS := &tls.Config{RootCAs: ca.pool, ServerName: "localhost"}
+
+	// the outcome of connecting with an sslmode: encrypted or unencrypted
+	// sessions, the code of the error of the server, or the error of the
+	// client
+	const (
+		encrypted   = "encrypted"
+		unencrypted = "unencrypted"
+		aborted     = "aborted"
+	)
+
+	tests := []struct {
+		name     string
+		srv      Server
+		outcomes map[string]string // by sslmode
+	}{
+		{"without TLS", New(&mockQueryer{}), map[string]string{
+			"disable":     unencrypted,
+			"prefer":      unencrypted,
+			"require":     aborted,
+			"verify-full": aborted,
+		}},
+		{"with TLS", New(&mockQueryer{}, WithTLSConfig(serverTLS)), map[string]string{
+			"disable":     unencrypted,
+			"prefer":      encrypted,
+			"require":     encrypted,
+			"verify-full": encrypted,
+		}},
+		{"requiring TLS", New(&mockQueryer{}, WithTLSConfig(serverTLS), WithRequireTLS()), map[string]string{
+			"disable":     "28000",
+			"prefer":      encrypted,
+			"require":     encrypted,
+			"verify-full": encrypted,
+		}},
+		{"requiring TLS without TLS", New(&mockQueryer{}, WithRequireTLS()), map[string]string{
+			"disable":     "28000",
+			"prefer":      "28000",
+			"require":     aborted,
+			"verify-full": aborted,
+		}},
+	}
+
+	for _, test := range tests {
+		for _, sslmode := range []string{"disable", "prefer", "require", "verify-full"} {
+			t.Run(test.name+"/"+sslmode, func(t *testing.T) {
+				conn := dialServer(t, test.srv)
+				defer conn.Close()
+
+				msg, isEncrypted, err := startUpSSLMode(t, conn, sslmode, clientTLS)
+				outcome := test.outcomes[sslmode]
+				switch outcome {
+				case aborted:
+					require.Equal(t, errSSLNotSupported, err)
+				case encrypted, unencrypted:
+					require.NoError(t, err)
+					require.IsType(t, &pgproto3.ReadyForQuery{}, msg)
+					require.Equal(t, outcome == encrypted, isEncrypted)
+				default:
+					require.NoError(t, err)
+					require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+					require.Equal(t, outcome, msg.(*pgproto3.ErrorResponse).Code)
+					require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+					require.Equal(t, "SSL connection is required", msg.(*pgproto3.ErrorResponse).Message)
+				}
+			})
+		}
+	}
+
+	t.Run("unix sockets are exempt", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "pgsrv")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		ln, err := ListenUnix(dir, 5432)
+		require.NoError(t, err)
+		defer ln.Close()
+		go New(&mockQueryer{}, WithTLSConfig(serverTLS), WithRequireTLS()).ServeListener(ln)
+
+		conn, err := net.Dial("unix", UnixSocketPath(dir, 5432))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		msg, _, err := startUpSSLMode(t, conn, "disable", nil)
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ReadyForQuery{}, msg)
+	})
+}
@@ -0,0 +1,167 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+// SpanTracer starts the spans tracing the sessions and their statements, see
+// WithSpanTracer. It's shaped after the Tracer of OpenTelemetry, so it's
+// satisfied by a thin adapter of it, without the package depending on
+// OpenTelemetry:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, pgsrv.Span) {
+//		ctx, span := t.Tracer.Start(ctx, name)
+//		return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ trace.Span }
+//
+//	func (s otelSpan) SetAttribute(key string, value interface{}) {
+//		s.SetAttributes(attribute.String(key, fmt.Sprint(value)))
+//	}
+//	func (s otelSpan) RecordError(err error) {
+//		s.Span.RecordError(err)
+//		s.SetStatus(codes.Error, err.Error())
+//	}
+//	func (s otelSpan) End() { s.Span.End() }
+type SpanTracer interface {
+	// Start starts a span as a child of the span in ctx, if there's one,
+	// returning a context that carries the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a SpanTracer
+type Span interface {
+	// SetAttribute sets an attribute of the span, whose value is a string,
+	// an int64 or a bool
+	SetAttribute(key string, value interface{})
+
+	// RecordError records the error that failed the operation of the span
+	RecordError(err error)
+
+	// End ends the span
+	End()
+}
+
+// the names of the spans started by the SpanTracer
+const (
+	sessionSpanName   = "pgsrv.session"
+	statementSpanName = "pgsrv.statement"
+)
+
+// statementKindNames are the names of the statement kinds in the
+// pgsrv.statement_kind attribute of the spans
+var statementKindNames = map[StatementKind]string{
+	CommandStatement:      "command",
+	QueryStatement:        "query",
+	PrepareStatement:      "prepare",
+	SetStatement:          "set",
+	ShowStatement:         "show",
+	NotificationStatement: "notification",
+	DiscardStatement:      "discard",
+	TransactionStatement:  "transaction",
+	CursorStatement:       "cursor",
+}
+
+// startSessionSpan starts the span of the session, from its startup until it
+// ends, as a child of the span of its base context, if there's one. The
+// returned context carries the span to the spans of its statements.
+func (s *session) startSessionSpan(ctx context.Context) context.Context {
+	if s.Server.spanTracer == nil {
+		return ctx
+	}
+
+	ctx, s.span = s.Server.spanTracer.Start(ctx, sessionSpanName)
+	s.span.SetAttribute("db.system", "postgresql")
+	s.span.SetAttribute("db.user", s.user)
+	s.span.SetAttribute("db.name", s.database)
+	s.span.SetAttribute("pgsrv.pid", int64(s.pid))
+	if s.appName != "" {
+		s.span.SetAttribute("pgsrv.application_name", s.appName)
+	}
+	return ctx
+}
+
+// endSessionSpan ends the span of the session, if it was started
+func (s *session) endSessionSpan() {
+	if s.span != nil {
+		s.span.End()
+		s.span = nil
+	}
+}
+
+// statementSpan is the span of a single statement, recording the outcome of
+// the statement as it's executed
+type statementSpan struct {
+	Span
+	err error // the first error reported to the client
+}
+
+// startSpan starts the span of a statement, or of the entire sql string in raw
+// sql mode, when there's a SpanTracer. The returned context carries the span,
+// for recording the outcome of the statement (see spanFromContext), while
+// calling the returned function with the error of the statement ends it.
+func (q *query) startSpan(ctx context.Context, kind string) (context.Context, func(error)) {
+	if q.spanTracer == nil {
+		return ctx, func(error) {}
+	}
+
+	ctx, s := q.spanTracer.Start(ctx, statementSpanName)
+	span := &statementSpan{Span: s}
+	span.SetAttribute("db.system", "postgresql")
+	if kind != "" {
+		span.SetAttribute("pgsrv.statement_kind", kind)
+	}
+
+	sql := q.sql
+	if q.redactSQL != nil {
+		sql = q.redactSQL(sql)
+	}
+	if sql != "" {
+		span.SetAttribute("db.statement", sql)
+	}
+
+	ctx = context.WithValue(ctx, spanCtxKey, span)
+	return ctx, func(err error) {
+		span.recordError(err)
+		span.End()
+	}
+}
+
+// spanFromContext returns the span of the statement in ctx, or nil when it's
+// not traced
+func spanFromContext(ctx context.Context) *statementSpan {
+	span, _ := ctx.Value(spanCtxKey).(*statementSpan)
+	return span
+}
+
+// recordError records the error that failed the statement, once
+func (span *statementSpan) recordError(err error) {
+	if span == nil || err == nil || span.err != nil {
+		return
+	}
+	span.err = err
+	span.RecordError(err)
+	span.SetAttribute("pgsrv.sqlstate", fromErr(err).C)
+}
+
+// setRows records the number of rows returned by the statement
+func (span *statementSpan) setRows(count int) {
+	if span != nil {
+		span.SetAttribute("pgsrv.rows", int64(count))
+	}
+}
+
+// setRowsAffected records the number of rows affected by a command, when the
+// backend reports it
+func (span *statementSpan) setRowsAffected(res driver.Result) {
+	if span == nil || res == nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil {
+		span.SetAttribute("pgsrv.rows", n)
+	}
+}
@@ -0,0 +1,193 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTracer records the spans it started, linking them to the span of
+// the context they were started in
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordingSpan
+}
+
+type spanKey struct{}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent, _ := ctx.Value(spanKey{}).(*recordingSpan)
+	span := &recordingSpan{name: name, parent: parent, attrs: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// named returns the spans of the name, in the order they were started
+func (t *recordingTracer) named(name string) []*recordingSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var spans []*recordingSpan
+	for _, span := range t.spans {
+		if span.name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+type recordingSpan struct {
+	mu     sync.Mutex
+	name   string
+	parent *recordingSpan
+	attrs  map[string]interface{}
+	errs   []error
+	ended  bool
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, err)
+}
+
+func (s *recordingSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+}
+
+func (s *recordingSpan) isEnded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ended
+}
+
+// tracedQueryer returns 2 rows for queries, and fails DROP statements
+type tracedQueryer struct{}
+
+func (tracedQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return &mockRows{rows: 2}, nil
+}
+
+func (tracedQueryer) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
+	if _, ok := n.(nodes.DropStmt); ok {
+		return nil, UndefinedTable("t")
+	}
+	return driver.RowsAffected(3), nil
+}
+
+func TestWithSpanTracer(t *testing.T) {
+	// expectReady reads the messages up to ReadyForQuery
+	expectReady := func(t *testing.T, frontend *pgproto3.Frontend) {
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				return
+			}
+		}
+	}
+
+	t.Run("session and statements", func(t *testing.T) {
+		tracer := &recordingTracer{}
+		upstream := &recordingSpan{name: "upstream"}
+		srv := New(tracedQueryer{}, WithSpanTracer(tracer), WithBaseContext(func(net.Conn) context.Context {
+			return context.WithValue(context.Background(), spanKey{}, upstream)
+		})).(*server)
+		frontend, pid := connect(t, srv)
+
+		sessions := tracer.named(sessionSpanName)
+		require.Len(t, sessions, 1)
+		session := sessions[0]
+		require.Equal(t, upstream, session.parent)
+		require.Equal(t, "postgresql", session.attrs["db.system"])
+		require.Equal(t, int64(pid), session.attrs["pgsrv.pid"])
+		require.Contains(t, session.attrs, "db.user")
+
+		sql := "SELECT * FROM foo; INSERT INTO foo VALUES (1); DROP TABLE t"
+		sendQuery(t, frontend, sql)
+		expectReady(t, frontend)
+
+		stmts := tracer.named(statementSpanName)
+		require.Len(t, stmts, 3)
+		for _, span := range stmts {
+			require.Equal(t, session, span.parent)
+			require.True(t, span.isEnded())
+			require.Equal(t, sql, span.attrs["db.statement"])
+		}
+
+		require.Equal(t, "query", stmts[0].attrs["pgsrv.statement_kind"])
+		require.Equal(t, int64(2), stmts[0].attrs["pgsrv.rows"])
+		require.Empty(t, stmts[0].errs)
+
+		require.Equal(t, "command", stmts[1].attrs["pgsrv.statement_kind"])
+		require.Equal(t, int64(3), stmts[1].attrs["pgsrv.rows"])
+		require.Empty(t, stmts[1].errs)
+
+		require.Len(t, stmts[2].errs, 1)
+		require.Equal(t, "42P01", stmts[2].attrs["pgsrv.sqlstate"])
+
+		require.False(t, session.isEnded())
+		require.NoError(t, frontend.Send(&pgproto3.Terminate{}))
+		require.Eventually(t, session.isEnded, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("rejected statements", func(t *testing.T) {
+		tracer := &recordingTracer{}
+		srv := New(tracedQueryer{}, WithSpanTracer(tracer), WithReadOnly()).(*server)
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "INSERT INTO foo VALUES (1)")
+		expectReady(t, frontend)
+
+		stmts := tracer.named(statementSpanName)
+		require.Len(t, stmts, 1)
+		require.Len(t, stmts[0].errs, 1)
+		require.Equal(t, "25006", stmts[0].attrs["pgsrv.sqlstate"])
+	})
+
+	t.Run("redacted sql", func(t *testing.T) {
+		tracer := &recordingTracer{}
+		redact := func(sql string) string {
+			if strings.Contains(sql, "secret") {
+				return ""
+			}
+			return strings.ToLower(sql)
+		}
+		srv := New(tracedQueryer{}, WithSpanTracer(tracer), WithSQLRedaction(redact)).(*server)
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "SELECT 1")
+		expectReady(t, frontend)
+		sendQuery(t, frontend, "SELECT 'secret'")
+		expectReady(t, frontend)
+
+		stmts := tracer.named(statementSpanName)
+		require.Len(t, stmts, 2)
+		require.Equal(t, "select 1", stmts[0].attrs["db.statement"])
+		require.NotContains(t, stmts[1].attrs, "db.statement")
+	})
+
+	t.Run("without tracer", func(t *testing.T) {
+		srv := New(tracedQueryer{}).(*server)
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "SELECT 1; DROP TABLE t")
+		expectReady(t, frontend)
+	})
+}
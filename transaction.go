@@ -0,0 +1,267 @@
+package pgsrv
+
+import (
+	"context"
+	"fmt"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"strings"
+)
+
+// transactionTags are the command tags of the transaction statements
+var transactionTags = map[nodes.TransactionStmtKind]string{
+	nodes.TRANS_STMT_BEGIN:             "BEGIN",
+	nodes.TRANS_STMT_START:             "START TRANSACTION",
+	nodes.TRANS_STMT_COMMIT:            "COMMIT",
+	nodes.TRANS_STMT_ROLLBACK:          "ROLLBACK",
+	nodes.TRANS_STMT_SAVEPOINT:         "SAVEPOINT",
+	nodes.TRANS_STMT_RELEASE:           "RELEASE",
+	nodes.TRANS_STMT_ROLLBACK_TO:       "ROLLBACK",
+	nodes.TRANS_STMT_PREPARE:           "PREPARE TRANSACTION",
+	nodes.TRANS_STMT_COMMIT_PREPARED:   "COMMIT PREPARED",
+	nodes.TRANS_STMT_ROLLBACK_PREPARED: "ROLLBACK PREPARED",
+}
+
+// defaultIsolation is the isolation level of transactions, unless it's changed
+// with default_transaction_isolation
+const defaultIsolation = "read committed"
+
+// isolationLevels are the transaction isolation levels, as reported by SHOW
+// transaction_isolation
+var isolationLevels = map[string]bool{
+	"serializable":     true,
+	"repeatable read":  true,
+	"read committed":   true,
+	"read uncommitted": true,
+}
+
+// transactionMode holds the characteristics of a transaction, which are set
+// with BEGIN or SET TRANSACTION, or for all of the transactions of the session
+// with SET SESSION CHARACTERISTICS
+type transactionMode struct {
+	isolation string
+	readOnly  bool
+}
+
+// transaction handles the statements controlling the transaction block,
+// keeping track of the block and of its characteristics (see SHOW
+// transaction_isolation). The statement is then passed on to the backend, if it
+// executes commands, to control its own transactions.
+func (q *query) transaction(ctx context.Context, sess Session, n nodes.Node) error {
+	s, ok := sess.(*session)
+	v, isTransaction := n.(nodes.TransactionStmt)
+	// only session implementation keeps track of the transaction block
+	if !ok || !isTransaction {
+		return q.Exec(ctx, n)
+	}
+
+	switch v.Kind {
+	case nodes.TRANS_STMT_BEGIN, nodes.TRANS_STMT_START:
+		if s.tx != nil {
+			err := q.warn(ActiveSQLTransaction("there is already a transaction in progress"))
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		mode := s.defaultTransactionMode()
+		err := mode.set(v.Options)
+		if err != nil {
+			return err
+		}
+		s.tx = &mode
+	case nodes.TRANS_STMT_COMMIT, nodes.TRANS_STMT_ROLLBACK, nodes.TRANS_STMT_PREPARE:
+		if s.tx == nil {
+			err := q.warn(NoActiveSQLTransaction("there is no transaction in progress"))
+			if err != nil {
+				return err
+			}
+		} else {
+			// a failed transaction block is rolled back, even by COMMIT,
+			// which is then reported as ROLLBACK, like in postgres
+			if s.aborted {
+				v.Kind = nodes.TRANS_STMT_ROLLBACK
+				n = v
+			}
+			s.endTransactionCursors(v.Kind == nodes.TRANS_STMT_COMMIT)
+		}
+		s.tx = nil
+		s.aborted = false
+	}
+
+	if _, ok := s.queryer.(Execer); !ok {
+		return q.transport.Write(protocol.CommandComplete(transactionTags[v.Kind]))
+	}
+	return q.Exec(ctx, n)
+}
+
+// fail marks the transaction block as failed once any of its statements fails,
+// until it ends, see checkAborted. It's called for every error sent to the
+// client.
+func (s *session) fail() {
+	if s.tx != nil {
+		s.aborted = true
+	}
+}
+
+// transactionStatus returns the transaction status indicator reported to the
+// client in ReadyForQuery: 'I' when idle, 'T' in a transaction block and 'E'
+// in a failed one
+func (s *session) transactionStatus() byte {
+	switch {
+	case s.tx == nil:
+		return 'I'
+	case s.aborted:
+		return 'E'
+	}
+	return 'T'
+}
+
+// checkAborted rejects the statements of a failed transaction block, other
+// than the ones ending it, like postgres does
+func checkAborted(sess Session, n nodes.Node) error {
+	s, ok := sess.(*session)
+	if !ok || !s.aborted || endsTransaction(n) {
+		return nil
+	}
+	return InFailedSQLTransaction("current transaction is aborted, commands ignored until end of transaction block")
+}
+
+// endsTransaction reports whether the statement ends the transaction block,
+// like COMMIT or ROLLBACK
+func endsTransaction(n nodes.Node) bool {
+	v, ok := n.(nodes.TransactionStmt)
+	if !ok {
+		return false
+	}
+	switch v.Kind {
+	case nodes.TRANS_STMT_COMMIT, nodes.TRANS_STMT_ROLLBACK, nodes.TRANS_STMT_PREPARE:
+		return true
+	}
+	return false
+}
+
+// setTransaction handles SET TRANSACTION, which changes the characteristics of
+// the current transaction, and SET SESSION CHARACTERISTICS, which changes the
+// defaults of the following transactions (see default_transaction_isolation)
+func (q *query) setTransaction(s *session, name string, modes nodes.List) error {
+	if name == "session characteristics" {
+		mode := s.defaultTransactionMode()
+		err := mode.set(modes)
+		if err != nil {
+			return err
+		}
+		s.Set("default_transaction_isolation", mode.isolation)
+		s.Set("default_transaction_read_only", formatBool(mode.readOnly))
+		return nil
+	}
+
+	if s.tx == nil {
+		return q.warn(NoActiveSQLTransaction("SET TRANSACTION can only be used in transaction blocks"))
+	}
+	return s.tx.set(modes)
+}
+
+// set applies the transaction modes, as provided by the parser with BEGIN or
+// SET TRANSACTION, like ISOLATION LEVEL SERIALIZABLE or READ ONLY
+func (mode *transactionMode) set(modes nodes.List) error {
+	for _, item := range modes.Items {
+		def, ok := item.(nodes.DefElem)
+		if !ok || def.Defname == nil {
+			continue
+		}
+
+		value := variableValue(nodes.List{Items: []nodes.Node{def.Arg}})
+		err := mode.setVariable(*def.Defname, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setVariable sets one of the characteristics by the name of its variable,
+// like transaction_isolation, ignoring unknown variables
+func (mode *transactionMode) setVariable(name, value string) error {
+	res := *mode
+	var err error
+	switch name {
+	case "transaction_isolation", "default_transaction_isolation":
+		res.isolation, err = parseIsolation(value)
+	case "transaction_read_only", "default_transaction_read_only":
+		res.readOnly, err = parseBool(value)
+	}
+	if err != nil {
+		return InvalidParameterValue("invalid value for parameter \"%s\": \"%s\"", name, value)
+	}
+	*mode = res
+	return nil
+}
+
+// defaultTransactionMode returns the characteristics of new transactions, as
+// set by default_transaction_isolation and default_transaction_read_only
+func (s *session) defaultTransactionMode() transactionMode {
+	mode := transactionMode{isolation: defaultIsolation}
+	for _, name := range []string{"default_transaction_isolation", "default_transaction_read_only"} {
+		if v, ok := s.Get(name).(string); ok {
+			// invalid startup values are ignored, like unknown ones
+			mode.setVariable(name, v)
+		}
+	}
+	return mode
+}
+
+// transactionMode returns the characteristics of the current transaction, or
+// of the next one outside of a transaction block
+func (s *session) transactionMode() transactionMode {
+	if s.tx != nil {
+		return *s.tx
+	}
+	return s.defaultTransactionMode()
+}
+
+// transactionReadOnly returns whether the current transaction of the session
+// is read-only, like with BEGIN READ ONLY
+func transactionReadOnly(sess Session) bool {
+	s, ok := sess.(*session)
+	return ok && s.transactionMode().readOnly
+}
+
+// parseIsolation parses the name of an isolation level, like "serializable"
+func parseIsolation(value string) (string, error) {
+	isolation := strings.ToLower(strings.Join(strings.Fields(value), " "))
+	if !isolationLevels[isolation] {
+		return "", fmt.Errorf("invalid isolation level: %s", value)
+	}
+	return isolation, nil
+}
+
+// parseBool parses a boolean value of a variable, like postgres does
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "on", "true", "yes", "1", "t", "y":
+		return true, nil
+	case "off", "false", "no", "0", "f", "n":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean value: %s", value)
+}
+
+// formatBool formats a boolean value of a variable, like SHOW reports it
+func formatBool(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// warn sends the error to the client as a warning, without failing the
+// statement
+func (q *query) warn(e error) error {
+	if q.localize != nil {
+		e = q.localize(e)
+	}
+	notice := q.encoding.encodeErr(WithSeverity(e, SeverityWarning))
+	return q.transport.Write(protocol.NoticeResponse(notice))
+}
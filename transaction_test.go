@@ -0,0 +1,217 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// showVariable returns the value of the variable, as reported by SHOW
+func showVariable(t *testing.T, frontend *pgproto3.Frontend, name string) string {
+	sendQuery(t, frontend, "SHOW "+name)
+	receive(t, frontend, &pgproto3.RowDescription{})
+	msg := receive(t, frontend, &pgproto3.DataRow{})
+	receive(t, frontend, &pgproto3.CommandComplete{})
+	receive(t, frontend, &pgproto3.ReadyForQuery{})
+	return string(msg.(*pgproto3.DataRow).Values[0])
+}
+
+func TestQuery_transaction(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+	frontend, _ := connect(t, srv)
+
+	tests := []struct {
+		sql       string
+		tag       string
+		notice    string // the code of the expected warning, if any
+		isolation string
+		readOnly  string
+	}{
+		{"BEGIN", "BEGIN", "", "read committed", "off"},
+		{"SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY", "SET", "", "repeatable read", "on"},
+		{"SET transaction_read_only = off", "SET", "", "repeatable read", "off"},
+		{"BEGIN", "BEGIN", "25001", "repeatable read", "off"},
+		{"COMMIT", "COMMIT", "", "read committed", "off"},
+		{"COMMIT", "COMMIT", "25P01", "read committed", "off"},
+		{"START TRANSACTION ISOLATION LEVEL SERIALIZABLE, READ ONLY", "START TRANSACTION", "", "serializable", "on"},
+		{"ROLLBACK", "ROLLBACK", "", "read committed", "off"},
+		{"SET TRANSACTION ISOLATION LEVEL SERIALIZABLE", "SET", "25P01", "read committed", "off"},
+		{"SET SESSION CHARACTERISTICS AS TRANSACTION ISOLATION LEVEL SERIALIZABLE", "SET", "", "serializable", "off"},
+		{"BEGIN READ ONLY", "BEGIN", "", "serializable", "on"},
+		{"END", "COMMIT", "", "serializable", "off"},
+		{"SET default_transaction_isolation = 'repeatable read'", "SET", "", "repeatable read", "off"},
+		{"RESET default_transaction_isolation", "RESET", "", "read committed", "off"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			sendQuery(t, frontend, test.sql)
+			if test.notice != "" {
+				msg := receive(t, frontend, &pgproto3.NoticeResponse{})
+				require.Equal(t, SeverityWarning, msg.(*pgproto3.NoticeResponse).Severity)
+				require.Equal(t, test.notice, msg.(*pgproto3.NoticeResponse).Code)
+			}
+			msg := receive(t, frontend, &pgproto3.CommandComplete{})
+			require.Equal(t, test.tag, string(msg.(*pgproto3.CommandComplete).CommandTag))
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+			require.Equal(t, test.isolation, showVariable(t, frontend, "transaction_isolation"))
+			require.Equal(t, test.readOnly, showVariable(t, frontend, "transaction_read_only"))
+		})
+	}
+
+	t.Run("session characteristics", func(t *testing.T) {
+		sendQuery(t, frontend, "SET SESSION CHARACTERISTICS AS TRANSACTION ISOLATION LEVEL READ UNCOMMITTED, READ ONLY")
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		require.Equal(t, "read uncommitted", showVariable(t, frontend, "default_transaction_isolation"))
+		require.Equal(t, "on", showVariable(t, frontend, "default_transaction_read_only"))
+	})
+
+	for _, sql := range []string{
+		"BEGIN ISOLATION LEVEL CHAOS",
+		"SET default_transaction_isolation = 'chaos'",
+		"SET default_transaction_read_only = 'maybe'",
+	} {
+		t.Run(sql, func(t *testing.T) {
+			sendQuery(t, frontend, sql)
+			msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+			require.Equal(t, "22023", msg.(*pgproto3.ErrorResponse).Code)
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+		})
+	}
+	require.Equal(t, "read uncommitted", showVariable(t, frontend, "transaction_isolation"))
+}
+
+// transactionExecer records the transaction statements it executes
+type transactionExecer struct {
+	mockQueryer
+	kinds []nodes.TransactionStmtKind
+}
+
+func (e *transactionExecer) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
+	if stmt, ok := n.(nodes.TransactionStmt); ok {
+		e.kinds = append(e.kinds, stmt.Kind)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func TestQuery_transactionExec(t *testing.T) {
+	execer := &transactionExecer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: execer}
+	frontend, _ := connect(t, srv)
+
+	for _, sql := range []string{"BEGIN", "ROLLBACK"} {
+		sendQuery(t, frontend, sql)
+		msg := receive(t, frontend, &pgproto3.CommandComplete{})
+		require.Equal(t, sql, string(msg.(*pgproto3.CommandComplete).CommandTag))
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+
+	require.Equal(t, []nodes.TransactionStmtKind{nodes.TRANS_STMT_BEGIN, nodes.TRANS_STMT_ROLLBACK}, execer.kinds)
+}
+
+func TestQuery_transactionAborted(t *testing.T) {
+	execer := &transactionExecer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: execer}
+	frontend, _ := connect(t, srv)
+
+	// expect sends the query, and expects its command tag, or error code
+	expect := func(t *testing.T, sql, expected string) {
+		sendQuery(t, frontend, sql)
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		if _, ok := msg.(*pgproto3.RowDescription); ok {
+			receive(t, frontend, &pgproto3.DataRow{})
+			msg = receive(t, frontend, &pgproto3.CommandComplete{})
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CommandComplete:
+			require.Equal(t, expected, msg.CommandTag, sql)
+		case *pgproto3.ErrorResponse:
+			require.Equal(t, expected, msg.Code, sql)
+		default:
+			require.Fail(t, "unexpected message", "%T", msg)
+		}
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+
+	t.Run("rolled back", func(t *testing.T) {
+		expect(t, "BEGIN", "BEGIN")
+		expect(t, "FETCH c", "34000")
+		expect(t, "SELECT 1", "25P02")
+		expect(t, "BEGIN", "25P02")
+		expect(t, "ROLLBACK", "ROLLBACK")
+		expect(t, "SELECT 1", "SELECT 1")
+	})
+
+	t.Run("commit rolls back", func(t *testing.T) {
+		execer.kinds = nil
+		expect(t, "BEGIN", "BEGIN")
+		expect(t, "FETCH c", "34000")
+		expect(t, "SELECT 1", "25P02")
+		expect(t, "COMMIT", "ROLLBACK")
+		expect(t, "SELECT 1", "SELECT 1")
+		require.Equal(t, []nodes.TransactionStmtKind{nodes.TRANS_STMT_BEGIN, nodes.TRANS_STMT_ROLLBACK}, execer.kinds)
+	})
+
+	t.Run("outside of a transaction block", func(t *testing.T) {
+		expect(t, "FETCH c", "34000")
+		expect(t, "SELECT 1", "SELECT 1")
+	})
+}
+
+func TestSession_transactionStatus(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+	frontend, _ := connect(t, srv)
+
+	// ready reads the responses up to ReadyForQuery, and returns its status
+	ready := func(t *testing.T) byte {
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if msg, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				return msg.TxStatus
+			}
+		}
+	}
+
+	t.Run("simple query", func(t *testing.T) {
+		for _, test := range []struct {
+			sql    string
+			status byte
+		}{
+			{"BEGIN", 'T'},
+			{"SELECT 1", 'T'},
+			{"FETCH c", 'E'},
+			{"SELECT 1", 'E'},
+			{"ROLLBACK", 'I'},
+			{"FETCH c", 'I'},
+		} {
+			sendQuery(t, frontend, test.sql)
+			require.Equal(t, string(test.status), string(ready(t)), test.sql)
+		}
+	})
+
+	t.Run("extended query", func(t *testing.T) {
+		// execute sends the sql in the extended protocol, up to Sync
+		execute := func(t *testing.T, sql string) byte {
+			require.NoError(t, frontend.Send(&pgproto3.Parse{Query: sql}))
+			require.NoError(t, frontend.Send(&pgproto3.Bind{}))
+			require.NoError(t, frontend.Send(&pgproto3.Execute{}))
+			require.NoError(t, frontend.Send(&pgproto3.Sync{}))
+			return ready(t)
+		}
+
+		require.Equal(t, "T", string(execute(t, "BEGIN")))
+		require.Equal(t, "T", string(execute(t, "SELECT 1")))
+		require.Equal(t, "E", string(execute(t, "FETCH c")))
+		require.Equal(t, "E", string(execute(t, "SELECT 1")))
+		require.Equal(t, "I", string(execute(t, "COMMIT")))
+	})
+}
@@ -0,0 +1,60 @@
+package pgsrv
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// DefaultUnixSocketDir is the conventional directory of the unix sockets of
+// postgres servers, where clients like psql look for them by default
+const DefaultUnixSocketDir = "/var/run/postgresql"
+
+// unixSocketPerm are the permissions of the socket file, allowing all local
+// users to connect like postgres does by default (unix_socket_permissions)
+const unixSocketPerm os.FileMode = 0777
+
+// UnixSocketPath returns the path of the unix socket for the port, following
+// the naming convention of postgres, like /var/run/postgresql/.s.PGSQL.5432
+func UnixSocketPath(dir string, port int) string {
+	return filepath.Join(dir, fmt.Sprintf(".s.PGSQL.%d", port))
+}
+
+// ListenUnix listens on a unix socket for the port in the directory (see
+// UnixSocketPath), to be served with Server.ServeListener. A stale socket file
+// left by a server that's no longer running is replaced. The socket file is
+// removed once the listener is closed.
+//
+// Clients connected over the socket are served exactly like TCP clients, with
+// the same startup and authentication. They may also be authenticated by the
+// operating system user of their process, with a Queryer that implements
+// PeerMapper.
+func ListenUnix(dir string, port int) (net.Listener, error) {
+	path := UnixSocketPath(dir, port)
+	if _, err := os.Stat(path); err == nil {
+		// another server may still be listening on the socket
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another server is already listening on %s", path)
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, unixSocketPerm)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
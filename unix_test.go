@@ -0,0 +1,101 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestUnixSocketPath(t *testing.T) {
+	require.Equal(t, "/var/run/postgresql/.s.PGSQL.5432", UnixSocketPath(DefaultUnixSocketDir, 5432))
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgsrv")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := UnixSocketPath(dir, 5432)
+
+	t.Run("serve", func(t *testing.T) {
+		ln, err := ListenUnix(dir, 5432)
+		require.NoError(t, err)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.ModeSocket, info.Mode()&os.ModeType)
+		require.Equal(t, os.FileMode(0777), info.Mode().Perm())
+
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+		done := make(chan error)
+		go func() {
+			done <- srv.ServeListener(ln)
+		}()
+
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		frontend, err := pgproto3.NewFrontend(conn, conn)
+		require.NoError(t, err)
+		err = frontend.Send(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "postgres"},
+		})
+		require.NoError(t, err)
+		receive(t, frontend, &pgproto3.Authentication{})
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				break
+			}
+		}
+
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		receive(t, frontend, &pgproto3.DataRow{})
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		// closing the listener stops serving and removes the socket
+		require.NoError(t, ln.Close())
+		require.Error(t, <-done)
+		_, err = os.Stat(path)
+		require.True(t, os.IsNotExist(err), "expected the socket file to be removed")
+	})
+
+	t.Run("stale socket", func(t *testing.T) {
+		stale, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		require.NoError(t, stale.Close())
+		_, err = os.Stat(path)
+		require.NoError(t, err)
+
+		ln, err := ListenUnix(dir, 5432)
+		require.NoError(t, err)
+		require.NoError(t, ln.Close())
+	})
+
+	t.Run("socket in use", func(t *testing.T) {
+		ln, err := ListenUnix(dir, 5432)
+		require.NoError(t, err)
+		defer ln.Close()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+
+		_, err = ListenUnix(dir, 5432)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "already listening")
+	})
+}
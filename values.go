@@ -0,0 +1,412 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"github.com/panoplyio/pgsrv/protocol"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// valueFormat holds the session variables that affect the text format of values.
+// Its zero value is the default format of postgres.
+type valueFormat struct {
+	// fixedFloats formats floats with a fixed number of significant digits,
+	// their precision plus extraFloatDigits, rather than the shortest exact
+	// representation. It's set when extra_float_digits is zero or less.
+	fixedFloats      bool
+	extraFloatDigits int
+	dateStyle        dateStyle
+}
+
+// sessionValueFormat returns the format of the values, per the session's variables
+func sessionValueFormat(sess Session) valueFormat {
+	var f valueFormat
+	value, _ := sess.Get("datestyle").(string)
+	f.dateStyle, _ = parseDateStyle(value, dateStyle{})
+
+	value, _ = sess.Get("extra_float_digits").(string)
+	n, err := parseExtraFloatDigits(value)
+	if err == nil && n <= 0 {
+		f.fixedFloats, f.extraFloatDigits = true, n
+	}
+	return f
+}
+
+// parseExtraFloatDigits parses the value of extra_float_digits, which is
+// between -15 and 3
+func parseExtraFloatDigits(value string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	if n < -15 || n > 3 {
+		return 0, fmt.Errorf("%d is outside the valid range (-15 .. 3)", n)
+	}
+	return n, nil
+}
+
+// appendValue appends the text representation of the value, in the default
+// postgres text format, to buf
+func appendValue(buf []byte, v driver.Value) []byte {
+	return valueFormat{}.appendValue(buf, v)
+}
+
+// appendValue appends the text representation of the value, in the postgres
+// text format, to buf. The common types are formatted without allocations,
+// while the rest fall back to fmt.
+func (f valueFormat) appendValue(buf []byte, v driver.Value) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(buf, v...)
+	case []byte:
+		return appendBytea(buf, v)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int32:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int16:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int8:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case uint64:
+		return strconv.AppendUint(buf, v, 10)
+	case uint:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case uint32:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case uint16:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case uint8:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case float64:
+		return f.appendFloat(buf, v, 64)
+	case float32:
+		return f.appendFloat(buf, float64(v), 32)
+	case bool:
+		if v {
+			return append(buf, 't')
+		}
+		return append(buf, 'f')
+	case time.Time:
+		return f.dateStyle.appendTime(buf, v, "")
+	default:
+		if rv := reflect.ValueOf(v); isArray(rv) {
+			return f.appendArray(buf, rv)
+		}
+		return append(buf, fmt.Sprintf("%v", v)...)
+	}
+}
+
+// isArray reports whether the value is formatted as a postgres array, which
+// are all of the slices and arrays other than bytes
+func isArray(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		return v.Type().Elem().Kind() != reflect.Uint8
+	}
+	return false
+}
+
+// appendArray appends the slice in the text format of postgres arrays, like
+// {1,2,3}. Nested slices are formatted as multi-dimensional arrays, and nil
+// elements as NULL.
+func (f valueFormat) appendArray(buf []byte, v reflect.Value) []byte {
+	buf = append(buf, '{')
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = f.appendElement(buf, v.Index(i))
+	}
+	return append(buf, '}')
+}
+
+// appendElement appends a single element of an array, quoted when needed
+func (f valueFormat) appendElement(buf []byte, v reflect.Value) []byte {
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return append(buf, "NULL"...)
+		}
+		v = v.Elem()
+	}
+	if isArray(v) {
+		return f.appendArray(buf, v)
+	}
+
+	start := len(buf)
+	buf = f.appendValue(buf, v.Interface())
+	if !needsQuotes(buf[start:]) {
+		return buf
+	}
+
+	// quote the element, escaping quotes and backslashes
+	elem := string(buf[start:])
+	buf = append(buf[:start], '"')
+	for i := 0; i < len(elem); i++ {
+		if elem[i] == '"' || elem[i] == '\\' {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, elem[i])
+	}
+	return append(buf, '"')
+}
+
+// needsQuotes reports whether an array element must be quoted, since it's
+// empty, NULL or contains characters that are special in arrays
+func needsQuotes(elem []byte) bool {
+	if len(elem) == 0 || strings.EqualFold(string(elem), "NULL") {
+		return true
+	}
+	for _, c := range elem {
+		switch c {
+		case '{', '}', ',', '"', '\\', ' ', '\t', '\n', '\r', '\v', '\f':
+			return true
+		}
+	}
+	return false
+}
+
+// appendBytea appends the bytes in the hex format of bytea, like \x0a1b
+func appendBytea(buf []byte, b []byte) []byte {
+	const digits = "0123456789abcdef"
+	buf = append(buf, '\\', 'x')
+	for _, c := range b {
+		buf = append(buf, digits[c>>4], digits[c&0x0f])
+	}
+	return buf
+}
+
+// appendBinaryBytea appends the bytes in the binary format of bytea, which is
+// the raw bytes themselves
+func appendBinaryBytea(buf []byte, b []byte) []byte {
+	return append(buf, b...)
+}
+
+// postgresEpoch is the epoch of the binary format of dates and timestamps,
+// 2000-01-01, in seconds since the unix epoch
+const postgresEpoch = 946684800
+
+// appendBinaryTime appends the time in the binary format of its column type,
+// with integer datetimes (see integer_datetimes): the days since 2000-01-01 as
+// an int4 for DATE, and the microseconds since 2000-01-01 as an int8 for
+// TIMESTAMP, of the wall clock of the time, and TIMESTAMPTZ, the default, of
+// the instant of the time.
+func appendBinaryTime(buf []byte, t time.Time, typ string) []byte {
+	switch typ {
+	case "DATE":
+		date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		days := (date.Unix() - postgresEpoch) / (24 * 60 * 60)
+		return appendUint32(buf, uint32(int32(days)))
+	case "TIMESTAMP":
+		_, offset := t.Zone()
+		t = t.Add(time.Duration(offset) * time.Second).UTC()
+	}
+	micros := (t.Unix()-postgresEpoch)*1000000 + int64(t.Nanosecond()/1000)
+	return appendUint64(buf, uint64(micros))
+}
+
+// appendUint32 appends the integer in big-endian
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// appendUint64 appends the integer in big-endian
+func appendUint64(buf []byte, v uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(v>>32)), uint32(v))
+}
+
+// textTypes are the types with the same text and binary formats, along with
+// the types that aren't known, which are described as TEXT
+var textTypes = map[string]bool{"": true, "TEXT": true, "VARCHAR": true, "CHAR": true, "JSON": true, "XML": true}
+
+// appendBinaryValue appends the value in the binary format of its column type
+func appendBinaryValue(buf []byte, v driver.Value, typ string) ([]byte, error) {
+	switch typ {
+	case "BOOL":
+		if b, ok := v.(bool); ok {
+			if b {
+				return append(buf, 1), nil
+			}
+			return append(buf, 0), nil
+		}
+	case "INT2", "INT4", "INT8":
+		if n, ok := intValue(v); ok {
+			switch typ {
+			case "INT2":
+				return appendUint16s(buf, uint16(n)), nil
+			case "INT4":
+				return appendUint32(buf, uint32(n)), nil
+			}
+			return appendUint64(buf, uint64(n)), nil
+		}
+	case "FLOAT4", "FLOAT8":
+		if f, ok := floatValue(v); ok {
+			if typ == "FLOAT4" {
+				return appendUint32(buf, math.Float32bits(float32(f))), nil
+			}
+			return appendUint64(buf, math.Float64bits(f)), nil
+		}
+	case "BYTEA":
+		switch v := v.(type) {
+		case []byte:
+			return appendBinaryBytea(buf, v), nil
+		case string:
+			return append(buf, v...), nil
+		}
+	case "DATE", "TIMESTAMP", "TIMESTAMPTZ", "TIMESTAMPZ":
+		if t, ok := v.(time.Time); ok {
+			return appendBinaryTime(buf, t, typ), nil
+		}
+	case "NUMERIC":
+		return appendBinaryNumeric(buf, v)
+	case "JSONB":
+		// the binary format of jsonb is its text prefixed by a version number
+		return appendValue(append(buf, 1), v), nil
+	default:
+		_, known := protocol.TypesOid[typ]
+		if textTypes[typ] || !known {
+			return appendValue(buf, v), nil
+		}
+	}
+	return nil, Unsupported("binary format of %T values of type %s", v, typ)
+}
+
+// intValue returns the value of integers of any size
+func intValue(v driver.Value) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), true
+	}
+	return 0, false
+}
+
+// floatValue returns the value of floats and integers of any size
+func floatValue(v driver.Value) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	n, ok := intValue(v)
+	return float64(n), ok
+}
+
+// floatDigits are the number of significant digits of the float types, beyond
+// which postgres formats them in scientific notation
+var floatDigits = map[int]int{32: 6, 64: 15}
+
+// appendFloat appends the float like postgres does, with the shortest
+// representation that's parsed back to the same value, in scientific notation
+// only for very large or small values (unlike Go, which formats 1000000 as
+// 1e+06). With fixedFloats, it's rounded to the precision of the type plus
+// the extra digits instead, like postgres before version 12.
+func (f valueFormat) appendFloat(buf []byte, v float64, bitSize int) []byte {
+	switch {
+	case math.IsNaN(v):
+		return append(buf, "NaN"...)
+	case math.IsInf(v, 1):
+		return append(buf, "Infinity"...)
+	case math.IsInf(v, -1):
+		return append(buf, "-Infinity"...)
+	}
+
+	if f.fixedFloats {
+		precision := floatDigits[bitSize] + f.extraFloatDigits
+		if precision < 1 {
+			precision = 1
+		}
+		return strconv.AppendFloat(buf, v, 'g', precision, bitSize)
+	}
+
+	// format in scientific notation to find the exponent
+	start := len(buf)
+	buf = strconv.AppendFloat(buf, v, 'e', -1, bitSize)
+	exp := 0
+	for i := len(buf) - 1; i > start; i-- {
+		if buf[i] == 'e' {
+			exp, _ = strconv.Atoi(string(buf[i+1:]))
+			break
+		}
+	}
+	if exp < -4 || exp >= floatDigits[bitSize] {
+		return buf
+	}
+	return strconv.AppendFloat(buf[:start], v, 'f', -1, bitSize)
+}
+
+// rowEncoder encodes the values of rows into DataRow messages, reusing its
+// buffers between the rows
+type rowEncoder struct {
+	encoding *clientEncoding
+	format   valueFormat
+	types    []string // of the columns, to tell dates and timestamps apart
+	formats  []int16  // of the columns, in text format unless binaryFormat
+	buf      []byte
+	ends     []int
+	vals     [][]byte
+}
+
+// encode creates the DataRow message of the row's values, converted to the
+// client encoding. The values of the columns in binary format are encoded by
+// their types, and only the strings among them are converted. Nil values are
+// NULL.
+func (e *rowEncoder) encode(row []driver.Value) (protocol.Message, error) {
+	var err error
+	e.buf, e.ends, e.vals = e.buf[:0], e.ends[:0], e.vals[:0]
+	for i, v := range row {
+		if v == nil {
+			e.ends = append(e.ends, -1) // NULL, see below
+			continue
+		}
+
+		if e.binary(i) {
+			e.buf, err = appendBinaryValue(e.buf, v, e.types[i])
+			if err != nil {
+				return nil, err
+			}
+		} else if t, ok := v.(time.Time); ok && i < len(e.types) {
+			e.buf = e.format.dateStyle.appendTime(e.buf, t, e.types[i])
+		} else {
+			e.buf = e.format.appendValue(e.buf, v)
+		}
+		e.ends = append(e.ends, len(e.buf))
+	}
+
+	start := 0
+	for i, end := range e.ends {
+		if end < 0 {
+			e.vals = append(e.vals, nil)
+			continue
+		}
+
+		// a nil slice is NULL, so empty values must not be nil
+		val := e.buf[start:end]
+		if val == nil {
+			val = []byte{}
+		}
+		if _, ok := row[i].(string); e.encoding != nil && (ok || !e.binary(i)) {
+			s, err := e.encoding.encode(string(val))
+			if err != nil {
+				return nil, err
+			}
+			val = []byte(s)
+		}
+		e.vals = append(e.vals, val)
+		start = end
+	}
+	return protocol.DataRowBytes(e.vals), nil
+}
+
+// binary reports whether the i-th column is in binary format
+func (e *rowEncoder) binary(i int) bool {
+	return i < len(e.formats) && i < len(e.types) && e.formats[i] == binaryFormat
+}
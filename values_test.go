@@ -0,0 +1,455 @@
+package pgsrv
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stringer struct{}
+
+func (stringer) String() string { return "stringer" }
+
+func TestAppendValue(t *testing.T) {
+	tests := []struct {
+		value    driver.Value
+		expected string
+	}{
+		{"hello", "hello"},
+		{"", ""},
+		{[]byte("bytes"), "\\x6279746573"},
+		{[]byte{0x00, 0xab, 0xff}, "\\x00abff"},
+		{[]byte{}, "\\x"},
+		{int64(42), "42"},
+		{int64(-42), "-42"},
+		{int64(math.MinInt64), "-9223372036854775808"},
+		{int(-7), "-7"},
+		{int32(math.MaxInt32), "2147483647"},
+		{int16(-300), "-300"},
+		{int8(-8), "-8"},
+		{uint64(math.MaxUint64), "18446744073709551615"},
+		{uint(7), "7"},
+		{uint32(32), "32"},
+		{uint16(16), "16"},
+		{uint8(8), "8"},
+		{float64(3.14159265358979), "3.14159265358979"},
+		{float64(-0.1), "-0.1"},
+		{float64(1) / 3, "0.3333333333333333"},
+		{float64(100), "100"},
+		{float64(1000000), "1000000"},
+		{float64(-123456789012345), "-123456789012345"},
+		{float64(1e15), "1e+15"},
+		{float64(1e21), "1e+21"},
+		{float64(0.0001), "0.0001"},
+		{float64(0.00001), "1e-05"},
+		{float64(0), "0"},
+		{math.NaN(), "NaN"},
+		{math.Inf(1), "Infinity"},
+		{math.Inf(-1), "-Infinity"},
+		{float32(0.1), "0.1"},
+		{float32(-2.5), "-2.5"},
+		{float32(100000), "100000"},
+		{float32(1000000), "1e+06"},
+		{true, "t"},
+		{false, "f"},
+		{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), "2020-01-02 03:04:05+00"},
+		{time.Date(2020, 1, 2, 3, 4, 5, 6000, time.FixedZone("", -3*3600)), "2020-01-02 03:04:05.000006-03"},
+		{time.Date(2020, 1, 2, 3, 4, 5, 500000000, time.FixedZone("", 5*3600+1800)), "2020-01-02 03:04:05.5+05:30"},
+		{stringer{}, "stringer"},
+		{[]int{1, 2}, "{1,2}"},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%T %s", test.value, test.expected), func(t *testing.T) {
+			require.Equal(t, test.expected, string(appendValue(nil, test.value)))
+			require.Equal(t, "prefix:"+test.expected, string(appendValue([]byte("prefix:"), test.value)))
+		})
+	}
+}
+
+func TestAppendValue_extraFloatDigits(t *testing.T) {
+	tests := []struct {
+		extraFloatDigits int
+		value            driver.Value
+		expected         string
+	}{
+		{1, float64(1) / 3, "0.3333333333333333"},
+		{3, float64(0.1), "0.1"},
+		{0, float64(1) / 3, "0.333333333333333"},
+		{0, float64(0.1), "0.1"},
+		{0, float64(1e15), "1e+15"},
+		{0, float64(123456), "123456"},
+		{-10, float64(123456), "1.2346e+05"},
+		{-15, float64(1) / 3, "0.3"},
+		{0, float32(1) / 3, "0.333333"},
+		{-3, float32(1) / 3, "0.333"},
+		{0, []float64{float64(1) / 3}, "{0.333333333333333}"},
+		{0, math.NaN(), "NaN"},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d %s", test.extraFloatDigits, test.expected), func(t *testing.T) {
+			f := valueFormat{fixedFloats: test.extraFloatDigits <= 0, extraFloatDigits: test.extraFloatDigits}
+			require.Equal(t, test.expected, string(f.appendValue(nil, test.value)))
+		})
+	}
+}
+
+// TestAppendValue_roundTrip verifies that clients decode the values back
+func TestAppendValue_roundTrip(t *testing.T) {
+	t.Run("timestamptz", func(t *testing.T) {
+		for _, v := range []time.Time{
+			time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			time.Date(2020, 12, 31, 23, 59, 59, 123456000, time.FixedZone("", -7*3600)),
+			time.Date(1999, 6, 15, 12, 0, 0, 1000, time.FixedZone("", 5*3600+1800)),
+		} {
+			var dst pgtype.Timestamptz
+			require.NoError(t, dst.DecodeText(nil, appendValue(nil, v)))
+			require.True(t, v.Equal(dst.Time), "expected %s, got %s", v, dst.Time)
+		}
+	})
+
+	t.Run("bytea", func(t *testing.T) {
+		for _, v := range [][]byte{{}, []byte("hello"), {0x00, 0x7f, 0x80, 0xff}} {
+			var dst pgtype.Bytea
+			require.NoError(t, dst.DecodeText(nil, appendValue(nil, v)))
+			require.Equal(t, v, dst.Bytes)
+		}
+	})
+
+	t.Run("bool", func(t *testing.T) {
+		for _, v := range []bool{true, false} {
+			var dst pgtype.Bool
+			require.NoError(t, dst.DecodeText(nil, appendValue(nil, v)))
+			require.Equal(t, v, dst.Bool)
+		}
+	})
+
+	t.Run("int8", func(t *testing.T) {
+		for _, v := range []int64{0, -1, math.MaxInt64, math.MinInt64} {
+			var dst pgtype.Int8
+			require.NoError(t, dst.DecodeText(nil, appendValue(nil, v)))
+			require.Equal(t, v, dst.Int)
+		}
+	})
+
+	t.Run("float8", func(t *testing.T) {
+		for _, v := range []float64{0, -0.1, 1.0 / 3, 1000000, 1e21, 1e-300, math.MaxFloat64, math.Inf(-1)} {
+			var dst pgtype.Float8
+			require.NoError(t, dst.DecodeText(nil, appendValue(nil, v)))
+			require.Equal(t, v, dst.Float)
+		}
+	})
+
+	t.Run("float4", func(t *testing.T) {
+		for _, v := range []float32{0, -2.5, 0.1, 1000000, math.MaxFloat32} {
+			var dst pgtype.Float4
+			require.NoError(t, dst.DecodeText(nil, appendValue(nil, v)))
+			require.Equal(t, v, dst.Float)
+		}
+	})
+}
+
+func TestAppendBinaryTime(t *testing.T) {
+	times := []time.Time{
+		time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		time.Date(2020, 12, 31, 23, 59, 59, 123456000, time.FixedZone("", -7*3600)),
+		time.Date(1999, 12, 31, 23, 59, 59, 999999000, time.UTC),
+		time.Date(1999, 6, 15, 12, 0, 0, 1000, time.FixedZone("", 5*3600+1800)),
+		time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(1901, 3, 4, 5, 6, 7, 8000, time.FixedZone("", -3*3600)),
+		time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(9999, 12, 31, 23, 59, 59, 999999000, time.UTC),
+	}
+
+	t.Run("timestamptz", func(t *testing.T) {
+		for _, v := range times {
+			var dst pgtype.Timestamptz
+			require.NoError(t, dst.DecodeBinary(nil, appendBinaryTime(nil, v, "TIMESTAMPTZ")))
+			require.True(t, v.Equal(dst.Time), "expected %s, got %s", v, dst.Time)
+
+			// the default for columns of unknown types
+			require.Equal(t, appendBinaryTime(nil, v, "TIMESTAMPTZ"), appendBinaryTime(nil, v, ""))
+		}
+	})
+
+	t.Run("timestamp", func(t *testing.T) {
+		for _, v := range times {
+			var dst pgtype.Timestamp
+			require.NoError(t, dst.DecodeBinary(nil, appendBinaryTime(nil, v, "TIMESTAMP")))
+
+			// the wall clock of the time, regardless of its zone
+			expected := time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second(), v.Nanosecond(), time.UTC)
+			require.Equal(t, expected, dst.Time)
+		}
+	})
+
+	t.Run("date", func(t *testing.T) {
+		for _, v := range times {
+			b := appendBinaryTime(nil, v, "DATE")
+			require.Len(t, b, 4)
+
+			var dst pgtype.Date
+			require.NoError(t, dst.DecodeBinary(nil, b))
+			require.Equal(t, time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, time.UTC), dst.Time)
+		}
+	})
+
+	t.Run("epoch", func(t *testing.T) {
+		epoch := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		require.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 0}, appendBinaryTime(nil, epoch, "TIMESTAMPTZ"))
+		require.Equal(t, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, appendBinaryTime(nil, epoch.Add(-time.Microsecond), "TIMESTAMPTZ"))
+		require.Equal(t, []byte{0xff, 0xff, 0xff, 0xff}, appendBinaryTime(nil, epoch.Add(-time.Hour), "DATE"))
+	})
+}
+
+func TestAppendBinaryValue(t *testing.T) {
+	tests := []struct {
+		typ string
+		v   driver.Value
+		res []byte
+	}{
+		{"BOOL", false, []byte{0}},
+		{"INT2", int64(-2), []byte{0xff, 0xfe}},
+		{"INT4", 7, []byte{0, 0, 0, 7}},
+		{"INT8", uint8(7), []byte{0, 0, 0, 0, 0, 0, 0, 7}},
+		{"FLOAT4", float32(1.5), encodeBinary(t, &pgtype.Float4{Float: 1.5, Status: pgtype.Present})},
+		{"FLOAT8", int64(2), encodeBinary(t, &pgtype.Float8{Float: 2, Status: pgtype.Present})},
+		{"BYTEA", []byte{0, 1}, []byte{0, 1}},
+		{"NUMERIC", "1.5", []byte{0, 2, 0, 0, 0, 0, 0, 1, 0, 1, 0x13, 0x88}},
+		{"JSONB", `{"a":1}`, []byte("\x01{\"a\":1}")},
+		{"TEXT", "foo", []byte("foo")},
+		{"", int64(7), []byte("7")},
+		{"CUSTOM", true, []byte("t")},
+	}
+	for _, test := range tests {
+		t.Run(test.typ, func(t *testing.T) {
+			res, err := appendBinaryValue(nil, test.v, test.typ)
+			require.NoError(t, err)
+			require.Equal(t, test.res, res)
+		})
+	}
+
+	t.Run("mismatched type", func(t *testing.T) {
+		_, err := appendBinaryValue(nil, "7", "INT4")
+		require.Error(t, err)
+		require.Equal(t, "0A000", fromErr(err).C)
+	})
+}
+
+func TestAppendValue_arrays(t *testing.T) {
+	s := "x"
+	tests := map[string]struct {
+		v        driver.Value
+		expected string
+	}{
+		"ints":          {[]int{1, 2, 3}, "{1,2,3}"},
+		"empty":         {[]int64{}, "{}"},
+		"floats":        {[]float64{1.5, math.NaN()}, "{1.5,NaN}"},
+		"bools":         {[]bool{true, false}, "{t,f}"},
+		"strings":       {[]string{"a", "b c", "", "NULL", `q"uote`, `back\slash`, "{,}"}, `{a,"b c","","NULL","q\"uote","back\\slash","{,}"}`},
+		"nulls":         {[]interface{}{1, nil, "a"}, "{1,NULL,a}"},
+		"pointers":      {[]*string{&s, nil}, "{x,NULL}"},
+		"nested":        {[][]int{{1, 2}, {3, 4}}, "{{1,2},{3,4}}"},
+		"bytea":         {[][]byte{{0x0a}}, `{"\\x0a"}`},
+		"fixed size":    {[2]int{1, 2}, "{1,2}"},
+		"timestamps":    {[]time.Time{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}, `{"2020-01-02 03:04:05+00"}`},
+		"named bytes":   {json.RawMessage(`{}`), fmt.Sprintf("%v", json.RawMessage(`{}`))},
+		"nested arrays": {[]interface{}{[]string{"a"}, []string{"b"}}, "{{a},{b}}"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, test.expected, string(appendValue(nil, test.v)))
+		})
+	}
+}
+
+func TestAppendValue_arraysRoundTrip(t *testing.T) {
+	t.Run("int4", func(t *testing.T) {
+		var dst pgtype.Int4Array
+		require.NoError(t, dst.DecodeText(nil, appendValue(nil, []int{1, -2, 3})))
+		var res []int32
+		require.NoError(t, dst.AssignTo(&res))
+		require.Equal(t, []int32{1, -2, 3}, res)
+	})
+
+	t.Run("text", func(t *testing.T) {
+		// pgx parses a quoted NULL as NULL, unlike postgres
+		v := []string{"a", "b c", "", `q"uote`, `back\slash`, "{,}", "\t"}
+		var dst pgtype.TextArray
+		require.NoError(t, dst.DecodeText(nil, appendValue(nil, v)))
+		var res []string
+		require.NoError(t, dst.AssignTo(&res))
+		require.Equal(t, v, res)
+	})
+
+	t.Run("float8", func(t *testing.T) {
+		v := []float64{0.1, 1e21, math.Inf(1)}
+		var dst pgtype.Float8Array
+		require.NoError(t, dst.DecodeText(nil, appendValue(nil, v)))
+		var res []float64
+		require.NoError(t, dst.AssignTo(&res))
+		require.Equal(t, v, res)
+	})
+
+	t.Run("nulls", func(t *testing.T) {
+		var dst pgtype.TextArray
+		require.NoError(t, dst.DecodeText(nil, appendValue(nil, []interface{}{"a", nil})))
+		require.Len(t, dst.Elements, 2)
+		require.Equal(t, pgtype.Present, dst.Elements[0].Status)
+		require.Equal(t, pgtype.Null, dst.Elements[1].Status)
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		var dst pgtype.Int4Array
+		require.NoError(t, dst.DecodeText(nil, appendValue(nil, [][]int{{1, 2, 3}, {4, 5, 6}})))
+		require.Equal(t, []pgtype.ArrayDimension{{Length: 2, LowerBound: 1}, {Length: 3, LowerBound: 1}}, dst.Dimensions)
+		for i, e := range dst.Elements {
+			require.Equal(t, int32(i+1), e.Int)
+		}
+	})
+}
+
+func TestRowEncoder(t *testing.T) {
+	decode := func(t *testing.T, msg protocol.Message) []string {
+		frontend, err := pgproto3.NewFrontend(bytes.NewReader(msg), nil)
+		require.NoError(t, err)
+		res, err := frontend.Receive()
+		require.NoError(t, err)
+
+		var vals []string
+		for _, v := range res.(*pgproto3.DataRow).Values {
+			vals = append(vals, string(v))
+		}
+		return vals
+	}
+
+	t.Run("reused buffers", func(t *testing.T) {
+		encoder := &rowEncoder{}
+		first, err := encoder.encode([]driver.Value{int64(1), "first row", 1.5})
+		require.NoError(t, err)
+		second, err := encoder.encode([]driver.Value{int64(2), "2nd", 2.5})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"1", "first row", "1.5"}, decode(t, first))
+		require.Equal(t, []string{"2", "2nd", "2.5"}, decode(t, second))
+	})
+
+	t.Run("nulls", func(t *testing.T) {
+		encoder := &rowEncoder{types: []string{"INT4", "TEXT", "TEXT"}, formats: []int16{binaryFormat}}
+		msg, err := encoder.encode([]driver.Value{nil, nil, ""})
+		require.NoError(t, err)
+
+		frontend, err := pgproto3.NewFrontend(bytes.NewReader(msg), nil)
+		require.NoError(t, err)
+		res, err := frontend.Receive()
+		require.NoError(t, err)
+		values := res.(*pgproto3.DataRow).Values
+		require.Len(t, values, 3)
+		require.Nil(t, values[0], "expected NULL in binary format")
+		require.Nil(t, values[1], "expected NULL in text format")
+		require.NotNil(t, values[2], "expected an empty value rather than NULL")
+		require.Empty(t, values[2])
+	})
+
+	t.Run("client encoding", func(t *testing.T) {
+		enc, err := newClientEncoding("LATIN1")
+		require.NoError(t, err)
+		encoder := &rowEncoder{encoding: enc}
+
+		msg, err := encoder.encode([]driver.Value{"café", int64(1)})
+		require.NoError(t, err)
+		require.Equal(t, []string{"caf\xe9", "1"}, decode(t, msg))
+
+		_, err = encoder.encode([]driver.Value{"€"})
+		require.Error(t, err)
+		require.Equal(t, "22P05", fromErr(err).C)
+	})
+
+	t.Run("binary formats", func(t *testing.T) {
+		enc, err := newClientEncoding("LATIN1")
+		require.NoError(t, err)
+		encoder := &rowEncoder{
+			encoding: enc,
+			types:    []string{"INT4", "TEXT", "FLOAT8", "BOOL", "INT8"},
+			formats:  []int16{binaryFormat, binaryFormat, textFormat, binaryFormat, binaryFormat},
+		}
+		msg, err := encoder.encode([]driver.Value{int64(7), "café", 1.5, true, int32(-1)})
+		require.NoError(t, err)
+		require.Equal(t, []string{"\x00\x00\x00\x07", "caf\xe9", "1.5", "\x01", strings.Repeat("\xff", 8)}, decode(t, msg))
+
+		encoder.types[0] = "INTERVAL"
+		_, err = encoder.encode([]driver.Value{"1 day", "", 1.5, true, int32(-1)})
+		require.Error(t, err)
+		require.Equal(t, "0A000", fromErr(err).C)
+	})
+}
+
+// wideRows returns a result of n rows with 10 columns of mixed types
+type wideRows struct {
+	n int
+}
+
+func (r *wideRows) Columns() []string {
+	return []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+}
+
+func (r *wideRows) Close() error { return nil }
+
+var benchTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func (r *wideRows) Next(dest []driver.Value) error {
+	if r.n == 0 {
+		return io.EOF
+	}
+	r.n--
+	for i := 0; i < len(dest); i += 5 {
+		dest[i] = int64(r.n)
+		dest[i+1] = float64(r.n) / 3
+		dest[i+2] = "some text value"
+		dest[i+3] = []byte("some bytes")
+		dest[i+4] = benchTime
+	}
+	return nil
+}
+
+// BenchmarkQuery_writeRows measures the encoding of a 10k rows result with 10
+// columns, compared to formatting each of the values with fmt
+func BenchmarkQuery_writeRows(b *testing.B) {
+	b.Run("encoder", func(b *testing.B) {
+		b.ReportAllocs()
+		q := &query{transport: protocol.NewTransport(&countingConn{})}
+		for i := 0; i < b.N; i++ {
+			q.writeRows(context.Background(), &wideRows{10000})
+		}
+	})
+
+	b.Run("sprintf", func(b *testing.B) {
+		b.ReportAllocs()
+		t := protocol.NewTransport(&countingConn{})
+		for i := 0; i < b.N; i++ {
+			rows := &wideRows{10000}
+			row := make([]driver.Value, 10)
+			vals := make([]string, 10)
+			for rows.Next(row) == nil {
+				for j, v := range row {
+					vals[j] = fmt.Sprintf("%v", v)
+				}
+				t.Write(protocol.DataRow(vals))
+			}
+		}
+	})
+}
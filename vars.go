@@ -0,0 +1,219 @@
+package pgsrv
+
+import (
+	"context"
+	"fmt"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// set handles SET and RESET of session variables. The new values are stored in
+// the session (see Session.Get) and the command is then passed on to the
+// backend, if it executes commands, to be applied there as well.
+func (q *query) set(ctx context.Context, sess Session, stmt nodes.VariableSetStmt) error {
+	s, ok := sess.(*session)
+	// only session implementation keeps track of the defaults for RESET
+	if !ok {
+		return q.Exec(ctx, stmt)
+	}
+
+	name := ""
+	if stmt.Name != nil {
+		name = strings.ToLower(*stmt.Name)
+	}
+
+	tag := "SET"
+	switch stmt.Kind {
+	case nodes.VAR_SET_VALUE:
+		value := variableValue(stmt.Args)
+
+		// the characteristics of the current transaction aren't kept with
+		// the session variables
+		if name == "transaction_isolation" || name == "transaction_read_only" {
+			if s.tx == nil {
+				err := q.warn(NoActiveSQLTransaction("SET TRANSACTION can only be used in transaction blocks"))
+				if err != nil {
+					return err
+				}
+				break
+			}
+			err := s.tx.setVariable(name, value)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		var err error
+		switch name {
+		case "statement_timeout":
+			_, err = parseTimeout(value)
+		case "extra_float_digits":
+			_, err = parseExtraFloatDigits(value)
+		case "datestyle":
+			// stored as reported by SHOW, with the missing parts kept
+			var ds dateStyle
+			ds, err = parseDateStyle(value, s.dateStyle())
+			value = ds.String()
+		case "default_transaction_isolation":
+			_, err = parseIsolation(value)
+		case "default_transaction_read_only":
+			_, err = parseBool(value)
+		case "search_path":
+			// the schemas are identifiers, quoted as needed when stored
+			value = formatSearchPath(variableValues(stmt.Args))
+		}
+		if err != nil {
+			return InvalidParameterValue("invalid value for parameter \"%s\": \"%s\"", name, value)
+		}
+		s.Set(name, value)
+	case nodes.VAR_SET_MULTI:
+		err := q.setTransaction(s, name, stmt.Args)
+		if err != nil {
+			return err
+		}
+	case nodes.VAR_SET_DEFAULT, nodes.VAR_RESET:
+		s.reset(name)
+		if stmt.Kind == nodes.VAR_RESET {
+			tag = "RESET"
+		}
+	case nodes.VAR_RESET_ALL:
+		s.resetAll()
+		tag = "RESET"
+	}
+
+	// application_name is reported back to the client whenever it changes
+	if name == "application_name" || stmt.Kind == nodes.VAR_RESET_ALL {
+		appName, _ := s.Get("application_name").(string)
+		s.setAppName(appName)
+		err := q.transport.Write(protocol.ParameterStatus("application_name", appName))
+		if err != nil {
+			return err
+		}
+	}
+
+	// and so is DateStyle
+	if name == "datestyle" || stmt.Kind == nodes.VAR_RESET_ALL {
+		err := q.transport.Write(protocol.ParameterStatus("DateStyle", s.dateStyle().String()))
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, ok := s.queryer.(Execer); !ok {
+		return q.transport.Write(protocol.CommandComplete(tag))
+	}
+	return q.Exec(ctx, stmt)
+}
+
+// reset restores the value of the session variable to the one provided at
+// startup, or removes it if it wasn't provided
+func (s *session) reset(k string) {
+	if v, ok := s.defaults[k]; ok {
+		s.Set(k, v)
+	} else {
+		s.Del(k)
+	}
+}
+
+// resetAll restores the values of all of the session variables to the ones
+// provided at startup, like RESET ALL
+func (s *session) resetAll() {
+	for k := range s.Args {
+		s.reset(k)
+	}
+	for k := range s.defaults {
+		s.reset(k)
+	}
+}
+
+// variableValue returns the value of SET as a string, like postgres reports it
+// with SHOW. Lists of values are separated by commas.
+func variableValue(args nodes.List) string {
+	return strings.Join(variableValues(args), ", ")
+}
+
+// variableValues returns the list of values of SET as strings
+func variableValues(args nodes.List) []string {
+	values := make([]string, 0, len(args.Items))
+	for _, arg := range args.Items {
+		c, ok := arg.(nodes.A_Const)
+		if !ok {
+			continue
+		}
+
+		switch v := c.Val.(type) {
+		case nodes.String:
+			values = append(values, v.Str)
+		case nodes.Integer:
+			values = append(values, strconv.FormatInt(v.Ival, 10))
+		case nodes.Float:
+			values = append(values, v.Str)
+		}
+	}
+	return values
+}
+
+// timeUnits maps the units accepted by postgres for time variables
+var timeUnits = map[string]time.Duration{
+	"us":  time.Microsecond,
+	"ms":  time.Millisecond,
+	"s":   time.Second,
+	"min": time.Minute,
+	"h":   time.Hour,
+	"d":   24 * time.Hour,
+}
+
+// parseTimeout parses the value of a time variable, like statement_timeout,
+// which is either a number of milliseconds or a number followed by a unit,
+// like "5s"
+func parseTimeout(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	idx := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	num, unit := value, "ms"
+	if idx >= 0 {
+		num, unit = value[:idx], strings.TrimSpace(value[idx:])
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	d, ok := timeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid unit: %s", unit)
+	}
+	return time.Duration(n * float64(d)), nil
+}
+
+// statementTimeout returns the timeout for executing a single statement: the
+// shorter of the server's query timeout (see WithQueryTimeout) and the
+// session's statement_timeout. Zero means no timeout.
+func (q *query) statementTimeout(sess Session) time.Duration {
+	timeout := q.queryTimeout
+
+	value, _ := sess.Get("statement_timeout").(string)
+	d, err := parseTimeout(value)
+	if err == nil && d > 0 && (timeout <= 0 || d < timeout) {
+		timeout = d
+	}
+	return timeout
+}
+
+// canceled replaces the provided error with a query_canceled error if the
+// statement's timeout has expired, or the query was canceled
+func canceled(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return QueryCanceled("canceling statement due to statement timeout")
+	case context.Canceled:
+		return QueryCanceled("canceling statement due to user request")
+	}
+	return err
+}
@@ -0,0 +1,247 @@
+package pgsrv
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseTimeout(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"0":      0,
+		"1500":   1500 * time.Millisecond,
+		"5s":     5 * time.Second,
+		"2 min":  2 * time.Minute,
+		"1.5h":   90 * time.Minute,
+		"250us":  250 * time.Microsecond,
+		" 10ms ": 10 * time.Millisecond,
+	} {
+		t.Run(value, func(t *testing.T) {
+			d, err := parseTimeout(value)
+			require.NoError(t, err)
+			require.Equal(t, expected, d)
+		})
+	}
+
+	for _, value := range []string{"", "abc", "5 years", "s"} {
+		t.Run(value, func(t *testing.T) {
+			_, err := parseTimeout(value)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestVariableValue(t *testing.T) {
+	args := nodes.List{Items: []nodes.Node{
+		nodes.A_Const{Val: nodes.String{Str: "public"}},
+		nodes.A_Const{Val: nodes.Integer{Ival: 5}},
+		nodes.A_Const{Val: nodes.Float{Str: "1.5"}},
+	}}
+	require.Equal(t, "public, 5, 1.5", variableValue(args))
+}
+
+func TestQuery_statementTimeout(t *testing.T) {
+	tests := map[string]struct {
+		server, session string
+		expected        time.Duration
+	}{
+		"none":             {"0", "", 0},
+		"server":           {"1s", "", time.Second},
+		"session":          {"0", "500", 500 * time.Millisecond},
+		"shorter session":  {"1s", "500", 500 * time.Millisecond},
+		"longer session":   {"1s", "5s", time.Second},
+		"disabled session": {"1s", "0", time.Second},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			d, _ := parseTimeout(test.server)
+			q := &query{queryTimeout: d}
+			sess := &session{Args: map[string]interface{}{}}
+			if test.session != "" {
+				sess.Set("statement_timeout", test.session)
+			}
+			require.Equal(t, test.expected, q.statementTimeout(sess))
+		})
+	}
+}
+
+// slowQueryer blocks until the query's context is done
+type slowQueryer struct{}
+
+func (*slowQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// endlessRows streams rows forever, ignoring the query's context
+type endlessRows struct{ mockRows }
+
+func (*endlessRows) Next(dest []driver.Value) error {
+	dest[0] = "row"
+	time.Sleep(time.Millisecond)
+	return nil
+}
+
+type endlessQueryer struct{}
+
+func (*endlessQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	return &endlessRows{}, nil
+}
+
+func TestSession_statementTimeout(t *testing.T) {
+	t.Run("backend honors the context", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &slowQueryer{}}
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "SET statement_timeout = 10")
+		msg := receive(t, frontend, &pgproto3.CommandComplete{})
+		require.Equal(t, "SET", msg.(*pgproto3.CommandComplete).CommandTag)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+		sendQuery(t, frontend, "SELECT 1")
+		msg = receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "57014", msg.(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, "canceling statement due to statement timeout", msg.(*pgproto3.ErrorResponse).Message)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("backend ignores the context", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &endlessQueryer{}, queryTimeout: 10 * time.Millisecond}
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "SELECT 1")
+		receive(t, frontend, &pgproto3.RowDescription{})
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if _, ok := msg.(*pgproto3.DataRow); ok {
+				continue
+			}
+			require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+			require.Equal(t, "57014", msg.(*pgproto3.ErrorResponse).Code)
+			break
+		}
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+		frontend, _ := connect(t, srv)
+
+		sendQuery(t, frontend, "SET statement_timeout = 'soon'")
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "22023", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
+
+// recordingExecer records the commands passed to the backend, along with the
+// session variables at the time
+type recordingExecer struct {
+	mockQueryer
+	vars []interface{}
+}
+
+func (e *recordingExecer) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
+	sess := ctx.Value(sessionCtxKey).(Session)
+	e.vars = append(e.vars, sess.Get("search_path"))
+	return driver.RowsAffected(0), nil
+}
+
+func TestQuery_set(t *testing.T) {
+	execer := &recordingExecer{}
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: execer}
+	frontend, _ := connectWith(t, srv, map[string]string{"user": "postgres", "search_path": "public"})
+
+	for _, sql := range []string{"SET search_path = 'foo'", "RESET search_path"} {
+		sendQuery(t, frontend, sql)
+		receive(t, frontend, &pgproto3.CommandComplete{})
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	}
+
+	require.Equal(t, []interface{}{"foo", "public"}, execer.vars)
+}
+
+func TestQuery_setApplicationName(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+	frontend, pid := connectWith(t, srv, map[string]string{"user": "postgres", "application_name": "psql"})
+
+	appName := func() string {
+		for _, info := range srv.Sessions() {
+			if info.PID == pid {
+				return info.AppName
+			}
+		}
+		return ""
+	}
+	require.Equal(t, "psql", appName())
+
+	tests := []struct {
+		sql      string
+		expected string
+	}{
+		{"SET application_name = 'worker'", "worker"},
+		{"RESET application_name", "psql"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			sendQuery(t, frontend, test.sql)
+			msg := receive(t, frontend, &pgproto3.ParameterStatus{})
+			require.Equal(t, &pgproto3.ParameterStatus{Name: "application_name", Value: test.expected}, msg)
+			receive(t, frontend, &pgproto3.CommandComplete{})
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+			require.Equal(t, test.expected, appName())
+		})
+	}
+}
+
+// floatQueryer returns a single float that requires full precision, 0.1 + 0.2
+type floatQueryer struct{}
+
+func (floatQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	a, b := 0.1, 0.2
+	return RowsFromValues([]ColumnDesc{{Name: "f", TypeName: "FLOAT8"}}, [][]interface{}{{a + b}}), nil
+}
+
+func TestQuery_extraFloatDigits(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: floatQueryer{}}
+	frontend, _ := connect(t, srv)
+
+	tests := []struct {
+		sql      string
+		expected string
+	}{
+		{"SET extra_float_digits = 3", "0.30000000000000004"},
+		{"SET extra_float_digits = 0", "0.3"},
+		{"SET extra_float_digits = -12", "0.3"},
+		{"RESET extra_float_digits", "0.30000000000000004"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			sendQuery(t, frontend, test.sql)
+			receive(t, frontend, &pgproto3.CommandComplete{})
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+
+			sendQuery(t, frontend, "SELECT 0.1::float8 + 0.2::float8")
+			receive(t, frontend, &pgproto3.RowDescription{})
+			msg := receive(t, frontend, &pgproto3.DataRow{})
+			require.Equal(t, test.expected, string(msg.(*pgproto3.DataRow).Values[0]))
+			receive(t, frontend, &pgproto3.CommandComplete{})
+			receive(t, frontend, &pgproto3.ReadyForQuery{})
+		})
+	}
+
+	t.Run("invalid value", func(t *testing.T) {
+		sendQuery(t, frontend, "SET extra_float_digits = 4")
+		msg := receive(t, frontend, &pgproto3.ErrorResponse{})
+		require.Equal(t, "22023", msg.(*pgproto3.ErrorResponse).Code)
+		receive(t, frontend, &pgproto3.ReadyForQuery{})
+	})
+}
@@ -0,0 +1,42 @@
+package pgsrv
+
+import (
+	"strconv"
+	"strings"
+)
+
+// defaultServerVersion is the postgres version reported to clients, unless
+// overridden with WithServerVersion
+const defaultServerVersion = "10.5"
+
+// version returns the postgres version reported to clients
+func (s *server) version() string {
+	if s.serverVersion == "" {
+		return defaultServerVersion
+	}
+	return s.serverVersion
+}
+
+// serverVersionNum derives the numeric form of a postgres version, as reported
+// in server_version_num. Since postgres 10 versions have two parts, so "10.5"
+// is 100005, while older ones have three, so "9.6.3" is 90603. Anything after
+// the numeric prefix of the version is ignored, so "12beta1" is 120000.
+func serverVersionNum(version string) string {
+	end := strings.IndexFunc(version, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if end >= 0 {
+		version = version[:end]
+	}
+
+	var parts [3]int
+	for i, part := range strings.SplitN(version, ".", len(parts)) {
+		parts[i], _ = strconv.Atoi(part)
+	}
+
+	num := parts[0]*10000 + parts[1]*100 + parts[2]
+	if parts[0] >= 10 {
+		num = parts[0]*10000 + parts[1]
+	}
+	return strconv.Itoa(num)
+}
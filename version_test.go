@@ -0,0 +1,59 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestServerVersionNum(t *testing.T) {
+	tests := map[string]string{
+		"10.5":          "100005",
+		"12":            "120000",
+		"16.1":          "160001",
+		"9.6.3":         "90603",
+		"9.6":           "90600",
+		"12beta1":       "120000",
+		"11.2 (Debian)": "110002",
+		"not a version": "0",
+	}
+
+	for version, expected := range tests {
+		t.Run(version, func(t *testing.T) {
+			require.Equal(t, expected, serverVersionNum(version))
+		})
+	}
+}
+
+func TestServer_serverVersion(t *testing.T) {
+	srv := &server{authenticator: &noPasswordAuthenticator{}, queryer: &mockQueryer{}}
+	WithServerVersion("9.6.3")(srv)
+
+	f, b := net.Pipe()
+	defer f.Close()
+	go srv.Serve(b)
+
+	frontend, err := pgproto3.NewFrontend(f, f)
+	require.NoError(t, err)
+	err = frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	})
+	require.NoError(t, err)
+
+	params := map[string]string{}
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		if status, ok := msg.(*pgproto3.ParameterStatus); ok {
+			params[status.Name] = status.Value
+		}
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+
+	require.Equal(t, "9.6.3", params["server_version"])
+	require.Equal(t, "90603", params["server_version_num"])
+}